@@ -0,0 +1,331 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"syscall/js"
+
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// resolveError reports every problem found by the resolver. resolve.ErrorList
+// only reports the first one, so a script with several undefined names would
+// otherwise have to be fixed one run at a time.
+type resolveError struct {
+	errs resolve.ErrorList
+}
+
+func (e resolveError) Error() string {
+	msgs := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// withAllResolveErrors replaces a resolve.ErrorList with a resolveError.
+func withAllResolveErrors(err error) error {
+	var errs resolve.ErrorList
+	if errors.As(err, &errs) && len(errs) > 1 {
+		return resolveError{errs}
+	}
+	return err
+}
+
+// bindingUses returns the binding identifiers of a resolved file in source
+// order, along with the number of uses of each. Uses are keyed by the binding
+// identifier since a free variable in a nested function gets its own Binding
+// that shares First. Only reads are uses: assigning a name again is not,
+// though an augmented assignment such as x += 1 reads it first.
+func bindingUses(f *syntax.File) ([]*syntax.Ident, map[*syntax.Ident]int) {
+	bindings := []*syntax.Ident{}
+	seen := make(map[*syntax.Ident]bool)
+	uses := make(map[*syntax.Ident]int)
+	targets := assignedIdents(f)
+
+	walkSyntax(f, func(n syntax.Node) bool {
+		id, ok := n.(*syntax.Ident)
+		if !ok {
+			return true
+		}
+		binding, ok := id.Binding.(*resolve.Binding)
+		if !ok {
+			return true
+		}
+		if binding.First == id {
+			// Walked twice for load("m", "x"), where From and To share an Ident.
+			if !seen[id] {
+				seen[id] = true
+				bindings = append(bindings, id)
+			}
+		} else if binding.First != nil && !targets[id] {
+			uses[binding.First]++
+		}
+		return true
+	})
+
+	return bindings, uses
+}
+
+// assignedIdents returns the identifiers of a file that are only written:
+// the targets of plain assignments and for loops, unpacked from any tuples
+// or lists, and the names of function definitions.
+func assignedIdents(f *syntax.File) map[*syntax.Ident]bool {
+	targets := make(map[*syntax.Ident]bool)
+	var add func(syntax.Expr)
+	add = func(lhs syntax.Expr) {
+		switch lhs := lhs.(type) {
+		case *syntax.Ident:
+			targets[lhs] = true
+		case *syntax.ParenExpr:
+			add(lhs.X)
+		case *syntax.TupleExpr:
+			for _, x := range lhs.List {
+				add(x)
+			}
+		case *syntax.ListExpr:
+			for _, x := range lhs.List {
+				add(x)
+			}
+		}
+	}
+
+	walkSyntax(f, func(n syntax.Node) bool {
+		switch n := n.(type) {
+		case *syntax.AssignStmt:
+			if n.Op == syntax.EQ {
+				add(n.LHS)
+			}
+		case *syntax.ForStmt:
+			add(n.Vars)
+		case *syntax.ForClause:
+			add(n.Vars)
+		case *syntax.DefStmt:
+			add(n.Name)
+		}
+		return true
+	})
+	return targets
+}
+
+// analysisFinding is a name reported by analyzeSource.
+type analysisFinding struct {
+	name string
+	// kind classifies unused names as "load", "module", or "variable".
+	kind    string
+	message string
+	start   syntax.Position
+	end     syntax.Position
+}
+
+// analysis is the result of statically analyzing a single file.
+type analysis struct {
+	// undefined lists every identifier that is neither bound in the file,
+	// predeclared, nor universal.
+	undefined []analysisFinding
+	// unused lists loaded symbols that are never used, load statements none
+	// of whose symbols are used, and top-level variables that are assigned
+	// but never read.
+	unused []analysisFinding
+	// errors are syntax errors and any other resolver errors.
+	errors []analysisFinding
+}
+
+// analyzeSource parses and resolves a file without executing it.
+func analyzeSource(filename string, source string, fileOptions *syntax.FileOptions, isPredeclared func(string) bool) *analysis {
+	result := &analysis{}
+
+	f, err := fileOptions.Parse(filename, source, 0)
+	if err != nil {
+		var syntaxErr syntax.Error
+		if errors.As(err, &syntaxErr) {
+			result.errors = append(result.errors, analysisFinding{message: syntaxErr.Msg, start: syntaxErr.Pos, end: syntaxErr.Pos})
+		} else {
+			result.errors = append(result.errors, analysisFinding{message: err.Error()})
+		}
+		return result
+	}
+
+	// The resolver's messages include spelling suggestions, so keep them
+	// for the undefined names found below.
+	messages := make(map[syntax.Position]string)
+	if err := resolve.File(f, isPredeclared, starlark.Universe.Has); err != nil {
+		var errs resolve.ErrorList
+		if errors.As(err, &errs) {
+			for _, e := range errs {
+				messages[e.Pos] = e.Msg
+			}
+		}
+	}
+
+	walkSyntax(f, func(n syntax.Node) bool {
+		id, ok := n.(*syntax.Ident)
+		if !ok {
+			return true
+		}
+		binding, ok := id.Binding.(*resolve.Binding)
+		if !ok || binding.Scope != resolve.Undefined {
+			return true
+		}
+		start, end := id.Span()
+		message, ok := messages[id.NamePos]
+		if !ok {
+			message = "undefined: " + id.Name
+		}
+		delete(messages, id.NamePos)
+		result.undefined = append(result.undefined, analysisFinding{name: id.Name, message: message, start: start, end: end})
+		return true
+	})
+
+	result.unused = findUnused(f)
+
+	for pos, message := range messages {
+		result.errors = append(result.errors, analysisFinding{message: message, start: pos, end: pos})
+	}
+	sort.Slice(result.errors, func(i, j int) bool {
+		a, b := result.errors[i].start, result.errors[j].start
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Col < b.Col
+	})
+
+	return result
+}
+
+// findUnused reports the unused loads and top-level variables of a resolved
+// file.
+func findUnused(f *syntax.File) []analysisFinding {
+	unused := []analysisFinding{}
+	bindings, uses := bindingUses(f)
+
+	functionNames := make(map[*syntax.Ident]bool)
+	loads := []*syntax.LoadStmt{}
+	walkSyntax(f, func(n syntax.Node) bool {
+		switch n := n.(type) {
+		case *syntax.DefStmt:
+			functionNames[n.Name] = true
+		case *syntax.LoadStmt:
+			loads = append(loads, n)
+		}
+		return true
+	})
+
+	loadedNames := make(map[*syntax.Ident]bool)
+	for _, load := range loads {
+		used := false
+		for _, to := range load.To {
+			loadedNames[to] = true
+			if uses[to] > 0 {
+				used = true
+				continue
+			}
+			start, end := to.Span()
+			unused = append(unused, analysisFinding{name: to.Name, kind: "load", message: fmt.Sprintf("loaded symbol %q is unused", to.Name), start: start, end: end})
+		}
+		if !used {
+			module := load.ModuleName()
+			start, end := load.Span()
+			unused = append(unused, analysisFinding{name: module, kind: "module", message: fmt.Sprintf("nothing loaded from %q is used", module), start: start, end: end})
+		}
+	}
+
+	for _, id := range bindings {
+		binding := id.Binding.(*resolve.Binding)
+		if binding.Scope != resolve.Global || functionNames[id] || loadedNames[id] || id.Name == "_" || uses[id] > 0 {
+			continue
+		}
+		start, end := id.Span()
+		unused = append(unused, analysisFinding{name: id.Name, kind: "variable", message: fmt.Sprintf("top-level variable %q is assigned but never used", id.Name), start: start, end: end})
+	}
+
+	sort.SliceStable(unused, func(i, j int) bool {
+		a, b := unused[i].start, unused[j].start
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Col < b.Col
+	})
+	return unused
+}
+
+func (f analysisFinding) toJSValue() js.Value {
+	obj := jsObject.New()
+	if f.name != "" {
+		obj.Set("name", f.name)
+	}
+	if f.kind != "" {
+		obj.Set("kind", f.kind)
+	}
+	obj.Set("message", f.message)
+	obj.Set("start", positionToJSValue(f.start))
+	obj.Set("end", positionToJSValue(f.end))
+	return obj
+}
+
+func findingsToJSValue(findings []analysisFinding) js.Value {
+	array := jsArray.New(len(findings))
+	for i, finding := range findings {
+		array.SetIndex(i, finding.toJSValue())
+	}
+	return array
+}
+
+func (a *analysis) toJSValue() js.Value {
+	obj := jsObject.New()
+	obj.Set("undefined", findingsToJSValue(a.undefined))
+	obj.Set("unused", findingsToJSValue(a.unused))
+	obj.Set("errors", findingsToJSValue(a.errors))
+	return obj
+}
+
+// jsAnalyze implements starlark.analyze(source, filename?, predeclared?),
+// where predeclared is an array of the global names the host will provide in
+// addition to the runner's own builtins.
+func jsAnalyze() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) (result interface{}) {
+		defer func() {
+			if r := recover(); r != nil {
+				result = errorToJSValue(newInternalError(r, panicStack()))
+			}
+		}()
+
+		if len(args) < 1 || args[0].Type() != js.TypeString {
+			return jsErrorConstructor.New("Error: analyze requires the source code as a string.")
+		}
+		filename := "<analyze>"
+		if len(args) > 1 && args[1].Type() == js.TypeString {
+			filename = args[1].String()
+		}
+		hostPredeclared := make(map[string]bool)
+		if len(args) > 2 && args[2].InstanceOf(jsArray) {
+			for i := 0; i < args[2].Length(); i++ {
+				hostPredeclared[args[2].Index(i).String()] = true
+			}
+		}
+
+		fileOptions := syntax.FileOptions{}
+		isPredeclared := func(name string) bool { return hostPredeclared[name] || predeclared.Has(name) }
+		return analyzeSource(filename, args[0].String(), &fileOptions, isPredeclared).toJSValue()
+	})
+}
@@ -0,0 +1,55 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"go.starlark.net/syntax"
+)
+
+func TestAnalyzeUnusedVariables(t *testing.T) {
+	fileOptions := &syntax.FileOptions{GlobalReassign: true, TopLevelControl: true}
+	tests := []struct {
+		name   string
+		source string
+		want   []string
+	}{
+		{name: "reassigned", source: "x = 1\nx = 2\n", want: []string{"x"}},
+		{name: "read", source: "x = 1\nx = 2\nprint(x)\n", want: []string{}},
+		{name: "augmented", source: "x = 1\nx += 2\n", want: []string{}},
+		{name: "unpacked", source: "a, (b, c) = 1, (2, 3)\nprint(b)\n", want: []string{"a", "c"}},
+		{name: "loop", source: "n = 0\nfor n in range(3):\n    pass\n", want: []string{"n"}},
+		{name: "index", source: "xs = [0]\nxs[0] = 1\n", want: []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := analyzeSource("test.star", test.source, fileOptions, func(string) bool { return false })
+			if len(result.errors) > 0 {
+				t.Fatalf("analyzeSource(%q) errors: %v", test.source, result.errors)
+			}
+			got := []string{}
+			for _, finding := range result.unused {
+				got = append(got, finding.name)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("analyzeSource(%q) unused = %v, want %v", test.source, got, test.want)
+			}
+		})
+	}
+}
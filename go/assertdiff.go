@@ -0,0 +1,291 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"syscall/js"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// maxAssertionDiffs is the most differences a failed assertion reports; the
+// rest are only counted.
+const maxAssertionDiffs = 100
+
+// assertionReprLimit bounds the repr of each value in an assertion's
+// differences.
+const assertionReprLimit = 200
+
+// The kinds of difference between an actual and an expected value, at a
+// path into them.
+const (
+	// valueAdded is in the actual value only.
+	valueAdded = "added"
+	// valueRemoved is in the expected value only.
+	valueRemoved = "removed"
+	// valueChanged differs between them.
+	valueChanged = "changed"
+)
+
+// valueDiff is a difference between an actual and an expected value, at a
+// path of indexes, keys and attributes, such as ["rows"][2].name, which is
+// empty for the values themselves.
+type valueDiff struct {
+	path     string
+	kind     string
+	actual   starlark.Value
+	expected starlark.Value
+}
+
+func (d valueDiff) String() string {
+	at := ""
+	if d.path != "" {
+		at = " at " + d.path
+	}
+	switch d.kind {
+	case valueAdded:
+		return fmt.Sprintf("added%s: %s", at, boundedRepr(d.actual, assertionReprLimit))
+	case valueRemoved:
+		return fmt.Sprintf("removed%s: %s", at, boundedRepr(d.expected, assertionReprLimit))
+	}
+	return fmt.Sprintf("changed%s: got %s, want %s", at, boundedRepr(d.actual, assertionReprLimit), boundedRepr(d.expected, assertionReprLimit))
+}
+
+func (d valueDiff) toJSValue() js.Value {
+	obj := jsObject.New()
+	obj.Set("path", d.path)
+	obj.Set("kind", d.kind)
+	if d.actual != nil {
+		obj.Set("actual", boundedRepr(d.actual, assertionReprLimit))
+	}
+	if d.expected != nil {
+		obj.Set("expected", boundedRepr(d.expected, assertionReprLimit))
+	}
+	return obj
+}
+
+// assertionError is raised by a failed assert.eq. Its message lists the
+// first differences, and it is reported to the host with all of them that
+// were kept, on the eval error the execution fails with.
+type assertionError struct {
+	message string
+	diffs   []valueDiff
+	// total is the number of differences, including those not kept.
+	total int
+}
+
+func (e *assertionError) Error() string {
+	return e.message
+}
+
+func (e *assertionError) toJSValue() js.Value {
+	diffs := jsArray.New(len(e.diffs))
+	for i, d := range e.diffs {
+		diffs.SetIndex(i, d.toJSValue())
+	}
+	obj := jsObject.New()
+	obj.Set("diffs", diffs)
+	obj.Set("total", e.total)
+	return obj
+}
+
+// assertionMessageDiffs is the number of differences listed in an
+// assertion's message.
+const assertionMessageDiffs = 10
+
+// newAssertionError describes the differences of a failed assertion, after
+// the message the script passed, if any.
+func newAssertionError(prefix string, diffs []valueDiff, total int) *assertionError {
+	var b strings.Builder
+	b.WriteString(prefix)
+	if total == 1 {
+		b.WriteString("1 difference")
+	} else {
+		fmt.Fprintf(&b, "%d differences", total)
+	}
+	for i, d := range diffs {
+		if i == assertionMessageDiffs {
+			fmt.Fprintf(&b, "\n  ... and %d more", total-i)
+			break
+		}
+		b.WriteString("\n  " + d.String())
+	}
+	return &assertionError{message: b.String(), diffs: diffs, total: total}
+}
+
+// valueDiffer walks an actual and an expected value together, collecting
+// where they differ.
+type valueDiffer struct {
+	// limit is the most differences kept, maxAssertionDiffs if zero.
+	limit int
+	diffs []valueDiff
+	total int
+}
+
+func (d *valueDiffer) add(diff valueDiff) {
+	d.total++
+	limit := d.limit
+	if limit == 0 {
+		limit = maxAssertionDiffs
+	}
+	if len(d.diffs) < limit {
+		d.diffs = append(d.diffs, diff)
+	}
+}
+
+// compare records the differences between actual and expected at path.
+// Dicts, lists, tuples and structs of the same type are compared element by
+// element; anything else that is not equal differs as a whole.
+func (d *valueDiffer) compare(path string, actual starlark.Value, expected starlark.Value) error {
+	eq, err := starlark.Equal(actual, expected)
+	if err != nil || eq {
+		return err
+	}
+	switch a := actual.(type) {
+	case *starlark.Dict:
+		if e, ok := expected.(*starlark.Dict); ok {
+			return d.compareDicts(path, a, e)
+		}
+	case *starlark.List:
+		if e, ok := expected.(*starlark.List); ok {
+			return d.compareSequences(path, a, e)
+		}
+	case starlark.Tuple:
+		if e, ok := expected.(starlark.Tuple); ok {
+			return d.compareSequences(path, a, e)
+		}
+	case *starlarkstruct.Struct:
+		if e, ok := expected.(*starlarkstruct.Struct); ok {
+			return d.compareStructs(path, a, e)
+		}
+	}
+	d.add(valueDiff{path: path, kind: valueChanged, actual: actual, expected: expected})
+	return nil
+}
+
+// compareDicts reports the keys of expected in its order, then the keys
+// only actual has in its order.
+func (d *valueDiffer) compareDicts(path string, actual *starlark.Dict, expected *starlark.Dict) error {
+	for _, item := range expected.Items() {
+		keyPath := path + "[" + item[0].String() + "]"
+		value, found, err := actual.Get(item[0])
+		if err != nil {
+			return err
+		}
+		if !found {
+			d.add(valueDiff{path: keyPath, kind: valueRemoved, expected: item[1]})
+			continue
+		}
+		if err := d.compare(keyPath, value, item[1]); err != nil {
+			return err
+		}
+	}
+	for _, item := range actual.Items() {
+		if _, found, _ := expected.Get(item[0]); !found {
+			d.add(valueDiff{path: path + "[" + item[0].String() + "]", kind: valueAdded, actual: item[1]})
+		}
+	}
+	return nil
+}
+
+// compareSequences compares sequences of the same length element by
+// element. Otherwise it matches up their elements as a diff of their reprs
+// would, so that an element added or removed in the middle is reported as
+// such, rather than as a change of every element after it. Each removed
+// element is at its index in expected, and each other at its index in
+// actual.
+func (d *valueDiffer) compareSequences(path string, actual starlark.Indexable, expected starlark.Indexable) error {
+	at := func(i int) string { return fmt.Sprintf("%s[%d]", path, i) }
+	if actual.Len() == expected.Len() {
+		for i := 0; i < actual.Len(); i++ {
+			if err := d.compare(at(i), actual.Index(i), expected.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	reprs := func(seq starlark.Indexable) []string {
+		s := make([]string, seq.Len())
+		for i := range s {
+			s[i] = seq.Index(i).String()
+		}
+		return s
+	}
+	lines := diffLines(reprs(expected), reprs(actual))
+	// A run of removed and added elements between equal ones pairs up as
+	// changed elements.
+	var removed, added []diffLine
+	flush := func() error {
+		n := min(len(removed), len(added))
+		for i := 0; i < n; i++ {
+			if err := d.compare(at(added[i].actual), actual.Index(added[i].actual), expected.Index(removed[i].golden)); err != nil {
+				return err
+			}
+		}
+		for _, line := range removed[n:] {
+			d.add(valueDiff{path: at(line.golden), kind: valueRemoved, expected: expected.Index(line.golden)})
+		}
+		for _, line := range added[n:] {
+			d.add(valueDiff{path: at(line.actual), kind: valueAdded, actual: actual.Index(line.actual)})
+		}
+		removed, added = removed[:0], added[:0]
+		return nil
+	}
+	for _, line := range lines {
+		switch line.kind {
+		case diffDelete:
+			removed = append(removed, line)
+		case diffInsert:
+			added = append(added, line)
+		default:
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// compareStructs compares the fields of structs by name.
+func (d *valueDiffer) compareStructs(path string, actual *starlarkstruct.Struct, expected *starlarkstruct.Struct) error {
+	names := expected.AttrNames()
+	for _, name := range actual.AttrNames() {
+		if _, err := expected.Attr(name); err != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		a, _ := actual.Attr(name)
+		e, _ := expected.Attr(name)
+		switch {
+		case a == nil:
+			d.add(valueDiff{path: path + "." + name, kind: valueRemoved, expected: e})
+		case e == nil:
+			d.add(valueDiff{path: path + "." + name, kind: valueAdded, actual: a})
+		default:
+			if err := d.compare(path+"."+name, a, e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
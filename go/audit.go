@@ -0,0 +1,133 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"sync"
+	"syscall/js"
+	"time"
+)
+
+// auditLimit is the most host crossings an audit log keeps. It counts the
+// rest, so that a script printing in a loop cannot exhaust memory.
+const auditLimit = 10000
+
+// auditSummaryLength bounds the summary of a crossing's arguments, in bytes.
+const auditSummaryLength = 200
+
+// auditEntry is a crossing of the bridge to the host: a call of one of its
+// callbacks, and for loads the wait for the promise it returns.
+type auditEntry struct {
+	callback string
+	// summary describes the arguments, such as the module loaded or the
+	// line printed.
+	summary string
+	// at is when the call was made, since the execution started.
+	at       time.Duration
+	duration time.Duration
+	err      error
+}
+
+func (a auditEntry) toJSValue() js.Value {
+	obj := jsObject.New()
+	obj.Set("callback", a.callback)
+	obj.Set("summary", a.summary)
+	obj.Set("time", milliseconds(a.at))
+	obj.Set("duration", milliseconds(a.duration))
+	if a.err != nil {
+		obj.Set("outcome", "error")
+		obj.Set("error", a.err.Error())
+	} else {
+		obj.Set("outcome", "ok")
+	}
+	return obj
+}
+
+// auditLog records the host crossings of an execution with the audit
+// option, so that what an untrusted script made the host do can be reviewed
+// afterwards.
+type auditLog struct {
+	start time.Time
+
+	mu      sync.Mutex
+	entries []auditEntry
+	dropped int
+}
+
+func newAuditLog() *auditLog {
+	return &auditLog{start: time.Now()}
+}
+
+func (l *auditLog) toJSValue() js.Value {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := jsArray.New(len(l.entries))
+	for i, entry := range l.entries {
+		entries.SetIndex(i, entry.toJSValue())
+	}
+	obj := jsObject.New()
+	obj.Set("entries", entries)
+	obj.Set("dropped", l.dropped)
+	return obj
+}
+
+// audited makes a call to a host callback, counting it in the metrics,
+// and recording it in the audit log, if the execution has one. summary is
+// only called if it does.
+func (e *execution) audited(callback string, summary func() string, call func() error) error {
+	e.hostCalls.Add(1)
+	start := time.Now()
+	err := call()
+	countHostCall(callback, time.Since(start))
+	if e.audit == nil {
+		return err
+	}
+	entry := auditEntry{
+		callback: callback,
+		summary:  truncateString(e.redactor.string(summary()), auditSummaryLength),
+		at:       start.Sub(e.audit.start),
+		duration: time.Since(start),
+		err:      err,
+	}
+	e.audit.mu.Lock()
+	defer e.audit.mu.Unlock()
+	if len(e.audit.entries) < auditLimit {
+		e.audit.entries = append(e.audit.entries, entry)
+	} else {
+		e.audit.dropped++
+	}
+	return err
+}
+
+// attachAudit sets the audit log on the value or error an execution settles
+// with, once its last crossings, those delivering batched output and trace
+// events, are made.
+func (e *execution) attachAudit(outcome js.Value) {
+	if e.audit != nil && outcome.Type() == js.TypeObject {
+		outcome.Set("audit", e.audit.toJSValue())
+	}
+}
+
+// countSummary describes a crossing that passes n things, such as lines.
+func countSummary(n int, thing string) func() string {
+	return func() string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s", thing)
+		}
+		return fmt.Sprintf("%d %ss", n, thing)
+	}
+}
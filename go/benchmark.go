@@ -0,0 +1,194 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"syscall/js"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// The defaults of a benchmark spec.
+const (
+	defaultBenchmarkIterations = 10
+	defaultBenchmarkWarmup     = 1
+)
+
+// benchmarkSample is the measurement of one timed call.
+type benchmarkSample struct {
+	elapsed time.Duration
+	steps   uint64
+}
+
+// benchmarkSpec is what starlark.benchmark is asked to run.
+type benchmarkSpec struct {
+	filename         string
+	funcName         string
+	args             js.Value
+	kwargs           js.Value
+	iterations       int
+	warmup           int
+	maxExecutionTime int
+}
+
+func parseBenchmarkSpec(value js.Value) (benchmarkSpec, error) {
+	spec := benchmarkSpec{
+		funcName:   "main",
+		args:       value.Get("args"),
+		kwargs:     value.Get("kwargs"),
+		iterations: defaultBenchmarkIterations,
+		warmup:     defaultBenchmarkWarmup,
+	}
+	filename := value.Get("filename")
+	if filename.Type() != js.TypeString {
+		return spec, fmt.Errorf("Error: the benchmark spec requires a filename.")
+	}
+	spec.filename = filename.String()
+	if funcName := value.Get("function"); funcName.Type() == js.TypeString {
+		spec.funcName = funcName.String()
+	}
+	if iterations := value.Get("iterations"); iterations.Type() == js.TypeNumber {
+		spec.iterations = iterations.Int()
+	}
+	if spec.iterations < 1 {
+		return spec, fmt.Errorf("Error: the benchmark needs at least one iteration.")
+	}
+	if warmup := value.Get("warmup"); warmup.Type() == js.TypeNumber {
+		spec.warmup = max(warmup.Int(), 0)
+	}
+	if maxExecutionTime := value.Get("maxExecutionTime"); maxExecutionTime.Type() == js.TypeNumber {
+		spec.maxExecutionTime = maxExecutionTime.Int()
+	}
+	return spec, nil
+}
+
+// runBenchmark initializes the spec's module once, then calls its function
+// warmup times and iterations times more, measuring each of the latter.
+// Converting the arguments, which is done afresh for every call so that
+// calls cannot see each other's changes to them, is not measured.
+func runBenchmark(exec *execution, spec benchmarkSpec) ([]benchmarkSample, error) {
+	samples := make([]benchmarkSample, 0, spec.iterations)
+	_, err := runWithTimeout(exec, spec.maxExecutionTime, func() (starlark.Value, error) {
+		load := exec.loader()
+		globals, err := load(nil, spec.filename)
+		if err != nil {
+			return nil, exec.wrapEvalError(codeEvalFailed, err)
+		}
+		fn, ok := globals[spec.funcName]
+		if !ok {
+			return nil, exec.messageErr(codeMissingFunction, "function", fmt.Sprintf("%q", spec.funcName))
+		}
+
+		conv := &converter{exec: exec}
+		for i := 0; i < spec.warmup+spec.iterations; i++ {
+			args, kwargs, err := conv.convertArgs(spec.args, spec.kwargs)
+			if err != nil {
+				return nil, err
+			}
+			thread := exec.newThread(fmt.Sprintf("%s benchmark %d", exec.id, i), load)
+			start := time.Now()
+			_, err = starlark.Call(thread, fn, args, kwargs)
+			elapsed := time.Since(start)
+			if err != nil {
+				exec.recordError(thread, err)
+				return nil, exec.wrapEvalError(codeExecFailed, err)
+			}
+			if i >= spec.warmup {
+				samples = append(samples, benchmarkSample{elapsed: elapsed, steps: thread.ExecutionSteps()})
+			}
+		}
+		return starlark.None, nil
+	})
+	return samples, err
+}
+
+// percentile returns the nearest-rank percentile p of sorted values.
+func percentile[T any](sorted []T, p float64) T {
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
+
+// summarize returns the min, median, p95 and mean of values.
+func summarize(values []float64) js.Value {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	var total float64
+	for _, value := range sorted {
+		total += value
+	}
+	summary := jsObject.New()
+	summary.Set("min", sorted[0])
+	summary.Set("median", percentile(sorted, 0.5))
+	summary.Set("p95", percentile(sorted, 0.95))
+	summary.Set("mean", total/float64(len(sorted)))
+	return summary
+}
+
+// benchmarkToJSValue returns the result of starlark.benchmark: summaries of
+// the times, in milliseconds, and steps of the timed calls, and each call's
+// own measurements.
+func benchmarkToJSValue(spec benchmarkSpec, samples []benchmarkSample) js.Value {
+	times := make([]float64, len(samples))
+	steps := make([]float64, len(samples))
+	jsSamples := jsArray.New(len(samples))
+	for i, sample := range samples {
+		times[i] = milliseconds(sample.elapsed)
+		steps[i] = float64(sample.steps)
+		jsSample := jsObject.New()
+		jsSample.Set("time", times[i])
+		jsSample.Set("steps", steps[i])
+		jsSamples.SetIndex(i, jsSample)
+	}
+	result := jsObject.New()
+	result.Set("iterations", spec.iterations)
+	result.Set("warmup", spec.warmup)
+	result.Set("time", summarize(times))
+	result.Set("steps", summarize(steps))
+	result.Set("samples", jsSamples)
+	return result
+}
+
+// jsBenchmark implements starlark.benchmark(executionId, spec, options),
+// where spec names the function to call and how often: {filename, function,
+// args, kwargs, iterations, warmup, maxExecutionTime}. The timings are taken
+// inside the wasm module, so they leave out the cost of crossing into it.
+func jsBenchmark() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 2 || args[1].Type() != js.TypeObject {
+			return rejected(fmt.Errorf("Error: requires executionId and a benchmark spec as arguments."))
+		}
+		options := js.Undefined()
+		if len(args) > 2 {
+			options = args[2]
+		}
+		return runAsync(args[0].String(), options, func(exec *execution) (js.Value, error) {
+			spec, err := parseBenchmarkSpec(args[1])
+			if err != nil {
+				return js.Null(), err
+			}
+			samples, err := runBenchmark(exec, spec)
+			if err != nil {
+				return js.Null(), err
+			}
+			return benchmarkToJSValue(spec, samples), nil
+		})
+	})
+}
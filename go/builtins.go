@@ -0,0 +1,149 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// predeclared holds the builtins the runner adds to every module, alongside
+// the universal ones such as len and print. They find their execution through
+// the calling thread rather than being bound to one, so that compiled modules
+// and their globals can be shared between executions.
+var predeclared = starlark.StringDict{
+	"eprint": starlark.NewBuiltin("eprint", executionBuiltin((*execution).eprint)),
+	"emit":   starlark.NewBuiltin("emit", executionBuiltin((*execution).emit)),
+}
+
+// executionKey is the thread-local holding the execution a thread belongs to.
+const executionKey = "starlark_wasm.execution"
+
+// executionBuiltin adapts a builtin implemented as a method of execution.
+func executionBuiltin(fn func(*execution, *starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error)) func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+	return func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		e, ok := thread.Local(executionKey).(*execution)
+		if !ok {
+			return nil, fmt.Errorf("%s: not called from an execution", b.Name())
+		}
+		if err := e.permit(b.Name()); err != nil {
+			return nil, err
+		}
+		if err := e.throttle(b.Name()); err != nil {
+			return nil, err
+		}
+		if e.tracer == nil {
+			return fn(e, thread, b, args, kwargs)
+		}
+		start := time.Now()
+		result, err := fn(e, thread, b, args, kwargs)
+		if traceErr := e.traceBuiltinCall(thread, b.Name(), start); traceErr != nil && err == nil {
+			err = traceErr
+		}
+		return result, err
+	}
+}
+
+// permit returns a PermissionError unless the execution may call the host
+// builtin with the given name.
+func (e *execution) permit(name string) error {
+	if e.options.allowBuiltins == nil || e.options.allowBuiltins[name] {
+		return nil
+	}
+	e.notifyCapabilityDenied(name, codePermissionDenied)
+	return e.messageErr(codePermissionDenied, "function", fmt.Sprintf("%q", name))
+}
+
+// guardBuiltin makes a plugin's builtin subject to the allowBuiltins and
+// maxCallRate options.
+// Values other than functions, such as a struct of them, cannot be guarded,
+// and are returned as they are.
+func guardBuiltin(value starlark.Value) starlark.Value {
+	b, ok := value.(*starlark.Builtin)
+	if !ok {
+		return value
+	}
+	return starlark.NewBuiltin(b.Name(), func(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		if e, ok := thread.Local(executionKey).(*execution); ok {
+			if err := e.permit(b.Name()); err != nil {
+				return nil, err
+			}
+			if err := e.throttle(b.Name()); err != nil {
+				return nil, err
+			}
+		}
+		return b.CallInternal(thread, args, kwargs)
+	})
+}
+
+// eprint is like print, but writes to the error stream so that hosts can show
+// diagnostics separately from a script's regular output.
+func (e *execution) eprint(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	sep := " "
+	if err := starlark.UnpackArgs(b.Name(), nil, kwargs, "sep?", &sep); err != nil {
+		return nil, err
+	}
+
+	buf := new(strings.Builder)
+	for i, v := range args {
+		if i > 0 {
+			buf.WriteString(sep)
+		}
+		if s, ok := starlark.AsString(v); ok {
+			buf.WriteString(s)
+		} else {
+			buf.WriteString(v.String())
+		}
+	}
+
+	if err := e.print(thread, "stderr", buf.String()); err != nil {
+		return nil, err
+	}
+	return starlark.None, nil
+}
+
+// emit delivers a structured value to the host's globalThis.starlark.emit
+// callback, converted as for a return value, so that scripts can stream
+// events without encoding them into print output. With the iterate option,
+// the value is also the next step of the run's iterator.
+func (e *execution) emit(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var value starlark.Value
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &value); err != nil {
+		return nil, err
+	}
+	e.meter.countCall()
+	value = e.redactor.value(value)
+
+	conv := &converter{exec: e}
+	jsValue, err := conv.convertToJSValue(value, "emit")
+	if err != nil {
+		return nil, err
+	}
+	if e.iterator != nil {
+		e.iterator.push(jsValue)
+	}
+	summary := func() string { return boundedRepr(value, auditSummaryLength) }
+	if err := e.audited("emit", summary, func() error { return jsEmit(e.options.callbacks, jsValue, e.id) }); err != nil {
+		if err := e.hostFailure("emit", err); err != nil {
+			return nil, err
+		}
+	}
+	return starlark.None, nil
+}
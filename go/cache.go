@@ -0,0 +1,313 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"syscall/js"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// maxCachedModules bounds the number of compiled modules kept between
+// executions. When there are more, the oldest module of a shard is evicted,
+// which is roughly the oldest overall.
+const maxCachedModules = 100
+
+// moduleKey identifies a version of a module. The filename is part of it as
+// compiled programs record the positions of their code, the names of the
+// host functions it was compiled with as its program looks them up, and the
+// key of its dialect as that decides what compiles.
+type moduleKey struct {
+	filename      string
+	hash          string
+	hostFunctions string
+	dialect       string
+}
+
+// cachedModule is a compiled module and, with the cacheGlobals option, the
+// globals it was initialized with.
+type cachedModule struct {
+	program *starlark.Program
+	globals starlark.StringDict
+	// generation identifies the globals, and deps the generation of the
+	// globals of each module they were initialized from, so that they are
+	// only reused while all of those are too.
+	generation uint64
+	deps       map[string]uint64
+}
+
+// lastGeneration is the generation of the most recently initialized cached
+// globals. Generation 0 stands for globals that never change, such as those
+// of bundled modules.
+var lastGeneration atomic.Uint64
+
+// moduleCacheShards is the number of shards of the module cache. Modules are
+// spread across them by filename, each with a lock of its own, so that
+// concurrent executions loading different modules do not contend.
+const moduleCacheShards = 16
+
+// moduleCacheShard holds some of the compiled modules of all executions, so
+// that a module is only compiled again when its content changes.
+type moduleCacheShard struct {
+	mu      sync.Mutex
+	modules map[moduleKey]*cachedModule
+	// order holds the keys of the shard's modules, oldest first.
+	order []moduleKey
+}
+
+var moduleCache = struct {
+	shards [moduleCacheShards]moduleCacheShard
+	// size counts the modules across all shards.
+	size atomic.Int64
+	// lookups, hits, contended and waited measure the cache: how often a
+	// shard's lock was taken by a lookup, how often that found a module,
+	// how often the lock was held by another execution, and for how long,
+	// in nanoseconds, those waited for it.
+	lookups, hits, contended, waited atomic.Int64
+}{}
+
+func init() {
+	for i := range moduleCache.shards {
+		moduleCache.shards[i].modules = make(map[moduleKey]*cachedModule)
+	}
+}
+
+// shardFor returns the shard holding the versions of the module with the
+// given filename.
+func shardFor(filename string) *moduleCacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(filename))
+	return &moduleCache.shards[h.Sum32()%moduleCacheShards]
+}
+
+// lock takes the shard's lock, counting the times it had to wait for it.
+func (s *moduleCacheShard) lock() {
+	if s.mu.TryLock() {
+		return
+	}
+	start := time.Now()
+	s.mu.Lock()
+	moduleCache.contended.Add(1)
+	moduleCache.waited.Add(int64(time.Since(start)))
+}
+
+func cachedModuleFor(key moduleKey) *cachedModule {
+	shard := shardFor(key.filename)
+	shard.lock()
+	defer shard.mu.Unlock()
+	moduleCache.lookups.Add(1)
+	module := shard.modules[key]
+	if module != nil {
+		moduleCache.hits.Add(1)
+	}
+	return module
+}
+
+func cacheModule(key moduleKey, module *cachedModule) {
+	shard := shardFor(key.filename)
+	shard.lock()
+	if _, ok := shard.modules[key]; !ok {
+		shard.order = append(shard.order, key)
+		moduleCache.size.Add(1)
+	}
+	shard.modules[key] = module
+	if moduleCache.size.Load() > maxCachedModules && len(shard.order) > 1 {
+		shard.evictOldest()
+		shard.mu.Unlock()
+		return
+	}
+	shard.mu.Unlock()
+
+	// The shard only holds the new module, so make room in another. The
+	// shards are locked one at a time, so that two executions doing this
+	// cannot deadlock.
+	for i := range moduleCache.shards {
+		if moduleCache.size.Load() <= maxCachedModules {
+			return
+		}
+		other := &moduleCache.shards[i]
+		if other == shard {
+			continue
+		}
+		other.lock()
+		if len(other.order) > 0 {
+			other.evictOldest()
+		}
+		other.mu.Unlock()
+	}
+}
+
+// evictOldest drops the shard's oldest module. The shard must be locked.
+func (s *moduleCacheShard) evictOldest() {
+	logf(logInfo, logCache, "%s: evicted, as the cache holds %d modules", s.order[0].filename, maxCachedModules)
+	delete(s.modules, s.order[0])
+	s.order = s.order[1:]
+	moduleCache.size.Add(-1)
+}
+
+// cacheStatsToJSValue returns the measurements of the module cache, for
+// starlark.cacheStats().
+func cacheStatsToJSValue() js.Value {
+	stats := jsObject.New()
+	stats.Set("shards", moduleCacheShards)
+	stats.Set("modules", moduleCache.size.Load())
+	stats.Set("lookups", moduleCache.lookups.Load())
+	stats.Set("hits", moduleCache.hits.Load())
+	stats.Set("contended", moduleCache.contended.Load())
+	stats.Set("waited", milliseconds(time.Duration(moduleCache.waited.Load())))
+	return stats
+}
+
+func jsCacheStats() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		return cacheStatsToJSValue()
+	})
+}
+
+// contentHash is the hash modules are cached by, unless the host's loader
+// provides one.
+func contentHash(source string) string {
+	sum := sha256.Sum256([]byte(source))
+	return hex.EncodeToString(sum[:])
+}
+
+// execModule initializes a module on the thread, compiling it unless a
+// module with the same filename and hash has been compiled already, or the
+// host persisted its program. With the cacheGlobals option, the globals of
+// an earlier initialization are reused too, so the module's top-level code
+// only runs the first time. Either way the host's verifier, if it has one,
+// must approve the module first.
+func (e *execution) execModule(thread *starlark.Thread, filename string, source string, hash string) (starlark.StringDict, error) {
+	if err := e.verifyModule(filename, source); err != nil {
+		return nil, err
+	}
+	key := e.moduleKeyFor(filename, source, hash)
+	// Globals hold on to the environment they were initialized with, so
+	// those of a run whose builtins, secrets or host functions change it
+	// are its own.
+	cacheGlobals := e.options.cacheGlobals && !e.ownsEnvironment()
+
+	module := cachedModuleFor(key)
+	if module != nil && cacheGlobals && module.globals != nil {
+		if e.depsUnchanged(thread, module) {
+			logf(logDebug, logCache, "%s: reusing its globals", filename)
+			e.setGeneration(filename, module.generation)
+			e.notifyModuleLoaded(filename)
+			return module.globals, nil
+		}
+		logf(logDebug, logCache, "%s: a module it loads changed, initializing it again", filename)
+	}
+	if module == nil {
+		var err error
+		if module, err = e.compileModule(key, source); err != nil {
+			return nil, err
+		}
+	} else {
+		logf(logDebug, logCache, "%s: reusing its compiled program", filename)
+	}
+
+	initStart := time.Now()
+	globals, err := module.program.Init(thread, e.env)
+	e.addPhase(phaseInit, filename, initStart)
+	globals.Freeze()
+	if err != nil {
+		return globals, err
+	}
+	if cacheGlobals {
+		module = &cachedModule{
+			program:    module.program,
+			globals:    globals,
+			generation: lastGeneration.Add(1),
+			deps:       make(map[string]uint64),
+		}
+		for i := 0; i < module.program.NumLoads(); i++ {
+			name, _ := module.program.Load(i)
+			module.deps[name] = e.generation(name)
+		}
+		e.setGeneration(filename, module.generation)
+	}
+	cacheModule(key, module)
+	e.notifyModuleLoaded(filename)
+	return globals, nil
+}
+
+// moduleKeyFor returns the key the execution caches a version of a module
+// under, with the hash of its source unless the loader gave one.
+func (e *execution) moduleKeyFor(filename string, source string, hash string) moduleKey {
+	if hash == "" {
+		hash = contentHash(source)
+	}
+	return moduleKey{filename: filename, hash: hash, hostFunctions: e.hostFunctionNames(), dialect: e.dialectKey()}
+}
+
+// compileModule returns the program of a module that is not in the cache:
+// the one the host persisted, if any, or else the one it compiles, which it
+// persists.
+func (e *execution) compileModule(key moduleKey, source string) (*cachedModule, error) {
+	if program := e.persistedProgram(key); program != nil {
+		return &cachedModule{program: program}, nil
+	}
+	logf(logDebug, logCache, "%s: not cached, compiling it", key.filename)
+	compileStart := time.Now()
+	_, program, err := starlark.SourceProgramOptions(e.fileOptions(), key.filename, source, e.isPredeclared)
+	e.addLoadTime(compileStart)
+	e.addPhase(phaseCompile, key.filename, compileStart)
+	if err != nil {
+		return nil, err
+	}
+	e.persistModule(key, source, program)
+	return &cachedModule{program: program}, nil
+}
+
+// depsUnchanged reports whether the modules that a module's cached globals
+// were initialized from are the same as this execution's, loading them on
+// the thread to find out. A module whose dependencies changed must be
+// initialized again, or it would keep using their old globals.
+func (e *execution) depsUnchanged(thread *starlark.Thread, module *cachedModule) bool {
+	for name, generation := range module.deps {
+		if _, err := thread.Load(thread, name); err != nil {
+			return false
+		}
+		if e.generation(name) != generation {
+			return false
+		}
+	}
+	return true
+}
+
+// generation returns the generation of the globals this execution
+// initialized or reused for a module; 0 if they were not cached.
+func (e *execution) generation(module string) uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.generations[module]
+}
+
+func (e *execution) setGeneration(module string, generation uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.generations == nil {
+		e.generations = make(map[string]uint64)
+	}
+	e.generations[module] = generation
+}
@@ -0,0 +1,58 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "syscall/js"
+
+// hostCancelReason is what a run the host cancels is cancelled with, unless
+// the host gives a reason of its own.
+const hostCancelReason = "cancelled by the host"
+
+// cancelExecution cancels the running execution with the given id, stopping
+// its threads, those loading modules included, at their next step, or the
+// one waiting for a slot, which then never starts. It returns whether there
+// was one.
+func cancelExecution(id string, reason string) bool {
+	e := runningExecution(id)
+	if e == nil {
+		e = queuedExecutionById(id)
+	}
+	if e == nil {
+		return false
+	}
+	if reason == "" {
+		reason = hostCancelReason
+	}
+	e.cancel(reason)
+	return true
+}
+
+// jsCancel implements starlark.cancel(executionId, reason), which cancels a
+// run, failing it with the reason, "cancelled by the host" if not given. It
+// returns whether the run was running.
+func jsCancel() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 1 || args[0].Type() != js.TypeString {
+			return jsErrorConstructor.New("Error: requires an executionId as argument.")
+		}
+		reason := ""
+		if len(args) > 1 && args[1].Type() == js.TypeString {
+			reason = args[1].String()
+		}
+		return cancelExecution(args[0].String(), reason)
+	})
+}
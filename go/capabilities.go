@@ -0,0 +1,69 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"runtime"
+	"syscall/js"
+
+	"dcollien.com/starlark-wasm/internal/runner"
+)
+
+// capabilitiesToJSValue reports what this binary was built with, and what
+// the JS environment it runs in allows, for starlark.capabilities(), so that
+// a host can adapt to a build rather than fail a run on what it lacks.
+func capabilitiesToJSValue() js.Value {
+	capabilities := jsObject.New()
+	capabilities.Set("goVersion", runtime.Version())
+	capabilities.Set("compiler", runtime.Compiler)
+	capabilities.Set("modules", stringsToJSArray(runner.BundledModuleNames()))
+	capabilities.Set("plugins", stringsToJSArray(runner.PluginNames()))
+	capabilities.Set("fileOptions", true)
+	capabilities.Set("debug", true)
+	// TinyGo keeps no symbol tables, so internal errors come without the Go
+	// stack.
+	capabilities.Set("stackTraces", runtime.Compiler != "tinygo")
+	capabilities.Set("sharedArrayBuffer", sharedArrayBufferAvailable())
+	return capabilities
+}
+
+// sharedArrayBufferAvailable reports whether loads can be answered through a
+// SharedArrayBuffer: browsers only provide it to cross-origin isolated
+// pages and their workers.
+func sharedArrayBufferAvailable() bool {
+	global := js.Global()
+	if global.Get("SharedArrayBuffer").Type() != js.TypeFunction || global.Get("Atomics").Type() != js.TypeObject {
+		return false
+	}
+	isolated := global.Get("crossOriginIsolated")
+	return isolated.Type() != js.TypeBoolean || isolated.Bool()
+}
+
+// stringsToJSArray converts a list of strings to a JS array.
+func stringsToJSArray(strings []string) js.Value {
+	array := jsArray.New(len(strings))
+	for i, s := range strings {
+		array.SetIndex(i, s)
+	}
+	return array
+}
+
+func jsCapabilities() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		return capabilitiesToJSValue()
+	})
+}
@@ -0,0 +1,356 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"sort"
+	"strings"
+	"syscall/js"
+	"unicode"
+
+	"dcollien.com/starlark-wasm/internal/runner"
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// completionPlaceholder is inserted at the cursor, so that source being typed,
+// such as "json.", still parses.
+const completionPlaceholder = "__complete__"
+
+// The kinds of completions, by what binds the name.
+const (
+	completeParameter   = "parameter"
+	completeLocal       = "local"
+	completeFunction    = "function"
+	completeGlobal      = "global"
+	completeLoad        = "load"
+	completePredeclared = "predeclared"
+	completeBuiltin     = "builtin"
+	completeMember      = "member"
+)
+
+// completion is a name that could be typed at the cursor.
+type completion struct {
+	label string
+	kind  string
+	// detail is the type of a module member.
+	detail string
+}
+
+func (c completion) toJSValue() js.Value {
+	obj := jsObject.New()
+	obj.Set("label", c.label)
+	obj.Set("kind", c.kind)
+	if c.detail != "" {
+		obj.Set("detail", c.detail)
+	}
+	return obj
+}
+
+// completions collects completions, keeping the first of each name, which
+// is that of the innermost scope binding it.
+type completions struct {
+	prefix string
+	seen   map[string]bool
+	items  []completion
+}
+
+func (c *completions) add(label string, kind string, detail string) {
+	if !strings.HasPrefix(label, c.prefix) || strings.Contains(label, completionPlaceholder) || c.seen[label] {
+		return
+	}
+	c.seen[label] = true
+	c.items = append(c.items, completion{label: label, kind: kind, detail: detail})
+}
+
+// isIdentRune reports whether r can be part of an identifier.
+func isIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// cursorContext splits the text before the cursor, at a 1-based line and
+// column in runes, into the identifier being typed, and the simple name it
+// is an attribute of, if it follows one and a dot. prefixStart is the column
+// the identifier starts at.
+func cursorContext(source string, line int, col int) (prefix string, object string, prefixStart int, ok bool) {
+	lines := strings.Split(source, "\n")
+	if line < 1 || line > len(lines) {
+		return "", "", 0, false
+	}
+	text := []rune(lines[line-1])
+	if col < 1 || col-1 > len(text) {
+		return "", "", 0, false
+	}
+	end := col - 1
+	start := end
+	for start > 0 && isIdentRune(text[start-1]) {
+		start--
+	}
+	prefix = string(text[start:end])
+	if start > 0 && text[start-1] == '.' {
+		objectEnd := start - 1
+		objectStart := objectEnd
+		for objectStart > 0 && isIdentRune(text[objectStart-1]) {
+			objectStart--
+		}
+		object = string(text[objectStart:objectEnd])
+		if object == "" {
+			// An attribute of something other than a name, say a call,
+			// whose type is not known without running it.
+			object = "."
+		}
+	}
+	return prefix, object, start + 1, true
+}
+
+// parseForCompletion parses the source with the placeholder at the cursor.
+// Failing that, it tries again without the lines after the cursor, which may
+// be just as unfinished, and then with the cursor's line blanked too, which
+// still gives the scopes around it.
+func parseForCompletion(filename string, source string, line int, col int) *syntax.File {
+	lines := strings.Split(source, "\n")
+	text := []rune(lines[line-1])
+	indent := 0
+	for indent < len(text) && (text[indent] == ' ' || text[indent] == '\t') {
+		indent++
+	}
+	placeholder := string(text[:col-1]) + completionPlaceholder + string(text[col-1:])
+	blank := string(text[:indent]) + "pass"
+	attempts := []struct {
+		text      string
+		truncated bool
+	}{{placeholder, false}, {placeholder, true}, {blank, true}}
+
+	fileOptions := syntax.FileOptions{}
+	for _, attempt := range attempts {
+		lines[line-1] = attempt.text
+		attemptLines := lines
+		if attempt.truncated {
+			attemptLines = lines[:line]
+		}
+		if f, err := fileOptions.Parse(filename, strings.Join(attemptLines, "\n"), 0); err == nil {
+			return f
+		}
+	}
+	return nil
+}
+
+// containsCursor reports whether a node spans the cursor.
+func containsCursor(n syntax.Node, line int32, col int32) bool {
+	start, end := n.Span()
+	return spanContains(start, end, line, col)
+}
+
+// spanContains reports whether the span from start to end, inclusive,
+// contains a line and column.
+func spanContains(start, end syntax.Position, line int32, col int32) bool {
+	if line < start.Line || line == start.Line && col < start.Col {
+		return false
+	}
+	return line < end.Line || line == end.Line && col <= end.Col
+}
+
+// completeSource lists the names that could complete the identifier being
+// typed at the cursor: the locals and parameters of the functions around it,
+// innermost first, the module's globals and loaded names, then the
+// predeclared names and builtins. After a name loaded from a bundled module
+// and a dot, it lists the module's members instead.
+func completeSource(filename string, source string, line int, col int, hostPredeclared map[string]bool) (prefix string, prefixStart int, items []completion) {
+	prefix, object, prefixStart, ok := cursorContext(source, line, col)
+	if !ok {
+		return "", 0, nil
+	}
+	c := &completions{prefix: prefix, seen: make(map[string]bool)}
+
+	f := parseForCompletion(filename, source, line, col)
+	if object != "" {
+		if f != nil {
+			c.addMembers(f, object)
+		}
+		return prefix, prefixStart, c.items
+	}
+
+	if f != nil {
+		// Unknown names are taken to be the host's, so that the resolver
+		// records the scopes of all the others.
+		resolve.File(f, func(string) bool { return true }, starlark.Universe.Has)
+		c.addScopes(f, int32(line), int32(col))
+	}
+	var names []string
+	for name := range hostPredeclared {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c.add(name, completePredeclared, "")
+	}
+	for _, name := range predeclared.Keys() {
+		c.add(name, completeBuiltin, "")
+	}
+	for _, name := range starlark.Universe.Keys() {
+		c.add(name, completeBuiltin, "")
+	}
+	return prefix, prefixStart, c.items
+}
+
+// addScopes adds the names bound by the file, from the functions around the
+// cursor out to the module.
+func (c *completions) addScopes(f *syntax.File, line int32, col int32) {
+	var functions []*resolve.Function
+	loaded := make(map[*syntax.Ident]bool)
+	defined := make(map[*syntax.Ident]bool)
+	walkSyntax(f, func(n syntax.Node) bool {
+		switch n := n.(type) {
+		case *syntax.LoadStmt:
+			for _, to := range n.To {
+				loaded[to] = true
+			}
+		case *syntax.DefStmt:
+			defined[n.Name] = true
+			if fn, ok := n.Function.(*resolve.Function); ok && containsCursor(n, line, col) {
+				functions = append(functions, fn)
+			}
+		case *syntax.LambdaExpr:
+			if fn, ok := n.Function.(*resolve.Function); ok && containsCursor(n, line, col) {
+				functions = append(functions, fn)
+			}
+		}
+		return true
+	})
+
+	for i := len(functions) - 1; i >= 0; i-- {
+		fn := functions[i]
+		params := 0
+		for _, param := range fn.Params {
+			// A bare * separates the keyword-only parameters, binding none.
+			if unary, ok := param.(*syntax.UnaryExpr); !ok || unary.X != nil {
+				params++
+			}
+		}
+		for j, binding := range fn.Locals {
+			kind := completeLocal
+			if j < params {
+				kind = completeParameter
+			}
+			c.addBinding(binding, kind, defined)
+		}
+	}
+	if module, ok := f.Module.(*resolve.Module); ok {
+		for _, binding := range module.Locals {
+			kind := completeLocal
+			if binding.First != nil && loaded[binding.First] {
+				kind = completeLoad
+			}
+			c.addBinding(binding, kind, defined)
+		}
+		for _, binding := range module.Globals {
+			kind := completeGlobal
+			if binding.First != nil && loaded[binding.First] {
+				kind = completeLoad
+			}
+			c.addBinding(binding, kind, defined)
+		}
+	}
+}
+
+func (c *completions) addBinding(binding *resolve.Binding, kind string, defined map[*syntax.Ident]bool) {
+	if binding.First == nil {
+		return
+	}
+	if defined[binding.First] {
+		kind = completeFunction
+	}
+	c.add(binding.First.Name, kind, "")
+}
+
+// addMembers adds the members of the bundled module that object was loaded
+// from, if it was.
+func (c *completions) addMembers(f *syntax.File, object string) {
+	for _, stmt := range f.Stmts {
+		load, ok := stmt.(*syntax.LoadStmt)
+		if !ok {
+			continue
+		}
+		for i, to := range load.To {
+			if to.Name != object {
+				continue
+			}
+			members, ok, err := runner.BundledModule(load.ModuleName())
+			if !ok || err != nil {
+				return
+			}
+			value, ok := members[load.From[i].Name].(starlark.HasAttrs)
+			if !ok {
+				return
+			}
+			names := value.AttrNames()
+			sort.Strings(names)
+			for _, name := range names {
+				detail := ""
+				if member, err := value.Attr(name); err == nil && member != nil {
+					detail = member.Type()
+				}
+				c.add(name, completeMember, detail)
+			}
+			return
+		}
+	}
+}
+
+// jsComplete implements starlark.complete(source, line, column, filename?,
+// predeclared?), which lists the identifiers that could be typed at a
+// 1-based line and column, for an editor's autocomplete. predeclared lists
+// the global names the host will provide.
+func jsComplete() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) (result interface{}) {
+		defer func() {
+			if r := recover(); r != nil {
+				result = errorToJSValue(newInternalError(r, panicStack()))
+			}
+		}()
+
+		if len(args) < 3 || args[0].Type() != js.TypeString || args[1].Type() != js.TypeNumber || args[2].Type() != js.TypeNumber {
+			return jsErrorConstructor.New("Error: complete requires the source code, a line and a column as arguments.")
+		}
+		filename := "<complete>"
+		if len(args) > 3 && args[3].Type() == js.TypeString {
+			filename = args[3].String()
+		}
+		hostPredeclared := make(map[string]bool)
+		if len(args) > 4 && args[4].InstanceOf(jsArray) {
+			for i := 0; i < args[4].Length(); i++ {
+				hostPredeclared[args[4].Index(i).String()] = true
+			}
+		}
+
+		line, col := args[1].Int(), args[2].Int()
+		prefix, prefixStart, items := completeSource(filename, args[0].String(), line, col, hostPredeclared)
+		array := jsArray.New(len(items))
+		for i, item := range items {
+			array.SetIndex(i, item.toJSValue())
+		}
+		obj := jsObject.New()
+		obj.Set("prefix", prefix)
+		if prefixStart > 0 {
+			obj.Set("from", positionToJSValue(syntax.MakePosition(nil, int32(line), int32(prefixStart))))
+		} else {
+			obj.Set("from", positionToJSValue(syntax.MakePosition(nil, int32(line), int32(col))))
+		}
+		obj.Set("items", array)
+		return obj
+	})
+}
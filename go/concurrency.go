@@ -0,0 +1,205 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"syscall/js"
+	"time"
+)
+
+// slots bounds how many executions run at once, once the host sets a limit
+// with starlark.setConcurrency; 0 is no limit. An execution over it waits
+// in queue, first come first served, until one that is running ends.
+var slots = struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+	queue   []*queuedExecution
+}{}
+
+// queuedExecution is an execution waiting for a slot, which ready is closed
+// once it has one.
+type queuedExecution struct {
+	e     *execution
+	ready chan struct{}
+}
+
+// acquireSlot waits until the execution may run. A synchronous run cannot
+// wait, so it fails if there is no slot free, and a run cancelled while it
+// waits fails with the reason.
+func acquireSlot(e *execution) error {
+	slots.mu.Lock()
+	if slots.limit <= 0 || slots.running < slots.limit && len(slots.queue) == 0 {
+		slots.running++
+		slots.mu.Unlock()
+		return nil
+	}
+	if e.synchronous {
+		limit := slots.limit
+		slots.mu.Unlock()
+		return fmt.Errorf("Error: a synchronous run cannot wait for another to end, and the limit of %d running at once is reached.", limit)
+	}
+	waiting := &queuedExecution{e: e, ready: make(chan struct{})}
+	slots.queue = append(slots.queue, waiting)
+	slots.mu.Unlock()
+	logf(logDebug, logQueue, "execution %s: waiting for a slot", e.id)
+
+	select {
+	case <-waiting.ready:
+		return nil
+	case <-e.cancelled:
+	}
+	slots.mu.Lock()
+	for i, queued := range slots.queue {
+		if queued == waiting {
+			slots.queue = append(slots.queue[:i], slots.queue[i+1:]...)
+			slots.mu.Unlock()
+			e.mu.Lock()
+			reason := e.cancelReason
+			e.mu.Unlock()
+			return fmt.Errorf("Error: the execution was %s before it started.", reason)
+		}
+	}
+	// It was given a slot as it was cancelled, so it runs, and fails at
+	// its first step.
+	slots.mu.Unlock()
+	return nil
+}
+
+// releaseSlot frees the slot of an execution that ran, giving it to the
+// execution that has waited the longest, if any.
+func releaseSlot() {
+	slots.mu.Lock()
+	defer slots.mu.Unlock()
+	slots.running--
+	admitQueued()
+}
+
+// admitQueued gives the free slots to the executions waiting for them. It
+// must be called with slots.mu held.
+func admitQueued() {
+	for len(slots.queue) > 0 && (slots.limit <= 0 || slots.running < slots.limit) {
+		waiting := slots.queue[0]
+		slots.queue[0] = nil
+		slots.queue = slots.queue[1:]
+		slots.running++
+		close(waiting.ready)
+	}
+}
+
+// setConcurrency sets the number of executions that may run at once, 0 for
+// no limit. Raising it starts those waiting that now fit; lowering it stops
+// none that are running.
+func setConcurrency(limit int) {
+	slots.mu.Lock()
+	defer slots.mu.Unlock()
+	slots.limit = max(limit, 0)
+	admitQueued()
+}
+
+// queuedExecutionById returns the execution waiting for a slot with the
+// given id, or nil.
+func queuedExecutionById(id string) *execution {
+	slots.mu.Lock()
+	defer slots.mu.Unlock()
+	for _, queued := range slots.queue {
+		if queued.e.id == id {
+			return queued.e
+		}
+	}
+	return nil
+}
+
+// queuedExecutions returns the executions waiting for a slot, in the order
+// they will start.
+func queuedExecutions() []*execution {
+	slots.mu.Lock()
+	defer slots.mu.Unlock()
+	queued := make([]*execution, len(slots.queue))
+	for i, waiting := range slots.queue {
+		queued[i] = waiting.e
+	}
+	return queued
+}
+
+// executionsToJSValue lists the executions running, in the order they
+// started, and then those waiting for a slot, for starlark.listExecutions.
+func executionsToJSValue() js.Value {
+	executions.mu.Lock()
+	running := make([]*execution, 0, len(executions.byId))
+	startedAt := make(map[*execution]time.Time, len(executions.byId))
+	for _, e := range executions.byId {
+		running = append(running, e)
+		startedAt[e] = e.startedAt
+	}
+	executions.mu.Unlock()
+	sort.Slice(running, func(i, j int) bool { return startedAt[running[i]].Before(startedAt[running[j]]) })
+
+	list := jsArray.New()
+	add := func(e *execution, state string) {
+		obj := jsObject.New()
+		obj.Set("executionId", e.id)
+		obj.Set("state", state)
+		obj.Set("calledAt", float64(e.calledAt.UnixMilli()))
+		if state == "running" {
+			obj.Set("startedAt", float64(startedAt[e].UnixMilli()))
+			obj.Set("steps", float64(e.steps()))
+		}
+		priority := e.options.priority
+		if priority == "" {
+			priority = priorityInteractive
+		}
+		obj.Set("priority", priority)
+		if e.options.sessionId != "" {
+			obj.Set("sessionId", e.options.sessionId)
+		}
+		if e.options.labels != nil {
+			obj.Set("labels", labelsToJSValue(e.options.labels))
+		}
+		list.Call("push", obj)
+	}
+	for _, e := range running {
+		add(e, "running")
+	}
+	for _, e := range queuedExecutions() {
+		add(e, "queued")
+	}
+	return list
+}
+
+// jsSetConcurrency implements starlark.setConcurrency(limit), where limit
+// is the number of runs that may run at once, or 0 or null for no limit.
+func jsSetConcurrency() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		limit := 0
+		if len(args) > 0 && args[0].Type() == js.TypeNumber {
+			limit = args[0].Int()
+		}
+		setConcurrency(limit)
+		return nil
+	})
+}
+
+// jsListExecutions implements starlark.listExecutions().
+func jsListExecutions() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		return executionsToJSValue()
+	})
+}
@@ -0,0 +1,399 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"syscall/js"
+
+	"go.starlark.net/starlark"
+)
+
+// maxSafeInteger is Number.MAX_SAFE_INTEGER; integers beyond it cannot be
+// represented exactly by a JS number.
+const maxSafeInteger = 1<<53 - 1
+
+// converter converts values crossing the bridge for a single execution,
+// reporting anything lossy as a warning on that execution, or as an error in
+// strict mode.
+type converter struct {
+	exec *execution
+	// converted maps the lists and dicts already converted for the host to
+	// their JS values, so that a value referenced many times is converted
+	// once, and references to it stay shared, cycles included.
+	converted map[starlark.Value]js.Value
+	// keys interns the keys of the dicts converted from the host, and
+	// jsStrings the short strings converted for it, as payloads tend to
+	// repeat the same keys and values many times over.
+	keys      map[string]starlark.Value
+	jsStrings map[string]js.Value
+	// strings holds the strings of the argument being converted, when they
+	// were collected in bulk.
+	strings *stringTable
+	// resultSize is the size of the result converted so far, counted
+	// against the maxResultSize option.
+	resultSize int
+}
+
+// convertArgument converts a top-level argument from the host. The strings
+// of an array or object are fetched in bulk rather than one at a time.
+func (c *converter) convertArgument(value js.Value, path string) (starlark.Value, error) {
+	if t, _ := jsTypeOf(value); t == js.TypeObject {
+		c.strings = newStringTable(value, c.exec.options.extendedTypes)
+		defer func() {
+			c.strings.release()
+			c.strings = nil
+		}()
+	}
+	return c.convertToStarlarkValue(value, path)
+}
+
+// stringOf returns the contents of a JS string, taking it from the bulk
+// strings if there are any.
+func (c *converter) stringOf(value js.Value) string {
+	if c.strings != nil {
+		if s, ok := c.strings.take(); ok {
+			return s
+		}
+	}
+	return value.String()
+}
+
+// memoize records the JS value for a converted list or dict.
+func (c *converter) memoize(value starlark.Value, jsValue js.Value) {
+	if c.converted == nil {
+		c.converted = make(map[starlark.Value]js.Value)
+	}
+	c.converted[value] = jsValue
+}
+
+// maxInternedLength is the length above which strings converted for the host
+// are not interned, being unlikely to repeat.
+const maxInternedLength = 64
+
+// keyOf returns the i-th of an object's keys as an interned String, taking it
+// from the bulk strings if there are any.
+func (c *converter) keyOf(keys js.Value, i int) starlark.Value {
+	if c.strings != nil {
+		if b, ok := c.strings.takeBytes(); ok {
+			// Looking bytes up as a string does not allocate.
+			if key, ok := c.keys[string(b)]; ok {
+				return key
+			}
+			return c.internKey(string(b))
+		}
+	}
+	s := keys.Index(i).String()
+	if key, ok := c.keys[s]; ok {
+		return key
+	}
+	return c.internKey(s)
+}
+
+func (c *converter) internKey(s string) starlark.Value {
+	if c.keys == nil {
+		c.keys = make(map[string]starlark.Value)
+	}
+	key := starlark.Value(starlark.String(s))
+	c.keys[s] = key
+	return key
+}
+
+// jsString converts a string for the host, reusing the JS string of an
+// earlier conversion of it if it is short.
+func (c *converter) jsString(s string) js.Value {
+	if len(s) > maxInternedLength {
+		return js.ValueOf(s)
+	}
+	if jsValue, ok := c.jsStrings[s]; ok {
+		return jsValue
+	}
+	if c.jsStrings == nil {
+		c.jsStrings = make(map[string]js.Value)
+	}
+	jsValue := js.ValueOf(s)
+	c.jsStrings[s] = jsValue
+	return jsValue
+}
+
+// lossy reports a conversion that loses information. In strict mode it
+// returns an error, which aborts the conversion; otherwise it records a
+// warning and returns nil.
+func (c *converter) lossy(code string, path string, message string) error {
+	logf(logWarn, logConvert, "execution %s: %s at %s: %s", c.exec.id, code, path, message)
+	if c.exec.options.strict {
+		return &conversionError{code: code, path: path, message: message}
+	}
+	c.exec.warn(code, path, message)
+	return nil
+}
+
+// resultSizeOf is the size a value counts for against the maxResultSize
+// option, leaving out its elements: the bytes of a string, 8 for a number,
+// and 1 for anything else. Dict keys count the bytes of the key.
+func resultSizeOf(value starlark.Value) int {
+	switch v := value.(type) {
+	case starlark.String:
+		return len(v)
+	case starlark.Int, starlark.Float:
+		return 8
+	default:
+		return 1
+	}
+}
+
+// countResult adds n bytes, converted at path, to the size of the result,
+// failing once it passes the maxResultSize option. This stops a huge result
+// early, instead of after it has all been converted.
+func (c *converter) countResult(n int, path string) error {
+	limit := c.exec.options.maxResultSize
+	if limit <= 0 {
+		return nil
+	}
+	c.resultSize += n
+	if c.resultSize > limit {
+		return &resultSizeError{limit: limit, size: c.resultSize, path: path}
+	}
+	return nil
+}
+
+// convertToStarlarkValue converts a JS value passed in from the host. path
+// describes where the value sits within the call's arguments (e.g. args[0] or
+// kwargs["name"][2]) so that conversion failures can point at the culprit
+// before any Starlark code runs.
+func (c *converter) convertToStarlarkValue(value js.Value, path string) (starlark.Value, error) {
+	t, bigint := jsTypeOf(value)
+	if bigint {
+		if c.exec.options.extendedTypes {
+			return bigIntToStarlark(value, path)
+		}
+		return nil, fmt.Errorf("%s has unsupported type bigint", path)
+	}
+	switch t {
+	case js.TypeNull:
+		return starlark.None, nil
+	case js.TypeBoolean:
+		return starlark.Bool(value.Bool()), nil
+	case js.TypeNumber:
+		return c.numberToStarlarkValue(value.Float(), path)
+	case js.TypeString:
+		return starlark.String(c.stringOf(value)), nil
+	case js.TypeObject:
+		if c.exec.options.extendedTypes {
+			if v, ok, err := c.extendedToStarlarkValue(value, path); ok {
+				return v, err
+			}
+		}
+		if value.InstanceOf(jsArray) {
+			length := value.Length()
+			if list, ok, err := c.numericArrayToStarlark(value, length, path); ok {
+				return list, err
+			}
+			list := []starlark.Value{}
+			for i := 0; i < length; i++ {
+				item, err := c.convertToStarlarkValue(value.Index(i), fmt.Sprintf("%s[%d]", path, i))
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, item)
+			}
+			return starlark.NewList(list), nil
+		} else {
+			keys := jsObjectKeys.Invoke(value)
+			length := keys.Length()
+			dict := starlark.NewDict(length)
+			for i := 0; i < length; i++ {
+				starlarkKey := c.keyOf(keys, i)
+				key := string(starlarkKey.(starlark.String))
+				itemPath := fmt.Sprintf("%s[%q]", path, key)
+				jsItem := value.Get(key)
+				if jsItem.IsUndefined() {
+					// Match JSON.stringify, which omits undefined properties.
+					if err := c.lossy("dropped_undefined", itemPath, "undefined property omitted"); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				item, err := c.convertToStarlarkValue(jsItem, itemPath)
+				if err != nil {
+					return nil, err
+				}
+				dict.SetKey(starlarkKey, item)
+			}
+			return dict, nil
+		}
+	case js.TypeUndefined:
+		return nil, fmt.Errorf("%s is undefined", path)
+	default:
+		return nil, fmt.Errorf("%s has unsupported type %s", path, t)
+	}
+}
+
+// numberToStarlarkValue converts a JS number, which is an int if it is
+// integral and a float otherwise.
+func (c *converter) numberToStarlarkValue(floatVal float64, path string) (starlark.Value, error) {
+	if floatVal == math.Trunc(floatVal) && math.Abs(floatVal) < math.MaxInt64 {
+		if math.Abs(floatVal) > maxSafeInteger {
+			if err := c.lossy("lossy_conversion", path, fmt.Sprintf("integer %.0f exceeds the precision of a JS number and may have been rounded", floatVal)); err != nil {
+				return nil, err
+			}
+		}
+		return starlark.MakeInt64(int64(floatVal)), nil
+	}
+	return starlark.Float(floatVal), nil
+}
+
+// convertToJSValue converts a Starlark value for the host. path describes
+// where the value sits within the result (e.g. result["items"][3]). It only
+// fails in strict mode. Warnings about a value referenced more than once are
+// only reported at the first path it was found at.
+func (c *converter) convertToJSValue(value starlark.Value, path string) (js.Value, error) {
+	switch value.(type) {
+	case *starlark.List, *starlark.Dict:
+		if jsValue, ok := c.converted[value]; ok {
+			return jsValue, nil
+		}
+	}
+	if err := c.countResult(resultSizeOf(value), path); err != nil {
+		return js.Null(), err
+	}
+	if c.exec.options.extendedTypes {
+		if jsValue, ok, err := c.extendedToJSValue(value, path); ok {
+			return jsValue, err
+		}
+	}
+
+	switch v := value.(type) {
+	case starlark.NoneType:
+		return js.Null(), nil
+	case starlark.Bool:
+		return js.ValueOf(bool(v)), nil
+	case starlark.Float:
+		return js.ValueOf(float64(v)), nil
+	case starlark.String:
+		return c.jsString(string(v)), nil
+	case starlark.Int:
+		intVal, ok := v.Int64()
+		if !ok || intVal > maxSafeInteger || intVal < -maxSafeInteger {
+			if err := c.lossy("lossy_conversion", path, fmt.Sprintf("integer %s exceeds the precision of a JS number", v)); err != nil {
+				return js.Null(), err
+			}
+			return js.ValueOf(float64(v.Float())), nil
+		}
+		return js.ValueOf(intVal), nil
+	case *starlark.List:
+		if array, ok := numericListToJS(v); ok {
+			c.memoize(v, array)
+			return array, c.countResult(8*v.Len(), path)
+		}
+		array := jsArray.New(v.Len())
+		c.memoize(v, array)
+		for i := 0; i < v.Len(); i++ {
+			item, err := c.convertToJSValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return js.Null(), err
+			}
+			array.SetIndex(i, item)
+		}
+		return array, nil
+	case *starlark.Dict:
+		obj := jsObject.New()
+		c.memoize(v, obj)
+		for _, item := range v.Items() {
+			key, ok := item[0].(starlark.String)
+			if !ok {
+				if err := c.lossy("unsupported_type", path, fmt.Sprintf("entry with %s key %s omitted", item[0].Type(), item[0])); err != nil {
+					return js.Null(), err
+				}
+				continue
+			}
+			itemPath := fmt.Sprintf("%s[%q]", path, string(key))
+			if err := c.countResult(len(key), itemPath); err != nil {
+				return js.Null(), err
+			}
+			jsItem, err := c.convertToJSValue(item[1], itemPath)
+			if err != nil {
+				return js.Null(), err
+			}
+			obj.Set(string(key), jsItem)
+		}
+		return obj, nil
+	default:
+		if err := c.lossy("unsupported_type", path, fmt.Sprintf("%s value converted to null", value.Type())); err != nil {
+			return js.Null(), err
+		}
+		return js.Null(), nil
+	}
+}
+
+// jsTypeName describes a JS value for error messages, using the constructor
+// name for objects (e.g. Date or Array).
+func jsTypeName(value js.Value) string {
+	if value.Type() == js.TypeObject {
+		if constructor := value.Get("constructor"); constructor.Type() == js.TypeFunction {
+			if name := constructor.Get("name"); name.Type() == js.TypeString && name.String() != "" {
+				return name.String()
+			}
+		}
+	}
+	return value.Type().String()
+}
+
+// isPlainObject reports whether value is an object literal (or created by
+// Object.create(null)), as opposed to an array or class instance.
+func isPlainObject(value js.Value) bool {
+	if value.Type() != js.TypeObject {
+		return false
+	}
+	proto := jsGetPrototypeOf.Invoke(value)
+	return proto.IsNull() || proto.Equal(jsObjectPrototype)
+}
+
+type kwargsEntry struct {
+	key   string
+	value js.Value
+}
+
+// kwargsEntries returns the entries of the kwargs argument, which must be a
+// plain object or a Map with string keys. Anything else would silently
+// produce garbage keys via Object.keys.
+func kwargsEntries(kwargs js.Value) ([]kwargsEntry, error) {
+	entries := []kwargsEntry{}
+
+	if kwargs.Type() == js.TypeObject && kwargs.InstanceOf(jsMap) {
+		items := jsArray.Call("from", kwargs.Call("entries"))
+		for i := 0; i < items.Length(); i++ {
+			key := items.Index(i).Index(0)
+			if key.Type() != js.TypeString {
+				return nil, fmt.Errorf("Error: kwargs Map keys must be strings, not %s.", jsTypeName(key))
+			}
+			entries = append(entries, kwargsEntry{key.String(), items.Index(i).Index(1)})
+		}
+		return entries, nil
+	}
+
+	if !isPlainObject(kwargs) {
+		return nil, fmt.Errorf("Error: kwargs must be a plain object or a Map, not %s.", jsTypeName(kwargs))
+	}
+	keys := jsObjectKeys.Invoke(kwargs)
+	for i := 0; i < keys.Length(); i++ {
+		key := keys.Index(i).String()
+		entries = append(entries, kwargsEntry{key, kwargs.Get(key)})
+	}
+	return entries, nil
+}
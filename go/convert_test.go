@@ -0,0 +1,179 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"syscall/js"
+	"testing"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// jsExpression returns the value of a JS expression.
+func jsExpression(expression string) js.Value {
+	return js.Global().Get("Function").New("return " + expression).Invoke()
+}
+
+// newTestExecution returns an execution with the options of a JS object
+// expression.
+func newTestExecution(options string) *execution {
+	return newExecution("test", parseRunOptions(jsExpression(options)), time.Now())
+}
+
+func TestConvertArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		options string
+		args    string
+		kwargs  string
+		// want is the converted arguments, as the arguments and keyword
+		// arguments of a call.
+		want     string
+		err      string
+		warnings []string
+	}{
+		{name: "none", args: "[]", kwargs: "undefined", want: "()"},
+		{name: "scalars", args: `[null, true, 1, 1.5, -0.25, "a"]`, kwargs: "null", want: `(None, True, 1, 1.5, -0.25, "a")`},
+		{name: "unicode", args: `["héllo", "😀"]`, kwargs: "null", want: `("héllo", "😀")`},
+		{name: "nested", args: `[[1, [2, "x"]], {a: {b: [null]}}]`, kwargs: "null", want: `([1, [2, "x"]], {"a": {"b": [None]}})`},
+		{name: "numeric array", args: "[Array.from({length: 16}, (_, i) => i / 2)]", kwargs: "null",
+			want: "([0, 0.5, 1, 1.5, 2, 2.5, 3, 3.5, 4, 4.5, 5, 5.5, 6, 6.5, 7, 7.5])"},
+		{name: "kwargs object", args: "[1]", kwargs: `{x: "a", y: [2]}`, want: `(1, x="a", y=[2])`},
+		{name: "kwargs map", args: "[]", kwargs: `new Map([["x", 1], ["y", 2]])`, want: "(x=1, y=2)"},
+		{name: "undefined kwarg", args: "[]", kwargs: "{x: undefined, y: 1}", want: "(y=1)",
+			warnings: []string{`dropped_undefined kwargs["x"]`}},
+		{name: "undefined property", args: "[{a: undefined, b: 1}]", kwargs: "null", want: `({"b": 1})`,
+			warnings: []string{`dropped_undefined args[0]["a"]`}},
+		{name: "unsafe integer", args: "[2 ** 60]", kwargs: "null", want: "(1152921504606846976)",
+			warnings: []string{"lossy_conversion args[0]"}},
+		{name: "strict unsafe integer", options: "{strict: true}", args: "[[2 ** 60]]", kwargs: "null",
+			err: "Error: unable to convert argument 0. Error: lossy conversion of args[0][0]"},
+		{name: "undefined argument", args: "[undefined]", kwargs: "null",
+			err: "Error: unable to convert argument 0. args[0] is undefined"},
+		{name: "bigint", args: "[1n]", kwargs: "null",
+			err: "Error: unable to convert argument 0. args[0] has unsupported type bigint"},
+		{name: "function", args: "[[() => 1]]", kwargs: "null",
+			err: "Error: unable to convert argument 0. args[0][0] has unsupported type function"},
+		{name: "extended", options: "{extendedTypes: true}", kwargs: "null",
+			args: `[12345678901234567890n, new Map([[1, "a"]]), new Set([1, 2]), new Uint8Array([104, 105]), Object.freeze([1, 2])]`,
+			want: `(12345678901234567890, {1: "a"}, set([1, 2]), b"hi", (1, 2))`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := test.options
+			if options == "" {
+				options = "{}"
+			}
+			exec := newTestExecution(options)
+			conv := &converter{exec: exec}
+			args, kwargs, err := conv.convertArgs(jsExpression(test.args), jsExpression(test.kwargs))
+			if test.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+					t.Fatalf("got %v, want an error starting %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := callString(args, kwargs); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+			got := []string{}
+			for _, w := range exec.warnings {
+				got = append(got, w.code+" "+w.path)
+			}
+			if want := append([]string{}, test.warnings...); strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("warnings %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// callString formats arguments as the argument list of a call.
+func callString(args starlark.Tuple, kwargs []starlark.Tuple) string {
+	parts := make([]string, 0, len(args)+len(kwargs))
+	for _, arg := range args {
+		parts = append(parts, arg.String())
+	}
+	for _, kwarg := range kwargs {
+		parts = append(parts, fmt.Sprintf("%s=%s", string(kwarg[0].(starlark.String)), kwarg[1]))
+	}
+	return "(" + strings.Join(parts, ", ") + ")"
+}
+
+func TestConvertToJSValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		options string
+		value   string
+		// want is the converted value, as JSON.
+		want     string
+		err      string
+		warnings []string
+	}{
+		{name: "scalars", value: `[None, True, 1, 1.5, "a"]`, want: `[null,true,1,1.5,"a"]`},
+		{name: "nested", value: `{"a": [1, {"b": "c"}], "d": {}}`, want: `{"a":[1,{"b":"c"}],"d":{}}`},
+		{name: "numeric list", value: "[x / 2 for x in range(16)]", want: "[0,0.5,1,1.5,2,2.5,3,3.5,4,4.5,5,5.5,6,6.5,7,7.5]"},
+		{name: "shared list", value: "(lambda x: [x, x])([1])", want: "[[1],[1]]"},
+		{name: "large integer", value: "1 << 60", want: "1152921504606847000", warnings: []string{"lossy_conversion result"}},
+		{name: "non-string key", value: `{1: "a", "b": 2}`, want: `{"b":2}`, warnings: []string{"unsupported_type result"}},
+		{name: "tuple", value: "(1, 2)", want: "null", warnings: []string{"unsupported_type result"}},
+		{name: "strict", options: "{strict: true}", value: "[range(3)]",
+			err: "Error: lossy conversion of result[0]: range value converted to null"},
+		{name: "result size", options: "{maxResultSize: 10}", value: `["abcdefghijk"]`, err: "result"},
+		{name: "extended", options: "{extendedTypes: true}", value: `[(1, 2), b"hi", set([3])]`, want: `[[1,2],{"0":104,"1":105},{}]`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := test.options
+			if options == "" {
+				options = "{}"
+			}
+			exec := newTestExecution(options)
+			value, err := starlark.EvalOptions(&syntax.FileOptions{Set: true}, &starlark.Thread{}, "test.star", test.value, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conv := &converter{exec: exec}
+			jsValue, err := conv.convertToJSValue(value, "result")
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got %v, want an error containing %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := js.Global().Get("JSON").Call("stringify", jsValue).String(); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+			got := []string{}
+			for _, w := range exec.warnings {
+				got = append(got, w.code+" "+w.path)
+			}
+			if strings.Join(got, "\n") != strings.Join(test.warnings, "\n") {
+				t.Errorf("warnings %q, want %q", got, test.warnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,374 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"syscall/js"
+
+	"go.starlark.net/starlark"
+)
+
+// The commands the host can resume a paused execution with, named as in the
+// Debug Adapter Protocol.
+const (
+	// debugContinue runs on to the next breakpoint.
+	debugContinue = "continue"
+	// debugNext steps over: it pauses at the next line of the same frame,
+	// or of its caller once it returns.
+	debugNext = "next"
+	// debugStepIn pauses at the next line reached, in any frame.
+	debugStepIn = "stepIn"
+	// debugStepOut pauses at the next line of the caller, once the frame
+	// returns.
+	debugStepOut = "stepOut"
+	// debugStop cancels the execution.
+	debugStop = "stop"
+	// debugStep is the original name of stepIn.
+	debugStep = "step"
+)
+
+// The reasons an execution paused, reported in the paused event.
+const (
+	pausedAtBreakpoint = "breakpoint"
+	pausedAfterStep    = "step"
+)
+
+// breakpoints holds the lines of each module that pause the execution when
+// reached, sorted.
+type breakpoints map[string][]int32
+
+// between reports whether there is a breakpoint on a line of the module after
+// from and up to to.
+func (b breakpoints) between(filename string, from int32, to int32) bool {
+	lines := b[filename]
+	i := sort.Search(len(lines), func(i int) bool { return lines[i] > from })
+	return i < len(lines) && lines[i] <= to
+}
+
+// parseBreakpoints reads the breakpoints option, an array of {filename,
+// line}. It returns nil unless the option is an array, which turns on debug
+// mode even if it is empty.
+func parseBreakpoints(value js.Value) breakpoints {
+	if value.Type() != js.TypeObject || !value.InstanceOf(jsArray) {
+		return nil
+	}
+	b := make(breakpoints)
+	for i := 0; i < value.Length(); i++ {
+		bp := value.Index(i)
+		if bp.Type() != js.TypeObject || bp.Get("filename").Type() != js.TypeString || bp.Get("line").Type() != js.TypeNumber {
+			continue
+		}
+		filename := bp.Get("filename").String()
+		b[filename] = append(b[filename], int32(bp.Get("line").Int()))
+	}
+	for _, lines := range b {
+		sort.Slice(lines, func(i, j int) bool { return lines[i] < lines[j] })
+	}
+	return b
+}
+
+// debugger pauses an execution at its breakpoints. While paused, the thread
+// that reached the breakpoint blocks in its step hook until the host resumes
+// it with starlark.resume.
+type debugger struct {
+	exec *execution
+
+	mu          sync.Mutex
+	breakpoints breakpoints
+	// watches are the expressions evaluated at each pause, and at each new
+	// line if watchOnLine is set.
+	watches     []string
+	watchOnLine bool
+	paused      bool
+	// frames holds the frames of the paused thread, for starlark.inspect.
+	frames []pausedFrame
+	resume chan string
+	// step is the step command the execution was last resumed with, if any,
+	// from a pause of thread at a stack of stepDepth frames.
+	step       string
+	stepThread *starlark.Thread
+	stepDepth  int
+	// interrupted is closed when the execution is cancelled, which must not
+	// wait for the host to resume it.
+	interrupted   chan struct{}
+	interruptOnce sync.Once
+}
+
+// debuggers holds the debuggers of the executions in flight, by execution
+// id, for starlark.resume to find.
+var debuggers = struct {
+	mu   sync.Mutex
+	byId map[string]*debugger
+}{byId: make(map[string]*debugger)}
+
+// attachDebugger gives the execution a debugger, until detach is called.
+func (e *execution) attachDebugger() (detach func()) {
+	d := &debugger{
+		exec:        e,
+		breakpoints: e.options.breakpoints,
+		watches:     e.options.watches,
+		watchOnLine: e.options.watchOn == watchOnLine,
+		resume:      make(chan string, 1),
+		interrupted: make(chan struct{}),
+	}
+	e.debugger = d
+	debuggers.mu.Lock()
+	debuggers.byId[e.id] = d
+	debuggers.mu.Unlock()
+	return func() {
+		debuggers.mu.Lock()
+		defer debuggers.mu.Unlock()
+		if debuggers.byId[e.id] == d {
+			delete(debuggers.byId, e.id)
+		}
+	}
+}
+
+// interrupt wakes a paused thread without waiting for the host.
+func (d *debugger) interrupt() {
+	d.interruptOnce.Do(func() { close(d.interrupted) })
+}
+
+// stepHook returns the step hook of a thread of the execution, which pauses
+// it on reaching a breakpoint, or the line a step command stops at.
+//
+// Starlark only records the positions of the operations that can fail, such
+// as calls and operators, so the hook sees a frame's line jump past those of
+// other statements, as well as lag one instruction behind. A breakpoint on a
+// line the frame jumped over pauses at the line it jumped to, as debuggers
+// move a breakpoint to the next line with code.
+func (d *debugger) stepHook() func(thread *starlark.Thread) {
+	// lines holds the line each frame of the stack was last seen at,
+	// outermost first.
+	var lines []int32
+	return func(thread *starlark.Thread) {
+		depth := thread.CallStackDepth()
+		if depth == 0 {
+			return
+		}
+		pos := thread.CallFrame(0).Pos
+		var from int32
+		returned := false
+		switch {
+		case depth > len(lines):
+			// A new frame: only a breakpoint on its first line counts.
+			lines = append(lines, pos.Line)
+			from = pos.Line - 1
+		case lines[depth-1] == pos.Line && depth == len(lines):
+			return
+		default:
+			// Any deeper frames have returned.
+			returned = depth < len(lines)
+			lines = lines[:depth]
+			from = lines[depth-1]
+			if from > pos.Line {
+				// Back to the top of a loop.
+				from = pos.Line - 1
+			}
+			lines[depth-1] = pos.Line
+		}
+		newLine := from != pos.Line
+
+		d.mu.Lock()
+		atBreakpoint := newLine && d.breakpoints.between(pos.Filename(), from, pos.Line)
+		stepped := d.stepped(thread, depth, newLine, returned)
+		watches := d.watches
+		d.mu.Unlock()
+		if !atBreakpoint && !stepped {
+			if newLine && d.watchOnLine && len(watches) > 0 {
+				if err := d.streamWatches(thread, watches); err != nil {
+					thread.Cancel(err.Error())
+				}
+			}
+			return
+		}
+		reason := pausedAfterStep
+		if atBreakpoint {
+			reason = pausedAtBreakpoint
+		}
+		if err := d.pause(thread, reason); err != nil {
+			thread.Cancel(err.Error())
+		}
+	}
+}
+
+// stepped reports whether the step command in progress stops the thread,
+// now at a stack of depth frames, having reached a new line of the top
+// frame or returned to it. It must be called with d.mu held.
+func (d *debugger) stepped(thread *starlark.Thread, depth int, newLine bool, returned bool) bool {
+	switch d.step {
+	case debugStepIn:
+		return newLine || returned && depth < d.stepDepth
+	case debugNext:
+		// Other threads run the modules being loaded, so stepping over a
+		// load does not stop in them.
+		return thread == d.stepThread && depth <= d.stepDepth && (newLine || returned && depth < d.stepDepth)
+	case debugStepOut:
+		return thread == d.stepThread && depth < d.stepDepth
+	}
+	return false
+}
+
+// pause tells the host where the thread stopped and why, and waits for a
+// command.
+func (d *debugger) pause(thread *starlark.Thread, reason string) error {
+	// Show the output so far before the pause.
+	if err := d.exec.flushOutput(); err != nil {
+		return err
+	}
+
+	stack := thread.CallStack()
+	locals := make([][]capturedLocal, len(stack))
+	for i := range locals {
+		// DebugFrame counts from the innermost frame, and the stack from the
+		// outermost.
+		locals[len(locals)-1-i] = appendFrameLocals(nil, thread.DebugFrame(i))
+	}
+	event := jsObject.New()
+	event.Set("reason", reason)
+	event.Set("position", printPositionToJSValue(stack.At(0).Pos))
+	event.Set("backtrace", callStackToJSValue(stack, locals))
+	d.mu.Lock()
+	watches := d.watches
+	d.mu.Unlock()
+	if len(watches) > 0 {
+		event.Set("watches", evalWatches(thread, watches))
+	}
+
+	d.mu.Lock()
+	d.step = ""
+	d.paused = true
+	d.frames = pausedFrames(thread)
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		d.paused = false
+		d.frames = nil
+		d.mu.Unlock()
+	}()
+
+	starlarkObj := hostGlobal()
+	paused := starlarkObj.Get("paused")
+	if paused.Type() != js.TypeFunction {
+		return fmt.Errorf("Error: %s.paused is not defined.", hostGlobalName())
+	}
+	err := d.exec.audited("paused", func() string { return reason + " at " + stack.At(0).Pos.String() }, func() error {
+		_, err := invokeHost(paused, d.exec.tag(event), d.exec.id)
+		return err
+	})
+	if err != nil {
+		// With the log policy, carry on as if resumed.
+		return d.exec.hostFailure("paused", err)
+	}
+
+	select {
+	case command := <-d.resume:
+		switch command {
+		case debugStepIn, debugNext, debugStepOut:
+			d.mu.Lock()
+			d.step, d.stepThread, d.stepDepth = command, thread, len(stack)
+			d.mu.Unlock()
+		case debugStop:
+			d.exec.cancel("stopped by the debugger")
+		}
+	case <-d.interrupted:
+	}
+	return nil
+}
+
+// setBreakpoints replaces the breakpoints of a running execution in debug
+// mode, reporting whether there was one.
+func setBreakpoints(executionId string, b breakpoints) bool {
+	debuggers.mu.Lock()
+	d := debuggers.byId[executionId]
+	debuggers.mu.Unlock()
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.breakpoints = b
+	return true
+}
+
+// jsSetBreakpoints implements starlark.setBreakpoints(executionId,
+// breakpoints), which replaces the breakpoints of a run in debug mode while
+// it runs, returning whether it is running.
+func jsSetBreakpoints() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 2 || args[0].Type() != js.TypeString {
+			return jsErrorConstructor.New("Error: requires an executionId and breakpoints as arguments.")
+		}
+		b := parseBreakpoints(args[1])
+		if b == nil {
+			return jsErrorConstructor.New("Error: breakpoints must be an array.")
+		}
+		return setBreakpoints(args[0].String(), b)
+	})
+}
+
+// resumeExecution resumes a paused execution with a command, reporting
+// whether it was paused.
+func resumeExecution(executionId string, command string) (bool, error) {
+	switch command {
+	case debugStep:
+		command = debugStepIn
+	case debugContinue, debugNext, debugStepIn, debugStepOut, debugStop:
+	default:
+		return false, fmt.Errorf("Error: unknown debug command %q.", command)
+	}
+	debuggers.mu.Lock()
+	d := debuggers.byId[executionId]
+	debuggers.mu.Unlock()
+	if d == nil {
+		return false, nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.paused {
+		return false, nil
+	}
+	select {
+	case d.resume <- command:
+	default:
+		// Already resumed, and not yet running again.
+		return false, nil
+	}
+	return true, nil
+}
+
+// jsResume implements starlark.resume(executionId, command), where command
+// is "continue" (the default), "next", "stepIn", "stepOut" or "stop".
+func jsResume() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 1 || args[0].Type() != js.TypeString {
+			return jsErrorConstructor.New("Error: requires an executionId as argument.")
+		}
+		command := debugContinue
+		if len(args) > 1 && args[1].Type() == js.TypeString {
+			command = args[1].String()
+		}
+		resumed, err := resumeExecution(args[0].String(), command)
+		if err != nil {
+			return jsErrorConstructor.New(err.Error())
+		}
+		return resumed
+	})
+}
@@ -0,0 +1,149 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"syscall/js"
+
+	"dcollien.com/starlark-wasm/internal/runner"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// dialect is the dialect option: the language features beyond Starlark's
+// defaults that the execution's modules may use, and the bundled modules
+// whose members they see as builtins, without loading them.
+type dialect struct {
+	options syntax.FileOptions
+	modules []string
+	// members holds the members of the modules, by name.
+	members starlark.StringDict
+	// key names the features and modules, which the programs compiled for
+	// the dialect depend on.
+	key string
+}
+
+// dialectFeatures are the features of the dialect option, the file options
+// that turn them on, and whether they are.
+var dialectFeatures = []struct {
+	name string
+	on   func(*syntax.FileOptions) *bool
+}{
+	{"set", func(o *syntax.FileOptions) *bool { return &o.Set }},
+	{"while", func(o *syntax.FileOptions) *bool { return &o.While }},
+	{"topLevelControl", func(o *syntax.FileOptions) *bool { return &o.TopLevelControl }},
+	{"globalReassign", func(o *syntax.FileOptions) *bool { return &o.GlobalReassign }},
+	{"recursion", func(o *syntax.FileOptions) *bool { return &o.Recursion }},
+}
+
+// parseDialect reads the dialect of a run: that of the dialect object on the
+// namespace's global object, with the features and modules the run's own
+// dialect option gives in place of the global ones. It returns nil if it is
+// Starlark's default, and an error if it names a module that is not
+// bundled.
+func parseDialect(options js.Value) (*dialect, error) {
+	d := &dialect{}
+	apply := func(value js.Value) {
+		if value.Type() != js.TypeObject {
+			return
+		}
+		for _, feature := range dialectFeatures {
+			if on := value.Get(feature.name); on.Type() == js.TypeBoolean {
+				*feature.on(&d.options) = on.Bool()
+			}
+		}
+		if modules := value.Get("modules"); modules.Type() == js.TypeObject && modules.InstanceOf(jsArray) {
+			d.modules = nil
+			for i := 0; i < modules.Length(); i++ {
+				if name := modules.Index(i); name.Type() == js.TypeString {
+					d.modules = append(d.modules, name.String())
+				}
+			}
+		}
+	}
+	if global := hostGlobal(); global.Type() == js.TypeObject {
+		apply(global.Get("dialect"))
+	}
+	if options.Type() == js.TypeObject {
+		apply(options.Get("dialect"))
+	}
+	if d.options == (syntax.FileOptions{}) && len(d.modules) == 0 {
+		return nil, nil
+	}
+
+	sort.Strings(d.modules)
+	modules := d.modules[:0]
+	for i, name := range d.modules {
+		if i == 0 || name != d.modules[i-1] {
+			modules = append(modules, name)
+		}
+	}
+	d.modules = modules
+	d.members = make(starlark.StringDict)
+	for _, name := range d.modules {
+		members, _, err := runner.BundledModule(runner.BundledModulePrefix + name)
+		if err != nil {
+			return nil, err
+		}
+		for member, value := range members {
+			d.members[member] = value
+		}
+	}
+	var features []string
+	for _, feature := range dialectFeatures {
+		if *feature.on(&d.options) {
+			features = append(features, feature.name)
+		}
+	}
+	d.key = strings.Join(features, ",") + ";" + strings.Join(d.modules, ",")
+	return d, nil
+}
+
+// fileOptions returns the file options the execution's modules are compiled
+// with.
+func (e *execution) fileOptions() *syntax.FileOptions {
+	options := syntax.FileOptions{}
+	if e.options.dialect != nil {
+		options = e.options.dialect.options
+	}
+	return &options
+}
+
+// hasSets reports whether the execution's dialect has the set feature.
+func (e *execution) hasSets() bool {
+	return e.options.dialect != nil && e.options.dialect.options.Set
+}
+
+// dialectMembers returns the members of the modules the execution's dialect
+// predeclares, or nil.
+func (e *execution) dialectMembers() starlark.StringDict {
+	if e.options.dialect == nil {
+		return nil
+	}
+	return e.options.dialect.members
+}
+
+// dialectKey returns the key of the execution's dialect, or "" for the
+// default one.
+func (e *execution) dialectKey() string {
+	if e.options.dialect == nil {
+		return ""
+	}
+	return e.options.dialect.key
+}
@@ -0,0 +1,470 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"syscall/js"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// The compiler lives in an internal package of starlark-go, so programs are
+// disassembled from their serialized form, which Program.Write produces. The
+// decoder below follows that format, and refuses any version but the one it
+// was written against.
+const (
+	compiledMagic   = "!sky"
+	compiledVersion = 14
+)
+
+// opcodeNames are the names of the opcodes of the bytecode, as the compiler
+// spells them, in the order of their values. Those from jmp on take an
+// argument.
+var opcodeNames = []string{
+	"nop", "dup", "dup2", "pop", "exch",
+	"lt", "gt", "ge", "le", "eql", "neq",
+	"plus", "minus", "star", "slash", "slashslash", "percent",
+	"amp", "pipe", "circumflex", "ltlt", "gtgt",
+	"in",
+	"uplus", "uminus", "tilde",
+	"none", "true", "false", "mandatory",
+	"iterpush", "iterpop", "not", "return", "setindex", "index",
+	"setdict", "setdictuniq", "append", "slice",
+	"inplace_add", "inplace_pipe", "makedict",
+	"jmp", "cjmp", "iterjmp",
+	"constant", "maketuple", "makelist", "makefunc", "load",
+	"setlocal", "setglobal", "local", "free", "freecell",
+	"localcell", "setlocalcell", "global", "predeclared", "universal",
+	"attr", "setfield", "unpack",
+	"call", "call_var", "call_kw", "call_var_kw",
+}
+
+// opcodeArgMin is the first opcode that takes an argument.
+const opcodeArgMin = 43
+
+// compiledBinding is a name bound by a program, and where.
+type compiledBinding struct {
+	name      string
+	line, col int32
+}
+
+// compiledFunction is a function of a program, toplevel included.
+type compiledFunction struct {
+	compiledBinding
+	doc       string
+	code      []byte
+	pclinetab []uint16
+	locals    []compiledBinding
+	freevars  []compiledBinding
+	maxStack  int
+	numParams int
+	numKwonly int
+	varargs   bool
+	kwargs    bool
+}
+
+// compiledProgram is a decoded program.
+type compiledProgram struct {
+	filename  string
+	loads     []compiledBinding
+	names     []string
+	constants []string
+	globals   []compiledBinding
+	functions []*compiledFunction
+}
+
+// programDecoder reads a serialized program: varints from p, and the strings
+// they give the lengths of from s.
+type programDecoder struct {
+	p, s []byte
+	err  error
+}
+
+func (d *programDecoder) int() int {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Varint(d.p)
+	if n <= 0 {
+		d.err = fmt.Errorf("truncated program")
+		return 0
+	}
+	d.p = d.p[n:]
+	return int(x)
+}
+
+func (d *programDecoder) uint64() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(d.p)
+	if n <= 0 {
+		d.err = fmt.Errorf("truncated program")
+		return 0
+	}
+	d.p = d.p[n:]
+	return x
+}
+
+func (d *programDecoder) bytes() []byte {
+	n := d.int()
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.s) {
+		d.err = fmt.Errorf("truncated program")
+		return nil
+	}
+	b := d.s[:n]
+	d.s = d.s[n:]
+	return b
+}
+
+func (d *programDecoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *programDecoder) binding() compiledBinding {
+	return compiledBinding{d.string(), int32(d.int()), int32(d.int())}
+}
+
+func (d *programDecoder) bindings() []compiledBinding {
+	n := d.int()
+	var binds []compiledBinding
+	for i := 0; i < n && d.err == nil; i++ {
+		binds = append(binds, d.binding())
+	}
+	return binds
+}
+
+func (d *programDecoder) function() *compiledFunction {
+	fn := &compiledFunction{compiledBinding: d.binding()}
+	fn.doc = d.string()
+	fn.code = d.bytes()
+	n := d.int()
+	for i := 0; i < n && d.err == nil; i++ {
+		fn.pclinetab = append(fn.pclinetab, uint16(d.int()))
+	}
+	fn.locals = d.bindings()
+	// The cells are the locals captured by nested functions, which the
+	// listing does not need.
+	n = d.int()
+	for i := 0; i < n && d.err == nil; i++ {
+		d.int()
+	}
+	fn.freevars = d.bindings()
+	fn.maxStack = d.int()
+	fn.numParams = d.int()
+	fn.numKwonly = d.int()
+	fn.varargs = d.int() != 0
+	fn.kwargs = d.int() != 0
+	return fn
+}
+
+// decodeProgram reads a program serialized with Program.Write.
+func decodeProgram(data []byte) (*compiledProgram, error) {
+	if len(data) < 8 || string(data[:4]) != compiledMagic {
+		return nil, fmt.Errorf("not a compiled program")
+	}
+	offset := binary.LittleEndian.Uint32(data[4:8])
+	if offset < 8 || int(offset) > len(data) {
+		return nil, fmt.Errorf("truncated program")
+	}
+	d := &programDecoder{p: data[8:offset], s: data[offset:]}
+	if v := d.int(); v != compiledVersion {
+		return nil, fmt.Errorf("unsupported bytecode version %d, want %d", v, compiledVersion)
+	}
+
+	prog := &compiledProgram{filename: d.string(), loads: d.bindings()}
+	n := d.int()
+	for i := 0; i < n && d.err == nil; i++ {
+		prog.names = append(prog.names, d.string())
+	}
+	n = d.int()
+	for i := 0; i < n && d.err == nil; i++ {
+		var c string
+		switch kind := d.int(); kind {
+		case 0:
+			c = starlark.String(d.string()).String()
+		case 1:
+			c = starlark.Bytes(d.string()).String()
+		case 2:
+			c = fmt.Sprint(d.int())
+		case 3:
+			c = starlark.Float(math.Float64frombits(d.uint64())).String()
+		case 4:
+			c = d.string()
+		default:
+			d.err = fmt.Errorf("unknown constant kind %d", kind)
+		}
+		prog.constants = append(prog.constants, c)
+	}
+	prog.globals = d.bindings()
+	prog.functions = append(prog.functions, d.function())
+	n = d.int()
+	for i := 0; i < n && d.err == nil; i++ {
+		prog.functions = append(prog.functions, d.function())
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return prog, nil
+}
+
+// instruction is a decoded instruction of a function.
+type instruction struct {
+	pc     uint32
+	op     string
+	arg    uint32
+	hasArg bool
+	// detail says what the argument refers to, such as the value of a
+	// constant or the name of a local.
+	detail    string
+	line, col int32
+}
+
+// disassemble decodes the instructions of a function of the program.
+func (prog *compiledProgram) disassemble(fn *compiledFunction) ([]instruction, error) {
+	positions := fn.positions()
+	var insns []instruction
+	for pc := uint32(0); pc < uint32(len(fn.code)); {
+		insn := instruction{pc: pc}
+		op := int(fn.code[pc])
+		pc++
+		if op >= len(opcodeNames) {
+			return nil, fmt.Errorf("illegal opcode %d at pc %d of %s", op, insn.pc, fn.name)
+		}
+		insn.op = opcodeNames[op]
+		if op >= opcodeArgMin {
+			arg, n := binary.Uvarint(fn.code[pc:])
+			if n <= 0 {
+				return nil, fmt.Errorf("truncated instruction at pc %d of %s", insn.pc, fn.name)
+			}
+			pc += uint32(n)
+			insn.arg, insn.hasArg = uint32(arg), true
+			insn.detail = prog.argDetail(fn, insn.op, insn.arg)
+		}
+		insn.line, insn.col = positions.at(insn.pc)
+		insns = append(insns, insn)
+	}
+	return insns, nil
+}
+
+// argDetail describes the argument of an instruction, or returns "" if it is
+// just a number.
+func (prog *compiledProgram) argDetail(fn *compiledFunction, op string, arg uint32) string {
+	name := func(binds []compiledBinding) string {
+		if int(arg) < len(binds) {
+			return binds[arg].name
+		}
+		return ""
+	}
+	switch op {
+	case "jmp", "cjmp", "iterjmp":
+		return fmt.Sprintf("to %d", arg)
+	case "constant":
+		if int(arg) < len(prog.constants) {
+			return prog.constants[arg]
+		}
+	case "makefunc":
+		if int(arg)+1 < len(prog.functions) {
+			return prog.functions[arg+1].name
+		}
+	case "setlocal", "local", "localcell", "setlocalcell":
+		return name(fn.locals)
+	case "free", "freecell":
+		return name(fn.freevars)
+	case "setglobal", "global":
+		return name(prog.globals)
+	case "attr", "setfield", "predeclared", "universal":
+		if int(arg) < len(prog.names) {
+			return prog.names[arg]
+		}
+	case "call", "call_var", "call_kw", "call_var_kw":
+		return fmt.Sprintf("%d pos, %d named", arg>>8, arg&0xff)
+	}
+	return ""
+}
+
+// pcPosition is a row of a function's line number table: the position of the
+// instructions from pc on.
+type pcPosition struct {
+	pc        uint32
+	line, col int32
+}
+
+type pcPositions []pcPosition
+
+// positions decodes the line number table of the function. Each entry packs
+// deltas of the pc (4 bits), line (5 bits, signed) and column (6 bits,
+// signed) from the previous row, starting at the function's own position, and
+// a bit that is set when the row continues in the next entry.
+func (fn *compiledFunction) positions() pcPositions {
+	var rows pcPositions
+	row := pcPosition{line: fn.line, col: fn.col}
+	for _, x := range fn.pclinetab {
+		row.pc += uint32(x) >> 12
+		row.line += int32((int16(x) << 4) >> (16 - 5))
+		row.col += int32((int16(x) << 9) >> (16 - 6))
+		if x&1 == 0 {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// at returns the position of the instruction at pc, which is that of the
+// last row at or before it.
+func (rows pcPositions) at(pc uint32) (line, col int32) {
+	for _, row := range rows {
+		if row.pc > pc {
+			break
+		}
+		line, col = row.line, row.col
+	}
+	return line, col
+}
+
+// disassembleSource compiles a file and lists the instructions of each of its
+// functions, along with a listing of them as text.
+func disassembleSource(filename string, source string, isPredeclared func(string) bool) (js.Value, error) {
+	fileOptions := syntax.FileOptions{}
+	_, program, err := starlark.SourceProgramOptions(&fileOptions, filename, source, isPredeclared)
+	if err != nil {
+		return js.Undefined(), withAllResolveErrors(err)
+	}
+	var buf bytes.Buffer
+	if err := program.Write(&buf); err != nil {
+		return js.Undefined(), err
+	}
+	prog, err := decodeProgram(buf.Bytes())
+	if err != nil {
+		return js.Undefined(), fmt.Errorf("unable to disassemble: %s", err)
+	}
+
+	var listing strings.Builder
+	functions := jsArray.New(len(prog.functions))
+	for i, fn := range prog.functions {
+		insns, err := prog.disassemble(fn)
+		if err != nil {
+			return js.Undefined(), fmt.Errorf("unable to disassemble: %s", err)
+		}
+		functions.SetIndex(i, fn.toJSValue(insns))
+
+		if i > 0 {
+			listing.WriteString("\n")
+		}
+		fmt.Fprintf(&listing, "%s at %s:%d:%d\n", fn.name, prog.filename, fn.line, fn.col)
+		for _, insn := range insns {
+			fmt.Fprintf(&listing, "\t%d\t%d:%d\t%s", insn.pc, insn.line, insn.col, insn.op)
+			if insn.hasArg {
+				fmt.Fprintf(&listing, "\t%d", insn.arg)
+			}
+			if insn.detail != "" {
+				fmt.Fprintf(&listing, "\t; %s", insn.detail)
+			}
+			listing.WriteString("\n")
+		}
+	}
+
+	obj := jsObject.New()
+	obj.Set("filename", prog.filename)
+	obj.Set("functions", functions)
+	obj.Set("listing", listing.String())
+	return obj, nil
+}
+
+func bindingNamesToJSValue(binds []compiledBinding) js.Value {
+	array := jsArray.New(len(binds))
+	for i, bind := range binds {
+		array.SetIndex(i, bind.name)
+	}
+	return array
+}
+
+func (fn *compiledFunction) toJSValue(insns []instruction) js.Value {
+	obj := jsObject.New()
+	obj.Set("name", fn.name)
+	obj.Set("position", positionToJSValue(syntax.MakePosition(nil, fn.line, fn.col)))
+	if fn.doc != "" {
+		obj.Set("doc", fn.doc)
+	}
+	obj.Set("params", bindingNamesToJSValue(fn.locals[:fn.numParams]))
+	obj.Set("kwonlyParams", fn.numKwonly)
+	obj.Set("varargs", fn.varargs)
+	obj.Set("kwargs", fn.kwargs)
+	obj.Set("locals", bindingNamesToJSValue(fn.locals))
+	obj.Set("freevars", bindingNamesToJSValue(fn.freevars))
+	obj.Set("maxStack", fn.maxStack)
+
+	array := jsArray.New(len(insns))
+	for i, insn := range insns {
+		item := jsObject.New()
+		item.Set("pc", insn.pc)
+		item.Set("op", insn.op)
+		if insn.hasArg {
+			item.Set("arg", insn.arg)
+		}
+		if insn.detail != "" {
+			item.Set("detail", insn.detail)
+		}
+		item.Set("position", positionToJSValue(syntax.MakePosition(nil, insn.line, insn.col)))
+		array.SetIndex(i, item)
+	}
+	obj.Set("instructions", array)
+	return obj
+}
+
+// jsDisassemble implements starlark.disassemble(source, filename?,
+// predeclared?), which compiles a file without running it and lists the
+// bytecode of each of its functions, toplevel first.
+func jsDisassemble() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) (result interface{}) {
+		defer func() {
+			if r := recover(); r != nil {
+				result = errorToJSValue(newInternalError(r, panicStack()))
+			}
+		}()
+
+		if len(args) < 1 || args[0].Type() != js.TypeString {
+			return jsErrorConstructor.New("Error: disassemble requires the source code as a string.")
+		}
+		filename := "<disassemble>"
+		if len(args) > 1 && args[1].Type() == js.TypeString {
+			filename = args[1].String()
+		}
+		hostPredeclared := make(map[string]bool)
+		if len(args) > 2 && args[2].InstanceOf(jsArray) {
+			for i := 0; i < args[2].Length(); i++ {
+				hostPredeclared[args[2].Index(i).String()] = true
+			}
+		}
+
+		// As runs compile the builtins, so that len, say, is predeclared.
+		predeclared := func(name string) bool { return hostPredeclared[name] || isPredeclared(name) }
+		value, err := disassembleSource(filename, args[0].String(), predeclared)
+		if err != nil {
+			return jsErrorConstructor.New(err.Error())
+		}
+		return value
+	})
+}
@@ -0,0 +1,237 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"syscall/js"
+
+	"go.starlark.net/starlark"
+)
+
+// defaultEnvironment is what modules are initialized with unless the
+// builtins option changes it: the runner's predeclared builtins, those of
+// plugins, and Starlark's universal builtins such as len and getattr.
+var defaultEnvironment starlark.StringDict
+
+// setBuiltin is the universal builtin that Starlark leaves out of its
+// default dialect. Only the environment of a dialect with sets has it.
+const setBuiltin = "set"
+
+// initEnvironment builds the default environment, once plugins have added
+// their builtins.
+func initEnvironment() {
+	defaultEnvironment = make(starlark.StringDict, len(starlark.Universe)+len(predeclared))
+	for name, value := range starlark.Universe {
+		if isUniversalBuiltin(name) && name != setBuiltin {
+			defaultEnvironment[name] = value
+		}
+	}
+	for name, value := range predeclared {
+		defaultEnvironment[name] = value
+	}
+	// Every execution shares the environment, and the plugins' builtins
+	// in it may be values such as a struct of constants.
+	defaultEnvironment.Freeze()
+}
+
+// isUniversalBuiltin reports whether name is one of Starlark's universal
+// functions, rather than a constant such as None.
+func isUniversalBuiltin(name string) bool {
+	_, ok := starlark.Universe[name].(*starlark.Builtin)
+	return ok
+}
+
+// isPredeclared reports whether modules are compiled to look up name in the
+// environment they are initialized with. Starlark would look up its
+// universal builtins in its own Universe instead, the same for every
+// execution, so they are declared too: that way the builtins option can
+// remove or replace them for one execution, while a module is compiled,
+// and cached, once for all. set is left to Starlark, whose resolver rejects
+// it unless the dialect has sets.
+func isPredeclared(name string) bool {
+	return predeclared.Has(name) || isUniversalBuiltin(name) && name != setBuiltin
+}
+
+// builtinsOption is the builtins option: which builtins of the environment
+// the execution keeps, and the host functions that replace some.
+type builtinsOption struct {
+	// only, if not nil, is the builtins kept; the others are removed.
+	only map[string]bool
+	// remove is the builtins removed.
+	remove map[string]bool
+	// replace holds the host functions called in place of builtins, by
+	// name.
+	replace map[string]js.Value
+}
+
+// parseBuiltinsOption reads the builtins option, {only?, remove?, replace?},
+// returning nil if there is none.
+func parseBuiltinsOption(value js.Value) *builtinsOption {
+	if value.Type() != js.TypeObject {
+		return nil
+	}
+	names := func(name string) map[string]bool {
+		list := value.Get(name)
+		if list.Type() != js.TypeObject || !list.InstanceOf(jsArray) {
+			return nil
+		}
+		set := make(map[string]bool, list.Length())
+		for i := 0; i < list.Length(); i++ {
+			if name := list.Index(i); name.Type() == js.TypeString {
+				set[name.String()] = true
+			}
+		}
+		return set
+	}
+	option := &builtinsOption{only: names("only"), remove: names("remove")}
+	if replace := value.Get("replace"); replace.Type() == js.TypeObject {
+		keys := jsObjectKeys.Invoke(replace)
+		option.replace = make(map[string]js.Value, keys.Length())
+		for i := 0; i < keys.Length(); i++ {
+			name := keys.Index(i).String()
+			if fn := replace.Get(name); fn.Type() == js.TypeFunction {
+				option.replace[name] = fn
+			}
+		}
+	}
+	return option
+}
+
+// changes reports whether the option removes or replaces the builtin.
+func (o *builtinsOption) changes(name string) bool {
+	_, replaced := o.replace[name]
+	return replaced || o.remove[name] || o.only != nil && !o.only[name]
+}
+
+// newEnvironment returns the environment of the execution, with the
+// builtins its builtins option removes failing with a PermissionError when
+// called, and those it replaces calling the host, with its secrets option's
+// values in secrets, with set and the members of the modules its dialect
+// predeclares, and with its host functions, which take the place of any
+// builtins of the same name. Removed builtins stay defined, as with
+// allowBuiltins, so that the modules compiled against them are the same for
+// every execution.
+func (e *execution) newEnvironment() starlark.StringDict {
+	if !e.ownsEnvironment() {
+		return defaultEnvironment
+	}
+	option := e.options.builtins
+	env := make(starlark.StringDict, len(defaultEnvironment)+1)
+	builtin := func(name string, value starlark.Value) {
+		env[name] = value
+		if option == nil {
+			return
+		}
+		if fn, ok := option.replace[name]; ok {
+			env[name] = e.hostBuiltin(name, fn)
+		} else if option.changes(name) {
+			env[name] = e.removedBuiltin(name)
+		}
+	}
+	for name, value := range defaultEnvironment {
+		builtin(name, value)
+	}
+	if e.hasSets() {
+		builtin(setBuiltin, starlark.Universe[setBuiltin])
+	}
+	if e.options.secrets != nil {
+		env[secretsName] = secretsStruct(e.options.secrets)
+	}
+	for name, value := range e.dialectMembers() {
+		env[name] = value
+	}
+	for name, fn := range e.options.hostFunctions {
+		env[name] = e.hostBuiltin(name, fn)
+	}
+	return env
+}
+
+// changesEnvironment reports whether the execution's builtins, secrets,
+// dialect or host functions give name a value of its own.
+func (e *execution) changesEnvironment(name string) bool {
+	if name == secretsName && e.options.secrets != nil {
+		return true
+	}
+	if name == setBuiltin && e.hasSets() {
+		return true
+	}
+	if _, ok := e.dialectMembers()[name]; ok {
+		return true
+	}
+	if _, ok := e.options.hostFunctions[name]; ok {
+		return true
+	}
+	return e.options.builtins != nil && e.options.builtins.changes(name)
+}
+
+// removedBuiltin returns the builtin left in place of one the builtins
+// option removes.
+func (e *execution) removedBuiltin(name string) *starlark.Builtin {
+	return starlark.NewBuiltin(name, func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+		e.notifyCapabilityDenied(name, codePermissionDenied)
+		return nil, e.messageErr(codePermissionDenied, "function", fmt.Sprintf("%q", name))
+	})
+}
+
+// hostBuiltin returns a builtin that calls a host function, fn(args,
+// kwargs, executionId), under the given name: in place of the builtin of
+// that name, or as one of the execution's host functions. What it
+// returns, or the promise resolves with, is the result, and what it throws
+// fails the call.
+func (e *execution) hostBuiltin(name string, fn js.Value) *starlark.Builtin {
+	return starlark.NewBuiltin(name, func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		if err := e.throttle(name); err != nil {
+			return nil, err
+		}
+		conv := &converter{exec: e}
+		jsArgs := jsArray.New(len(args))
+		for i, arg := range args {
+			jsArg, err := conv.convertToJSValue(arg, fmt.Sprintf("%s args[%d]", name, i))
+			if err != nil {
+				return nil, err
+			}
+			jsArgs.SetIndex(i, jsArg)
+		}
+		jsKwargs := jsObject.New()
+		for _, kwarg := range kwargs {
+			key := string(kwarg[0].(starlark.String))
+			jsArg, err := conv.convertToJSValue(kwarg[1], fmt.Sprintf("%s kwargs[%q]", name, key))
+			if err != nil {
+				return nil, err
+			}
+			jsKwargs.Set(key, jsArg)
+		}
+		var result js.Value
+		err := e.audited("builtin", func() string { return name }, func() error {
+			var err error
+			result, err = invokeHost(fn, jsArgs, jsKwargs, e.id)
+			if err != nil || result.Type() != js.TypeObject || result.Get("then").Type() != js.TypeFunction {
+				return err
+			}
+			if e.synchronous {
+				return fmt.Errorf("a synchronous run cannot wait for the promise it returned")
+			}
+			result, err = jsAwait(result)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		return conv.convertToStarlarkValue(result, name)
+	})
+}
@@ -0,0 +1,483 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+	"syscall/js"
+	"unicode/utf8"
+
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// jsError is an error that is reported to the host as a structured object
+// rather than as a message string.
+type jsError interface {
+	error
+	toJSValue() js.Value
+}
+
+// errorToJSValue converts an error to the value a call is rejected with:
+// structured errors convert themselves, and any other error becomes a plain
+// {kind: "error", message} object, with the code of the runner's own
+// errors.
+func errorToJSValue(err error) js.Value {
+	var obj js.Value
+	var structuredErr jsError
+	if errors.As(err, &structuredErr) {
+		obj = structuredErr.toJSValue()
+	} else {
+		obj = jsObject.New()
+		obj.Set("kind", "error")
+		obj.Set("message", err.Error())
+		var msgErr *messageError
+		if errors.As(err, &msgErr) {
+			obj.Set("code", msgErr.code)
+		}
+	}
+	obj.Set("instanceId", instanceId)
+	return attachErrorMethods(obj)
+}
+
+// hostError is a host callback failure.
+type hostError struct {
+	callback string
+	message  string
+}
+
+func (e *hostError) Error() string {
+	return e.message
+}
+
+func (e *hostError) toJSValue() js.Value {
+	obj := jsObject.New()
+	obj.Set("kind", "host")
+	obj.Set("message", e.message)
+	obj.Set("callback", e.callback)
+	return obj
+}
+
+// conversionError is a lossy conversion refused in strict mode.
+type conversionError struct {
+	code    string
+	path    string
+	message string
+}
+
+func (e *conversionError) Error() string {
+	return fmt.Sprintf("Error: lossy conversion of %s: %s", e.path, e.message)
+}
+
+func (e *conversionError) toJSValue() js.Value {
+	obj := jsObject.New()
+	obj.Set("kind", "conversion")
+	obj.Set("message", e.Error())
+	obj.Set("code", e.code)
+	obj.Set("path", e.path)
+	return obj
+}
+
+// resultSizeError stops the conversion of a result that has grown past the
+// maxResultSize option.
+type resultSizeError struct {
+	limit int
+	size  int
+	path  string
+}
+
+func (e *resultSizeError) Error() string {
+	return fmt.Sprintf("Error: the result exceeds the size limit of %d bytes, having reached %d bytes at %s.", e.limit, e.size, e.path)
+}
+
+func (e *resultSizeError) toJSValue() js.Value {
+	obj := jsObject.New()
+	obj.Set("kind", "resultSize")
+	obj.Set("message", e.Error())
+	obj.Set("limit", e.limit)
+	obj.Set("size", e.size)
+	obj.Set("path", e.path)
+	return obj
+}
+
+// internalError is a Go panic recovered while servicing a call. It is
+// reported to the host as a structured object instead of the raw panic
+// value, which is frequently an opaque js.Value.
+type internalError struct {
+	category string
+	message  string
+	stack    string
+}
+
+// newInternalError classifies a recovered panic value. The categories cover
+// the panics we know the bridge can raise: failed type assertions while
+// converting values, misuse of a js.Value, and exceptions thrown by host
+// callbacks.
+func newInternalError(r interface{}, stack []byte) *internalError {
+	e := &internalError{stack: string(stack)}
+	switch v := r.(type) {
+	case *runtime.TypeAssertionError:
+		e.category = "type_assertion"
+		e.message = v.Error()
+	case *js.ValueError:
+		e.category = "js_value"
+		e.message = v.Error()
+	case js.Error:
+		e.category = "js_exception"
+		e.message = v.Error()
+	case runtime.Error:
+		e.category = "runtime"
+		e.message = v.Error()
+	case error:
+		e.category = "error"
+		e.message = v.Error()
+	case js.Value:
+		e.category = "js_value"
+		e.message = v.String()
+	default:
+		e.category = "panic"
+		e.message = fmt.Sprint(v)
+	}
+	return e
+}
+
+func (e *internalError) Error() string {
+	return fmt.Sprintf("Error: internal error (%s). %s", e.category, e.message)
+}
+
+func (e *internalError) toJSValue() js.Value {
+	obj := jsObject.New()
+	obj.Set("kind", "internal")
+	obj.Set("category", e.category)
+	obj.Set("message", e.Error())
+	obj.Set("stack", e.stack)
+	return obj
+}
+
+// evalError is a Starlark runtime error, reported along with the call stack
+// at the point of failure.
+type evalError struct {
+	// code is that of the runner's error the failure came from, if any, or
+	// else evalFailed or execFailed.
+	code    string
+	message string
+	err     *starlark.EvalError
+	// locals holds the locals of each frame of err.CallStack when the
+	// captureLocals option is set.
+	locals [][]capturedLocal
+}
+
+// defaultMaxErrorLength is the default limit, in bytes, on the error quoted
+// in an error message. Messages embed values, which can be huge, e.g. for a
+// failed comparison of two long strings.
+const defaultMaxErrorLength = 8192
+
+// truncateString cuts s to at most limit bytes, on a rune boundary, noting
+// how much was cut. A limit of 0 or less leaves s alone.
+func truncateString(s string, limit int) string {
+	if limit <= 0 || len(s) <= limit {
+		return s
+	}
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s... (truncated %d bytes)", s[:cut], len(s)-cut)
+}
+
+// wrapEvalError describes a failure of the execution with the message of
+// code for context, keeping its call stack when it is a Starlark runtime
+// error, and the positions of its problems when it is a syntax error.
+func (e *execution) wrapEvalError(code string, err error) error {
+	e.mu.Lock()
+	hostErr := e.hostErr
+	throttleErr := e.throttleErr
+	overBudget := e.overBudget
+	cancelledAt := e.cancelledAt
+	cancelErr := e.cancelErr
+	e.mu.Unlock()
+	if hostErr != nil {
+		// The execution was aborted by a failing host callback, so that is
+		// the real cause of whatever the threads report.
+		return hostErr
+	}
+	if overBudget {
+		return &stepLimitError{message: e.message(codeStepLimit, "limit", strconv.FormatUint(e.options.maxSteps, 10)), locale: e.options.locale, limit: e.options.maxSteps, err: cancelledAt, steps: e.steps()}
+	}
+	if throttleErr != nil {
+		// However a load wrapped it, the run failed for the call.
+		var evalErr *starlark.EvalError
+		errors.As(err, &evalErr)
+		return throttleErr.at(evalErr)
+	}
+
+	message := fmt.Sprintf("%s %q", e.message(code), truncateString(err.Error(), e.options.maxErrorLength))
+	code = errorCode(err, code)
+	if cancelErr != nil {
+		// A hook failed the thread by cancelling it, which loses the
+		// error's code.
+		code = errorCode(cancelErr, code)
+	}
+	var evalErr *starlark.EvalError
+	if !errors.As(err, &evalErr) {
+		if errs := syntaxErrorsOf(err); errs != nil {
+			return &syntaxError{code: code, message: message, errs: errs}
+		}
+		return &messageError{code: code, message: message}
+	}
+
+	e.mu.Lock()
+	locals := e.locals[evalErr]
+	e.mu.Unlock()
+	return &evalError{code: code, message: message, err: evalErr, locals: locals}
+}
+
+func (e *evalError) Error() string {
+	return e.message
+}
+
+func (e *evalError) toJSValue() js.Value {
+	obj := jsObject.New()
+	obj.Set("kind", "eval")
+	obj.Set("message", e.message)
+	obj.Set("code", e.code)
+	obj.Set("backtrace", callStackToJSValue(e.err.CallStack, e.locals))
+	// A builtin such as fail() is the innermost frame, at <builtin>:0:0, so
+	// the error is placed at the script's call to it instead.
+	stack := e.err.CallStack
+	for len(stack) > 1 && stack.At(0).Pos.Filename() == "<builtin>" {
+		stack = stack[:len(stack)-1]
+	}
+	if len(stack) > 0 {
+		obj.Set("position", printPositionToJSValue(stack.At(0).Pos))
+	}
+	var assertErr *assertionError
+	if errors.As(e.err, &assertErr) {
+		obj.Set("assertion", assertErr.toJSValue())
+	}
+	return obj
+}
+
+// syntaxError is source that does not parse, or uses names that are not
+// defined, reported with the position of each problem.
+type syntaxError struct {
+	code    string
+	message string
+	errs    []syntax.Error
+}
+
+// syntaxErrorsOf returns the problems of a scanner, parser or resolver
+// error, every one the resolver found, or nil for any other error.
+func syntaxErrorsOf(err error) []syntax.Error {
+	var resolveErr resolveError
+	var errList resolve.ErrorList
+	var syntaxErr syntax.Error
+	switch {
+	case errors.As(err, &resolveErr):
+		errList = resolveErr.errs
+	case errors.As(err, &errList):
+	case errors.As(err, &syntaxErr):
+		return []syntax.Error{syntaxErr}
+	default:
+		return nil
+	}
+	errs := make([]syntax.Error, len(errList))
+	for i, err := range errList {
+		errs[i] = syntax.Error{Pos: err.Pos, Msg: err.Msg}
+	}
+	return errs
+}
+
+func (e *syntaxError) Error() string {
+	return e.message
+}
+
+func (e *syntaxError) toJSValue() js.Value {
+	obj := jsObject.New()
+	obj.Set("kind", "syntax")
+	obj.Set("message", e.message)
+	obj.Set("code", e.code)
+	obj.Set("position", printPositionToJSValue(e.errs[0].Pos))
+	errs := jsArray.New(len(e.errs))
+	for i, err := range e.errs {
+		problem := jsObject.New()
+		problem.Set("message", err.Msg)
+		problem.Set("position", printPositionToJSValue(err.Pos))
+		errs.SetIndex(i, problem)
+	}
+	obj.Set("errors", errs)
+	return obj
+}
+
+// timeoutError is reported when an execution runs out of time.
+type timeoutError struct {
+	message string
+	// locale is the locale of message.
+	locale string
+	// err is the error raised where the script was interrupted, or nil if it
+	// did not stop in time, e.g. because it was waiting on the host.
+	err *starlark.EvalError
+	// steps is the number of steps executed, across all threads.
+	steps uint64
+	// code is the code of message: timeout, or retryBudget when the time
+	// shared by the retries of the run ran out.
+	code string
+}
+
+func (e *timeoutError) Error() string {
+	if e.err != nil && len(e.err.CallStack) > 0 {
+		return localize(e.locale, codeAtPosition, "error", e.message, "position", e.err.CallStack.At(0).Pos.String())
+	}
+	return e.message
+}
+
+func (e *timeoutError) toJSValue() js.Value {
+	obj := jsObject.New()
+	obj.Set("kind", "timeout")
+	obj.Set("message", e.Error())
+	obj.Set("code", e.code)
+	obj.Set("steps", e.steps)
+	if e.err != nil && len(e.err.CallStack) > 0 {
+		obj.Set("position", printPositionToJSValue(e.err.CallStack.At(0).Pos))
+		obj.Set("backtrace", callStackToJSValue(e.err.CallStack, nil))
+	}
+	return obj
+}
+
+// stepLimitError is reported when an execution runs past the maxSteps
+// option.
+type stepLimitError struct {
+	message string
+	// locale is the locale of message.
+	locale string
+	limit  uint64
+	// err is the error raised where the script was stopped.
+	err   *starlark.EvalError
+	steps uint64
+}
+
+func (e *stepLimitError) Error() string {
+	if e.err != nil && len(e.err.CallStack) > 0 {
+		return localize(e.locale, codeAtPosition, "error", e.message, "position", e.err.CallStack.At(0).Pos.String())
+	}
+	return e.message
+}
+
+func (e *stepLimitError) toJSValue() js.Value {
+	obj := jsObject.New()
+	obj.Set("kind", "steps")
+	obj.Set("message", e.Error())
+	obj.Set("code", codeStepLimit)
+	obj.Set("limit", e.limit)
+	obj.Set("steps", e.steps)
+	if e.err != nil && len(e.err.CallStack) > 0 {
+		obj.Set("position", printPositionToJSValue(e.err.CallStack.At(0).Pos))
+		obj.Set("backtrace", callStackToJSValue(e.err.CallStack, nil))
+	}
+	return obj
+}
+
+// throttleError fails a call of a host builtin past the maxCallRate option.
+type throttleError struct {
+	message string
+	// locale is the locale of message.
+	locale  string
+	builtin string
+	rate    float64
+	burst   int
+	// stack is the call stack where the script made the call.
+	stack starlark.CallStack
+}
+
+// at returns the error as raised at err, if it is not nil, with the call
+// stack of the script that called the builtin, not of the builtin itself.
+func (e *throttleError) at(err *starlark.EvalError) *throttleError {
+	copied := *e
+	if err != nil {
+		copied.stack = err.CallStack
+		if n := len(copied.stack); n > 1 && copied.stack.At(0).Pos.Filename() == "<builtin>" {
+			copied.stack = copied.stack[:n-1]
+		}
+	}
+	return &copied
+}
+
+func (e *throttleError) Error() string {
+	if len(e.stack) > 0 {
+		return localize(e.locale, codeAtPosition, "error", e.message, "position", e.stack.At(0).Pos.String())
+	}
+	return e.message
+}
+
+func (e *throttleError) toJSValue() js.Value {
+	obj := jsObject.New()
+	obj.Set("kind", "throttled")
+	obj.Set("message", e.Error())
+	obj.Set("code", codeThrottled)
+	obj.Set("builtin", e.builtin)
+	obj.Set("rate", e.rate)
+	obj.Set("burst", e.burst)
+	if len(e.stack) > 0 {
+		obj.Set("position", printPositionToJSValue(e.stack.At(0).Pos))
+		obj.Set("backtrace", callStackToJSValue(e.stack, nil))
+	}
+	return obj
+}
+
+// quotaError rejects a run whose tenant has used up a quota.
+type quotaError struct {
+	tenant string
+	// resource is the quota used up: steps, time, loads or hostCalls.
+	resource string
+	used     float64
+	limit    float64
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("Error: the tenant %q has used up its quota of %g %s.", e.tenant, e.limit, e.resource)
+}
+
+func (e *quotaError) toJSValue() js.Value {
+	obj := jsObject.New()
+	obj.Set("kind", "quota")
+	obj.Set("message", e.Error())
+	obj.Set("tenant", e.tenant)
+	obj.Set("resource", e.resource)
+	obj.Set("used", e.used)
+	obj.Set("limit", e.limit)
+	return obj
+}
+
+// callStackToJSValue converts a call stack to an array of frames, outermost
+// first. locals, if not nil, holds the captured locals of each frame.
+func callStackToJSValue(stack starlark.CallStack, locals [][]capturedLocal) js.Value {
+	backtrace := jsArray.New(len(stack))
+	for i, fr := range stack {
+		frame := jsObject.New()
+		frame.Set("name", fr.Name)
+		frame.Set("position", printPositionToJSValue(fr.Pos))
+		if i < len(locals) && locals[i] != nil {
+			frame.Set("locals", capturedLocalsToJSValue(locals[i]))
+		}
+		backtrace.SetIndex(i, frame)
+	}
+	return backtrace
+}
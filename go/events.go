@@ -0,0 +1,252 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall/js"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// The events the host can subscribe to with starlark.on, each passed to its
+// handlers as an object tagged with the executionId of the run, along with
+// the executionId itself.
+const (
+	// eventPrint is a line printed, {stream, message, position?}, whether
+	// or not the run captures or batches its output.
+	eventPrint = "print"
+	// eventProgress reports a running execution's {steps, elapsed} in
+	// milliseconds, at most every progressInterval.
+	eventProgress = "progress"
+	// eventModuleLoaded is a module that loaded and ran its top level,
+	// {filename}, the file run itself included.
+	eventModuleLoaded = "moduleLoaded"
+	// eventWarning is a warning, {warning}, as the warn callback is given.
+	eventWarning = "warning"
+	// eventDone is the end of a run, {ok, error?}.
+	eventDone = "done"
+	// eventSessionEvicted is a REPL session the session policy evicted,
+	// {reason, idle, globals}.
+	eventSessionEvicted = "sessionEvicted"
+	// eventMemoryWatermark is a level of a memory budget that a run, or
+	// the instance, has risen to, {scope, level, used, limit,
+	// executions?}.
+	eventMemoryWatermark = "memoryWatermark"
+	// The security events tell of a policy a run's script broke, the run
+	// failing with the error of the code they carry as well. eventLoadDenied
+	// is a module the verifier did not approve or the lockfile does not
+	// allow, {filename, code, hash?, locked?}.
+	eventLoadDenied = "loadDenied"
+	// eventQuotaExceeded is a run refused as its tenant has used up its
+	// quota, {tenant, resource, used, limit}.
+	eventQuotaExceeded = "quotaExceeded"
+	// eventCapabilityDenied is a builtin the script may not call, by the
+	// allowBuiltins, builtins or printPolicy options, {function, code}.
+	eventCapabilityDenied = "capabilityDenied"
+)
+
+var eventNames = []string{eventPrint, eventProgress, eventModuleLoaded, eventWarning, eventDone, eventSessionEvicted, eventMemoryWatermark, eventLoadDenied, eventQuotaExceeded, eventCapabilityDenied}
+
+// progressInterval is how often a running execution reports its progress.
+const progressInterval = 100 * time.Millisecond
+
+// listeners holds the handlers of each event, in the order they subscribed.
+// progressWanted is set while progress has any, so that threads need not
+// look otherwise.
+var listeners = struct {
+	mu             sync.Mutex
+	byEvent        map[string][]js.Value
+	progressWanted atomic.Bool
+}{byEvent: make(map[string][]js.Value)}
+
+// subscribe adds a handler for an event.
+func subscribe(event string, handler js.Value) error {
+	if !isEventName(event) {
+		return fmt.Errorf("Error: unknown event %q. Use %s.", event, strings.Join(eventNames, ", "))
+	}
+	listeners.mu.Lock()
+	defer listeners.mu.Unlock()
+	listeners.byEvent[event] = append(listeners.byEvent[event], handler)
+	listeners.progressWanted.Store(len(listeners.byEvent[eventProgress]) > 0)
+	return nil
+}
+
+// unsubscribe removes a handler for an event, reporting whether it had
+// subscribed. It removes the latest subscription, should there be several.
+func unsubscribe(event string, handler js.Value) bool {
+	listeners.mu.Lock()
+	defer listeners.mu.Unlock()
+	handlers := listeners.byEvent[event]
+	for i := len(handlers) - 1; i >= 0; i-- {
+		if handlers[i].Equal(handler) {
+			listeners.byEvent[event] = append(handlers[:i:i], handlers[i+1:]...)
+			listeners.progressWanted.Store(len(listeners.byEvent[eventProgress]) > 0)
+			return true
+		}
+	}
+	return false
+}
+
+func isEventName(event string) bool {
+	for _, name := range eventNames {
+		if name == event {
+			return true
+		}
+	}
+	return false
+}
+
+// notify calls the handlers of an event with the object fields makes, which
+// is only made if there are any. A failing handler must not break the
+// execution, so its error is only logged.
+func (e *execution) notify(event string, fields func() js.Value) {
+	listeners.mu.Lock()
+	handlers := listeners.byEvent[event]
+	listeners.mu.Unlock()
+	if len(handlers) == 0 {
+		return
+	}
+	obj := e.tag(fields())
+	obj.Set("type", event)
+	for _, handler := range handlers {
+		if _, err := invokeHost(handler, obj, e.id); err != nil {
+			js.Global().Get("console").Call("error", fmt.Sprintf("Error: a %s handler failed. %s", event, err))
+		}
+	}
+}
+
+// notifyDone counts how the execution ended in the metrics, and tells the
+// done handlers: rejection is the error it failed with, or undefined.
+func (e *execution) notifyDone(rejection js.Value) {
+	e.countOutcome(rejection)
+	e.notify(eventDone, func() js.Value {
+		obj := jsObject.New()
+		obj.Set("ok", rejection.IsUndefined())
+		if !rejection.IsUndefined() {
+			obj.Set("error", rejection)
+		}
+		return obj
+	})
+}
+
+// notifyModuleLoaded tells the moduleLoaded handlers a module is ready.
+func (e *execution) notifyModuleLoaded(filename string) {
+	e.notify(eventModuleLoaded, func() js.Value {
+		obj := jsObject.New()
+		obj.Set("filename", filename)
+		return obj
+	})
+}
+
+// notifyLoadDenied tells the loadDenied handlers a module was kept from
+// running, with the error code saying why, the hash of its source, if it
+// was loaded, and the hash the lockfile has for it, if any.
+func (e *execution) notifyLoadDenied(filename, code, hash, locked string) {
+	e.notify(eventLoadDenied, func() js.Value {
+		obj := jsObject.New()
+		obj.Set("filename", filename)
+		obj.Set("code", code)
+		if hash != "" {
+			obj.Set("hash", hash)
+		}
+		if locked != "" {
+			obj.Set("locked", locked)
+		}
+		return obj
+	})
+}
+
+// notifyQuotaExceeded tells the quotaExceeded handlers the run was refused
+// for the quota it would exceed.
+func (e *execution) notifyQuotaExceeded(exceeded *quotaError) {
+	e.notify(eventQuotaExceeded, func() js.Value {
+		obj := jsObject.New()
+		obj.Set("tenant", exceeded.tenant)
+		obj.Set("resource", exceeded.resource)
+		obj.Set("used", exceeded.used)
+		obj.Set("limit", exceeded.limit)
+		return obj
+	})
+}
+
+// notifyCapabilityDenied tells the capabilityDenied handlers the script
+// called a function it may not, failing with the error code given.
+func (e *execution) notifyCapabilityDenied(function, code string) {
+	e.notify(eventCapabilityDenied, func() js.Value {
+		obj := jsObject.New()
+		obj.Set("function", function)
+		obj.Set("code", code)
+		return obj
+	})
+}
+
+// progressHook returns a step hook reporting the execution's progress to
+// the progress handlers, if there are any, every progressInterval.
+func (e *execution) progressHook() func(thread *starlark.Thread) {
+	return func(thread *starlark.Thread) {
+		if !listeners.progressWanted.Load() {
+			return
+		}
+		now := time.Now()
+		e.mu.Lock()
+		due := now.Sub(e.progressAt) >= progressInterval
+		if due {
+			e.progressAt = now
+		}
+		e.mu.Unlock()
+		if !due {
+			return
+		}
+		e.notify(eventProgress, func() js.Value {
+			obj := jsObject.New()
+			obj.Set("steps", e.steps())
+			obj.Set("elapsed", milliseconds(now.Sub(e.calledAt)))
+			return obj
+		})
+	}
+}
+
+// jsOn implements starlark.on(event, handler), which subscribes the handler
+// to the event for every run of the instance, and returns a function that
+// unsubscribes it: off, bound to the event and handler.
+func jsOn(off js.Func) js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 2 || args[0].Type() != js.TypeString || args[1].Type() != js.TypeFunction {
+			return jsErrorConstructor.New("Error: requires an event name and a handler function as arguments.")
+		}
+		if err := subscribe(args[0].String(), args[1]); err != nil {
+			return jsErrorConstructor.New(err.Error())
+		}
+		return off.Value.Call("bind", js.Null(), args[0], args[1])
+	})
+}
+
+// jsOff implements starlark.off(event, handler), which unsubscribes the
+// handler from the event, returning whether it was subscribed.
+func jsOff() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 2 || args[0].Type() != js.TypeString {
+			return jsErrorConstructor.New("Error: requires an event name and a handler as arguments.")
+		}
+		return unsubscribe(args[0].String(), args[1])
+	})
+}
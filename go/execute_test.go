@@ -0,0 +1,282 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"syscall/js"
+	"testing"
+	"time"
+
+	"dcollien.com/starlark-wasm/internal/runner"
+	"dcollien.com/starlark-wasm/internal/runner/runnertest"
+)
+
+func TestMain(m *testing.M) {
+	initRunner()
+	os.Exit(m.Run())
+}
+
+// hostCallbacks returns run options whose load and print callbacks are
+// served by host, with the given options besides.
+func hostCallbacks(host *runnertest.Host, options string) js.Value {
+	value := jsExpression(options)
+	value.Set("load", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		source, err := host.Load(args[0].String())
+		if err != nil {
+			return js.Global().Get("Promise").Call("reject", js.Global().Get("Error").New(err.Error()))
+		}
+		return source
+	}))
+	value.Set("print", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		host.Print("stdout", args[0].String())
+		return nil
+	}))
+	return value
+}
+
+// jsonOf returns the JSON of a JS value.
+func jsonOf(value js.Value) string {
+	return js.Global().Get("JSON").Call("stringify", value).String()
+}
+
+func TestExecuteJS(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  string
+		modules  map[string]string
+		function string
+		args     string
+		kwargs   string
+		timeout  int
+		// want is the result as JSON, or for a run that fails, the kind of
+		// error it rejects with, the start of its message, and for an
+		// eval error, the position it reports.
+		want     string
+		kind     string
+		err      string
+		position string
+		output   []string
+		loads    []string
+	}{
+		{
+			name:     "arguments",
+			modules:  map[string]string{"main.star": "def main(xs, scale = 1):\n    return {\"max\": max(xs) * scale, \"n\": len(xs)}\n"},
+			function: "main",
+			args:     "[[1, 2, 3.5]]",
+			kwargs:   "{scale: 2}",
+			want:     `{"max":7,"n":3}`,
+			loads:    []string{"main.star"},
+		},
+		{
+			name: "loads",
+			modules: map[string]string{
+				"main.star": "load(\"a.star\", \"a\")\nload(\"b.star\", \"b\")\ndef main():\n    print(a + b)\n    return [a, b]\n",
+				"a.star":    "load(\"c.star\", \"c\")\na = c + \"a\"\n",
+				"b.star":    "load(\"c.star\", \"c\")\nb = c + \"b\"\n",
+				"c.star":    "c = \"c\"\n",
+			},
+			function: "main",
+			args:     "[]",
+			kwargs:   "null",
+			want:     `["ca","cb"]`,
+			output:   []string{"cacb"},
+			loads:    []string{"main.star", "a.star", "c.star", "b.star"},
+		},
+		{
+			name:     "missing function",
+			modules:  map[string]string{"main.star": "x = 1\n"},
+			function: "main",
+			args:     "[]",
+			kwargs:   "null",
+			kind:     "error",
+			err:      `Error: the function "main" is missing.`,
+			loads:    []string{"main.star"},
+		},
+		{
+			name:     "missing module",
+			modules:  map[string]string{"main.star": "load(\"lib.star\", \"x\")\n"},
+			function: "main",
+			args:     "[]",
+			kwargs:   "null",
+			kind:     "eval",
+			err:      "Error: unable to evaluate the starlark code.",
+			loads:    []string{"main.star", "lib.star"},
+		},
+		{
+			name:     "runtime error",
+			modules:  map[string]string{"main.star": "def main():\n    return 1 // 0\n"},
+			function: "main",
+			args:     "[]",
+			kwargs:   "null",
+			kind:     "eval",
+			err:      "Error: unable to execute the starlark code.",
+			loads:    []string{"main.star"},
+		},
+		{
+			name:     "set",
+			options:  "{dialect: {set: true}}",
+			modules:  map[string]string{"main.star": "def main():\n    return len(set([1, 1]))\n"},
+			function: "main",
+			args:     "[]",
+			kwargs:   "null",
+			want:     "1",
+			loads:    []string{"main.star"},
+		},
+		{
+			name:     "set outside its dialect",
+			modules:  map[string]string{"main.star": "def main():\n    return len(set([1, 1]))\n"},
+			function: "main",
+			args:     "[]",
+			kwargs:   "null",
+			kind:     "syntax",
+			err:      "Error: unable to evaluate the starlark code.",
+			loads:    []string{"main.star"},
+		},
+		{
+			name:     "fail",
+			modules:  map[string]string{"main.star": "def main():\n    x = 1\n    fail(\"x\")\n"},
+			function: "main",
+			args:     "[]",
+			kwargs:   "null",
+			kind:     "eval",
+			err:      "Error: unable to execute the starlark code.",
+			position: "main.star:3:9",
+			loads:    []string{"main.star"},
+		},
+		{
+			name: "builtin in a module",
+			modules: map[string]string{
+				"main.star": "load(\"lib.star\", \"parse\")\ndef main():\n    return parse(\"zz\")\n",
+				"lib.star":  "def parse(s):\n    return int(s)\n",
+			},
+			function: "main",
+			args:     "[]",
+			kwargs:   "null",
+			kind:     "eval",
+			err:      "Error: unable to execute the starlark code.",
+			position: "lib.star:2:15",
+			loads:    []string{"main.star", "lib.star"},
+		},
+		{
+			name:     "cycle",
+			modules:  map[string]string{"main.star": "load(\"main.star\", \"x\")\n"},
+			function: "main",
+			args:     "[]",
+			kwargs:   "null",
+			kind:     "eval",
+			err:      "Error: unable to evaluate the starlark code.",
+			loads:    []string{"main.star"},
+		},
+		{
+			name:     "strict result",
+			options:  "{strict: true}",
+			modules:  map[string]string{"main.star": "def main():\n    return [range(2)]\n"},
+			function: "main",
+			args:     "[]",
+			kwargs:   "null",
+			kind:     "conversion",
+			err:      "Error: lossy conversion of result[0]",
+			loads:    []string{"main.star"},
+		},
+		{
+			name:     "timeout",
+			modules:  map[string]string{"main.star": "def main():\n    while True:\n        pass\n"},
+			options:  "{dialect: {while: true}}",
+			function: "main",
+			args:     "[]",
+			kwargs:   "null",
+			timeout:  1,
+			kind:     "timeout",
+			loads:    []string{"main.star"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := test.options
+			if options == "" {
+				options = "{}"
+			}
+			host := runnertest.NewHost(test.modules)
+			exec := newExecution("test", parseRunOptions(hostCallbacks(host, options)), time.Now())
+			jsArgs := []js.Value{js.ValueOf("test"), js.ValueOf("main.star"), js.ValueOf(test.function), jsExpression(test.args), jsExpression(test.kwargs), js.ValueOf(test.timeout)}
+			result, err := runStarlarkCodeJs(exec, jsArgs)
+			if test.kind != "" {
+				if err == nil {
+					t.Fatalf("got %s, want a %s error", jsonOf(result), test.kind)
+				}
+				rejection := errorToJSValue(err)
+				if kind := rejection.Get("kind").String(); kind != test.kind {
+					t.Errorf("got a %s error, %v, want a %s error", kind, err, test.kind)
+				}
+				if message := rejection.Get("message").String(); !strings.HasPrefix(message, test.err) {
+					t.Errorf("got message %q, want one starting %q", message, test.err)
+				}
+				if test.position != "" {
+					position := rejection.Get("position")
+					got := fmt.Sprintf("%s:%d:%d", position.Get("filename").String(), position.Get("line").Int(), position.Get("column").Int())
+					if got != test.position {
+						t.Errorf("got position %s, want %s", got, test.position)
+					}
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if got := jsonOf(result); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+			got := []string{}
+			for _, line := range host.Output() {
+				got = append(got, line.Message)
+			}
+			if strings.Join(got, "\n") != strings.Join(test.output, "\n") {
+				t.Errorf("printed %q, want %q", got, test.output)
+			}
+			if loads := host.Loads(); !reflect.DeepEqual(loads, test.loads) {
+				t.Errorf("loaded %q, want %q", loads, test.loads)
+			}
+			if test.kind != "" || test.options != "" {
+				return
+			}
+
+			// Without options, the runner gives the same result for the
+			// plain host.
+			plain := runnertest.NewHost(test.modules)
+			conv := &converter{exec: newTestExecution("{}")}
+			args, kwargs, err := conv.convertArgs(jsExpression(test.args), jsExpression(test.kwargs))
+			if err != nil {
+				t.Fatal(err)
+			}
+			value, err := runner.Execute(runner.Run{Host: plain, Filename: "main.star", Function: test.function, Args: args, Kwargs: kwargs})
+			if err != nil {
+				t.Fatal(err)
+			}
+			jsValue, err := conv.convertToJSValue(value, "result")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := jsonOf(jsValue); got != test.want {
+				t.Errorf("the runner got %s, want %s", got, test.want)
+			}
+			if !reflect.DeepEqual(plain.Output(), host.Output()) {
+				t.Errorf("the runner printed %v, want %v", plain.Output(), host.Output())
+			}
+		})
+	}
+}
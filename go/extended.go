@@ -0,0 +1,197 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+	"syscall/js"
+
+	"go.starlark.net/starlark"
+)
+
+// With the extendedTypes option, the values that have no JSON form cross
+// the bridge as the JS values closest to them, rather than as null, so that
+// they come back as they went: a tuple as a frozen array, a set as a Set,
+// bytes as a Uint8Array, an int beyond Number.MAX_SAFE_INTEGER as a BigInt,
+// and a dict with keys other than strings as a Map.
+
+// extendedKindSource names the kind of a JS object that the extendedTypes
+// option converts other than as an array or a plain object, if it is one.
+const extendedKindSource = `
+if (value instanceof Map) return "map";
+if (value instanceof Set) return "set";
+if (value instanceof Uint8Array) return "bytes";
+if (Array.isArray(value) && Object.isFrozen(value)) return "tuple";
+return "";
+`
+
+var (
+	extendedKindOnce sync.Once
+	extendedKindFn   js.Value
+)
+
+// extendedKind returns the kind of a JS object, as extendedKindSource names
+// it.
+func extendedKind(value js.Value) string {
+	extendedKindOnce.Do(func() {
+		extendedKindFn = js.Global().Get("Function").New("value", extendedKindSource)
+	})
+	return extendedKindFn.Invoke(value).String()
+}
+
+// jsTypeOf returns the type of a JS value, and whether it is a BigInt, for
+// which js.Value.Type has no type and panics.
+func jsTypeOf(value js.Value) (t js.Type, bigint bool) {
+	defer func() {
+		if recover() != nil {
+			bigint = true
+		}
+	}()
+	return value.Type(), false
+}
+
+// bigIntToStarlark converts a BigInt to an int. It is converted by way of
+// String, as the methods of js.Value that call into JS panic on a BigInt.
+func bigIntToStarlark(value js.Value, path string) (starlark.Value, error) {
+	n, ok := new(big.Int).SetString(jsStringConstructor.Invoke(value).String(), 10)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an integer", path)
+	}
+	return starlark.MakeBigInt(n), nil
+}
+
+// extendedToStarlarkValue converts the JS objects that are only converted
+// with the extendedTypes option: a Map to a dict, a Set to a set, a
+// Uint8Array to bytes and a frozen array to a tuple. ok is false for any
+// other value.
+func (c *converter) extendedToStarlarkValue(value js.Value, path string) (result starlark.Value, ok bool, err error) {
+	switch extendedKind(value) {
+	case "map":
+		entries := jsArray.Call("from", value.Call("entries"))
+		dict := starlark.NewDict(entries.Length())
+		for i := 0; i < entries.Length(); i++ {
+			key, err := c.convertToStarlarkValue(entries.Index(i).Index(0), fmt.Sprintf("%s.keys()[%d]", path, i))
+			if err != nil {
+				return nil, true, err
+			}
+			itemPath := fmt.Sprintf("%s[%s]", path, key)
+			item, err := c.convertToStarlarkValue(entries.Index(i).Index(1), itemPath)
+			if err != nil {
+				return nil, true, err
+			}
+			if err := dict.SetKey(key, item); err != nil {
+				return nil, true, fmt.Errorf("%s: %v", itemPath, err)
+			}
+		}
+		return dict, true, nil
+	case "set":
+		elements := jsArray.Call("from", value)
+		set := starlark.NewSet(elements.Length())
+		for i := 0; i < elements.Length(); i++ {
+			elemPath := fmt.Sprintf("%s[%d]", path, i)
+			elem, err := c.convertToStarlarkValue(elements.Index(i), elemPath)
+			if err != nil {
+				return nil, true, err
+			}
+			if err := set.Insert(elem); err != nil {
+				return nil, true, fmt.Errorf("%s: %v", elemPath, err)
+			}
+		}
+		return set, true, nil
+	case "bytes":
+		b := make([]byte, value.Length())
+		js.CopyBytesToGo(b, value)
+		return starlark.Bytes(b), true, nil
+	case "tuple":
+		tuple := make(starlark.Tuple, value.Length())
+		for i := range tuple {
+			if tuple[i], err = c.convertToStarlarkValue(value.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return nil, true, err
+			}
+		}
+		return tuple, true, nil
+	}
+	return nil, false, nil
+}
+
+// extendedToJSValue converts the Starlark values that are only converted
+// with the extendedTypes option, as the JS values extendedToStarlarkValue
+// converts back. ok is false for any other value, such as a dict whose keys
+// are all strings, which converts to a plain object as usual.
+func (c *converter) extendedToJSValue(value starlark.Value, path string) (result js.Value, ok bool, err error) {
+	switch v := value.(type) {
+	case starlark.Int:
+		if n, exact := v.Int64(); exact && n <= maxSafeInteger && n >= -maxSafeInteger {
+			return js.Null(), false, nil
+		}
+		return jsBigInt.Invoke(v.String()), true, nil
+	case starlark.Bytes:
+		array := jsUint8Array.New(len(v))
+		js.CopyBytesToJS(array, []byte(v))
+		return array, true, c.countResult(len(v), path)
+	case starlark.Tuple:
+		array := jsArray.New(len(v))
+		for i, elem := range v {
+			item, err := c.convertToJSValue(elem, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return js.Null(), true, err
+			}
+			array.SetIndex(i, item)
+		}
+		return jsObject.Call("freeze", array), true, nil
+	case *starlark.Set:
+		set := jsSet.New()
+		iter := v.Iterate()
+		defer iter.Done()
+		var elem starlark.Value
+		for i := 0; iter.Next(&elem); i++ {
+			item, err := c.convertToJSValue(elem, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return js.Null(), true, err
+			}
+			set.Call("add", item)
+		}
+		return set, true, nil
+	case *starlark.Dict:
+		for _, key := range v.Keys() {
+			if _, ok := key.(starlark.String); !ok {
+				return c.dictToJSMap(v, path)
+			}
+		}
+	}
+	return js.Null(), false, nil
+}
+
+// dictToJSMap converts a dict whose keys are not all strings to a Map.
+func (c *converter) dictToJSMap(dict *starlark.Dict, path string) (js.Value, bool, error) {
+	m := jsMap.New()
+	c.memoize(dict, m)
+	for i, item := range dict.Items() {
+		key, err := c.convertToJSValue(item[0], fmt.Sprintf("%s.keys()[%d]", path, i))
+		if err != nil {
+			return js.Null(), true, err
+		}
+		value, err := c.convertToJSValue(item[1], fmt.Sprintf("%s[%s]", path, item[0]))
+		if err != nil {
+			return js.Null(), true, err
+		}
+		m.Call("set", key, value)
+	}
+	return m, true, nil
+}
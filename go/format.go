@@ -0,0 +1,558 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall/js"
+	"unicode/utf8"
+
+	"go.starlark.net/syntax"
+)
+
+const (
+	// formatWidth is the column past which a bracketed list of arguments,
+	// elements or parameters is wrapped, one to a line.
+	formatWidth = 80
+	// formatIndent is the indentation of each nested block or wrapped line.
+	formatIndent = "    "
+)
+
+// formatter prints a syntax tree in the canonical layout.
+type formatter struct {
+	out    strings.Builder
+	col    int
+	indent int
+	// printed holds the comments already written, by position, as a suffix
+	// comment may be attached to a node printed somewhere else.
+	printed map[tokenPos]bool
+}
+
+// write appends text to the output, keeping track of the column.
+func (f *formatter) write(text string) {
+	f.out.WriteString(text)
+	if i := strings.LastIndexByte(text, '\n'); i >= 0 {
+		f.col = utf8.RuneCountInString(text[i+1:])
+	} else {
+		f.col += utf8.RuneCountInString(text)
+	}
+}
+
+// newline ends the line, and indents the next one.
+func (f *formatter) newline() {
+	f.write("\n")
+	f.write(strings.Repeat(formatIndent, f.indent))
+}
+
+// comment reports whether a comment is still to be written, marking it
+// written.
+func (f *formatter) comment(c syntax.Comment) bool {
+	pos := tokenPos{c.Start.Line, c.Start.Col}
+	if f.printed[pos] {
+		return false
+	}
+	f.printed[pos] = true
+	return true
+}
+
+// suffix writes the suffix comments of a node at the end of the line.
+func (f *formatter) suffix(n syntax.Node) {
+	f.suffixBefore(n, syntax.Position{})
+}
+
+// suffixBefore writes the suffix comments of a node that come before a
+// position, if it is valid.
+func (f *formatter) suffixBefore(n syntax.Node, limit syntax.Position) {
+	if comments := n.Comments(); comments != nil {
+		for _, c := range comments.Suffix {
+			if limit.IsValid() && !positionBefore(c.Start, limit) {
+				continue
+			}
+			if f.comment(c) {
+				f.write("  " + c.Text)
+			}
+		}
+	}
+}
+
+// positionBefore reports whether p comes before q in the source.
+func positionBefore(p, q syntax.Position) bool {
+	return p.Line < q.Line || p.Line == q.Line && p.Col < q.Col
+}
+
+// before writes the whole-line comments before a node, each on a line of
+// its own at the current indentation, keeping any blank line between them
+// and the node.
+func (f *formatter) before(n syntax.Node) {
+	comments := n.Comments()
+	if comments == nil {
+		return
+	}
+	start, _ := n.Span()
+	for i, c := range comments.Before {
+		if !f.comment(c) {
+			continue
+		}
+		f.write(c.Text)
+		next := start.Line
+		if i+1 < len(comments.Before) {
+			next = comments.Before[i+1].Start.Line
+		}
+		if next-c.Start.Line > 1 {
+			f.write("\n")
+		}
+		f.newline()
+	}
+}
+
+// firstLine returns the line a statement starts on, counting the comments
+// before it.
+func firstLine(n syntax.Node) int32 {
+	start, _ := n.Span()
+	if comments := n.Comments(); comments != nil && len(comments.Before) > 0 {
+		return comments.Before[0].Start.Line
+	}
+	return start.Line
+}
+
+// stmts writes a block of statements, each on its own line, keeping at most
+// one blank line where the source had any between two of them.
+func (f *formatter) stmts(stmts []syntax.Stmt) {
+	for i, stmt := range stmts {
+		if i > 0 {
+			_, end := stmts[i-1].Span()
+			if firstLine(stmt)-end.Line > 1 {
+				f.write("\n")
+			}
+			f.newline()
+		}
+		f.before(stmt)
+		f.stmt(stmt)
+	}
+}
+
+// block writes the body of a compound statement, after its header.
+func (f *formatter) block(header syntax.Node, body []syntax.Stmt) {
+	f.write(":")
+	f.suffix(header)
+	f.indent++
+	f.newline()
+	f.stmts(body)
+	f.indent--
+}
+
+func (f *formatter) stmt(stmt syntax.Stmt) {
+	switch stmt := stmt.(type) {
+	case *syntax.ExprStmt:
+		f.expr(stmt.X)
+	case *syntax.AssignStmt:
+		f.expr(stmt.LHS)
+		f.write(" " + stmt.Op.String() + " ")
+		f.expr(stmt.RHS)
+	case *syntax.BranchStmt:
+		f.write(stmt.Token.String())
+	case *syntax.ReturnStmt:
+		f.write("return")
+		if stmt.Result != nil {
+			f.write(" ")
+			f.expr(stmt.Result)
+		}
+	case *syntax.LoadStmt:
+		f.load(stmt)
+	case *syntax.DefStmt:
+		f.write("def " + stmt.Name.Name)
+		f.sequence("(", stmt.Params, ")", stmt.Lparen, stmt.Rparen, true)
+		// A comment on the header line is attached to its last node.
+		var header syntax.Node = stmt.Name
+		if len(stmt.Params) > 0 {
+			header = stmt.Params[len(stmt.Params)-1]
+		}
+		f.block(header, stmt.Body)
+	case *syntax.ForStmt:
+		f.write("for " + flatExpr(stmt.Vars) + " in ")
+		f.expr(stmt.X)
+		f.block(stmt.X, stmt.Body)
+	case *syntax.WhileStmt:
+		f.write("while ")
+		f.expr(stmt.Cond)
+		f.block(stmt.Cond, stmt.Body)
+	case *syntax.IfStmt:
+		f.write("if ")
+		f.ifStmt(stmt)
+	}
+	f.suffix(stmt)
+}
+
+// ifStmt writes an if statement after its keyword, with each elif clause
+// it was written with.
+func (f *formatter) ifStmt(stmt *syntax.IfStmt) {
+	f.expr(stmt.Cond)
+	f.block(stmt.Cond, stmt.True)
+	if len(stmt.False) == 0 {
+		return
+	}
+	f.newline()
+	if elif, ok := stmt.False[0].(*syntax.IfStmt); ok && len(stmt.False) == 1 && elif.If == stmt.ElsePos {
+		f.before(elif)
+		f.write("elif ")
+		f.ifStmt(elif)
+		f.suffix(elif)
+		return
+	}
+	f.write("else")
+	f.block(stmt, stmt.False)
+}
+
+// load writes a load statement, whose names are not expressions.
+func (f *formatter) load(stmt *syntax.LoadStmt) {
+	items := []string{stmt.Module.Raw}
+	for i, to := range stmt.To {
+		from := strconv.Quote(stmt.From[i].Name)
+		if to.Name == stmt.From[i].Name {
+			items = append(items, from)
+		} else {
+			items = append(items, to.Name+" = "+from)
+		}
+	}
+	flat := "load(" + strings.Join(items, ", ") + ")"
+	if stmt.Load.Line == stmt.Rparen.Line && f.col+utf8.RuneCountInString(flat) <= formatWidth {
+		f.write(flat)
+		return
+	}
+	f.write("load(")
+	f.indent++
+	for _, item := range items {
+		f.newline()
+		f.write(item + ",")
+	}
+	f.indent--
+	f.newline()
+	f.write(")")
+}
+
+// sequence writes a bracketed list of expressions, on one line if it fits
+// and was on one line in the source, otherwise one to a line with a
+// trailing comma. In the arguments of a call or the parameters of a
+// function, name=value has no spaces around the equals sign.
+func (f *formatter) sequence(open string, list []syntax.Expr, close string, lbrack, rbrack syntax.Position, args bool) {
+	item := flatExpr
+	if args {
+		item = flatArg
+	}
+	multiline := len(list) > 0 && lbrack.IsValid() && rbrack.IsValid() && lbrack.Line != rbrack.Line
+	var flat []string
+	for _, e := range list {
+		// A comment after the closing bracket, as on the header line of a
+		// function, is attached to the last item but written after it all.
+		if comments := e.Comments(); comments != nil {
+			for _, c := range comments.Suffix {
+				multiline = multiline || !rbrack.IsValid() || positionBefore(c.Start, rbrack)
+			}
+			multiline = multiline || len(comments.Before) > 0
+		}
+		flat = append(flat, item(e))
+	}
+	text := open + strings.Join(flat, ", ")
+	if len(list) == 1 && open == "(" && !args {
+		// A tuple of one element.
+		text += ","
+	}
+	text += close
+	if !multiline && f.col+utf8.RuneCountInString(text) <= formatWidth {
+		f.write(text)
+		return
+	}
+
+	f.write(open)
+	f.indent++
+	for _, e := range list {
+		f.newline()
+		f.before(e)
+		if args {
+			f.arg(e)
+		} else {
+			f.expr(e)
+		}
+		f.write(",")
+		f.suffixBefore(e, rbrack)
+	}
+	f.indent--
+	f.newline()
+	f.write(close)
+}
+
+// arg writes an argument of a call or a parameter of a function.
+func (f *formatter) arg(e syntax.Expr) {
+	if binary, ok := e.(*syntax.BinaryExpr); ok && binary.Op == syntax.EQ {
+		f.write(flatExpr(binary.X) + "=")
+		f.expr(binary.Y)
+		return
+	}
+	f.expr(e)
+}
+
+// expr writes an expression, wrapping the bracketed lists within it that
+// do not fit.
+func (f *formatter) expr(e syntax.Expr) {
+	switch e := e.(type) {
+	case *syntax.CallExpr:
+		f.expr(e.Fn)
+		f.sequence("(", e.Args, ")", e.Lparen, e.Rparen, true)
+	case *syntax.ListExpr:
+		f.sequence("[", e.List, "]", e.Lbrack, e.Rbrack, false)
+	case *syntax.DictExpr:
+		f.sequence("{", e.List, "}", e.Lbrace, e.Rbrace, false)
+	case *syntax.TupleExpr:
+		if e.Lparen.IsValid() {
+			f.sequence("(", e.List, ")", e.Lparen, e.Rparen, false)
+		} else {
+			f.write(flatExpr(e))
+		}
+	case *syntax.DictEntry:
+		f.expr(e.Key)
+		f.write(": ")
+		f.expr(e.Value)
+	case *syntax.ParenExpr:
+		f.write("(")
+		f.expr(e.X)
+		f.write(")")
+	case *syntax.BinaryExpr:
+		f.expr(e.X)
+		f.write(" " + e.Op.String() + " ")
+		f.expr(e.Y)
+	case *syntax.DotExpr:
+		f.expr(e.X)
+		f.write("." + e.Name.Name)
+	case *syntax.IndexExpr:
+		f.expr(e.X)
+		f.write("[")
+		f.expr(e.Y)
+		f.write("]")
+	default:
+		f.write(flatExpr(e))
+	}
+}
+
+// flatArg returns an argument of a call or a parameter of a function, on
+// one line.
+func flatArg(e syntax.Expr) string {
+	if binary, ok := e.(*syntax.BinaryExpr); ok && binary.Op == syntax.EQ {
+		return flatExpr(binary.X) + "=" + flatExpr(binary.Y)
+	}
+	return flatExpr(e)
+}
+
+// flatList returns a list of expressions, separated by commas.
+func flatList(list []syntax.Expr, item func(syntax.Expr) string) string {
+	texts := make([]string, len(list))
+	for i, e := range list {
+		texts[i] = item(e)
+	}
+	return strings.Join(texts, ", ")
+}
+
+// flatExpr returns an expression on one line, apart from any multiline
+// string within it.
+func flatExpr(e syntax.Expr) string {
+	switch e := e.(type) {
+	case nil:
+		return ""
+	case *syntax.Ident:
+		return e.Name
+	case *syntax.Literal:
+		return e.Raw
+	case *syntax.ParenExpr:
+		return "(" + flatExpr(e.X) + ")"
+	case *syntax.TupleExpr:
+		text := flatList(e.List, flatExpr)
+		if len(e.List) == 1 {
+			text += ","
+		}
+		if e.Lparen.IsValid() {
+			text = "(" + text + ")"
+		}
+		return text
+	case *syntax.ListExpr:
+		return "[" + flatList(e.List, flatExpr) + "]"
+	case *syntax.DictExpr:
+		return "{" + flatList(e.List, flatExpr) + "}"
+	case *syntax.DictEntry:
+		return flatExpr(e.Key) + ": " + flatExpr(e.Value)
+	case *syntax.CallExpr:
+		return flatExpr(e.Fn) + "(" + flatList(e.Args, flatArg) + ")"
+	case *syntax.DotExpr:
+		return flatExpr(e.X) + "." + e.Name.Name
+	case *syntax.IndexExpr:
+		return flatExpr(e.X) + "[" + flatExpr(e.Y) + "]"
+	case *syntax.SliceExpr:
+		text := flatExpr(e.X) + "[" + flatExpr(e.Lo) + ":" + flatExpr(e.Hi)
+		if e.Step != nil {
+			text += ":" + flatExpr(e.Step)
+		}
+		return text + "]"
+	case *syntax.UnaryExpr:
+		if e.Op == syntax.NOT {
+			return "not " + flatExpr(e.X)
+		}
+		return e.Op.String() + flatExpr(e.X)
+	case *syntax.BinaryExpr:
+		return flatExpr(e.X) + " " + e.Op.String() + " " + flatExpr(e.Y)
+	case *syntax.CondExpr:
+		return flatExpr(e.True) + " if " + flatExpr(e.Cond) + " else " + flatExpr(e.False)
+	case *syntax.LambdaExpr:
+		if len(e.Params) == 0 {
+			return "lambda: " + flatExpr(e.Body)
+		}
+		return "lambda " + flatList(e.Params, flatArg) + ": " + flatExpr(e.Body)
+	case *syntax.Comprehension:
+		open, close := "[", "]"
+		if e.Curly {
+			open, close = "{", "}"
+		}
+		text := open + flatExpr(e.Body)
+		for _, clause := range e.Clauses {
+			switch clause := clause.(type) {
+			case *syntax.ForClause:
+				text += " for " + flatExpr(clause.Vars) + " in " + flatExpr(clause.X)
+			case *syntax.IfClause:
+				text += " if " + flatExpr(clause.Cond)
+			}
+		}
+		return text + close
+	}
+	panic(fmt.Sprintf("unexpected expression %T", e))
+}
+
+// syntaxOutline describes the parts of a syntax tree that formatting must
+// keep: its nodes in order, with their names, operators and literals, and
+// all of its comments.
+func syntaxOutline(f *syntax.File) (nodes []string, comments []string) {
+	walkSyntax(f, func(n syntax.Node) bool {
+		node := fmt.Sprintf("%T", n)
+		switch n := n.(type) {
+		case *syntax.Ident:
+			node += " " + n.Name
+		case *syntax.Literal:
+			node += " " + n.Raw
+		case *syntax.BinaryExpr:
+			node += " " + n.Op.String()
+		case *syntax.UnaryExpr:
+			node += " " + n.Op.String()
+		case *syntax.AssignStmt:
+			node += " " + n.Op.String()
+		case *syntax.BranchStmt:
+			node += " " + n.Token.String()
+		case *syntax.Comprehension:
+			node += " " + strconv.FormatBool(n.Curly)
+		}
+		nodes = append(nodes, node)
+		if c := n.Comments(); c != nil {
+			for _, list := range [][]syntax.Comment{c.Before, c.Suffix, c.After} {
+				for _, comment := range list {
+					comments = append(comments, comment.Text)
+				}
+			}
+		}
+		return true
+	})
+	sort.Strings(comments)
+	return nodes, comments
+}
+
+// formatSource returns the source in the canonical layout: four spaces of
+// indentation, single spaces around operators and after commas, at most
+// one blank line in a row, and bracketed lists that do not fit in
+// formatWidth columns, or that were already split over lines, wrapped one
+// item to a line with a trailing comma.
+//
+// Comments are kept, but not every place a comment can be written has a
+// place in the layout, as within a single operand. Rather than drop one,
+// formatSource fails, as it does for source that does not parse.
+func formatSource(filename string, source string) (string, error) {
+	fileOptions := syntax.FileOptions{}
+	file, err := fileOptions.Parse(filename, source, syntax.RetainComments)
+	if err != nil {
+		return "", fmt.Errorf("Error: unable to format source that does not parse. %s", err)
+	}
+
+	f := &formatter{printed: make(map[tokenPos]bool)}
+	f.stmts(file.Stmts)
+	if comments := file.Comments(); comments != nil && len(comments.After) > 0 {
+		last := int32(0)
+		if len(file.Stmts) > 0 {
+			_, end := file.Stmts[len(file.Stmts)-1].Span()
+			last = end.Line
+			f.newline()
+		}
+		for i, c := range comments.After {
+			if last > 0 && c.Start.Line-last > 1 {
+				f.write("\n")
+			}
+			if i > 0 {
+				f.newline()
+			}
+			f.write(c.Text)
+			last = c.Start.Line
+		}
+	}
+	formatted := f.out.String()
+	if formatted != "" {
+		formatted += "\n"
+	}
+
+	reparsed, err := fileOptions.Parse(filename, formatted, syntax.RetainComments)
+	if err != nil {
+		return "", fmt.Errorf("Error: unable to format the source, as the result does not parse. %s", err)
+	}
+	nodes, comments := syntaxOutline(file)
+	formattedNodes, formattedComments := syntaxOutline(reparsed)
+	if strings.Join(nodes, "\n") != strings.Join(formattedNodes, "\n") {
+		return "", fmt.Errorf("Error: unable to format the source without changing its meaning.")
+	}
+	if strings.Join(comments, "\n") != strings.Join(formattedComments, "\n") {
+		return "", fmt.Errorf("Error: unable to format the source without moving a comment out of place.")
+	}
+	return formatted, nil
+}
+
+// jsFormat implements starlark.format(source, filename?), which returns the
+// source in the canonical layout.
+func jsFormat() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) (result interface{}) {
+		defer func() {
+			if r := recover(); r != nil {
+				result = errorToJSValue(newInternalError(r, panicStack()))
+			}
+		}()
+
+		if len(args) < 1 || args[0].Type() != js.TypeString {
+			return jsErrorConstructor.New("Error: format requires the source code as a string.")
+		}
+		filename := "<format>"
+		if len(args) > 1 && args[1].Type() == js.TypeString {
+			filename = args[1].String()
+		}
+		formatted, err := formatSource(filename, args[0].String())
+		if err != nil {
+			return jsErrorConstructor.New(err.Error())
+		}
+		return formatted
+	})
+}
@@ -0,0 +1,168 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"syscall/js"
+	"time"
+
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// formulaFilename is the filename positions in a formula are reported in.
+const formulaFilename = "<formula>"
+
+// freeNames returns the names a formula uses that are neither Starlark's
+// universal builtins nor among the execution's predeclared names, such as
+// the cells A1 and B2 of "A1 * 2 + B2", in the order they first appear.
+func (e *execution) freeNames(fileOptions *syntax.FileOptions, formula string) ([]string, error) {
+	expr, err := fileOptions.ParseExpr(formulaFilename, formula, 0)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	seen := make(map[string]bool)
+	isPredeclared := func(name string) bool {
+		// Asked before isUniversal is, so len stays the builtin.
+		if starlark.Universe.Has(name) {
+			return false
+		}
+		if _, ok := e.env[name]; !ok && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+		return true
+	}
+	if _, err := resolve.ExprOptions(fileOptions, expr, isPredeclared, starlark.Universe.Has); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// resolveReferences asks the host for the values of the names, calling its
+// resolve callback once with (names, executionId), which returns, or
+// resolves to, an object of their values. A name it leaves out stays
+// undefined, and fails the formula that uses it.
+func (e *execution) resolveReferences(names []string) (starlark.StringDict, error) {
+	resolved := make(starlark.StringDict, len(names))
+	fn := hostCallback(e.options.callbacks, "resolve")
+	if len(names) == 0 || fn.Type() != js.TypeFunction {
+		return resolved, nil
+	}
+	jsNames := jsArray.New(len(names))
+	for i, name := range names {
+		jsNames.SetIndex(i, name)
+	}
+	var values js.Value
+	err := e.audited("resolve", func() string { return strings.Join(names, ", ") }, func() error {
+		var err error
+		values, err = invokeHost(fn, jsNames, e.id)
+		if err != nil || values.Type() != js.TypeObject || values.Get("then").Type() != js.TypeFunction {
+			return err
+		}
+		values, err = jsAwait(values)
+		return err
+	})
+	if err != nil {
+		return nil, &hostError{callback: "resolve", message: fmt.Sprintf("Error: the resolve callback failed. %s", err)}
+	}
+	if values.Type() != js.TypeObject {
+		return resolved, nil
+	}
+	conv := &converter{exec: e}
+	for _, name := range names {
+		value := values.Get(name)
+		if value.IsUndefined() {
+			continue
+		}
+		if resolved[name], err = conv.convertToStarlarkValue(value, name); err != nil {
+			return nil, err
+		}
+	}
+	return resolved, nil
+}
+
+// evalFormula evaluates a formula, an expression whose free names are
+// resolved by the host, all in one call, before it is evaluated.
+func (e *execution) evalFormula(formula string) (starlark.Value, error) {
+	fileOptions := syntax.FileOptions{}
+	parseStart := time.Now()
+	names, err := e.freeNames(&fileOptions, formula)
+	e.addPhase(phaseCompile, formulaFilename, parseStart)
+	if err != nil {
+		return nil, e.wrapEvalError(codeEvalFailed, withAllResolveErrors(err))
+	}
+	resolved, err := e.resolveReferences(names)
+	if err != nil {
+		return nil, err
+	}
+	env := make(starlark.StringDict, len(e.env)+len(resolved))
+	for name, value := range e.env {
+		env[name] = value
+	}
+	for name, value := range resolved {
+		env[name] = value
+	}
+
+	thread := e.newThread(e.id, nil)
+	execStart := time.Now()
+	defer e.addPhase(phaseExecute, "", execStart)
+	value, err := starlark.EvalOptions(&fileOptions, thread, formulaFilename, formula, env)
+	if err != nil {
+		e.recordError(thread, err)
+		return nil, e.wrapEvalError(codeExecFailed, withAllResolveErrors(err))
+	}
+	return value, nil
+}
+
+// jsEvaluate implements starlark.evaluate(executionId, formula, options),
+// which evaluates a formula, such as "SUM(A1, A2) * Rate", asking the
+// resolve callback of the options, or of globalThis.starlark, for the
+// values of the names it uses that Starlark does not know, instead of the
+// host having to pass every value it might refer to. maxExecutionTime may
+// be given as an option.
+func jsEvaluate() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 2 || args[1].Type() != js.TypeString {
+			return rejected(fmt.Errorf("Error: requires executionId and a formula as arguments."))
+		}
+		formula := args[1].String()
+		options := js.Undefined()
+		maxExecutionTime := 0
+		if len(args) > 2 && args[2].Type() == js.TypeObject {
+			options = args[2]
+			if value := options.Get("maxExecutionTime"); value.Type() == js.TypeNumber {
+				maxExecutionTime = value.Int()
+			}
+		}
+		return runAsync(args[0].String(), options, func(exec *execution) (js.Value, error) {
+			if exec.options.envelope {
+				runtime.ReadMemStats(&exec.memory.start)
+			}
+			return runToJS(exec, &converter{exec: exec}, func() (starlark.Value, error) {
+				return runWithTimeout(exec, maxExecutionTime, func() (starlark.Value, error) {
+					return exec.evalFormula(formula)
+				})
+			})
+		})
+	})
+}
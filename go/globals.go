@@ -0,0 +1,39 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "syscall/js"
+
+// The JS globals the runner uses, looked up once at startup rather than on
+// every conversion and call: each lookup crosses into JS and allocates a
+// js.Value with a finalizer. The starlark object is not among them, as the
+// host may replace its callbacks, or the object itself, at any time.
+var (
+	jsArray             = js.Global().Get("Array")
+	jsBigInt            = js.Global().Get("BigInt")
+	jsErrorConstructor  = js.Global().Get("Error")
+	jsMap               = js.Global().Get("Map")
+	jsObject            = js.Global().Get("Object")
+	jsPromise           = js.Global().Get("Promise")
+	jsSet               = js.Global().Get("Set")
+	jsStringConstructor = js.Global().Get("String")
+	jsUint8Array        = js.Global().Get("Uint8Array")
+
+	jsObjectKeys      = jsObject.Get("keys")
+	jsGetPrototypeOf  = jsObject.Get("getPrototypeOf")
+	jsObjectPrototype = jsObject.Get("prototype")
+)
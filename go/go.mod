@@ -2,7 +2,6 @@ module dcollien.com/starlark-wasm
 
 go 1.23.4
 
-require (
-	go.starlark.net v0.0.0-20241125201518-c05ff208a98f // indirect
-	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
-)
+require go.starlark.net v0.0.0-20241125201518-c05ff208a98f
+
+require golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
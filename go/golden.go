@@ -0,0 +1,383 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"syscall/js"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// goldenContext is the number of unchanged lines shown around each change of
+// a golden diff, as diff -u does.
+const goldenContext = 3
+
+// The parts of a call's outcome that a golden test compares, in the order
+// they are reported.
+var goldenParts = []string{"stdout", "stderr", "value"}
+
+// goldenSpec is what starlark.golden is asked to check.
+type goldenSpec struct {
+	filename         string
+	funcName         string
+	args             js.Value
+	kwargs           js.Value
+	maxExecutionTime int
+	// golden holds the expected text of each part the host gave.
+	golden map[string]string
+}
+
+func parseGoldenSpec(value js.Value) (goldenSpec, error) {
+	spec := goldenSpec{
+		funcName: "main",
+		args:     value.Get("args"),
+		kwargs:   value.Get("kwargs"),
+		golden:   make(map[string]string),
+	}
+	filename := value.Get("filename")
+	if filename.Type() != js.TypeString {
+		return spec, fmt.Errorf("Error: the golden spec requires a filename.")
+	}
+	spec.filename = filename.String()
+	if funcName := value.Get("function"); funcName.Type() == js.TypeString {
+		spec.funcName = funcName.String()
+	}
+	if maxExecutionTime := value.Get("maxExecutionTime"); maxExecutionTime.Type() == js.TypeNumber {
+		spec.maxExecutionTime = maxExecutionTime.Int()
+	}
+	golden := value.Get("golden")
+	if golden.Type() != js.TypeObject {
+		return spec, fmt.Errorf("Error: the golden spec requires the golden data.")
+	}
+	for _, part := range goldenParts {
+		if text := golden.Get(part); text.Type() == js.TypeString {
+			spec.golden[part] = text.String()
+		} else if !text.IsUndefined() {
+			return spec, fmt.Errorf("Error: the golden %s must be a string.", part)
+		}
+	}
+	return spec, nil
+}
+
+// runGolden calls the spec's function with its output captured, and returns
+// the text of each part of the outcome: the lines printed to each stream,
+// and the return value as indented JSON, or its repr if it has no JSON
+// encoding, with its secrets redacted as the output's are.
+func runGolden(exec *execution, spec goldenSpec) (map[string]string, error) {
+	conv := &converter{exec: exec}
+	args, kwargs, err := conv.convertArgs(spec.args, spec.kwargs)
+	if err != nil {
+		return nil, err
+	}
+	value, err := exec.execute(spec.filename, spec.funcName, args, kwargs, time.Duration(spec.maxExecutionTime)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout, stderr strings.Builder
+	exec.mu.Lock()
+	for _, line := range exec.output {
+		if line.stream == "stderr" {
+			stderr.WriteString(line.message + "\n")
+		} else {
+			stdout.WriteString(line.message + "\n")
+		}
+	}
+	exec.mu.Unlock()
+	thread := exec.newThread(exec.id+" golden", nil)
+	return map[string]string{"stdout": stdout.String(), "stderr": stderr.String(), "value": goldenValue(thread, exec.redactor.value(value))}, nil
+}
+
+// goldenValue renders a return value for comparison, as JSON indented by
+// two spaces, or its repr if it has no JSON encoding.
+func goldenValue(thread *starlark.Thread, value starlark.Value) string {
+	encoded, err := encodeJSON(thread, value)
+	if err != nil {
+		return value.String() + "\n"
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, []byte(encoded), "", "  "); err != nil {
+		return value.String() + "\n"
+	}
+	buf.WriteString("\n")
+	return buf.String()
+}
+
+// The kinds of line in a diff.
+const (
+	diffEqual  = "equal"
+	diffDelete = "delete"
+	diffInsert = "insert"
+)
+
+// diffLine is a line of a diff: one of the golden text's, with diffDelete,
+// one of the actual text's, with diffInsert, or one of both, with
+// diffEqual. golden and actual are the numbers of lines of each text before
+// it.
+type diffLine struct {
+	kind   string
+	text   string
+	golden int
+	actual int
+}
+
+// splitLines splits text into its lines, ignoring a final newline.
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// diffLines returns a shortest edit script from the lines a to the lines b,
+// found with Myers' algorithm, in O((N+M)D) time and O(D²) space for D
+// differences.
+func diffLines(a []string, b []string) []diffLine {
+	n, m := len(a), len(b)
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+	// trace holds the furthest x reached on each diagonal k in [-d, d]
+	// before step d.
+	var trace [][]int
+	for d := 0; d <= n+m; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		done := false
+		for k := -d; k <= d && !done; k += 2 {
+			var x int
+			if k == -d || k != d && v[offset+k-1] < v[offset+k+1] {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			done = x >= n && y >= m
+		}
+		if done {
+			break
+		}
+	}
+
+	// Walk back from the end, collecting the lines in reverse.
+	var lines []diffLine
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		prev := func(k int) int { return trace[d][k+d] }
+		k := x - y
+		prevK := k - 1
+		if d == 0 {
+			prevK = k
+		} else if k == -d || k != d && prev(k-1) < prev(k+1) {
+			prevK = k + 1
+		}
+		prevX := 0
+		if d > 0 {
+			prevX = prev(prevK)
+		}
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			lines = append(lines, diffLine{kind: diffEqual, text: a[x], golden: x, actual: y})
+		}
+		if d == 0 {
+			break
+		}
+		if prevK == k+1 {
+			lines = append(lines, diffLine{kind: diffInsert, text: b[prevY], golden: prevX, actual: prevY})
+		} else {
+			lines = append(lines, diffLine{kind: diffDelete, text: a[prevX], golden: prevX, actual: prevY})
+		}
+		x, y = prevX, prevY
+	}
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return lines
+}
+
+// diffHunk is a run of changed lines of a diff, with up to goldenContext
+// unchanged lines around them.
+type diffHunk struct {
+	lines []diffLine
+}
+
+// diffHunks groups the changes of a diff into hunks, merging those that
+// share context.
+func diffHunks(lines []diffLine) []diffHunk {
+	var hunks []diffHunk
+	for i := 0; i < len(lines); {
+		if lines[i].kind == diffEqual {
+			i++
+			continue
+		}
+		start := max(i-goldenContext, 0)
+		end := i
+		for end < len(lines) {
+			if lines[end].kind != diffEqual {
+				end++
+				continue
+			}
+			next := end
+			for next < len(lines) && lines[next].kind == diffEqual {
+				next++
+			}
+			if next == len(lines) || next-end > 2*goldenContext {
+				break
+			}
+			end = next
+		}
+		stop := min(end+goldenContext, len(lines))
+		hunks = append(hunks, diffHunk{lines: lines[start:stop]})
+		i = stop
+	}
+	return hunks
+}
+
+// ranges returns the first line and number of lines of the hunk in each
+// text. As in diff -u, the first line of an empty range is the one before
+// it.
+func (h diffHunk) ranges() (goldenStart int, goldenLines int, actualStart int, actualLines int) {
+	for _, line := range h.lines {
+		if line.kind != diffInsert {
+			goldenLines++
+		}
+		if line.kind != diffDelete {
+			actualLines++
+		}
+	}
+	goldenStart, actualStart = h.lines[0].golden, h.lines[0].actual
+	if goldenLines > 0 {
+		goldenStart++
+	}
+	if actualLines > 0 {
+		actualStart++
+	}
+	return goldenStart, goldenLines, actualStart, actualLines
+}
+
+// unifiedRange formats a range of a hunk header, leaving out a length of 1.
+func unifiedRange(start int, lines int) string {
+	if lines == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, lines)
+}
+
+// unifiedDiff renders the hunks of a part's diff in the unified format.
+func unifiedDiff(part string, hunks []diffHunk) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- golden/%s\n+++ actual/%s\n", part, part)
+	prefixes := map[string]string{diffEqual: " ", diffDelete: "-", diffInsert: "+"}
+	for _, hunk := range hunks {
+		goldenStart, goldenLines, actualStart, actualLines := hunk.ranges()
+		fmt.Fprintf(&b, "@@ -%s +%s @@\n", unifiedRange(goldenStart, goldenLines), unifiedRange(actualStart, actualLines))
+		for _, line := range hunk.lines {
+			b.WriteString(prefixes[line.kind] + line.text + "\n")
+		}
+	}
+	return b.String()
+}
+
+func (h diffHunk) toJSValue() js.Value {
+	goldenStart, goldenLines, actualStart, actualLines := h.ranges()
+	lines := jsArray.New(len(h.lines))
+	for i, line := range h.lines {
+		jsLine := jsObject.New()
+		jsLine.Set("kind", line.kind)
+		jsLine.Set("text", line.text)
+		lines.SetIndex(i, jsLine)
+	}
+	hunk := jsObject.New()
+	hunk.Set("goldenStart", goldenStart)
+	hunk.Set("goldenLines", goldenLines)
+	hunk.Set("actualStart", actualStart)
+	hunk.Set("actualLines", actualLines)
+	hunk.Set("lines", lines)
+	return hunk
+}
+
+// goldenToJSValue returns the result of starlark.golden: whether every part
+// the golden data has matched, the actual text of each part, to update the
+// golden data from, and a diff of each part that did not match.
+func goldenToJSValue(spec goldenSpec, actual map[string]string) js.Value {
+	jsActual := jsObject.New()
+	diffs := jsArray.New()
+	for _, part := range goldenParts {
+		jsActual.Set(part, actual[part])
+		golden, ok := spec.golden[part]
+		if !ok {
+			continue
+		}
+		hunks := diffHunks(diffLines(splitLines(golden), splitLines(actual[part])))
+		if len(hunks) == 0 {
+			continue
+		}
+		jsHunks := jsArray.New(len(hunks))
+		for i, hunk := range hunks {
+			jsHunks.SetIndex(i, hunk.toJSValue())
+		}
+		diff := jsObject.New()
+		diff.Set("part", part)
+		diff.Set("unified", unifiedDiff(part, hunks))
+		diff.Set("hunks", jsHunks)
+		diffs.Call("push", diff)
+	}
+	result := jsObject.New()
+	result.Set("passed", diffs.Length() == 0)
+	result.Set("actual", jsActual)
+	result.Set("diffs", diffs)
+	return result
+}
+
+// jsGolden implements starlark.golden(executionId, spec, options), where
+// spec names the function to call and the outcome expected of it:
+// {filename, function, args, kwargs, maxExecutionTime, golden: {stdout,
+// stderr, value}}. The call's output is captured rather than printed, and
+// each part the golden data has is compared line by line with the call's,
+// ignoring a final newline, so that the diff is made inside the wasm module.
+func jsGolden() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 2 || args[1].Type() != js.TypeObject {
+			return rejected(fmt.Errorf("Error: requires executionId and a golden spec as arguments."))
+		}
+		options := jsObject.New()
+		if len(args) > 2 && args[2].Type() == js.TypeObject {
+			options = jsObject.Call("assign", options, args[2])
+		}
+		options.Set("captureOutput", true)
+		return runAsync(args[0].String(), options, func(exec *execution) (js.Value, error) {
+			spec, err := parseGoldenSpec(args[1])
+			if err != nil {
+				return js.Null(), err
+			}
+			actual, err := runGolden(exec, spec)
+			if err != nil {
+				return js.Null(), err
+			}
+			return goldenToJSValue(spec, actual), nil
+		})
+	})
+}
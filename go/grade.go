@@ -0,0 +1,381 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync/atomic"
+	"syscall/js"
+	"time"
+
+	"dcollien.com/starlark-wasm/internal/runner"
+	"go.starlark.net/starlark"
+)
+
+// gradeCase is a test case of starlark.grade: a call of one of the module's
+// functions, and what to check of what it returns.
+type gradeCase struct {
+	// source is the case as the host gave it, for a host checker.
+	source   js.Value
+	name     string
+	funcName string
+	args     js.Value
+	kwargs   js.Value
+	// expected is the value the call should return, or undefined.
+	expected js.Value
+	// check is the name of a function of the checker module, a host
+	// function, or undefined.
+	check    js.Value
+	maxSteps uint64
+	timeout  time.Duration
+}
+
+// gradeSpec is what starlark.grade is asked to run.
+type gradeSpec struct {
+	filename string
+	// checker is the module the cases' checks are named in, if any.
+	checker          string
+	cases            []gradeCase
+	maxExecutionTime int
+}
+
+func parseGradeSpec(value js.Value) (gradeSpec, error) {
+	var spec gradeSpec
+	filename := value.Get("filename")
+	if filename.Type() != js.TypeString {
+		return spec, fmt.Errorf("Error: the grading spec requires a filename.")
+	}
+	spec.filename = filename.String()
+	if checker := value.Get("checker"); checker.Type() == js.TypeString {
+		spec.checker = checker.String()
+	}
+	if maxExecutionTime := value.Get("maxExecutionTime"); maxExecutionTime.Type() == js.TypeNumber {
+		spec.maxExecutionTime = maxExecutionTime.Int()
+	}
+	cases := value.Get("cases")
+	if !jsArray.Call("isArray", cases).Bool() {
+		return spec, fmt.Errorf("Error: the grading spec requires an array of cases.")
+	}
+	// The spec's limits apply to each case that does not set its own.
+	defaults := gradeCase{funcName: "main"}
+	parseCaseLimits(value, &defaults)
+	for i := 0; i < cases.Length(); i++ {
+		jsCase := cases.Index(i)
+		if jsCase.Type() != js.TypeObject {
+			return spec, fmt.Errorf("Error: case %d of the grading spec is not an object.", i)
+		}
+		c := defaults
+		c.source = jsCase
+		c.name = fmt.Sprintf("case %d", i+1)
+		if name := jsCase.Get("name"); name.Type() == js.TypeString {
+			c.name = name.String()
+		}
+		if funcName := jsCase.Get("function"); funcName.Type() == js.TypeString {
+			c.funcName = funcName.String()
+		}
+		c.args = jsCase.Get("args")
+		c.kwargs = jsCase.Get("kwargs")
+		c.expected = jsCase.Get("expected")
+		c.check = jsCase.Get("check")
+		switch c.check.Type() {
+		case js.TypeUndefined, js.TypeFunction:
+		case js.TypeString:
+			if spec.checker == "" {
+				return spec, fmt.Errorf("Error: the check of case %q names a function, but the grading spec has no checker module.", c.name)
+			}
+		default:
+			return spec, fmt.Errorf("Error: the check of case %q must be the name of a function of the checker module, or a function.", c.name)
+		}
+		parseCaseLimits(jsCase, &c)
+		spec.cases = append(spec.cases, c)
+	}
+	return spec, nil
+}
+
+// parseCaseLimits reads the maxSteps and timeout, in milliseconds, of a
+// case, or of the spec, leaving those it does not give as they are. A case
+// lifts a limit of the spec with 0.
+func parseCaseLimits(value js.Value, c *gradeCase) {
+	if maxSteps := value.Get("maxSteps"); maxSteps.Type() == js.TypeNumber && maxSteps.Float() >= 0 {
+		c.maxSteps = uint64(maxSteps.Float())
+	}
+	if timeout := value.Get("timeout"); timeout.Type() == js.TypeNumber && timeout.Float() >= 0 {
+		c.timeout = time.Duration(timeout.Float() * float64(time.Millisecond))
+	}
+}
+
+const caseLimitKey = "starlark_wasm.caseLimit"
+
+// caseLimit holds the limits of the case a thread of starlark.grade runs,
+// and which of them it ran past.
+type caseLimit struct {
+	maxSteps  uint64
+	overSteps atomic.Bool
+	timedOut  atomic.Bool
+}
+
+// caseStepBudget is the step count at which a thread of starlark.grade
+// first runs over the maxSteps of its case, if it has any.
+func caseStepBudget(thread *starlark.Thread) uint64 {
+	if limit, ok := thread.Local(caseLimitKey).(*caseLimit); ok && limit.maxSteps > 0 {
+		return limit.maxSteps + 1
+	}
+	return math.MaxUint64
+}
+
+// exceedCaseSteps stops the case of a thread, which has run past its
+// maxSteps. The other cases still run.
+func exceedCaseSteps(thread *starlark.Thread) {
+	limit := thread.Local(caseLimitKey).(*caseLimit)
+	limit.overSteps.Store(true)
+	thread.Cancel(fmt.Sprintf("exceeded the budget of %d steps", limit.maxSteps))
+}
+
+// runGrade initializes the spec's module, and its checker module, once,
+// then runs each case in turn, in its own thread, and returns the outcome
+// of each. A case that fails, runs past its limits or is failed by its
+// check does not stop the others; a failure of the execution as a whole,
+// such as its timeout, does.
+func runGrade(exec *execution, spec gradeSpec) ([]js.Value, error) {
+	results := make([]js.Value, 0, len(spec.cases))
+	_, err := runWithTimeout(exec, spec.maxExecutionTime, func() (starlark.Value, error) {
+		load := exec.loader()
+		globals, err := load(nil, spec.filename)
+		if err != nil {
+			return nil, exec.wrapEvalError(codeEvalFailed, err)
+		}
+		var checkers starlark.StringDict
+		if spec.checker != "" {
+			if checkers, err = load(nil, spec.checker); err != nil {
+				return nil, exec.wrapEvalError(codeEvalFailed, err)
+			}
+		}
+		for i, c := range spec.cases {
+			result, err := exec.gradeCase(load, globals, checkers, c, i)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, result)
+		}
+		return starlark.None, nil
+	})
+	return results, err
+}
+
+// gradeCase runs a case, returning its outcome: {name, passed, value?,
+// repr?, message?, error?, output, steps, time}. It only fails if the host
+// gave the case what cannot be converted, or the execution as a whole
+// failed.
+func (e *execution) gradeCase(load func(*starlark.Thread, string) (starlark.StringDict, error), globals starlark.StringDict, checkers starlark.StringDict, c gradeCase, index int) (js.Value, error) {
+	result := jsObject.New()
+	result.Set("name", c.name)
+	conv := &converter{exec: e}
+	args, kwargs, err := conv.convertArgs(c.args, c.kwargs)
+	if err != nil {
+		return js.Null(), err
+	}
+	var expected starlark.Value
+	if !c.expected.IsUndefined() {
+		if expected, err = conv.convertToStarlarkValue(c.expected, c.name+" expected"); err != nil {
+			return js.Null(), err
+		}
+	}
+	var check starlark.Value
+	if c.check.Type() == js.TypeString {
+		var ok bool
+		if check, ok = checkers[c.check.String()]; !ok {
+			return js.Null(), e.messageErr(codeMissingFunction, "function", fmt.Sprintf("%q", c.check.String()))
+		}
+	}
+
+	thread := e.newThread(fmt.Sprintf("%s grade %d", e.id, index), load)
+	limit := &caseLimit{maxSteps: c.maxSteps}
+	thread.SetLocal(caseLimitKey, limit)
+	runner.RescheduleStepHooks(thread)
+	if c.timeout > 0 {
+		timer := time.AfterFunc(c.timeout, func() {
+			limit.timedOut.Store(true)
+			thread.Cancel("timeout")
+		})
+		defer timer.Stop()
+	}
+	e.mu.Lock()
+	outputStart := len(e.output)
+	e.mu.Unlock()
+
+	start := time.Now()
+	var value starlark.Value
+	fn, ok := globals[c.funcName]
+	if !ok {
+		err = e.messageErr(codeMissingFunction, "function", fmt.Sprintf("%q", c.funcName))
+	} else {
+		value, err = starlark.Call(thread, fn, args, kwargs)
+	}
+	elapsed := time.Since(start)
+	steps := thread.ExecutionSteps()
+
+	e.mu.Lock()
+	output := jsArray.New(len(e.output) - outputStart)
+	for i, line := range e.output[outputStart:] {
+		output.SetIndex(i, line.toJSValue())
+	}
+	e.mu.Unlock()
+	result.Set("output", output)
+	result.Set("steps", steps)
+	result.Set("time", milliseconds(elapsed))
+
+	if err != nil {
+		select {
+		case <-e.cancelled:
+			e.recordError(thread, err)
+			return js.Null(), e.wrapEvalError(codeExecFailed, err)
+		default:
+		}
+		var evalErr *starlark.EvalError
+		errors.As(err, &evalErr)
+		switch {
+		case limit.overSteps.Load():
+			err = &stepLimitError{message: e.message(codeStepLimit, "limit", strconv.FormatUint(c.maxSteps, 10)), locale: e.options.locale, limit: c.maxSteps, err: evalErr, steps: steps}
+		case limit.timedOut.Load():
+			err = &timeoutError{message: e.message(codeTimeout), locale: e.options.locale, err: evalErr, steps: steps, code: codeTimeout}
+		case evalErr != nil:
+			e.recordError(thread, err)
+			err = e.wrapEvalError(codeExecFailed, err)
+		}
+		result.Set("passed", false)
+		result.Set("error", e.tag(errorToJSValue(err)))
+		return result, nil
+	}
+
+	// The host is shown the value with its secrets redacted, while a
+	// Starlark check and the expected value are compared with it as it is.
+	shown := e.redactor.value(value)
+	result.Set("repr", shown.String())
+	jsValue, convErr := conv.convertToJSValue(shown, c.name)
+	if convErr == nil {
+		result.Set("value", jsValue)
+	}
+	var verdict js.Value
+	switch {
+	case check != nil:
+		// The check is given the case's arguments afresh, as the call may
+		// have changed them.
+		checkArgs, checkKwargs, err := conv.convertArgs(c.args, c.kwargs)
+		if err != nil {
+			return js.Null(), err
+		}
+		checkThread := e.newThread(fmt.Sprintf("%s grade %d check", e.id, index), load)
+		answer, err := starlark.Call(checkThread, check, append(starlark.Tuple{value}, checkArgs...), checkKwargs)
+		if err != nil {
+			e.recordError(checkThread, err)
+			result.Set("passed", false)
+			result.Set("error", e.tag(errorToJSValue(e.wrapEvalError(codeExecFailed, err))))
+			return result, nil
+		}
+		if s, ok := answer.(starlark.String); ok {
+			verdict = js.ValueOf(string(s))
+		} else {
+			verdict = js.ValueOf(bool(answer.Truth()))
+		}
+	case c.check.Type() == js.TypeFunction:
+		if convErr != nil {
+			result.Set("passed", false)
+			result.Set("error", e.tag(errorToJSValue(convErr)))
+			return result, nil
+		}
+		err := e.audited("check", func() string { return c.name }, func() error {
+			var err error
+			verdict, err = invokeHost(c.check, jsValue, c.source, e.id)
+			if err != nil || verdict.Type() != js.TypeObject || verdict.Get("then").Type() != js.TypeFunction {
+				return err
+			}
+			verdict, err = jsAwait(verdict)
+			return err
+		})
+		if err != nil {
+			return js.Null(), &hostError{callback: "check", message: fmt.Sprintf("Error: the check of case %q failed. %v", c.name, err)}
+		}
+	case expected != nil:
+		equal, err := starlark.Equal(value, expected)
+		verdict = js.ValueOf(err == nil && equal)
+	default:
+		verdict = js.ValueOf(true)
+	}
+	// A check answers whether the case passed, or the message it failed
+	// with.
+	if verdict.Type() == js.TypeString {
+		result.Set("passed", false)
+		result.Set("message", e.redactor.string(verdict.String()))
+	} else {
+		result.Set("passed", verdict.Truthy())
+	}
+	return result, nil
+}
+
+// gradeToJSValue returns the result of starlark.grade: how many cases
+// passed and failed, the steps they took in all, and the outcome of each.
+func gradeToJSValue(results []js.Value) js.Value {
+	passed, steps := 0, 0.0
+	cases := jsArray.New(len(results))
+	for i, result := range results {
+		if result.Get("passed").Bool() {
+			passed++
+		}
+		steps += result.Get("steps").Float()
+		cases.SetIndex(i, result)
+	}
+	grade := jsObject.New()
+	grade.Set("passed", passed)
+	grade.Set("failed", len(results)-passed)
+	grade.Set("steps", steps)
+	grade.Set("cases", cases)
+	return grade
+}
+
+// jsGrade implements starlark.grade(executionId, spec, options), where spec
+// is a module and the cases to test it with: {filename, checker?, cases:
+// [{name?, function, args, kwargs, expected?, check?, maxSteps?,
+// timeout?}], maxSteps?, timeout?, maxExecutionTime?}. All the cases run
+// inside the wasm module, in one execution, with their output captured, so
+// that grading a submission crosses into it once rather than per case.
+func jsGrade() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 2 || args[1].Type() != js.TypeObject {
+			return rejected(fmt.Errorf("Error: requires executionId and a grading spec as arguments."))
+		}
+		options := jsObject.New()
+		if len(args) > 2 && args[2].Type() == js.TypeObject {
+			options = jsObject.Call("assign", options, args[2])
+		}
+		options.Set("captureOutput", true)
+		return runAsync(args[0].String(), options, func(exec *execution) (js.Value, error) {
+			spec, err := parseGradeSpec(args[1])
+			if err != nil {
+				return js.Null(), err
+			}
+			exec.grading = true
+			results, err := runGrade(exec, spec)
+			if err != nil {
+				return js.Null(), err
+			}
+			return gradeToJSValue(results), nil
+		})
+	})
+}
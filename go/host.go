@@ -0,0 +1,159 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall/js"
+)
+
+// hostNamespace is the name of the global object the runner adds its
+// functions to, and finds the host's callbacks on. It is "starlark" unless
+// the host chose another, to keep two copies of the runner apart, with the
+// STARLARK_NAMESPACE environment variable or a --namespace= argument, which
+// wasm_exec.js passes from go.env and go.argv.
+var hostNamespace = "starlark"
+
+// hostBridge is the object the host handed the runner to use in place of
+// the namespace's global object, if it handed it one.
+var hostBridge js.Value
+
+// initHostNamespace reads the namespace the host chose, if any, and takes
+// the bridge the host handed over, if it did. A bridge is handed over under
+// the global name given by the STARLARK_BRIDGE environment variable or a
+// --bridge= argument, which only holds it until the runner starts: the
+// runner removes it, and never looks at the global again, for hosts such as
+// extension content scripts that must not depend on globals.
+func initHostNamespace() {
+	if name := os.Getenv("STARLARK_NAMESPACE"); name != "" {
+		hostNamespace = name
+	}
+	bridgeName := os.Getenv("STARLARK_BRIDGE")
+	for _, arg := range os.Args[1:] {
+		if name, ok := strings.CutPrefix(arg, "--namespace="); ok && name != "" {
+			hostNamespace = name
+		}
+		if name, ok := strings.CutPrefix(arg, "--bridge="); ok && name != "" {
+			bridgeName = name
+		}
+	}
+	if bridgeName == "" {
+		return
+	}
+	bridge := js.Global().Get(bridgeName)
+	js.Global().Delete(bridgeName)
+	if bridge.Type() != js.TypeObject {
+		panic(fmt.Sprintf("no bridge object was handed over as globalThis.%s", bridgeName))
+	}
+	hostBridge = bridge
+}
+
+// hostGlobal returns the bridge the host handed over, or else the global
+// object of the namespace, which may be undefined.
+func hostGlobal() js.Value {
+	if !hostBridge.IsUndefined() {
+		return hostBridge
+	}
+	return js.Global().Get(hostNamespace)
+}
+
+// hostGlobalName names the object hostGlobal returns, for error messages.
+func hostGlobalName() string {
+	if !hostBridge.IsUndefined() {
+		return "the bridge"
+	}
+	return "globalThis." + hostNamespace
+}
+
+// runCallback returns the function a run's options give for a callback, or
+// undefined.
+func runCallback(callbacks js.Value, name string) js.Value {
+	if callbacks.Type() == js.TypeObject {
+		if fn := callbacks.Get(name); fn.Type() == js.TypeFunction {
+			return fn
+		}
+	}
+	return js.Undefined()
+}
+
+// hostCallback returns the function the host gave for a callback: the
+// run's own, if its options have one, or else the one on the namespace's
+// global object. Either way the global object is optional. It is undefined
+// if there is neither.
+func hostCallback(callbacks js.Value, name string) js.Value {
+	if fn := runCallback(callbacks, name); fn.Type() == js.TypeFunction {
+		return fn
+	}
+	if global := hostGlobal(); global.Type() == js.TypeObject {
+		if fn := global.Get(name); fn.Type() == js.TypeFunction {
+			return fn
+		}
+	}
+	return js.Undefined()
+}
+
+// The ways of handling a host callback that throws, chosen by the
+// onHostError option.
+const (
+	// hostPolicyAbort stops the execution, which is rejected with the
+	// callback's error.
+	hostPolicyAbort = "abort"
+	// hostPolicyRaise fails the Starlark call that triggered the callback,
+	// as a runtime error at that point in the script.
+	hostPolicyRaise = "raise"
+	// hostPolicyLog logs the error to the console and carries on.
+	hostPolicyLog = "log"
+)
+
+// invokeHost calls a host callback, returning what it throws as an error
+// instead of panicking.
+func invokeHost(fn js.Value, args ...interface{}) (result js.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			jsErr, ok := r.(js.Error)
+			if !ok {
+				panic(r)
+			}
+			err = jsErr
+		}
+	}()
+	return fn.Invoke(args...), nil
+}
+
+// hostFailure applies the execution's onHostError policy to an error thrown
+// by a host callback. It returns the error to fail the current Starlark call
+// with, or nil to carry on.
+func (e *execution) hostFailure(callback string, err error) error {
+	hostErr := &hostError{callback: callback, message: fmt.Sprintf("Error: the %s callback failed. %s", callback, err)}
+	switch e.options.onHostError {
+	case hostPolicyLog:
+		js.Global().Get("console").Call("error", hostErr.message)
+		return nil
+	case hostPolicyRaise:
+		return hostErr
+	default:
+		e.mu.Lock()
+		if e.hostErr == nil {
+			e.hostErr = hostErr
+		}
+		e.mu.Unlock()
+		e.cancel(hostErr.message)
+		return hostErr
+	}
+}
@@ -0,0 +1,87 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"syscall/js"
+)
+
+// parseHostFunctions reads the host functions a run's modules see as
+// builtins: those of the hostFunctions object on the namespace's global
+// object, and those of the run's own hostFunctions option, which take the
+// place of the global ones of the same name. It returns nil if there are
+// none.
+func parseHostFunctions(options js.Value) map[string]js.Value {
+	var functions map[string]js.Value
+	add := func(value js.Value) {
+		if value.Type() != js.TypeObject {
+			return
+		}
+		keys := jsObjectKeys.Invoke(value)
+		for i := 0; i < keys.Length(); i++ {
+			name := keys.Index(i).String()
+			if fn := value.Get(name); fn.Type() == js.TypeFunction {
+				if functions == nil {
+					functions = make(map[string]js.Value)
+				}
+				functions[name] = fn
+			}
+		}
+	}
+	if global := hostGlobal(); global.Type() == js.TypeObject {
+		add(global.Get("hostFunctions"))
+	}
+	if options.Type() == js.TypeObject {
+		add(options.Get("hostFunctions"))
+	}
+	return functions
+}
+
+// hostFunctionNames returns the names of the execution's host functions,
+// sorted and joined by commas, which the programs compiled for it depend
+// on.
+func (e *execution) hostFunctionNames() string {
+	names := make([]string, 0, len(e.options.hostFunctions))
+	for name := range e.options.hostFunctions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// isPredeclared reports whether the execution's modules are compiled to look
+// up name in their environment: the builtins every execution has, the
+// execution's host functions, and set and the members of the modules its
+// dialect predeclares.
+func (e *execution) isPredeclared(name string) bool {
+	if _, ok := e.options.hostFunctions[name]; ok {
+		return true
+	}
+	if name == setBuiltin && e.hasSets() {
+		return true
+	}
+	_, ok := e.dialectMembers()[name]
+	return ok || isPredeclared(name)
+}
+
+// ownsEnvironment reports whether the execution's options give it an
+// environment of its own, rather than the default one.
+func (e *execution) ownsEnvironment() bool {
+	return e.options.builtins != nil || e.options.secrets != nil || e.options.hostFunctions != nil || e.hasSets() || len(e.dialectMembers()) > 0
+}
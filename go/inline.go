@@ -0,0 +1,167 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"syscall/js"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// The filenames that source run by starlark.exec and expressions evaluated
+// by starlark.eval are reported under, in errors and backtraces.
+const (
+	execFilename = "<exec>"
+	evalFilename = "<eval>"
+)
+
+// inlineEnv returns the execution's environment with the given globals, an
+// object of values the host passes in as arguments are converted, added to
+// it.
+func (e *execution) inlineEnv(globals js.Value) (starlark.StringDict, error) {
+	if globals.IsUndefined() || globals.IsNull() {
+		return e.env, nil
+	}
+	if !isPlainObject(globals) {
+		return nil, fmt.Errorf("Error: globals must be a plain object, not %s.", jsTypeName(globals))
+	}
+	keys := jsObjectKeys.Invoke(globals)
+	env := make(starlark.StringDict, len(e.env)+keys.Length())
+	for name, value := range e.env {
+		env[name] = value
+	}
+	conv := &converter{exec: e}
+	for i := 0; i < keys.Length(); i++ {
+		name := keys.Index(i).String()
+		value, err := conv.convertArgument(globals.Get(name), name)
+		if err != nil {
+			return nil, fmt.Errorf("Error: unable to convert the global %q. %w", name, err)
+		}
+		env[name] = value
+	}
+	return env, nil
+}
+
+// execSource runs source as a module whose environment has the given
+// globals, loading what it loads through the loader, and returns the
+// globals it defines, other than its functions, as a dict sorted by name.
+func (e *execution) execSource(source string, globals js.Value) (starlark.Value, error) {
+	env, err := e.inlineEnv(globals)
+	if err != nil {
+		return nil, err
+	}
+	compileStart := time.Now()
+	_, program, err := starlark.SourceProgramOptions(e.fileOptions(), execFilename, source, env.Has)
+	e.addPhase(phaseCompile, execFilename, compileStart)
+	if err != nil {
+		return nil, e.wrapEvalError(codeEvalFailed, withAllResolveErrors(err))
+	}
+	thread := e.newThread(e.id, e.loader())
+	execStart := time.Now()
+	defined, err := program.Init(thread, env)
+	e.addPhase(phaseExecute, "", execStart)
+	if err != nil {
+		e.recordError(thread, err)
+		return nil, e.wrapEvalError(codeExecFailed, withAllResolveErrors(err))
+	}
+	names := defined.Keys()
+	sort.Strings(names)
+	result := starlark.NewDict(len(names))
+	for _, name := range names {
+		if _, ok := defined[name].(starlark.Callable); ok {
+			continue
+		}
+		result.SetKey(starlark.String(name), defined[name])
+	}
+	return result, nil
+}
+
+// evalSource evaluates an expression in an environment with the given
+// globals.
+func (e *execution) evalSource(expr string, globals js.Value) (starlark.Value, error) {
+	env, err := e.inlineEnv(globals)
+	if err != nil {
+		return nil, err
+	}
+	compileStart := time.Now()
+	fn, err := starlark.ExprFuncOptions(e.fileOptions(), evalFilename, expr, env)
+	e.addPhase(phaseCompile, evalFilename, compileStart)
+	if err != nil {
+		return nil, e.wrapEvalError(codeEvalFailed, withAllResolveErrors(err))
+	}
+	thread := e.newThread(e.id, nil)
+	execStart := time.Now()
+	defer e.addPhase(phaseExecute, "", execStart)
+	value, err := starlark.Call(thread, fn, nil, nil)
+	if err != nil {
+		e.recordError(thread, err)
+		return nil, e.wrapEvalError(codeExecFailed, withAllResolveErrors(err))
+	}
+	return value, nil
+}
+
+// jsInline returns the implementation of starlark.exec or starlark.eval,
+// (executionId, source, globals, options), which runs source passed to it
+// rather than loaded, with globals, an object of values, as globals of its
+// own. maxExecutionTime may be given as an option.
+func jsInline(run func(e *execution, source string, globals js.Value) (starlark.Value, error)) js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 2 || args[1].Type() != js.TypeString {
+			return rejected(fmt.Errorf("Error: requires executionId and source as arguments."))
+		}
+		source := args[1].String()
+		globals := js.Undefined()
+		if len(args) > 2 {
+			globals = args[2]
+		}
+		options := js.Undefined()
+		maxExecutionTime := 0
+		if len(args) > 3 && args[3].Type() == js.TypeObject {
+			options = args[3]
+			if value := options.Get("maxExecutionTime"); value.Type() == js.TypeNumber {
+				maxExecutionTime = value.Int()
+			}
+		}
+		return runAsync(args[0].String(), options, func(exec *execution) (js.Value, error) {
+			if exec.options.envelope {
+				runtime.ReadMemStats(&exec.memory.start)
+			}
+			return runToJS(exec, &converter{exec: exec}, func() (starlark.Value, error) {
+				return runWithTimeout(exec, maxExecutionTime, func() (starlark.Value, error) {
+					return run(exec, source, globals)
+				})
+			})
+		})
+	})
+}
+
+// jsExec implements starlark.exec(executionId, source, globals, options),
+// which runs source as a module and resolves with the globals it defines,
+// other than its functions.
+func jsExec() js.Func {
+	return jsInline((*execution).execSource)
+}
+
+// jsEval implements starlark.eval(executionId, expression, globals,
+// options), which resolves with the value of the expression.
+func jsEval() js.Func {
+	return jsInline((*execution).evalSource)
+}
@@ -0,0 +1,349 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"syscall/js"
+	"unicode/utf8"
+
+	"go.starlark.net/starlark"
+)
+
+// defaultInspectCount is the number of variables an inspection returns unless
+// it asks for a count.
+const defaultInspectCount = 100
+
+// pausedFrame is what an inspection can see of a frame of a paused
+// execution: its locals, and the globals of the module it belongs to.
+type pausedFrame struct {
+	locals  []capturedLocal
+	globals []capturedLocal
+}
+
+// pausedFrames captures the frames of the thread, outermost first. Values
+// are only converted when inspected, as most of them never are.
+func pausedFrames(thread *starlark.Thread) []pausedFrame {
+	depth := thread.CallStackDepth()
+	frames := make([]pausedFrame, depth)
+	for i := range frames {
+		fr := thread.DebugFrame(depth - 1 - i)
+		frame := &frames[i]
+		for j := 0; j < fr.NumLocals(); j++ {
+			binding, value := fr.Local(j)
+			if value != nil {
+				frame.locals = append(frame.locals, capturedLocal{name: binding.Name, value: value})
+			}
+		}
+		if fn, ok := fr.Callable().(*starlark.Function); ok {
+			globals := fn.Globals()
+			for _, name := range globals.Keys() {
+				frame.globals = append(frame.globals, capturedLocal{name: name, value: globals[name]})
+			}
+		}
+	}
+	return frames
+}
+
+// inspectRequest picks the variables to inspect: those of a scope of a frame,
+// or the elements of a value in one, reached by path.
+type inspectRequest struct {
+	// frame indexes the backtrace of the paused event, outermost first.
+	frame int
+	// scope is "locals" or "globals".
+	scope string
+	// path names a variable of the scope, then an element of each value
+	// in turn, by its index among the elements.
+	path  []js.Value
+	start int
+	count int
+}
+
+func parseInspectRequest(value js.Value) (inspectRequest, error) {
+	req := inspectRequest{scope: "locals", count: defaultInspectCount}
+	if value.Type() != js.TypeObject {
+		return req, fmt.Errorf("Error: requires an inspection request as argument.")
+	}
+	if frame := value.Get("frame"); frame.Type() == js.TypeNumber {
+		req.frame = frame.Int()
+	}
+	if scope := value.Get("scope"); scope.Type() == js.TypeString {
+		req.scope = scope.String()
+	}
+	if req.scope != "locals" && req.scope != "globals" {
+		return req, fmt.Errorf("Error: unknown scope %q.", req.scope)
+	}
+	if path := value.Get("path"); path.Type() == js.TypeObject && path.InstanceOf(jsArray) {
+		for i := 0; i < path.Length(); i++ {
+			req.path = append(req.path, path.Index(i))
+		}
+	}
+	if start := value.Get("start"); start.Type() == js.TypeNumber && start.Int() > 0 {
+		req.start = start.Int()
+	}
+	if count := value.Get("count"); count.Type() == js.TypeNumber && count.Int() > 0 {
+		req.count = count.Int()
+	}
+	return req, nil
+}
+
+// inspectable is something with variables to list: a scope, or a
+// container value.
+type inspectable interface {
+	len() int
+	// at returns the i'th variable, for 0 <= i < len().
+	at(i int) capturedLocal
+}
+
+type scopeVariables []capturedLocal
+
+func (s scopeVariables) len() int               { return len(s) }
+func (s scopeVariables) at(i int) capturedLocal { return s[i] }
+
+type indexableElements struct{ starlark.Indexable }
+
+func (e indexableElements) len() int { return e.Len() }
+func (e indexableElements) at(i int) capturedLocal {
+	return capturedLocal{name: fmt.Sprint(i), value: e.Index(i)}
+}
+
+// itemElements are the entries of a mapping, named by the repr of their
+// keys.
+type itemElements []starlark.Tuple
+
+func (e itemElements) len() int { return len(e) }
+func (e itemElements) at(i int) capturedLocal {
+	return capturedLocal{name: e[i][0].String(), value: e[i][1]}
+}
+
+type attrElements struct {
+	value starlark.HasAttrs
+	names []string
+}
+
+func (e attrElements) len() int { return len(e.names) }
+func (e attrElements) at(i int) capturedLocal {
+	value, err := e.value.Attr(e.names[i])
+	if err != nil {
+		value = starlark.String(err.Error())
+	} else if value == nil {
+		value = starlark.None
+	}
+	return capturedLocal{name: e.names[i], value: value}
+}
+
+// elementsOf returns the elements of a container value, or nil for a value
+// shown by its repr alone. Strings and builtin types have attributes too,
+// but only methods.
+func elementsOf(v starlark.Value) inspectable {
+	switch v := v.(type) {
+	case starlark.String, starlark.Bytes, *starlark.Builtin, *starlark.Function:
+		return nil
+	case starlark.IterableMapping:
+		return itemElements(v.Items())
+	case *starlark.Set:
+		var elems starlark.Tuple
+		iter := v.Iterate()
+		defer iter.Done()
+		var elem starlark.Value
+		for iter.Next(&elem) {
+			elems = append(elems, elem)
+		}
+		return indexableElements{elems}
+	case starlark.Indexable:
+		return indexableElements{v}
+	case starlark.HasAttrs:
+		names := v.AttrNames()
+		sort.Strings(names)
+		return attrElements{value: v, names: names}
+	}
+	return nil
+}
+
+// inspect lists the variables req asks for.
+func inspect(frames []pausedFrame, req inspectRequest) (js.Value, error) {
+	if req.frame < 0 || req.frame >= len(frames) {
+		return js.Undefined(), fmt.Errorf("Error: there is no frame %d.", req.frame)
+	}
+	var vars inspectable = scopeVariables(frames[req.frame].locals)
+	if req.scope == "globals" {
+		vars = scopeVariables(frames[req.frame].globals)
+	}
+	for depth, step := range req.path {
+		var value starlark.Value
+		switch {
+		case depth == 0 && step.Type() == js.TypeString:
+			scope := vars.(scopeVariables)
+			for _, v := range scope {
+				if v.name == step.String() {
+					value = v.value
+				}
+			}
+		case depth > 0 && step.Type() == js.TypeNumber && step.Int() >= 0 && step.Int() < vars.len():
+			value = vars.at(step.Int()).value
+		}
+		if value == nil {
+			return js.Undefined(), fmt.Errorf("Error: nothing to inspect at %s.", pathString(req.path[:depth+1]))
+		}
+		if vars = elementsOf(value); vars == nil {
+			return js.Undefined(), fmt.Errorf("Error: %s has no elements to inspect.", pathString(req.path[:depth+1]))
+		}
+	}
+
+	total := vars.len()
+	start := req.start
+	if start > total {
+		start = total
+	}
+	end := total
+	if req.count < end-start {
+		end = start + req.count
+	}
+	variables := jsArray.New(end - start)
+	for i := start; i < end; i++ {
+		v := vars.at(i)
+		obj := jsObject.New()
+		obj.Set("name", v.name)
+		obj.Set("type", v.value.Type())
+		obj.Set("value", boundedRepr(v.value, maxCapturedLocalLength))
+		if elems := elementsOf(v.value); elems != nil {
+			obj.Set("elements", elems.len())
+		}
+		variables.SetIndex(i-start, obj)
+	}
+	result := jsObject.New()
+	result.Set("variables", variables)
+	result.Set("total", total)
+	return result, nil
+}
+
+// boundedRepr returns the repr of v, cut short after about limit bytes. A
+// variable can hold a huge list or dict, and rendering all of it only to show
+// the start would stall the host, so lists, tuples and dicts are rendered only
+// as far as the limit. Other values are rendered whole.
+func boundedRepr(v starlark.Value, limit int) string {
+	var b strings.Builder
+	writeBoundedRepr(&b, v, limit)
+	repr := b.String()
+	if len(repr) <= limit {
+		return repr
+	}
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(repr[cut]) {
+		cut--
+	}
+	return repr[:cut] + "..."
+}
+
+func writeBoundedRepr(b *strings.Builder, v starlark.Value, limit int) {
+	elems := func(open string, close string, n int, write func(i int)) {
+		b.WriteString(open)
+		for i := 0; i < n; i++ {
+			if b.Len() > limit {
+				return
+			}
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			write(i)
+		}
+		b.WriteString(close)
+	}
+	switch v := v.(type) {
+	case starlark.String:
+		if len(v) > limit {
+			// The rest would be cut anyway.
+			v = v[:limit]
+		}
+		b.WriteString(v.String())
+	case *starlark.List:
+		elems("[", "]", v.Len(), func(i int) { writeBoundedRepr(b, v.Index(i), limit) })
+	case starlark.Tuple:
+		if len(v) == 1 {
+			b.WriteString("(")
+			writeBoundedRepr(b, v[0], limit)
+			b.WriteString(",)")
+			return
+		}
+		elems("(", ")", len(v), func(i int) { writeBoundedRepr(b, v[i], limit) })
+	case *starlark.Dict:
+		items := v.Items()
+		elems("{", "}", len(items), func(i int) {
+			writeBoundedRepr(b, items[i][0], limit)
+			b.WriteString(": ")
+			writeBoundedRepr(b, items[i][1], limit)
+		})
+	default:
+		b.WriteString(v.String())
+	}
+}
+
+// pathString shows an inspection path for an error message.
+func pathString(path []js.Value) string {
+	s := ""
+	for i, step := range path {
+		if i == 0 && step.Type() == js.TypeString {
+			s = step.String()
+		} else if i == 0 {
+			s = fmt.Sprint(step.Float())
+		} else {
+			s += fmt.Sprintf("[%d]", step.Int())
+		}
+	}
+	return s
+}
+
+// inspectExecution inspects the variables of a paused execution.
+func inspectExecution(executionId string, req inspectRequest) (js.Value, error) {
+	debuggers.mu.Lock()
+	d := debuggers.byId[executionId]
+	debuggers.mu.Unlock()
+	if d == nil {
+		return js.Undefined(), fmt.Errorf("Error: no execution %q is running in debug mode.", executionId)
+	}
+	d.mu.Lock()
+	frames := d.frames
+	d.mu.Unlock()
+	if frames == nil {
+		return js.Undefined(), fmt.Errorf("Error: the execution is not paused.")
+	}
+	// The paused thread is blocked until resumed, so its values can be read
+	// here.
+	return inspect(frames, req)
+}
+
+// jsInspect implements starlark.inspect(executionId, request), which lists
+// the variables of a paused execution: {variables: [{name, type, value,
+// elements?}], total}, where value is a repr and elements, if set, is how many
+// elements the value has for a further request to list.
+func jsInspect() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 2 || args[0].Type() != js.TypeString {
+			return jsErrorConstructor.New("Error: requires an executionId and an inspection request as arguments.")
+		}
+		req, err := parseInspectRequest(args[1])
+		if err != nil {
+			return jsErrorConstructor.New(err.Error())
+		}
+		result, err := inspectExecution(args[0].String(), req)
+		if err != nil {
+			return jsErrorConstructor.New(err.Error())
+		}
+		return result
+	})
+}
@@ -0,0 +1,88 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"runtime"
+	"strings"
+	"syscall/js"
+	"time"
+)
+
+// instanceId identifies this copy of the wasm module among those a host
+// runs, say one per worker. It is chosen at random, unless the host names
+// the instance with the STARLARK_INSTANCE_ID environment variable or an
+// --instance-id= argument. It tags every diagnostic and worker message, and
+// is announced by the ready message a worker posts when it starts serving.
+var instanceId string
+
+// startedAt is when the instance started, for its uptime.
+var startedAt = time.Now()
+
+// initInstanceId reads the instance id the host chose, or makes one up.
+func initInstanceId() {
+	instanceId = os.Getenv("STARLARK_INSTANCE_ID")
+	for _, arg := range os.Args[1:] {
+		if id, ok := strings.CutPrefix(arg, "--instance-id="); ok && id != "" {
+			instanceId = id
+		}
+	}
+	if instanceId == "" {
+		var b [8]byte
+		rand.Read(b[:])
+		instanceId = hex.EncodeToString(b[:])
+	}
+}
+
+// usageToJSValue measures the resources the instance is using, for
+// starlark.usage().
+func usageToJSValue() js.Value {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	executions.mu.Lock()
+	active, started := executions.active, executions.started
+	executions.mu.Unlock()
+
+	usage := jsObject.New()
+	usage.Set("instanceId", instanceId)
+	usage.Set("uptime", milliseconds(time.Since(startedAt)))
+	runs := jsObject.New()
+	runs.Set("active", active)
+	runs.Set("started", started)
+	usage.Set("executions", runs)
+	memory := jsObject.New()
+	memory.Set("heapAlloc", mem.HeapAlloc)
+	memory.Set("heapSys", mem.HeapSys)
+	memory.Set("sys", mem.Sys)
+	memory.Set("totalAlloc", mem.TotalAlloc)
+	memory.Set("gcCycles", mem.NumGC)
+	usage.Set("memory", memory)
+	usage.Set("goroutines", runtime.NumGoroutine())
+	usage.Set("moduleCache", cacheStatsToJSValue())
+	usage.Set("labels", labelUsageToJSValue())
+	return usage
+}
+
+func jsUsage() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		return usageToJSValue()
+	})
+}
@@ -0,0 +1,48 @@
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runner
+
+import (
+	"fmt"
+
+	"go.starlark.net/starlark"
+)
+
+// ConvertArgs converts the arguments of a call from a host's values: n
+// positional ones, the ith of which arg converts given its path, args[i],
+// and the keyword ones with the given keys, the ith of which kwarg converts
+// given its path, kwargs["key"]. A keyword argument kwarg converts to nil is
+// left out, for its parameter to take its default.
+func ConvertArgs(n int, arg func(i int, path string) (starlark.Value, error), keys []string, kwarg func(i int, path string) (starlark.Value, error)) (starlark.Tuple, []starlark.Tuple, error) {
+	args := starlark.Tuple{}
+	for i := 0; i < n; i++ {
+		value, err := arg(i, fmt.Sprintf("args[%d]", i))
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error: unable to convert argument %d. %w", i, err)
+		}
+		args = append(args, value)
+	}
+	kwargs := []starlark.Tuple{}
+	for i, key := range keys {
+		value, err := kwarg(i, fmt.Sprintf("kwargs[%q]", key))
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error: unable to convert keyword argument %q. %w", key, err)
+		}
+		if value != nil {
+			kwargs = append(kwargs, starlark.Tuple{starlark.String(key), value})
+		}
+	}
+	return args, kwargs, nil
+}
@@ -0,0 +1,228 @@
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runner
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// Values cross between the runner and a host without JavaScript as JSON,
+// converted as the js build converts JS values: integral numbers become
+// ints, other numbers floats, and objects dicts keeping the order of their
+// keys. Starlark values convert back the same way, and those with no JSON
+// counterpart, such as functions, are errors. path describes where a value
+// sits, e.g. args[0]["items"][3], for error messages.
+
+// DecodeJSON converts JSON to a Starlark value.
+func DecodeJSON(data []byte, path string) (starlark.Value, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	value, err := decodeValue(dec, path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("%s has data after the value", path)
+	}
+	return value, nil
+}
+
+func decodeValue(dec *json.Decoder, path string) (starlark.Value, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, fmt.Errorf("%s is not valid JSON: %s", path, err)
+	}
+	switch token := token.(type) {
+	case nil:
+		return starlark.None, nil
+	case bool:
+		return starlark.Bool(token), nil
+	case string:
+		return starlark.String(token), nil
+	case json.Number:
+		return decodeNumber(token, path)
+	case json.Delim:
+		if token == '[' {
+			var list []starlark.Value
+			for i := 0; dec.More(); i++ {
+				item, err := decodeValue(dec, fmt.Sprintf("%s[%d]", path, i))
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, item)
+			}
+			dec.Token()
+			return starlark.NewList(list), nil
+		}
+		dict := starlark.NewDict(0)
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, fmt.Errorf("%s is not valid JSON: %s", path, err)
+			}
+			item, err := decodeValue(dec, fmt.Sprintf("%s[%q]", path, key))
+			if err != nil {
+				return nil, err
+			}
+			dict.SetKey(starlark.String(key.(string)), item)
+		}
+		dec.Token()
+		return dict, nil
+	}
+	return nil, fmt.Errorf("%s has unexpected JSON %v", path, token)
+}
+
+// decodeNumber converts a JSON number. Integers keep all their digits,
+// unlike in the js build, where they are rounded to a JS number first.
+func decodeNumber(number json.Number, path string) (starlark.Value, error) {
+	text := number.String()
+	if !strings.ContainsAny(text, ".eE") {
+		if i, ok := new(big.Int).SetString(text, 10); ok {
+			return starlark.MakeBigInt(i), nil
+		}
+	}
+	floatVal, err := strconv.ParseFloat(text, 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return nil, fmt.Errorf("%s is not a number: %s", path, text)
+	}
+	if floatVal == math.Trunc(floatVal) && math.Abs(floatVal) < math.MaxInt64 {
+		return starlark.MakeInt64(int64(floatVal)), nil
+	}
+	return starlark.Float(floatVal), nil
+}
+
+// EncodeJSON converts a Starlark value to JSON.
+func EncodeJSON(value starlark.Value, path string) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := encodeValue(buf, value, path, make(map[starlark.Value]bool)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeValue writes value as JSON. seen holds the containers being
+// written, as one that contains itself has no JSON form.
+func encodeValue(buf *bytes.Buffer, value starlark.Value, path string, seen map[starlark.Value]bool) error {
+	switch v := value.(type) {
+	case starlark.NoneType:
+		buf.WriteString("null")
+		return nil
+	case starlark.Bool:
+		buf.WriteString(strconv.FormatBool(bool(v)))
+		return nil
+	case starlark.Int:
+		buf.WriteString(v.String())
+		return nil
+	case starlark.Float:
+		f := float64(v)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return fmt.Errorf("%s is %s, which JSON cannot represent", path, v)
+		}
+		buf.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+		return nil
+	case starlark.String:
+		return encodeString(buf, string(v))
+	}
+
+	switch value.(type) {
+	case *starlark.List, *starlark.Dict, *starlarkstruct.Struct:
+		if seen[value] {
+			return fmt.Errorf("%s contains itself", path)
+		}
+		seen[value] = true
+		defer delete(seen, value)
+	}
+	switch v := value.(type) {
+	case *starlark.List:
+		return encodeArray(buf, v, path, seen)
+	case starlark.Tuple:
+		return encodeArray(buf, v, path, seen)
+	case *starlark.Dict:
+		buf.WriteByte('{')
+		for i, item := range v.Items() {
+			key, ok := item[0].(starlark.String)
+			if !ok {
+				return fmt.Errorf("%s has a %s key %s, which JSON cannot represent", path, item[0].Type(), item[0])
+			}
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			encodeString(buf, string(key))
+			buf.WriteByte(':')
+			if err := encodeValue(buf, item[1], fmt.Sprintf("%s[%q]", path, string(key)), seen); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		return nil
+	case *starlarkstruct.Struct:
+		buf.WriteByte('{')
+		for i, name := range v.AttrNames() {
+			field, err := v.Attr(name)
+			if err != nil {
+				return err
+			}
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			encodeString(buf, name)
+			buf.WriteByte(':')
+			if err := encodeValue(buf, field, path+"."+name, seen); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		return nil
+	}
+	return fmt.Errorf("%s is a %s value, which JSON cannot represent", path, value.Type())
+}
+
+func encodeArray(buf *bytes.Buffer, list starlark.Indexable, path string, seen map[starlark.Value]bool) error {
+	buf.WriteByte('[')
+	for i := 0; i < list.Len(); i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if err := encodeValue(buf, list.Index(i), fmt.Sprintf("%s[%d]", path, i), seen); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte(']')
+	return nil
+}
+
+// encodeString writes s as a JSON string, leaving <, > and & as they are,
+// as JSON.stringify does.
+func encodeString(buf *bytes.Buffer, s string) error {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(s); err != nil {
+		return err
+	}
+	// Encode ends the value with a newline.
+	buf.Truncate(buf.Len() - 1)
+	return nil
+}
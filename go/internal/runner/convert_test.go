@@ -0,0 +1,141 @@
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runner
+
+import (
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+func TestDecodeJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want string
+	}{
+		{"null", `null`, `None`},
+		{"bools", `[true, false]`, `[True, False]`},
+		{"integer", `42`, `42`},
+		{"negative integer", `-7`, `-7`},
+		{"integral float", `2.0`, `2`},
+		{"exponent", `1e3`, `1000`},
+		{"float", `1.5`, `1.5`},
+		{"big integer keeps its digits", `123456789012345678901234567890`, `123456789012345678901234567890`},
+		{"huge float", `1e300`, `1e+300`},
+		{"string", `"a\"bé"`, `"a\"bé"`},
+		{"empty array", `[]`, `[]`},
+		{"nested", `{"a": [1, {"b": null}]}`, `{"a": [1, {"b": None}]}`},
+		{"key order", `{"z": 1, "a": 2, "m": 3}`, `{"z": 1, "a": 2, "m": 3}`},
+		{"duplicate key keeps the last", `{"a": 1, "a": 2}`, `{"a": 2}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, err := DecodeJSON([]byte(test.json), "args")
+			if err != nil {
+				t.Fatalf("DecodeJSON(%s): %v", test.json, err)
+			}
+			if got := value.String(); got != test.want {
+				t.Errorf("DecodeJSON(%s) = %s, want %s", test.json, got, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeJSONErrors(t *testing.T) {
+	tests := []struct {
+		json string
+		want string
+	}{
+		{`[1, `, `args[1] is not valid JSON`},
+		{`{"a": [tru]}`, `args["a"][0] is not valid JSON`},
+		{`1 2`, `args has data after the value`},
+		{``, `args is not valid JSON`},
+	}
+	for _, test := range tests {
+		_, err := DecodeJSON([]byte(test.json), "args")
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("DecodeJSON(%q) = %v, want an error containing %q", test.json, err, test.want)
+		}
+	}
+}
+
+func TestEncodeJSON(t *testing.T) {
+	self := starlark.NewList(nil)
+	self.Append(self)
+	dict := starlark.NewDict(2)
+	dict.SetKey(starlark.String("z"), starlark.MakeInt(1))
+	dict.SetKey(starlark.String("a"), starlark.Tuple{starlark.None, starlark.True})
+	shared := starlark.NewList([]starlark.Value{starlark.MakeInt(1)})
+	intKeys := starlark.NewDict(1)
+	intKeys.SetKey(starlark.MakeInt(1), starlark.None)
+	bigInt := starlark.MakeInt(1).Lsh(100)
+
+	tests := []struct {
+		name  string
+		value starlark.Value
+		want  string
+		err   string
+	}{
+		{name: "none", value: starlark.None, want: `null`},
+		{name: "ints", value: starlark.Tuple{starlark.MakeInt(0), starlark.MakeInt(-3)}, want: `[0,-3]`},
+		{name: "big int", value: bigInt, want: `1267650600228229401496703205376`},
+		{name: "floats", value: starlark.Tuple{starlark.Float(1.5), starlark.Float(1e21), starlark.Float(2)}, want: `[1.5,1e+21,2]`},
+		{name: "string escapes", value: starlark.String("<\"\n\">"), want: `"<\"\n\">"`},
+		{name: "dict keeps its order", value: dict, want: `{"z":1,"a":[null,true]}`},
+		{name: "struct", value: starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{"b": starlark.MakeInt(2), "a": starlark.MakeInt(1)}), want: `{"a":1,"b":2}`},
+		{name: "shared list", value: starlark.Tuple{shared, shared}, want: `[[1],[1]]`},
+		{name: "nan", value: starlark.NewList([]starlark.Value{starlark.Float(0).Mod(starlark.Float(0))}), err: `result[0] is nan, which JSON cannot represent`},
+		{name: "int keys", value: intKeys, err: `result has a int key 1, which JSON cannot represent`},
+		{name: "function", value: starlark.Tuple{starlark.NewBuiltin("f", nil)}, err: `result[0] is a builtin_function_or_method value, which JSON cannot represent`},
+		{name: "cycle", value: self, err: `result[0] contains itself`},
+		{name: "set", value: starlark.NewSet(0), err: `result is a set value, which JSON cannot represent`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := EncodeJSON(test.value, "result")
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("EncodeJSON(%s) = %s, %v, want error %q", test.value, got, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("EncodeJSON(%s): %v", test.value, err)
+			}
+			if string(got) != test.want {
+				t.Errorf("EncodeJSON(%s) = %s, want %s", test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	for _, text := range []string{`{"a":[1,2.5,"x",null,true],"b":{}}`, `[[],[[]],{"":0}]`, `18446744073709551617`} {
+		value, err := DecodeJSON([]byte(text), "value")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := EncodeJSON(value, "value")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != text {
+			t.Errorf("round trip of %s gave %s", text, got)
+		}
+	}
+}
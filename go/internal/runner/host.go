@@ -0,0 +1,90 @@
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package runner runs Starlark scripts for a host it knows only through the
+// Host interface, so that it can be built for any target, and driven by
+// tests without a browser. The wasm builds adapt it to their hosts: the
+// WASI build to JSON messages over stdio, and the js build to
+// globalThis.starlark, through an Adapter that layers its debugging,
+// profiling, caching and policies on the runner's loading and execution.
+package runner
+
+import (
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// Host is what a run needs from its environment.
+type Host interface {
+	// Load returns the source of a module a script loads, other than a
+	// bundled one.
+	Load(filename string) (string, error)
+	// Print receives a line of output, to the stream "stdout" from print
+	// and "stderr" from eprint.
+	Print(stream string, message string)
+	// Now is the time, for time.now() and for timeouts.
+	Now() time.Time
+	// Rand returns random bits, for the builtins that need them, so that a
+	// test can fix them.
+	Rand() uint64
+}
+
+const hostKey = "starlark_wasm.host"
+
+// HostOf returns the host of a thread the runner created, or nil.
+func HostOf(thread *starlark.Thread) Host {
+	host, _ := thread.Local(hostKey).(Host)
+	return host
+}
+
+// LoadFunc is the load function of a run's threads, which loads a module for
+// the thread that loads it.
+type LoadFunc func(caller *starlark.Thread, module string) (starlark.StringDict, error)
+
+// An Adapter is a Host that takes over the parts of a run its build does
+// differently, as the js build's does. The runner still decides what a run
+// does: it keeps each module to one load, finds bundled modules and cycles,
+// calls the function and enforces the time limit.
+type Adapter interface {
+	Host
+	// NewThread returns a new thread of the run, which loads modules with
+	// load, in place of one the runner would make.
+	NewThread(name string, load LoadFunc) *starlark.Thread
+	// Cancel stops every thread of the run at its next step, and aborts
+	// whatever they are waiting on the host for.
+	Cancel(reason string)
+	// CheckLoad fails the loads the host forbids. It is called for every
+	// load, before the module is looked up, with caller nil for the module
+	// the run starts with.
+	CheckLoad(caller *starlark.Thread, module string) error
+	// Bundled returns the members of a bundled module as a script sees
+	// them.
+	Bundled(members starlark.StringDict) starlark.StringDict
+	// ExecModule loads a module that is not bundled, for caller, and
+	// executes it on thread.
+	ExecModule(caller *starlark.Thread, thread *starlark.Thread, module string) (starlark.StringDict, error)
+	// Call calls the run's function on thread.
+	Call(thread *starlark.Thread, fn starlark.Value, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error)
+	// Failed is the error of a run whose module, at EvalFailed, or
+	// function, at ExecFailed, failed with err.
+	Failed(stage Stage, err error) error
+	// MissingFunction is the error of a run whose module has no function
+	// of the name.
+	MissingFunction(name string) error
+	// TimedOut is the error of a run stopped at its time limit.
+	TimedOut() error
+	// Panicked is the error of a run that panicked with r.
+	Panicked(r interface{}) error
+}
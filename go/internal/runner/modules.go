@@ -0,0 +1,87 @@
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runner
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.starlark.net/starlark"
+)
+
+// BundledModulePrefix marks the names of the modules compiled into the
+// runner, which load() resolves itself instead of asking the host, e.g.
+// load("@std/json", "json").
+const BundledModulePrefix = "@std/"
+
+// bundledModules holds the modules compiled into the runner, keyed by name.
+// Each is registered from a file of its own behind a build tag, so that a
+// deployment can leave out what it does not use, e.g. with
+// -tags starlark_no_time.
+var bundledModules = map[string]*lazyModule{}
+
+// A lazyModule builds the members of a bundled module the first time it is
+// loaded, so that the modules a script never loads cost nothing at startup.
+// The members are frozen, as every run that loads the module shares them.
+type lazyModule struct {
+	once    sync.Once
+	build   func() starlark.StringDict
+	members starlark.StringDict
+}
+
+func (m *lazyModule) get() starlark.StringDict {
+	m.once.Do(func() {
+		m.members = m.build()
+		m.members.Freeze()
+		m.build = nil
+	})
+	return m.members
+}
+
+// RegisterModule registers a bundled module, whose members build returns
+// when it is first loaded.
+func RegisterModule(name string, build func() starlark.StringDict) {
+	bundledModules[name] = &lazyModule{build: build}
+}
+
+// BundledModule returns the members of a bundled module, if module names
+// one. The error reports a bundled module missing from this build.
+func BundledModule(module string) (starlark.StringDict, bool, error) {
+	name, ok := strings.CutPrefix(module, BundledModulePrefix)
+	if !ok {
+		return nil, false, nil
+	}
+	lazy, ok := bundledModules[name]
+	if !ok {
+		available := "none"
+		if len(bundledModules) > 0 {
+			available = strings.Join(BundledModuleNames(), ", ")
+		}
+		return nil, true, fmt.Errorf("Error: there is no bundled module %q in this build. Available: %s.", name, available)
+	}
+	return lazy.get(), true, nil
+}
+
+// BundledModuleNames returns the names of the bundled modules, sorted.
+func BundledModuleNames() []string {
+	names := make([]string, 0, len(bundledModules))
+	for name := range bundledModules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
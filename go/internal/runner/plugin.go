@@ -0,0 +1,93 @@
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runner
+
+import (
+	"fmt"
+	"sort"
+
+	"go.starlark.net/starlark"
+)
+
+// A Plugin adds native builtins and modules to the runner. Plugins are
+// compiled in from files of their own, each registering its plugin from an
+// init function, usually behind a build tag so that a build can choose
+// them, as the bundled modules are:
+//
+//	//go:build starlark_plugin_geo
+//
+//	func init() { runner.RegisterPlugin(geoPlugin{}) }
+//
+// A fork can so add its own domain modules without changing the runner.
+type Plugin interface {
+	// Name identifies the plugin, in errors and in the list of those
+	// compiled in.
+	Name() string
+	// Modules returns the modules the plugin bundles, by name, each with
+	// the function building its members the first time it is loaded, as
+	// for RegisterModule. Scripts load them as @std/<name>.
+	Modules() map[string]func() starlark.StringDict
+	// Builtins returns the globals the plugin adds to every module, which
+	// are frozen, as every run shares them.
+	Builtins() starlark.StringDict
+}
+
+var (
+	plugins        []Plugin
+	pluginBuiltins = starlark.StringDict{}
+	// builtinOwners is the plugin that added each builtin.
+	builtinOwners = map[string]string{}
+)
+
+// RegisterPlugin compiles a plugin in. A plugin that reuses the name of a
+// bundled module or of another plugin's builtin is a mistake in the build,
+// which panics as the binary starts.
+func RegisterPlugin(p Plugin) {
+	modules, builtins := p.Modules(), p.Builtins()
+	for name := range modules {
+		if _, ok := bundledModules[name]; ok {
+			panic(fmt.Sprintf("plugin %s: there is already a bundled module %q", p.Name(), name))
+		}
+	}
+	for name := range builtins {
+		if owner, ok := builtinOwners[name]; ok {
+			panic(fmt.Sprintf("plugin %s: plugin %s already adds the builtin %q", p.Name(), owner, name))
+		}
+	}
+	for name, build := range modules {
+		RegisterModule(name, build)
+	}
+	for name, value := range builtins {
+		value.Freeze()
+		builtinOwners[name] = p.Name()
+		pluginBuiltins[name] = value
+	}
+	plugins = append(plugins, p)
+}
+
+// PluginBuiltins returns the builtins the plugins add to every module.
+func PluginBuiltins() starlark.StringDict {
+	return pluginBuiltins
+}
+
+// PluginNames returns the names of the plugins compiled in, sorted.
+func PluginNames() []string {
+	names := make([]string, len(plugins))
+	for i, p := range plugins {
+		names[i] = p.Name()
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,135 @@
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runner_test
+
+import (
+	"strings"
+	"testing"
+
+	"dcollien.com/starlark-wasm/internal/runner"
+	"dcollien.com/starlark-wasm/internal/runner/runnertest"
+	"go.starlark.net/starlark"
+)
+
+// testPlugin bundles @std/greet and adds the builtin shout.
+type testPlugin struct {
+	name    string
+	module  string
+	builtin string
+}
+
+func (p testPlugin) Name() string { return p.name }
+
+func (p testPlugin) Modules() map[string]func() starlark.StringDict {
+	return map[string]func() starlark.StringDict{
+		p.module: func() starlark.StringDict {
+			return starlark.StringDict{"greeting": starlark.String("hello")}
+		},
+	}
+}
+
+func (p testPlugin) Builtins() starlark.StringDict {
+	return starlark.StringDict{
+		p.builtin: starlark.NewBuiltin(p.builtin, func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var s string
+			if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &s); err != nil {
+				return nil, err
+			}
+			return starlark.String(s + "!"), nil
+		}),
+	}
+}
+
+func TestPlugin(t *testing.T) {
+	runner.RegisterPlugin(testPlugin{name: "greet", module: "greet", builtin: "shout"})
+	host := runnertest.NewHost(map[string]string{"main.star": "load(\"@std/greet\", \"greeting\")\ndef main():\n    return shout(greeting)\n"})
+	value, err := runner.Execute(runner.Run{Host: host, Filename: "main.star", Function: "main"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.String() != `"hello!"` {
+		t.Errorf("got %s, want the plugin's module and builtin to be used", value)
+	}
+
+	found := false
+	for _, name := range runner.PluginNames() {
+		found = found || name == "greet"
+	}
+	if !found {
+		t.Errorf("plugins %v do not include greet", runner.PluginNames())
+	}
+
+	for _, p := range []testPlugin{
+		{name: "json", module: "json", builtin: "unused"},
+		{name: "loud", module: "loud", builtin: "shout"},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("registering %s did not panic", p.name)
+				}
+			}()
+			runner.RegisterPlugin(p)
+		}()
+		if _, ok := runner.PluginBuiltins()["unused"]; ok {
+			t.Errorf("the plugin %s was partly registered", p.name)
+		}
+		for _, name := range runner.BundledModuleNames() {
+			if name == "loud" {
+				t.Errorf("the plugin %s was partly registered", p.name)
+			}
+		}
+	}
+}
+
+// mutablePlugin bundles @std/mutable and adds the builtin defaults, both
+// of which hold a list.
+type mutablePlugin struct{}
+
+func (mutablePlugin) Name() string { return "mutable" }
+
+func (mutablePlugin) Modules() map[string]func() starlark.StringDict {
+	return map[string]func() starlark.StringDict{
+		"mutable": func() starlark.StringDict {
+			return starlark.StringDict{"names": starlark.NewList(nil)}
+		},
+	}
+}
+
+func (mutablePlugin) Builtins() starlark.StringDict {
+	return starlark.StringDict{"defaults": starlark.NewList([]starlark.Value{starlark.MakeInt(1)})}
+}
+
+func TestPluginValuesAreFrozen(t *testing.T) {
+	runner.RegisterPlugin(mutablePlugin{})
+	for _, source := range []string{
+		"load(\"@std/mutable\", \"names\")\nnames.append(1)\n",
+		"defaults.append(2)\n",
+	} {
+		host := runnertest.NewHost(map[string]string{"main.star": source})
+		_, err := runner.Execute(runner.Run{Host: host, Filename: "main.star"})
+		if err == nil || !strings.Contains(err.Error(), "frozen") {
+			t.Errorf("%q: got %v, want a frozen value error", source, err)
+		}
+	}
+	host := runnertest.NewHost(map[string]string{"main.star": "load(\"@std/mutable\", \"names\")\ndef main():\n    return [names, defaults]\n"})
+	value, err := runner.Execute(runner.Run{Host: host, Filename: "main.star", Function: "main"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.String() != "[[], [1]]" {
+		t.Errorf("got %s, want the plugin's values unchanged", value)
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runner
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	startime "go.starlark.net/lib/time"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// Run describes a run of a script: a module, and optionally a function of it
+// to call.
+type Run struct {
+	Host Host
+	// Filename names the module to run, which is loaded from the host.
+	Filename string
+	// Name names the threads of the run: the one calling Function is Name,
+	// and the one executing a module Name + " exec " + its filename. It
+	// defaults to Filename.
+	Name string
+	// Function, if set, is called with Args and Kwargs once the module has
+	// run, and gives the result. A run without one results in None.
+	Function string
+	Args     starlark.Tuple
+	Kwargs   []starlark.Tuple
+	// MaxExecutionTime cancels the run once it has taken this long; 0 for
+	// no limit. An Adapter's run is cancelled by a timer, even while it
+	// waits on the host, and any other's by its threads watching the
+	// host's clock.
+	MaxExecutionTime time.Duration
+	// Predeclared are the globals of the modules the runner executes,
+	// beyond Starlark's own, eprint and those of plugins. They are frozen
+	// as the run starts, so that a host passing the same values to several
+	// runs cannot have one script change what the next one sees. An
+	// Adapter executes its modules itself, with globals of its own.
+	Predeclared starlark.StringDict
+	// Hooks are installed on each thread the runner makes, alongside its
+	// own.
+	Hooks []StepHook
+}
+
+// Stage is a stage of a run that can fail, named as the code of the js
+// build's message for it.
+type Stage string
+
+const (
+	// EvalFailed is the execution of the run's module.
+	EvalFailed Stage = "evalFailed"
+	// ExecFailed is the call of its function.
+	ExecFailed Stage = "execFailed"
+)
+
+// Error is an error of a run, which keeps the Starlark error behind it, if
+// any, for its backtrace.
+type Error struct {
+	Message string
+	Cause   error
+}
+
+func (e *Error) Error() string { return e.Message }
+func (e *Error) Unwrap() error { return e.Cause }
+
+// execution is a run in progress.
+type execution struct {
+	run Run
+	// adapter is the run's host, if it is an Adapter.
+	adapter Adapter
+	start   time.Time
+	// modules holds the modules loaded so far, nil while one is loading.
+	modules     map[string]*module
+	predeclared starlark.StringDict
+	// timedOut is set once the run has been cancelled for taking too long.
+	timedOut bool
+}
+
+type module struct {
+	globals starlark.StringDict
+	err     error
+}
+
+func newExecution(run Run) *execution {
+	if run.Name == "" {
+		run.Name = run.Filename
+	}
+	e := &execution{run: run, start: run.Host.Now(), modules: make(map[string]*module)}
+	e.adapter, _ = run.Host.(Adapter)
+	if e.adapter != nil {
+		return e
+	}
+	e.predeclared = starlark.StringDict{"eprint": starlark.NewBuiltin("eprint", e.eprint)}
+	for name, value := range PluginBuiltins() {
+		e.predeclared[name] = value
+	}
+	for name, value := range run.Predeclared {
+		value.Freeze()
+		e.predeclared[name] = value
+	}
+	return e
+}
+
+// Execute runs a script, returning the result of its function.
+func Execute(run Run) (starlark.Value, error) {
+	e := newExecution(run)
+	if e.adapter != nil {
+		return WithTimeLimit(e.adapter, run.MaxExecutionTime, e.execute)
+	}
+	return e.execute()
+}
+
+// NewLoader returns a load function that loads modules for the threads of
+// a run as Execute does, each at most once, for a host that runs scripts
+// its own way. Only the Host, Name, Predeclared and Hooks of the run are
+// used.
+func NewLoader(run Run) LoadFunc {
+	return newExecution(run).load
+}
+
+func (e *execution) execute() (starlark.Value, error) {
+	globals, err := e.load(nil, e.run.Filename)
+	if err != nil {
+		return nil, e.failure(EvalFailed, err)
+	}
+	if e.run.Function == "" {
+		return starlark.None, nil
+	}
+	fn, ok := globals[e.run.Function]
+	if !ok {
+		if e.adapter != nil {
+			return nil, e.adapter.MissingFunction(e.run.Function)
+		}
+		return nil, fmt.Errorf("Error: the function %q is missing.", e.run.Function)
+	}
+	thread := e.newThread(e.run.Name, e.load)
+	var value starlark.Value
+	if e.adapter != nil {
+		value, err = e.adapter.Call(thread, fn, e.run.Args, e.run.Kwargs)
+	} else {
+		value, err = starlark.Call(thread, fn, e.run.Args, e.run.Kwargs)
+	}
+	if err != nil {
+		return nil, e.failure(ExecFailed, err)
+	}
+	return value, nil
+}
+
+// newThread returns a thread of the run, whose output and clock are the
+// host's, unless the host is an Adapter that makes its own.
+func (e *execution) newThread(name string, load LoadFunc) *starlark.Thread {
+	host := e.run.Host
+	if e.adapter != nil {
+		thread := e.adapter.NewThread(name, load)
+		thread.SetLocal(hostKey, host)
+		return thread
+	}
+	thread := &starlark.Thread{
+		Name: name,
+		Load: load,
+		Print: func(thread *starlark.Thread, msg string) {
+			host.Print("stdout", msg)
+		},
+	}
+	thread.SetLocal(hostKey, host)
+	startime.SetNow(thread, func() (time.Time, error) { return host.Now(), nil })
+
+	hooks := e.run.Hooks
+	if limit := e.run.MaxExecutionTime; limit > 0 {
+		hooks = append(hooks[:len(hooks):len(hooks)], StepHook{Interval: YieldInterval, Fn: func(thread *starlark.Thread) {
+			if host.Now().Sub(e.start) > limit {
+				e.timedOut = true
+				thread.Cancel("execution timed out")
+			}
+		}})
+	}
+	InstallStepHooks(thread, hooks)
+	return thread
+}
+
+// load loads a module, from those bundled or from the host, once per run.
+func (e *execution) load(caller *starlark.Thread, name string) (starlark.StringDict, error) {
+	if e.adapter != nil {
+		if err := e.adapter.CheckLoad(caller, name); err != nil {
+			return nil, err
+		}
+	}
+	if members, ok, err := BundledModule(name); ok {
+		if err == nil && e.adapter != nil {
+			members = e.adapter.Bundled(members)
+		}
+		return members, err
+	}
+	m, ok := e.modules[name]
+	if m == nil {
+		if ok {
+			return nil, fmt.Errorf("cycle in load graph")
+		}
+		e.modules[name] = nil
+		m = &module{}
+		thread := e.newThread(e.run.Name+" exec "+name, e.load)
+		m.globals, m.err = e.execModule(caller, thread, name)
+		if caller != nil {
+			// The caller's share of any step budget has shrunk.
+			RescheduleStepHooks(caller)
+		}
+		e.modules[name] = m
+	}
+	return m.globals, m.err
+}
+
+// execModule executes a module on thread, or has the Adapter do it.
+func (e *execution) execModule(caller *starlark.Thread, thread *starlark.Thread, name string) (starlark.StringDict, error) {
+	if e.adapter != nil {
+		return e.adapter.ExecModule(caller, thread, name)
+	}
+	source, err := e.run.Host.Load(name)
+	if err != nil {
+		return nil, err
+	}
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, name, source, e.predeclared)
+	// As wasm_runner's, so that the modules loading it cannot change it
+	// under one another.
+	globals.Freeze()
+	return globals, err
+}
+
+// eprint is print, to the host's stderr.
+func (e *execution) eprint(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	sep := " "
+	if err := starlark.UnpackArgs(b.Name(), nil, kwargs, "sep?", &sep); err != nil {
+		return nil, err
+	}
+	buf := new(strings.Builder)
+	for i, v := range args {
+		if i > 0 {
+			buf.WriteString(sep)
+		}
+		if s, ok := starlark.AsString(v); ok {
+			buf.WriteString(s)
+		} else {
+			buf.WriteString(v.String())
+		}
+	}
+	e.run.Host.Print("stderr", buf.String())
+	return starlark.None, nil
+}
+
+// failure describes an error of the run at stage, as wasm_runner would, or
+// as the Adapter does.
+func (e *execution) failure(stage Stage, err error) error {
+	if e.adapter != nil {
+		return e.adapter.Failed(stage, err)
+	}
+	var message string
+	switch {
+	case e.timedOut:
+		message = "Error: execution timed out"
+	case stage == EvalFailed:
+		message = fmt.Sprintf("Error: unable to evaluate the starlark code. %q", err.Error())
+	default:
+		message = fmt.Sprintf("Error: unable to execute the starlark code. %q", err.Error())
+	}
+	return &Error{Message: message, Cause: err}
+}
@@ -0,0 +1,478 @@
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runner_test
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"dcollien.com/starlark-wasm/internal/runner"
+	"dcollien.com/starlark-wasm/internal/runner/runnertest"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+var _ runner.Host = (*runnertest.Host)(nil)
+
+func TestExecute(t *testing.T) {
+	tests := []struct {
+		name     string
+		modules  map[string]string
+		function string
+		args     starlark.Tuple
+		kwargs   []starlark.Tuple
+		want     string
+		err      string
+	}{
+		{
+			name:     "function",
+			modules:  map[string]string{"main.star": "def main(x, y=2):\n    return x * y\n"},
+			function: "main",
+			args:     starlark.Tuple{starlark.MakeInt(21)},
+			want:     "42",
+		},
+		{
+			name:     "kwargs",
+			modules:  map[string]string{"main.star": "def main(x, y=2):\n    return [x, y]\n"},
+			function: "main",
+			args:     starlark.Tuple{starlark.MakeInt(1)},
+			kwargs:   []starlark.Tuple{{starlark.String("y"), starlark.String("b")}},
+			want:     `[1, "b"]`,
+		},
+		{
+			name:    "module only",
+			modules: map[string]string{"main.star": "x = 1\n"},
+			want:    "None",
+		},
+		{
+			name: "loads from the host",
+			modules: map[string]string{
+				"main.star": "load(\"lib.star\", \"double\")\ndef main():\n    return double(4)\n",
+				"lib.star":  "def double(n):\n    return n * 2\n",
+			},
+			function: "main",
+			want:     "8",
+		},
+		{
+			name:     "bundled module",
+			modules:  map[string]string{"main.star": "load(\"@std/json\", \"json\")\ndef main():\n    return json.encode({\"a\": 1})\n"},
+			function: "main",
+			want:     `"{\"a\":1}"`,
+		},
+		{
+			name:     "missing bundled module",
+			modules:  map[string]string{"main.star": "load(\"@std/nope\", \"nope\")\n"},
+			function: "main",
+			err:      `there is no bundled module \"nope\" in this build`,
+		},
+		{
+			name:     "missing function",
+			modules:  map[string]string{"main.star": "x = 1\n"},
+			function: "main",
+			err:      `Error: the function "main" is missing.`,
+		},
+		{
+			name:    "missing module",
+			modules: map[string]string{},
+			err:     `Error: unable to evaluate the starlark code. "Error: failed to load the file \"main.star\".`,
+		},
+		{
+			name: "load cycle",
+			modules: map[string]string{
+				"main.star": "load(\"a.star\", \"a\")\n",
+				"a.star":    "load(\"main.star\", \"b\")\na = 1\n",
+			},
+			err: "cycle in load graph",
+		},
+		{
+			name:    "syntax error",
+			modules: map[string]string{"main.star": "def main(:\n"},
+			err:     `Error: unable to evaluate the starlark code. "main.star:1:11: got ':'`,
+		},
+		{
+			name:     "runtime error",
+			modules:  map[string]string{"main.star": "def main():\n    return 1 // 0\n"},
+			function: "main",
+			err:      `Error: unable to execute the starlark code. "floored division by zero"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, err := runner.Execute(runner.Run{
+				Host:     runnertest.NewHost(test.modules),
+				Filename: "main.star",
+				Function: test.function,
+				Args:     test.args,
+				Kwargs:   test.kwargs,
+			})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got %v, %v, want an error containing %q", value, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := value.String(); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestExecuteBacktrace(t *testing.T) {
+	host := runnertest.NewHost(map[string]string{"main.star": "def main():\n    fail(\"boom\")\n"})
+	_, err := runner.Execute(runner.Run{Host: host, Filename: "main.star", Function: "main"})
+	var evalErr *starlark.EvalError
+	if !errors.As(err, &evalErr) {
+		t.Fatalf("got %v, want an error wrapping a *starlark.EvalError", err)
+	}
+	if backtrace := evalErr.Backtrace(); !strings.Contains(backtrace, "main.star:2:9: in main") {
+		t.Errorf("backtrace %q does not name the line that failed", backtrace)
+	}
+}
+
+func TestExecuteOutput(t *testing.T) {
+	host := runnertest.NewHost(map[string]string{
+		"main.star": "load(\"lib.star\", \"x\")\nprint(\"top\", x)\ndef main():\n    eprint(\"a\", \"b\", sep=\"-\")\n    print(1, [2])\n",
+		"lib.star":  "print(\"lib\")\nx = 1\n",
+	})
+	if _, err := runner.Execute(runner.Run{Host: host, Filename: "main.star", Function: "main"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []runnertest.Line{
+		{Stream: "stdout", Message: "lib"},
+		{Stream: "stdout", Message: "top 1"},
+		{Stream: "stderr", Message: "a-b"},
+		{Stream: "stdout", Message: "1 [2]"},
+	}
+	if got := host.Output(); !reflect.DeepEqual(got, want) {
+		t.Errorf("output %v, want %v", got, want)
+	}
+	if got := host.Loads(); !reflect.DeepEqual(got, []string{"main.star", "lib.star"}) {
+		t.Errorf("loads %v, want main.star then lib.star", got)
+	}
+}
+
+func TestExecuteLoadsEachModuleOnce(t *testing.T) {
+	host := runnertest.NewHost(map[string]string{
+		"main.star": "load(\"a.star\", \"a\")\nload(\"b.star\", \"b\")\n",
+		"a.star":    "load(\"c.star\", \"c\")\na = c\n",
+		"b.star":    "load(\"c.star\", \"c\")\nb = c\n",
+		"c.star":    "print(\"c\")\nc = 1\n",
+	})
+	if _, err := runner.Execute(runner.Run{Host: host, Filename: "main.star"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(host.Output()); got != 1 {
+		t.Errorf("c.star ran %d times, want once", got)
+	}
+}
+
+func TestExecuteClock(t *testing.T) {
+	host := runnertest.NewHost(map[string]string{"main.star": "load(\"@std/time\", \"time\")\ndef main():\n    return str(time.now())\n"})
+	value, err := runner.Execute(runner.Run{Host: host, Filename: "main.star", Function: "main"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"2024-01-01 00:00:00 +0000 UTC"`; value.String() != want {
+		t.Errorf("time.now() = %s, want %s", value, want)
+	}
+}
+
+func TestExecuteTimeout(t *testing.T) {
+	host := runnertest.NewHost(map[string]string{"main.star": "def main():\n    for i in range(1000000000):\n        pass\n"})
+	host.Tick = time.Second
+	_, err := runner.Execute(runner.Run{Host: host, Filename: "main.star", Function: "main", MaxExecutionTime: 5 * time.Second})
+	if err == nil || err.Error() != "Error: execution timed out" {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+	var evalErr *starlark.EvalError
+	if !errors.As(err, &evalErr) || !strings.Contains(evalErr.Backtrace(), "main.star:2:") {
+		t.Errorf("the timeout %v does not say where the script was", err)
+	}
+}
+
+func TestExecuteHooksAndPredeclared(t *testing.T) {
+	host := runnertest.NewHost(map[string]string{"main.star": "def main():\n    return [roll(), roll()]\n"})
+	roll := starlark.NewBuiltin("roll", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		return starlark.MakeUint64(runner.HostOf(thread).Rand()), nil
+	})
+	hooked := 0
+	value, err := runner.Execute(runner.Run{
+		Host:        host,
+		Filename:    "main.star",
+		Function:    "main",
+		Predeclared: starlark.StringDict{"roll": roll},
+		Hooks:       []runner.StepHook{{Interval: 1, Fn: func(*starlark.Thread) { hooked++ }}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.String() != "[1, 2]" {
+		t.Errorf("got %s, want the fake host's first two random numbers", value)
+	}
+	if hooked == 0 {
+		t.Error("the step hook never ran")
+	}
+}
+
+func TestExecuteFreezesPredeclared(t *testing.T) {
+	shared := starlark.NewList([]starlark.Value{starlark.MakeInt(1)})
+	// The same list is reachable under two names and through a dict, so
+	// none of them can be a way around the freezing.
+	config := starlark.NewDict(1)
+	if err := config.SetKey(starlark.String("items"), shared); err != nil {
+		t.Fatal(err)
+	}
+	predeclared := starlark.StringDict{"items": shared, "alias": shared, "config": config}
+	for _, source := range []string{
+		"items.append(2)\n",
+		"alias.append(2)\n",
+		"config[\"items\"].append(2)\n",
+		"config[\"other\"] = 2\n",
+		"def main():\n    items.clear()\nmain()\n",
+	} {
+		host := runnertest.NewHost(map[string]string{"main.star": source})
+		_, err := runner.Execute(runner.Run{Host: host, Filename: "main.star", Predeclared: predeclared})
+		if err == nil || !strings.Contains(err.Error(), "frozen") {
+			t.Errorf("%q: got %v, want a frozen value error", source, err)
+		}
+	}
+	if shared.String() != "[1]" || config.Len() != 1 {
+		t.Errorf("a script changed the host's values to %s and %s", shared, config)
+	}
+
+	// A second run sees the values as the host passed them.
+	host := runnertest.NewHost(map[string]string{"main.star": "def main():\n    return [items, alias == items, config]\n"})
+	value, err := runner.Execute(runner.Run{Host: host, Filename: "main.star", Function: "main", Predeclared: predeclared})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `[[1], True, {"items": [1]}]`; value.String() != want {
+		t.Errorf("got %s, want %s", value, want)
+	}
+}
+
+func TestExecuteFreezesLoadedModules(t *testing.T) {
+	host := runnertest.NewHost(map[string]string{
+		"main.star": "load(\"a.star\", \"a\")\nload(\"b.star\", \"b\")\ndef main():\n    return b\n",
+		"a.star":    "load(\"c.star\", \"shared\")\nshared.append(\"a\")\na = 1\n",
+		"b.star":    "load(\"c.star\", \"shared\")\nb = shared\n",
+		"c.star":    "shared = []\n",
+	})
+	_, err := runner.Execute(runner.Run{Host: host, Filename: "main.star", Function: "main"})
+	if err == nil || !strings.Contains(err.Error(), "frozen") {
+		t.Errorf("got %v, want a.star's change to c.star's list to fail", err)
+	}
+}
+
+func TestSliceSteps(t *testing.T) {
+	for _, test := range []struct {
+		share float64
+		want  uint64
+	}{
+		{1, runner.YieldInterval},
+		{0.5, runner.YieldInterval / 2},
+		{4, 4 * runner.YieldInterval},
+		{0, runner.YieldInterval / 100},
+		{1000, 10 * runner.YieldInterval},
+	} {
+		if got := runner.SliceSteps(test.share); got != test.want {
+			t.Errorf("SliceSteps(%v) = %d, want %d", test.share, got, test.want)
+		}
+	}
+}
+
+// adapter is an Adapter over a runnertest.Host that runs its modules with
+// the predeclared name adapted, and records what the runner asked of it.
+type adapter struct {
+	*runnertest.Host
+	denied    string
+	cancelled string
+	stages    []runner.Stage
+}
+
+func (a *adapter) NewThread(name string, load runner.LoadFunc) *starlark.Thread {
+	return &starlark.Thread{Name: name, Load: load}
+}
+
+func (a *adapter) Cancel(reason string) { a.cancelled = reason }
+
+func (a *adapter) CheckLoad(caller *starlark.Thread, module string) error {
+	if caller != nil && module == a.denied {
+		return fmt.Errorf("%s may not be loaded", module)
+	}
+	return nil
+}
+
+func (a *adapter) Bundled(members starlark.StringDict) starlark.StringDict {
+	return starlark.StringDict{"adapted": starlark.True}
+}
+
+func (a *adapter) ExecModule(caller *starlark.Thread, thread *starlark.Thread, module string) (starlark.StringDict, error) {
+	source, err := a.Load(module)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.ExecFileOptions(&syntax.FileOptions{}, thread, module, source, starlark.StringDict{"adapted": starlark.True})
+}
+
+func (a *adapter) Call(thread *starlark.Thread, fn starlark.Value, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	return starlark.Call(thread, fn, args, kwargs)
+}
+
+func (a *adapter) Failed(stage runner.Stage, err error) error {
+	a.stages = append(a.stages, stage)
+	return fmt.Errorf("%s: %w", stage, err)
+}
+
+func (a *adapter) MissingFunction(name string) error { return fmt.Errorf("no %s", name) }
+
+func (a *adapter) TimedOut() error { return errors.New("timed out") }
+
+func (a *adapter) Panicked(r interface{}) error { return fmt.Errorf("panicked: %v", r) }
+
+var _ runner.Adapter = (*adapter)(nil)
+
+func TestExecuteAdapter(t *testing.T) {
+	tests := []struct {
+		name     string
+		modules  map[string]string
+		function string
+		denied   string
+		want     string
+		err      string
+		stages   []runner.Stage
+	}{
+		{
+			name:     "function",
+			modules:  map[string]string{"main.star": "def main():\n    return adapted\n"},
+			function: "main",
+			want:     "True",
+		},
+		{
+			name:     "bundled module",
+			modules:  map[string]string{"main.star": "load(\"@std/json\", \"adapted\")\ndef main():\n    return adapted\n"},
+			function: "main",
+			want:     "True",
+		},
+		{
+			name: "denied load",
+			modules: map[string]string{
+				"main.star": "load(\"lib.star\", \"x\")\n",
+				"lib.star":  "x = 1\n",
+			},
+			denied: "lib.star",
+			err:    "evalFailed: cannot load lib.star: lib.star may not be loaded",
+			stages: []runner.Stage{runner.EvalFailed},
+		},
+		{
+			name:     "missing function",
+			modules:  map[string]string{"main.star": "x = 1\n"},
+			function: "main",
+			err:      "no main",
+		},
+		{
+			name:     "runtime error",
+			modules:  map[string]string{"main.star": "def main():\n    return 1 // 0\n"},
+			function: "main",
+			err:      "execFailed: floored division by zero",
+			stages:   []runner.Stage{runner.ExecFailed},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			host := &adapter{Host: runnertest.NewHost(test.modules), denied: test.denied}
+			value, err := runner.Execute(runner.Run{Host: host, Filename: "main.star", Function: test.function})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got %v, %v, want an error containing %q", value, err, test.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if got := value.String(); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+			if !reflect.DeepEqual(host.stages, test.stages) {
+				t.Errorf("failed at %v, want %v", host.stages, test.stages)
+			}
+		})
+	}
+}
+
+func TestWithTimeLimit(t *testing.T) {
+	host := &adapter{Host: runnertest.NewHost(nil)}
+	value, err := runner.WithTimeLimit(host, time.Second, func() (starlark.Value, error) {
+		return starlark.MakeInt(1), nil
+	})
+	if err != nil || value != starlark.MakeInt(1) {
+		t.Errorf("got %v, %v, want the run's own result", value, err)
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+	_, err = runner.WithTimeLimit(host, time.Millisecond, func() (starlark.Value, error) {
+		<-release
+		return starlark.None, nil
+	})
+	if err == nil || err.Error() != "timed out" || host.cancelled != "timeout" {
+		t.Errorf("got %v, cancelled for %q, want a cancelled run that timed out", err, host.cancelled)
+	}
+
+	_, err = runner.WithTimeLimit(host, time.Second, func() (starlark.Value, error) {
+		panic("boom")
+	})
+	if err == nil || err.Error() != "panicked: boom" {
+		t.Errorf("got %v, want the host's error for the panic", err)
+	}
+}
+
+func TestConvertArgs(t *testing.T) {
+	values := []string{"a", "b"}
+	arg := func(i int, path string) (starlark.Value, error) {
+		return starlark.String(path + "=" + values[i]), nil
+	}
+	keys := []string{"x", "skipped", "y"}
+	kwarg := func(i int, path string) (starlark.Value, error) {
+		if keys[i] == "skipped" {
+			return nil, nil
+		}
+		return starlark.String(path), nil
+	}
+	args, kwargs, err := runner.ConvertArgs(len(values), arg, keys, kwarg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `("args[0]=a", "args[1]=b")`; args.String() != want {
+		t.Errorf("args %s, want %s", args, want)
+	}
+	if want := `[("x", "kwargs[\"x\"]") ("y", "kwargs[\"y\"]")]`; fmt.Sprint(kwargs) != want {
+		t.Errorf("kwargs %s, want %s", kwargs, want)
+	}
+
+	failing := func(i int, path string) (starlark.Value, error) { return nil, errors.New("bad") }
+	if _, _, err := runner.ConvertArgs(2, failing, nil, nil); err == nil || err.Error() != "Error: unable to convert argument 0. bad" {
+		t.Errorf("got %v, want the first argument's error", err)
+	}
+	if _, _, err := runner.ConvertArgs(0, nil, []string{"k"}, failing); err == nil || err.Error() != `Error: unable to convert keyword argument "k". bad` {
+		t.Errorf("got %v, want the keyword argument's error", err)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package runnertest provides a Host for testing code built on the runner
+// without a browser or a wasm runtime: its modules are held in memory, its
+// output is captured, and its clock only moves when told to.
+package runnertest
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Line is a line of output a Host captured.
+type Line struct {
+	Stream  string
+	Message string
+}
+
+// Host is a runner.Host for tests. Its zero value has no modules, and a
+// clock stopped at the zero time.
+type Host struct {
+	// Modules holds the source of the modules Load finds, by filename.
+	Modules map[string]string
+	// Tick is how far the clock moves each time it is read, so that a
+	// script that reads it, or a run with a timeout, sees time pass.
+	Tick time.Duration
+
+	mu    sync.Mutex
+	now   time.Time
+	rand  uint64
+	lines []Line
+	loads []string
+}
+
+// NewHost returns a host with the given modules, and a clock set to a fixed
+// time.
+func NewHost(modules map[string]string) *Host {
+	return &Host{Modules: modules, now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (h *Host) Load(filename string) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.loads = append(h.loads, filename)
+	source, ok := h.Modules[filename]
+	if !ok {
+		return "", fmt.Errorf("Error: failed to load the file %q. Error: \"no such module\"", filename)
+	}
+	return source, nil
+}
+
+func (h *Host) Print(stream string, message string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lines = append(h.lines, Line{stream, message})
+}
+
+func (h *Host) Now() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := h.now
+	h.now = h.now.Add(h.Tick)
+	return now
+}
+
+// Rand returns the numbers 1, 2, 3 and so on, in turn.
+func (h *Host) Rand() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rand++
+	return h.rand
+}
+
+// Advance moves the clock forward by d.
+func (h *Host) Advance(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.now = h.now.Add(d)
+}
+
+// Output returns the lines printed so far.
+func (h *Host) Output() []Line {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Line(nil), h.lines...)
+}
+
+// Loads returns the filenames loaded so far, in order.
+func (h *Host) Loads() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.loads...)
+}
@@ -0,0 +1,131 @@
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runner
+
+import (
+	"math"
+	"runtime"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// YieldInterval is the number of steps a thread runs between yields to the
+// Go scheduler. Goroutines are never preempted in wasm, so without yielding a
+// busy script would starve timers, and with them timeouts, as well as any
+// other execution in flight.
+const YieldInterval = 10000
+
+// HostYieldInterval is the longest a busy script keeps the host's event loop
+// waiting. Yielding to the Go scheduler does not return to the host, which
+// only runs once every goroutine is blocked, so without a pause now and then
+// the host could not so much as ask what the script is doing; see
+// starlark.stack.
+const HostYieldInterval = 200 * time.Millisecond
+
+// Yielder is the step hook that yields a thread, to the Go scheduler and now
+// and then to the host.
+//
+// Yielding to the Go scheduler puts the goroutine at the back of its run
+// queue, so busy threads take turns, each running as many steps between
+// yields as the hook's interval: a thread whose hook runs every
+// 2*YieldInterval steps gets twice the steps of one yielding every
+// YieldInterval. See SliceSteps.
+func Yielder() func(thread *starlark.Thread) {
+	last := time.Now()
+	return func(*starlark.Thread) {
+		if time.Since(last) < HostYieldInterval {
+			runtime.Gosched()
+			return
+		}
+		// Once every goroutine is blocked, the host runs until the first
+		// timer is due. A shorter sleep is over before the scheduler goes
+		// idle.
+		time.Sleep(time.Millisecond)
+		last = time.Now()
+	}
+}
+
+// MinShare and MaxShare bound a thread's share, the multiple of YieldInterval
+// steps it runs in each turn. The smallest still runs a hundred steps a
+// turn, and the largest cannot keep the others waiting for long.
+const (
+	MinShare = 0.01
+	MaxShare = 10
+)
+
+// SliceSteps is how many steps a thread with the given share of the turns,
+// 1 being the usual, runs before yielding to the Go scheduler: the interval
+// of its Yielder hook.
+func SliceSteps(share float64) uint64 {
+	share = min(max(share, MinShare), MaxShare)
+	return uint64(share * YieldInterval)
+}
+
+// StepHook is a function run every Interval steps of a thread, or, if At is
+// set, once the thread has executed the number of steps At returns.
+type StepHook struct {
+	Interval uint64
+	At       func(thread *starlark.Thread) uint64
+	Fn       func(thread *starlark.Thread)
+}
+
+const stepHooksKey = "starlark_wasm.stepHooks"
+
+// InstallStepHooks arranges for each hook to run every Interval steps the
+// thread executes. Starlark has no step hook of its own, so this piggybacks
+// on the step limit: OnMaxSteps runs the hooks that are due and then raises
+// the limit to the next step at which one is due.
+func InstallStepHooks(thread *starlark.Thread, hooks []StepHook) {
+	if len(hooks) == 0 {
+		return
+	}
+	nextDue := func(thread *starlark.Thread) uint64 {
+		steps := thread.ExecutionSteps()
+		next := uint64(math.MaxUint64)
+		for _, hook := range hooks {
+			var due uint64
+			if hook.At != nil {
+				due = max(hook.At(thread), steps+1)
+			} else {
+				due = (steps/hook.Interval + 1) * hook.Interval
+			}
+			if due < next {
+				next = due
+			}
+		}
+		return next
+	}
+
+	thread.OnMaxSteps = func(thread *starlark.Thread) {
+		steps := thread.ExecutionSteps()
+		for _, hook := range hooks {
+			if hook.At != nil && steps >= hook.At(thread) || hook.At == nil && steps%hook.Interval == 0 {
+				hook.Fn(thread)
+			}
+		}
+		thread.SetMaxExecutionSteps(nextDue(thread))
+	}
+	thread.SetMaxExecutionSteps(nextDue(thread))
+	thread.SetLocal(stepHooksKey, nextDue)
+}
+
+// RescheduleStepHooks recomputes when the next of the thread's hooks is due,
+// for hooks whose At has changed while the thread was not stepping.
+func RescheduleStepHooks(thread *starlark.Thread) {
+	if nextDue, ok := thread.Local(stepHooksKey).(func(*starlark.Thread) uint64); ok {
+		thread.SetMaxExecutionSteps(nextDue(thread))
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runner
+
+import (
+	"context"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// CancelGracePeriod is how long a cancelled script has to stop before the
+// runner gives up waiting for it.
+const CancelGracePeriod = 100 * time.Millisecond
+
+// WithTimeLimit calls run, cancelling it through the host if it takes longer
+// than limit; 0 for no limit. Once cancelled, the run has CancelGracePeriod
+// to unwind, so that the host's TimedOut error can say where it was, and a
+// panic in it is the host's Panicked error.
+func WithTimeLimit(host Adapter, limit time.Duration, run func() (starlark.Value, error)) (starlark.Value, error) {
+	if limit <= 0 {
+		return run()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), limit)
+	defer cancel()
+
+	type result struct {
+		value starlark.Value
+		err   error
+	}
+	resultChan := make(chan result, 1)
+
+	go func() {
+		var value starlark.Value
+		var err error
+		defer func() {
+			// A panic here would otherwise take down the whole wasm instance.
+			if r := recover(); r != nil {
+				err = host.Panicked(r)
+			}
+			resultChan <- result{value, err}
+		}()
+		value, err = run()
+	}()
+
+	select {
+	case <-ctx.Done():
+	case result := <-resultChan:
+		return result.value, result.err
+	}
+
+	// Stop the script, and give it a moment to unwind. It can only stop
+	// between steps, so it may not make it if it is blocked waiting on the
+	// host.
+	host.Cancel("timeout")
+	select {
+	case <-resultChan:
+	case <-time.After(CancelGracePeriod):
+	}
+	return nil, host.TimedOut()
+}
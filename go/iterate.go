@@ -0,0 +1,199 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"syscall/js"
+)
+
+// iterationStoppedReason is the reason a run is cancelled with when the host
+// stops iterating over it before it has settled.
+const iterationStoppedReason = "the iteration was stopped"
+
+// emitIterator is the handle wasm_runner returns with the iterate option, in
+// place of a promise: an async iterator over the values the run emits, which
+// ends with the run's outcome, the value of its last step, or rejects with
+// its error. Values the host has not asked for yet wait in values, and calls
+// of next that have no value yet wait in waiting, oldest first.
+type emitIterator struct {
+	executionId string
+
+	mu      sync.Mutex
+	values  []js.Value
+	waiting []iteratorWaiter
+	// settled is set once the run has settled, with outcome its result, or
+	// its rejection if failed is set.
+	settled bool
+	outcome js.Value
+	failed  bool
+	// finished is set once a call of next has had the outcome, or the host
+	// has called return, after which next only ends the iteration.
+	finished bool
+}
+
+// iteratorWaiter is a call of next waiting for a value.
+type iteratorWaiter struct {
+	resolve js.Value
+	reject  js.Value
+}
+
+// iterationResult returns the {value, done} object a step of an async
+// iterator resolves with.
+func iterationResult(value js.Value, done bool) js.Value {
+	result := jsObject.New()
+	result.Set("value", value)
+	result.Set("done", done)
+	return result
+}
+
+// iterateAsync starts an execution as runAsync does, but returns its
+// emitIterator as a JS object: next and return, as for an async iterator,
+// Symbol.asyncIterator, so that it works with for await, its executionId,
+// and result, the promise runAsync returns.
+func iterateAsync(executionId string, options js.Value, run func(exec *execution) (js.Value, error)) js.Value {
+	it := &emitIterator{executionId: executionId}
+	promise := runAsync(executionId, options, func(exec *execution) (js.Value, error) {
+		exec.iterator = it
+		return run(exec)
+	})
+	promise.Call("then",
+		js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			it.settle(args[0], false)
+			return nil
+		}),
+		js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			it.settle(args[0], true)
+			return nil
+		}),
+	)
+
+	handle := jsObject.New()
+	handle.Set("executionId", executionId)
+	handle.Set("result", promise)
+	handle.Set("next", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		return it.next()
+	}))
+	handle.Set("return", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		value := js.Undefined()
+		if len(args) > 0 {
+			value = args[0]
+		}
+		return it.stop(value)
+	}))
+	descriptor := jsObject.New()
+	descriptor.Set("value", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		return this
+	}))
+	jsObject.Call("defineProperty", handle, js.Global().Get("Symbol").Get("asyncIterator"), descriptor)
+	return handle
+}
+
+// push hands a value the run emitted to the oldest waiting call of next, or
+// keeps it for the next call. Values emitted once the host has stopped
+// iterating are dropped.
+func (it *emitIterator) push(value js.Value) {
+	it.mu.Lock()
+	if it.finished {
+		it.mu.Unlock()
+		return
+	}
+	if len(it.waiting) > 0 {
+		waiter := it.waiting[0]
+		it.waiting = it.waiting[1:]
+		it.mu.Unlock()
+		waiter.resolve.Invoke(iterationResult(value, false))
+		return
+	}
+	it.values = append(it.values, value)
+	it.mu.Unlock()
+}
+
+// settle records the outcome of the run, and ends the calls of next waiting
+// on it, of which there are only any once every value has been read.
+func (it *emitIterator) settle(outcome js.Value, failed bool) {
+	it.mu.Lock()
+	it.settled, it.outcome, it.failed = true, outcome, failed
+	waiting := it.waiting
+	it.waiting = nil
+	it.mu.Unlock()
+	for _, waiter := range waiting {
+		it.finish(waiter)
+	}
+}
+
+// next returns a promise of the next step of the iteration: the oldest value
+// not yet read, or once there are none left and the run has settled, its
+// outcome.
+func (it *emitIterator) next() js.Value {
+	return jsPromise.New(js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		waiter := iteratorWaiter{resolve: args[0], reject: args[1]}
+		it.mu.Lock()
+		switch {
+		case len(it.values) > 0:
+			value := it.values[0]
+			it.values = it.values[1:]
+			it.mu.Unlock()
+			waiter.resolve.Invoke(iterationResult(value, false))
+		case it.settled || it.finished:
+			it.mu.Unlock()
+			it.finish(waiter)
+		default:
+			it.waiting = append(it.waiting, waiter)
+			it.mu.Unlock()
+		}
+		return nil
+	}))
+}
+
+// finish answers a call of next once there is no value left for it: the
+// first with the run's outcome, and those after with the end of the
+// iteration.
+func (it *emitIterator) finish(waiter iteratorWaiter) {
+	it.mu.Lock()
+	first := !it.finished
+	it.finished = true
+	it.mu.Unlock()
+	switch {
+	case !first:
+		waiter.resolve.Invoke(iterationResult(js.Undefined(), true))
+	case it.failed:
+		waiter.reject.Invoke(it.outcome)
+	default:
+		waiter.resolve.Invoke(iterationResult(it.outcome, true))
+	}
+}
+
+// stop ends the iteration early, as a for await loop does when it breaks,
+// dropping the values not yet read and cancelling the run if it has not
+// settled. Its result promise still settles with the outcome.
+func (it *emitIterator) stop(value js.Value) js.Value {
+	it.mu.Lock()
+	settled := it.settled
+	it.finished = true
+	it.values = nil
+	waiting := it.waiting
+	it.waiting = nil
+	it.mu.Unlock()
+	for _, waiter := range waiting {
+		waiter.resolve.Invoke(iterationResult(js.Undefined(), true))
+	}
+	if !settled {
+		cancelExecution(it.executionId, iterationStoppedReason)
+	}
+	return jsPromise.Call("resolve", iterationResult(value, true))
+}
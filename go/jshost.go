@@ -0,0 +1,184 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"dcollien.com/starlark-wasm/internal/runner"
+	"go.starlark.net/starlark"
+)
+
+// jsHost is the runner's host for an execution. It loads modules through
+// the host's callbacks, as the execution's options say, and makes the
+// threads, errors and messages of the run, so that runner.Execute does for
+// the js build what it does for any other.
+type jsHost struct {
+	exec *execution
+}
+
+// host returns the runner's host for the execution.
+func (e *execution) host() *jsHost {
+	return &jsHost{exec: e}
+}
+
+// loader returns a load function for the execution's threads. Each module
+// is loaded and initialized at most once per loader.
+func (e *execution) loader() runner.LoadFunc {
+	return runner.NewLoader(runner.Run{Host: e.host(), Name: e.id})
+}
+
+// execute runs a module and calls its function, as wasm_runner does, within
+// a time limit that the budget of the execution's retry key may shorten.
+func (e *execution) execute(filename string, function string, args starlark.Tuple, kwargs []starlark.Tuple, limit time.Duration) (starlark.Value, error) {
+	limit, err := e.retryLimit(limit)
+	if err != nil {
+		return nil, err
+	}
+	return runner.Execute(runner.Run{
+		Host:             e.host(),
+		Filename:         filename,
+		Name:             e.id,
+		Function:         function,
+		Args:             args,
+		Kwargs:           kwargs,
+		MaxExecutionTime: limit,
+	})
+}
+
+// runWithTimeout calls run, cancelling the execution if it takes longer than
+// maxExecutionTime seconds; 0 for no limit.
+func runWithTimeout(exec *execution, maxExecutionTime int, run func() (starlark.Value, error)) (starlark.Value, error) {
+	return runWithTimeLimit(exec, time.Duration(maxExecutionTime)*time.Second, run)
+}
+
+// runWithTimeLimit is runWithTimeout for a limit of any duration, which the
+// budget of the execution's retry key may shorten.
+func runWithTimeLimit(exec *execution, limit time.Duration, run func() (starlark.Value, error)) (starlark.Value, error) {
+	limit, err := exec.retryLimit(limit)
+	if err != nil {
+		return nil, err
+	}
+	return runner.WithTimeLimit(exec.host(), limit, run)
+}
+
+func (h *jsHost) Load(filename string) (string, error) {
+	source, _, err := h.exec.lockedLoad(filename)
+	return source, err
+}
+
+// Print writes output that did not come from a thread's print, so it has no
+// position.
+func (h *jsHost) Print(stream string, message string) {
+	h.exec.print(nil, stream, message)
+}
+
+func (h *jsHost) Now() time.Time { return time.Now() }
+
+func (h *jsHost) Rand() uint64 {
+	var b [8]byte
+	rand.Read(b[:])
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+func (h *jsHost) NewThread(name string, load runner.LoadFunc) *starlark.Thread {
+	return h.exec.newThread(name, load)
+}
+
+func (h *jsHost) Cancel(reason string) {
+	h.exec.cancel(reason)
+}
+
+func (h *jsHost) CheckLoad(caller *starlark.Thread, module string) error {
+	return h.exec.checkLoadAllowed(caller, module)
+}
+
+func (h *jsHost) Bundled(members starlark.StringDict) starlark.StringDict {
+	if h.exec.tracer != nil {
+		return traceMembers(members)
+	}
+	return members
+}
+
+// ExecModule loads a module from the host, within the maxModules and
+// maxSourceSize options, and initializes it as execModule does. The module
+// a synchronous run starts with is its source instead.
+func (h *jsHost) ExecModule(caller *starlark.Thread, thread *starlark.Thread, module string) (starlark.StringDict, error) {
+	exec := h.exec
+	if caller == nil && exec.entrySource != nil {
+		globals, err := exec.execModule(thread, module, *exec.entrySource, "")
+		exec.recordError(thread, err)
+		return globals, withAllResolveErrors(err)
+	}
+
+	loaded := exec.traceLoad(caller, module)
+	exec.meter.countLoad()
+	loadStart := time.Now()
+	var data, hash string
+	err := exec.checkModuleCount(module, exec.modules)
+	if err == nil {
+		exec.modules++
+		data, hash, err = exec.lockedLoad(module)
+	}
+	if err == nil {
+		exec.sourceSize += len(data)
+		err = exec.checkSourceSize(module, exec.sourceSize)
+	}
+	exec.addLoadTime(loadStart)
+	exec.addPhase(phaseLoad, module, loadStart)
+
+	var globals starlark.StringDict
+	if err == nil {
+		globals, err = exec.execModule(thread, module, data, hash)
+	}
+	loaded(thread)
+	exec.recordError(thread, err)
+	return globals, withAllResolveErrors(err)
+}
+
+func (h *jsHost) Call(thread *starlark.Thread, fn starlark.Value, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	callStart := time.Now()
+	value, err := starlark.Call(thread, fn, args, kwargs)
+	h.exec.addPhase(phaseExecute, "", callStart)
+	if err != nil {
+		h.exec.recordError(thread, err)
+	}
+	return value, err
+}
+
+func (h *jsHost) Failed(stage runner.Stage, err error) error {
+	code := codeEvalFailed
+	if stage == runner.ExecFailed {
+		code = codeExecFailed
+	}
+	return h.exec.wrapEvalError(code, err)
+}
+
+func (h *jsHost) MissingFunction(name string) error {
+	return h.exec.messageErr(codeMissingFunction, "function", fmt.Sprintf("%q", name))
+}
+
+func (h *jsHost) TimedOut() error {
+	return h.exec.timedOut()
+}
+
+func (h *jsHost) Panicked(r interface{}) error {
+	return newInternalError(r, panicStack())
+}
@@ -0,0 +1,119 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"syscall/js"
+	"time"
+)
+
+// parseLabels reads the labels option, an object of strings such as
+// {tenant: "acme", feature: "rules"}. Labels that are not strings are
+// ignored.
+func parseLabels(value js.Value) map[string]string {
+	if value.Type() != js.TypeObject {
+		return nil
+	}
+	keys := jsObject.Call("keys", value)
+	labels := make(map[string]string, keys.Length())
+	for i := 0; i < keys.Length(); i++ {
+		key := keys.Index(i).String()
+		if v := value.Get(key); v.Type() == js.TypeString {
+			labels[key] = v.String()
+		}
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
+
+// labelsToJSValue returns the labels as an object, their keys sorted.
+func labelsToJSValue(labels map[string]string) js.Value {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	obj := jsObject.New()
+	for _, key := range keys {
+		obj.Set(key, labels[key])
+	}
+	return obj
+}
+
+// labelTotals adds up the executions that had a label.
+type labelTotals struct {
+	runs  uint64
+	steps uint64
+	time  time.Duration
+}
+
+// labelUsage holds the totals of the executions that have ended, by label
+// and value, for starlark.usage().
+var labelUsage = struct {
+	mu      sync.Mutex
+	byLabel map[string]map[string]*labelTotals
+}{byLabel: make(map[string]map[string]*labelTotals)}
+
+// accountLabels adds the execution, once it has ended, to the totals of each
+// of its labels.
+func (e *execution) accountLabels() {
+	if len(e.options.labels) == 0 {
+		return
+	}
+	steps, elapsed := e.steps(), time.Since(e.calledAt)
+	labelUsage.mu.Lock()
+	defer labelUsage.mu.Unlock()
+	for key, value := range e.options.labels {
+		values := labelUsage.byLabel[key]
+		if values == nil {
+			values = make(map[string]*labelTotals)
+			labelUsage.byLabel[key] = values
+		}
+		totals := values[value]
+		if totals == nil {
+			totals = &labelTotals{}
+			values[value] = totals
+		}
+		totals.runs++
+		totals.steps += steps
+		totals.time += elapsed
+	}
+}
+
+// labelUsageToJSValue returns the totals by label, as {label: {value: {runs,
+// steps, time}}}, with time in milliseconds.
+func labelUsageToJSValue() js.Value {
+	labelUsage.mu.Lock()
+	defer labelUsage.mu.Unlock()
+	obj := jsObject.New()
+	for key, values := range labelUsage.byLabel {
+		jsValues := jsObject.New()
+		for value, totals := range values {
+			jsTotals := jsObject.New()
+			jsTotals.Set("runs", totals.runs)
+			jsTotals.Set("steps", totals.steps)
+			jsTotals.Set("time", milliseconds(totals.time))
+			jsValues.Set(value, jsTotals)
+		}
+		obj.Set(key, jsValues)
+	}
+	return obj
+}
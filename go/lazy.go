@@ -0,0 +1,245 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"syscall/js"
+
+	"go.starlark.net/starlark"
+)
+
+// With the lazy option, lists and dicts in a result are returned as JS
+// proxies that convert each element on first access, and keep it, so that a
+// host reading a few fields of a huge result only pays for those. The
+// proxies' handlers are written in JS, so that they can throw, and call back
+// into Go to look values up.
+
+// lazyProxySource builds the function that makes a proxy for a registered
+// value, given the Go callbacks: lookup(id, key) resolving to {value},
+// {error} or {} for a missing key, keys(id) listing the own keys, and
+// materialize(id) resolving like lookup to the fully converted value. The
+// registration is released once the proxy is garbage collected.
+const lazyProxySource = `
+const idKey = Symbol("starlark");
+const registry = new FinalizationRegistry(release);
+const unwrap = (result) => {
+	if (result.error !== undefined) {
+		throw result.error;
+	}
+	return result.value;
+};
+const resolve = (target, prop) => {
+	const result = lookup(target[idKey], prop);
+	if (!("value" in result) && result.error === undefined) {
+		return false;
+	}
+	Object.defineProperty(target, prop, { value: unwrap(result), writable: true, enumerable: true, configurable: true });
+	return true;
+};
+const isLazy = (target, prop) =>
+	typeof prop === "string" && !Object.prototype.hasOwnProperty.call(target, prop) &&
+	(!Array.isArray(target) || /^(0|[1-9][0-9]*)$/.test(prop));
+const handler = {
+	get(target, prop, receiver) {
+		if (prop === "materialize") {
+			return () => unwrap(materialize(target[idKey]));
+		}
+		if (isLazy(target, prop)) {
+			resolve(target, prop);
+		}
+		return Reflect.get(target, prop, receiver);
+	},
+	has(target, prop) {
+		if (isLazy(target, prop) && resolve(target, prop)) {
+			return true;
+		}
+		return Reflect.has(target, prop);
+	},
+	ownKeys(target) {
+		const own = Reflect.ownKeys(target).filter((key) => key !== idKey && typeof key !== "string");
+		return [...unwrap(keys(target[idKey])), ...own];
+	},
+	getOwnPropertyDescriptor(target, prop) {
+		if (prop === idKey) {
+			return undefined;
+		}
+		if (isLazy(target, prop)) {
+			resolve(target, prop);
+		}
+		return Reflect.getOwnPropertyDescriptor(target, prop);
+	},
+};
+return (id, length) => {
+	const target = length < 0 ? {} : new Array(length);
+	Object.defineProperty(target, idKey, { value: id, configurable: true });
+	const proxy = new Proxy(target, handler);
+	registry.register(proxy, id);
+	return proxy;
+};
+`
+
+// lazyValue is a list or dict behind a proxy.
+type lazyValue struct {
+	conv  *converter
+	value starlark.Value
+	path  string
+	// ownKeys caches the result of keys, so that enumerating the proxy
+	// again neither repeats the work nor its warnings.
+	ownKeys js.Value
+}
+
+var lazyValues = struct {
+	mu     sync.Mutex
+	next   int
+	values map[int]*lazyValue
+}{values: make(map[int]*lazyValue)}
+
+var (
+	lazyProxyOnce sync.Once
+	makeProxy     js.Value
+)
+
+// lazyResult wraps the outcome of a callback for unwrap in lazyProxySource.
+func lazyResult(value js.Value, err error) js.Value {
+	result := jsObject.New()
+	if err != nil {
+		result.Set("error", errorToJSValue(err))
+	} else {
+		result.Set("value", value)
+	}
+	return result
+}
+
+func lookupLazyValue(id int) *lazyValue {
+	lazyValues.mu.Lock()
+	defer lazyValues.mu.Unlock()
+	return lazyValues.values[id]
+}
+
+// lazyProxyMaker returns the function compiled from lazyProxySource.
+func lazyProxyMaker() js.Value {
+	lazyProxyOnce.Do(func() {
+		lookup := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			lazy := lookupLazyValue(args[0].Int())
+			if lazy == nil {
+				return lazyResult(js.Undefined(), fmt.Errorf("Error: the lazy value has been released."))
+			}
+			return lazy.lookup(args[1].String())
+		})
+		keys := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			lazy := lookupLazyValue(args[0].Int())
+			if lazy == nil {
+				return lazyResult(jsArray.New(), nil)
+			}
+			return lazyResult(lazy.keys())
+		})
+		materialize := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			lazy := lookupLazyValue(args[0].Int())
+			if lazy == nil {
+				return lazyResult(js.Undefined(), fmt.Errorf("Error: the lazy value has been released."))
+			}
+			conv := &converter{exec: lazy.conv.exec}
+			return lazyResult(conv.convertToJSValue(lazy.value, lazy.path))
+		})
+		release := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			lazyValues.mu.Lock()
+			delete(lazyValues.values, args[0].Int())
+			lazyValues.mu.Unlock()
+			return nil
+		})
+		factory := js.Global().Get("Function").New("lookup", "keys", "materialize", "release", lazyProxySource)
+		makeProxy = factory.Invoke(lookup, keys, materialize, release)
+	})
+	return makeProxy
+}
+
+// convertToLazyJSValue converts a value for the host as convertToJSValue
+// does, except that lists and dicts become proxies.
+func (c *converter) convertToLazyJSValue(value starlark.Value, path string) (js.Value, error) {
+	length := -1
+	switch v := value.(type) {
+	case *starlark.List:
+		length = v.Len()
+	case *starlark.Dict:
+	default:
+		return c.convertToJSValue(value, path)
+	}
+	if proxy, ok := c.converted[value]; ok {
+		return proxy, nil
+	}
+
+	lazyValues.mu.Lock()
+	id := lazyValues.next
+	lazyValues.next++
+	lazyValues.values[id] = &lazyValue{conv: c, value: value, path: path}
+	lazyValues.mu.Unlock()
+
+	proxy := lazyProxyMaker().Invoke(id, length)
+	c.memoize(value, proxy)
+	return proxy, nil
+}
+
+// lookup converts the element at key, resolving to {} if there is none.
+func (l *lazyValue) lookup(key string) js.Value {
+	switch v := l.value.(type) {
+	case *starlark.List:
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i >= v.Len() {
+			return jsObject.New()
+		}
+		return lazyResult(l.conv.convertToLazyJSValue(v.Index(i), fmt.Sprintf("%s[%d]", l.path, i)))
+	case *starlark.Dict:
+		item, found, err := v.Get(starlark.String(key))
+		if err != nil || !found {
+			return jsObject.New()
+		}
+		return lazyResult(l.conv.convertToLazyJSValue(item, fmt.Sprintf("%s[%q]", l.path, key)))
+	}
+	return jsObject.New()
+}
+
+// keys lists the own keys of the proxy's target: the indices and length of
+// a list, or the string keys of a dict.
+func (l *lazyValue) keys() (js.Value, error) {
+	if !l.ownKeys.IsUndefined() {
+		return l.ownKeys, nil
+	}
+	keys := jsArray.New()
+	switch v := l.value.(type) {
+	case *starlark.List:
+		for i := 0; i < v.Len(); i++ {
+			keys.Call("push", strconv.Itoa(i))
+		}
+		keys.Call("push", "length")
+	case *starlark.Dict:
+		for _, item := range v.Items() {
+			key, ok := item[0].(starlark.String)
+			if !ok {
+				if err := l.conv.lossy("unsupported_type", l.path, fmt.Sprintf("entry with %s key %s omitted", item[0].Type(), item[0])); err != nil {
+					return js.Null(), err
+				}
+				continue
+			}
+			keys.Call("push", string(key))
+		}
+	}
+	l.ownKeys = keys
+	return keys, nil
+}
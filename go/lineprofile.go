@@ -0,0 +1,125 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"sort"
+	"sync"
+	"syscall/js"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// lineSampleInterval is the number of steps between samples of the line
+// profiler. Each sample attributes the steps and time since the last one to
+// the line being executed.
+const lineSampleInterval = 10
+
+// sourceLine identifies a line of a module.
+type sourceLine struct {
+	filename string
+	line     int32
+}
+
+// lineCost is what the line profiler attributed to a line.
+type lineCost struct {
+	steps   uint64
+	time    time.Duration
+	samples int
+}
+
+// lineProfiler attributes the steps and time of an execution to the lines
+// of its modules, with the profileLines option. It is a lightweight
+// alternative to the profile option, which needs pprof tools to read.
+type lineProfiler struct {
+	mu sync.Mutex
+	// last is when any thread of the execution was last sampled, so that
+	// the time a thread spends waiting for a load it started is counted
+	// against the module loaded, not the load statement.
+	last  time.Time
+	lines map[sourceLine]*lineCost
+}
+
+func newLineProfiler() *lineProfiler {
+	return &lineProfiler{last: time.Now(), lines: make(map[sourceLine]*lineCost)}
+}
+
+// stepHook returns the step hook of a thread that samples it.
+func (p *lineProfiler) stepHook() func(thread *starlark.Thread) {
+	var lastSteps uint64
+	return func(thread *starlark.Thread) {
+		if thread.CallStackDepth() == 0 {
+			return
+		}
+		// Starlark only records positions where an instruction can fail,
+		// so a sample falls on the last such line reached, lagging one
+		// instruction behind.
+		pos := thread.CallFrame(0).Pos
+		key := sourceLine{filename: pos.Filename(), line: pos.Line}
+		steps := thread.ExecutionSteps()
+		now := time.Now()
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		cost := p.lines[key]
+		if cost == nil {
+			cost = &lineCost{}
+			p.lines[key] = cost
+		}
+		cost.steps += steps - lastSteps
+		cost.time += now.Sub(p.last)
+		cost.samples++
+		lastSteps = steps
+		p.last = now
+	}
+}
+
+// toJSValue returns the n lines that took the most steps, most first, as
+// {filename, line, steps, time, samples}, with time in milliseconds.
+func (p *lineProfiler) toJSValue(n int) js.Value {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	keys := make([]sourceLine, 0, len(p.lines))
+	for key := range p.lines {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := p.lines[keys[i]], p.lines[keys[j]]
+		if a.steps != b.steps {
+			return a.steps > b.steps
+		}
+		if keys[i].filename != keys[j].filename {
+			return keys[i].filename < keys[j].filename
+		}
+		return keys[i].line < keys[j].line
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	lines := jsArray.New(len(keys))
+	for i, key := range keys {
+		cost := p.lines[key]
+		obj := jsObject.New()
+		obj.Set("filename", key.filename)
+		obj.Set("line", key.line)
+		obj.Set("steps", cost.steps)
+		obj.Set("time", milliseconds(cost.time))
+		obj.Set("samples", cost.samples)
+		lines.SetIndex(i, obj)
+	}
+	return lines
+}
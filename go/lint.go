@@ -0,0 +1,201 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"syscall/js"
+
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// lintFinding is a single problem reported by lintSource, in the spirit of
+// buildifier's warnings.
+type lintFinding struct {
+	check    string
+	severity string
+	message  string
+	start    syntax.Position
+	end      syntax.Position
+}
+
+var (
+	functionNamePattern = regexp.MustCompile(`^_*[a-z][a-z0-9_]*$`)
+	variableNamePattern = regexp.MustCompile(`^_*([a-z][a-z0-9_]*|[A-Z][A-Z0-9_]*)$`)
+)
+
+// lintSource runs the lint checks over a single file. The checks are:
+//
+//   - unused-load: a name bound by load() is never used
+//   - builtin-shadow: a binding hides a universal builtin such as len or str
+//   - constant-condition: an if statement or conditional expression whose
+//     condition is a constant
+//   - name-conventions: functions are not lower_snake_case, or variables are
+//     neither lower_snake_case nor UPPER_SNAKE_CASE
+//
+// Syntax and resolver errors are reported as findings with severity "error".
+func lintSource(filename string, source string) []lintFinding {
+	fileOptions := syntax.FileOptions{}
+	f, err := fileOptions.Parse(filename, source, 0)
+	if err != nil {
+		var syntaxErr syntax.Error
+		if errors.As(err, &syntaxErr) {
+			return []lintFinding{{check: "syntax-error", severity: "error", message: syntaxErr.Msg, start: syntaxErr.Pos, end: syntaxErr.Pos}}
+		}
+		return []lintFinding{{check: "syntax-error", severity: "error", message: err.Error()}}
+	}
+
+	findings := []lintFinding{}
+
+	// Names that are neither bound nor universal are assumed to be
+	// predeclared by the host, so they are not reported here.
+	isPredeclared := func(name string) bool { return !starlark.Universe.Has(name) }
+	if err := resolve.File(f, isPredeclared, starlark.Universe.Has); err != nil {
+		var resolveErrs resolve.ErrorList
+		if errors.As(err, &resolveErrs) {
+			for _, e := range resolveErrs {
+				findings = append(findings, lintFinding{check: "resolve-error", severity: "error", message: e.Msg, start: e.Pos, end: e.Pos})
+			}
+		}
+	}
+
+	functionNames := make(map[*syntax.Ident]bool)
+	loadedNames := make(map[*syntax.Ident]bool)
+	walkSyntax(f, func(n syntax.Node) bool {
+		switch n := n.(type) {
+		case *syntax.DefStmt:
+			functionNames[n.Name] = true
+		case *syntax.LoadStmt:
+			for _, to := range n.To {
+				loadedNames[to] = true
+			}
+		case *syntax.IfStmt:
+			findings = append(findings, lintCondition(n.Cond, "if statement")...)
+		case *syntax.CondExpr:
+			findings = append(findings, lintCondition(n.Cond, "conditional expression")...)
+		}
+		return true
+	})
+
+	bindings, uses := bindingUses(f)
+	for _, id := range bindings {
+		start, end := id.Span()
+		if loadedNames[id] {
+			if uses[id] == 0 {
+				findings = append(findings, lintFinding{check: "unused-load", severity: "warning", message: fmt.Sprintf("loaded symbol %q is unused", id.Name), start: start, end: end})
+			}
+			continue
+		}
+
+		if starlark.Universe.Has(id.Name) {
+			findings = append(findings, lintFinding{check: "builtin-shadow", severity: "warning", message: fmt.Sprintf("%q shadows the builtin of the same name", id.Name), start: start, end: end})
+		}
+
+		if functionNames[id] {
+			if !functionNamePattern.MatchString(id.Name) {
+				findings = append(findings, lintFinding{check: "name-conventions", severity: "warning", message: fmt.Sprintf("function name %q should be lower_snake_case", id.Name), start: start, end: end})
+			}
+		} else if !variableNamePattern.MatchString(id.Name) && id.Name != "_" {
+			findings = append(findings, lintFinding{check: "name-conventions", severity: "warning", message: fmt.Sprintf("variable name %q should be lower_snake_case or UPPER_SNAKE_CASE", id.Name), start: start, end: end})
+		}
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		a, b := findings[i].start, findings[j].start
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Col < b.Col
+	})
+	return findings
+}
+
+func lintCondition(cond syntax.Expr, context string) []lintFinding {
+	if !isConstantExpr(cond) {
+		return nil
+	}
+	start, end := cond.Span()
+	return []lintFinding{{check: "constant-condition", severity: "warning", message: fmt.Sprintf("the condition of this %s is always the same", context), start: start, end: end}}
+}
+
+// isConstantExpr reports whether the truth value of e is known statically.
+func isConstantExpr(e syntax.Expr) bool {
+	switch e := e.(type) {
+	case *syntax.Literal:
+		return true
+	case *syntax.Ident:
+		binding, ok := e.Binding.(*resolve.Binding)
+		return ok && binding.Scope == resolve.Universal && (e.Name == "True" || e.Name == "False" || e.Name == "None")
+	case *syntax.ListExpr, *syntax.DictExpr, *syntax.TupleExpr:
+		return true
+	case *syntax.ParenExpr:
+		return isConstantExpr(e.X)
+	case *syntax.UnaryExpr:
+		return e.Op == syntax.NOT && isConstantExpr(e.X)
+	default:
+		return false
+	}
+}
+
+func positionToJSValue(pos syntax.Position) js.Value {
+	obj := jsObject.New()
+	obj.Set("line", pos.Line)
+	obj.Set("column", pos.Col)
+	return obj
+}
+
+func (f lintFinding) toJSValue() js.Value {
+	obj := jsObject.New()
+	obj.Set("check", f.check)
+	obj.Set("severity", f.severity)
+	obj.Set("message", f.message)
+	obj.Set("start", positionToJSValue(f.start))
+	obj.Set("end", positionToJSValue(f.end))
+	return obj
+}
+
+// jsLint implements starlark.lint(source, filename?), returning an array of
+// findings.
+func jsLint() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) (result interface{}) {
+		defer func() {
+			if r := recover(); r != nil {
+				result = errorToJSValue(newInternalError(r, panicStack()))
+			}
+		}()
+
+		if len(args) < 1 || args[0].Type() != js.TypeString {
+			return jsErrorConstructor.New("Error: lint requires the source code as a string.")
+		}
+		filename := "<lint>"
+		if len(args) > 1 && args[1].Type() == js.TypeString {
+			filename = args[1].String()
+		}
+
+		findings := lintSource(filename, args[0].String())
+		array := jsArray.New(len(findings))
+		for i, finding := range findings {
+			array.SetIndex(i, finding.toJSValue())
+		}
+		return array
+	})
+}
@@ -0,0 +1,111 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"syscall/js"
+
+	"go.starlark.net/starlark"
+)
+
+// loadPolicy is what the allowLoads and denyLoads options let the load
+// statements of an execution load: the modules, bundled ones included, that
+// match a pattern of allow, or any if allow is nil, and none that match a
+// pattern of deny. Patterns are as path.Match takes them, so that "lib/*"
+// matches the modules of lib but not of its subdirectories.
+type loadPolicy struct {
+	allow []string
+	deny  []string
+}
+
+// parseLoadPolicy reads the allowLoads and denyLoads options, arrays of
+// patterns. It returns nil if neither is set, and an error for a pattern
+// path.Match cannot read, rather than have it match nothing.
+func parseLoadPolicy(value js.Value) (*loadPolicy, error) {
+	allow, err := parsePatterns(value, "allowLoads")
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parsePatterns(value, "denyLoads")
+	if err != nil {
+		return nil, err
+	}
+	if allow == nil && deny == nil {
+		return nil, nil
+	}
+	return &loadPolicy{allow: allow, deny: deny}, nil
+}
+
+// parsePatterns reads the option of the given name as an array of patterns.
+// It returns nil if the option is not set, and an empty slice for an empty
+// array. Anything but an array of strings is an error, as a policy that
+// could not be read must not let every load through.
+func parsePatterns(value js.Value, name string) ([]string, error) {
+	option := value.Get(name)
+	if option.IsUndefined() || option.IsNull() {
+		return nil, nil
+	}
+	if option.Type() != js.TypeObject || !option.InstanceOf(jsArray) {
+		return nil, fmt.Errorf("Error: the %s option must be an array of patterns, not %s.", name, jsTypeName(option))
+	}
+	patterns := make([]string, 0, option.Length())
+	for i := 0; i < option.Length(); i++ {
+		pattern := option.Index(i)
+		if pattern.Type() != js.TypeString {
+			return nil, fmt.Errorf("Error: the %s option has %s at index %d, rather than a pattern.", name, jsTypeName(pattern), i)
+		}
+		if _, err := path.Match(pattern.String(), ""); err != nil {
+			return nil, fmt.Errorf("Error: the %s option has the pattern %q, which is malformed.", name, pattern.String())
+		}
+		patterns = append(patterns, pattern.String())
+	}
+	return patterns, nil
+}
+
+// matchesAny reports whether module matches one of the patterns.
+func matchesAny(patterns []string, module string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, module); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// permits reports whether the policy lets a load statement load module.
+func (p *loadPolicy) permits(module string) bool {
+	if p == nil {
+		return true
+	}
+	if matchesAny(p.deny, module) {
+		return false
+	}
+	return p.allow == nil || matchesAny(p.allow, module)
+}
+
+// checkLoadAllowed fails a load the load policy forbids, telling the
+// loadDenied handlers. Only load statements are checked, those with a
+// caller, so that the file run need not be allowed too.
+func (e *execution) checkLoadAllowed(caller *starlark.Thread, module string) error {
+	if caller == nil || e.options.loads.permits(module) {
+		return nil
+	}
+	e.notifyLoadDenied(module, codeLoadForbidden, "", "")
+	return e.messageErr(codeLoadForbidden, "file", fmt.Sprintf("%q", module))
+}
@@ -0,0 +1,114 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"syscall/js"
+
+	"go.starlark.net/starlark"
+)
+
+const (
+	// maxCapturedLocals is the most locals captured for any one frame.
+	maxCapturedLocals = 50
+	// maxCapturedLocalLength is the longest repr kept for a captured local.
+	maxCapturedLocalLength = 200
+)
+
+const localsRecorderKey = "starlark_wasm.localsRecorder"
+
+// capturedLocal is a local variable of a frame at the point of an error.
+type capturedLocal struct {
+	name  string
+	value starlark.Value
+}
+
+// localsRecorder keeps a copy of the locals of each active frame of a
+// thread, updated before every instruction. Locals are discarded as soon as
+// a failing frame unwinds, so they must be copied before the error happens.
+type localsRecorder struct {
+	// frames is indexed by stack depth, outermost first.
+	frames [][]capturedLocal
+}
+
+func (r *localsRecorder) record(thread *starlark.Thread) {
+	depth := thread.CallStackDepth()
+	if depth == 0 {
+		return
+	}
+	for len(r.frames) < depth {
+		r.frames = append(r.frames, nil)
+	}
+	// Deeper frames have returned.
+	r.frames = r.frames[:depth]
+
+	r.frames[depth-1] = appendFrameLocals(r.frames[depth-1][:0], thread.DebugFrame(0))
+}
+
+// appendFrameLocals appends the assigned locals of a frame to locals, up to
+// maxCapturedLocals.
+func appendFrameLocals(locals []capturedLocal, fr starlark.DebugFrame) []capturedLocal {
+	for i := 0; i < fr.NumLocals() && len(locals) < maxCapturedLocals; i++ {
+		binding, value := fr.Local(i)
+		if value == nil {
+			// Not yet assigned.
+			continue
+		}
+		locals = append(locals, capturedLocal{name: binding.Name, value: value})
+	}
+	return locals
+}
+
+// snapshot returns copies of the recorded locals for a stack of the given
+// depth.
+func (r *localsRecorder) snapshot(depth int) [][]capturedLocal {
+	frames := make([][]capturedLocal, depth)
+	for i := 0; i < depth && i < len(r.frames); i++ {
+		frames[i] = append([]capturedLocal(nil), r.frames[i]...)
+	}
+	return frames
+}
+
+// recordLocals saves the locals of the frames of an EvalError raised on the
+// thread, when the captureLocals option is set.
+func (e *execution) recordLocals(thread *starlark.Thread, err error) {
+	recorder, ok := thread.Local(localsRecorderKey).(*localsRecorder)
+	evalErr, isEvalErr := err.(*starlark.EvalError)
+	if !ok || !isEvalErr {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.locals == nil {
+		e.locals = make(map[*starlark.EvalError][][]capturedLocal)
+	}
+	e.locals[evalErr] = recorder.snapshot(len(evalErr.CallStack))
+}
+
+func capturedLocalsToJSValue(locals []capturedLocal) js.Value {
+	array := jsArray.New(len(locals))
+	for i, local := range locals {
+		repr := truncateString(local.value.String(), maxCapturedLocalLength)
+		obj := jsObject.New()
+		obj.Set("name", local.name)
+		obj.Set("type", local.value.Type())
+		obj.Set("value", repr)
+		array.SetIndex(i, obj)
+	}
+	return array
+}
@@ -0,0 +1,84 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"syscall/js"
+)
+
+// A lockfile pins each module a run may load to the hash of its source,
+// and perhaps to the URL it is fetched from, so that a run loads exactly
+// what it was reviewed with: the loader is asked for the URL rather than
+// the module's name, and a source with some other hash fails to load.
+
+// lockedModule is a module's entry in the lockfile option.
+type lockedModule struct {
+	// hash is the SHA-256 of the module's source, in lowercase hex, as
+	// contentHash gives it.
+	hash string
+	// url is what the loader is asked for in place of the module's name.
+	url string
+}
+
+// parseLockfile reads the lockfile option, an object of {hash, url?} by
+// module name. Entries without a string hash are ignored, so that their
+// modules cannot be loaded at all.
+func parseLockfile(value js.Value) map[string]lockedModule {
+	if value.Type() != js.TypeObject {
+		return nil
+	}
+	lockfile := make(map[string]lockedModule)
+	keys := jsObjectKeys.Invoke(value)
+	for i := 0; i < keys.Length(); i++ {
+		name := keys.Index(i).String()
+		entry := value.Get(name)
+		if entry.Type() != js.TypeObject || entry.Get("hash").Type() != js.TypeString {
+			continue
+		}
+		locked := lockedModule{hash: strings.ToLower(entry.Get("hash").String()), url: name}
+		if url := entry.Get("url"); url.Type() == js.TypeString && url.String() != "" {
+			locked.url = url.String()
+		}
+		lockfile[name] = locked
+	}
+	return lockfile
+}
+
+// lockedLoad loads a module as hostLoad does, from the URL the lockfile
+// option resolves it to, failing if the lockfile has no entry for it or
+// the source has drifted from its hash. Without a lockfile it is hostLoad.
+func (e *execution) lockedLoad(module string) (source string, hash string, err error) {
+	if e.options.lockfile == nil {
+		return e.hostLoad(module)
+	}
+	locked, ok := e.options.lockfile[module]
+	if !ok {
+		e.notifyLoadDenied(module, codeNotLocked, "", "")
+		return "", "", e.messageErr(codeNotLocked, "file", fmt.Sprintf("%q", module))
+	}
+	source, hash, err = e.hostLoad(locked.url)
+	if err != nil {
+		return "", "", err
+	}
+	if got := contentHash(source); got != locked.hash {
+		e.notifyLoadDenied(module, codeLockDrift, got, locked.hash)
+		return "", "", e.messageErr(codeLockDrift, "file", fmt.Sprintf("%q", module), "hash", got, "locked", locked.hash)
+	}
+	return source, hash, nil
+}
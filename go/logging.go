@@ -0,0 +1,108 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"syscall/js"
+	"time"
+)
+
+// The levels of the internal log, least severe first. Messages below the
+// current level are dropped before they are formatted, so the log costs
+// nothing while it is off, as it is by default.
+const (
+	logDebug int32 = iota
+	logInfo
+	logWarn
+	logError
+	logOff
+)
+
+// logLevelNames are the names of the levels, as the host gives and receives
+// them, and as the console methods they are written with are named.
+var logLevelNames = []string{"debug", "info", "warn", "error", "off"}
+
+// The parts of the runner that log, which each message is tagged with.
+const (
+	logInit    = "init"
+	logCache   = "cache"
+	logCancel  = "cancel"
+	logConvert = "convert"
+	logQueue   = "queue"
+)
+
+var logLevel atomic.Int32
+
+func init() {
+	logLevel.Store(logOff)
+}
+
+// parseLogLevel returns the level with the given name.
+func parseLogLevel(name string) (int32, error) {
+	for i, levelName := range logLevelNames {
+		if levelName == name {
+			return int32(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Error: unknown log level %q. Use debug, info, warn, error or off.", name)
+}
+
+// logf writes a message to the internal log, if its level is enabled: to
+// starlark.log({level, category, message, time}) when the host defines it,
+// otherwise to the console.
+func logf(level int32, category string, format string, args ...interface{}) {
+	if level < logLevel.Load() {
+		return
+	}
+	message := fmt.Sprintf(format, args...)
+	levelName := logLevelNames[level]
+	if hostLog := hostGlobal().Get("log"); hostLog.Type() == js.TypeFunction {
+		entry := jsObject.New()
+		entry.Set("level", levelName)
+		entry.Set("category", category)
+		entry.Set("message", message)
+		entry.Set("time", float64(time.Now().UnixNano())/1e6)
+		if _, err := invokeHost(hostLog, entry); err == nil {
+			return
+		}
+		// Fall back to the console, rather than losing the message.
+	}
+	js.Global().Get("console").Call(levelName, "starlark ["+category+"] "+message)
+}
+
+// setLogLevel changes the level of the internal log, returning the previous
+// one.
+func setLogLevel(level int32) int32 {
+	return logLevel.Swap(level)
+}
+
+// jsSetLogLevel implements starlark.setLogLevel(level), which turns the
+// internal log on or off while the module runs, returning the previous
+// level.
+func jsSetLogLevel() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 1 || args[0].Type() != js.TypeString {
+			return jsErrorConstructor.New("Error: setLogLevel requires a level as argument.")
+		}
+		level, err := parseLogLevel(args[0].String())
+		if err != nil {
+			return jsErrorConstructor.New(err.Error())
+		}
+		return logLevelNames[setLogLevel(level)]
+	})
+}
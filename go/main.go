@@ -1,3 +1,5 @@
+//go:build js
+
 // Copyright 2024 David Collien
 
 // Licensed under the Apache License, Version 2.0 (the "License");
@@ -15,80 +17,638 @@
 package main
 
 import (
-	"context"
+	"errors"
 	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"syscall/js"
 	"time"
 
+	"dcollien.com/starlark-wasm/internal/runner"
 	"go.starlark.net/starlark"
 	"go.starlark.net/syntax"
 )
 
-func convertToStarlarkValue(value js.Value) starlark.Value {
-	switch value.Type() {
-	case js.TypeBoolean:
-		return starlark.Bool(value.Bool())
-	case js.TypeNumber:
-		floatVal := value.Float()
-		if floatVal == float64(int(floatVal)) {
-			return starlark.MakeInt(value.Int())
-		}
-		return starlark.Float(floatVal)
-	case js.TypeString:
-		return starlark.String(value.String())
-	case js.TypeObject:
-		if value.InstanceOf(js.Global().Get("Array")) {
-			list := []starlark.Value{}
-			length := value.Length()
-			for i := 0; i < length; i++ {
-				list = append(list, convertToStarlarkValue(value.Index(i)))
-			}
-			return starlark.NewList(list)
-		} else {
-			dict := starlark.NewDict(value.Length())
-			keys := js.Global().Get("Object").Call("keys", value)
-			length := keys.Length()
-			for i := 0; i < length; i++ {
-				key := keys.Index(i).String()
-				dict.SetKey(starlark.String(key), convertToStarlarkValue(value.Get(key)))
+// runOptions are the optional settings passed as the last argument to
+// wasm_runner.
+type runOptions struct {
+	// envelope resolves the call with {value, warnings} instead of the bare
+	// return value.
+	envelope bool
+	// printPositions passes the source position of each print() call to the
+	// host's print callback.
+	printPositions bool
+	// captureOutput buffers output instead of forwarding it to the host, and
+	// returns it in the envelope, which it implies.
+	captureOutput bool
+	// settle resolves the call with the envelope even if it fails, with ok
+	// set and the error, and with the output it printed as logs, which is
+	// forwarded to the host too. It implies envelope.
+	settle bool
+	// printBatchSize, when above 1, buffers output and delivers it to the
+	// host in batches of up to this many lines, instead of a call per line.
+	printBatchSize int
+	// printFlushInterval is the longest batched output waits before it is
+	// delivered.
+	printFlushInterval time.Duration
+	// maxUnackedOutput, when above 0, pauses the execution when it has
+	// printed this many lines the host has not acknowledged with
+	// starlark.ackOutput, until the host does.
+	maxUnackedOutput int
+	// captureLocals attaches the local variables of each frame to runtime
+	// errors. It slows execution, as locals are recorded at every step.
+	captureLocals bool
+	// trace delivers trace events to the host's trace callback. It slows
+	// execution, as the stack is checked at every step.
+	trace bool
+	// profile runs the execution under Starlark's profiler and returns the
+	// profile in the envelope, which it implies.
+	profile bool
+	// profileLines, when positive, samples the lines the execution runs and
+	// returns this many of the most costly in the envelope, which it
+	// implies.
+	profileLines int
+	// record logs the responses of the host the execution depends on, its
+	// loads and clock readings, and returns them in the envelope, which it
+	// implies.
+	record bool
+	// audit logs every call the execution makes to the host's callbacks,
+	// and returns the log with the outcome, whether it succeeds or fails.
+	// It implies envelope.
+	audit bool
+	// replay, when not nil, serves the host responses from the recording
+	// of an earlier execution instead of asking the host.
+	replay *hostRecording
+	// replayErr is why the replay option could not be read.
+	replayErr error
+	// binary passes arguments and the result as MessagePack in Uint8Arrays
+	// instead of as JS values.
+	binary bool
+	// lazy returns lists and dicts in the result as proxies that convert
+	// their elements on first access.
+	lazy bool
+	// chunkSize, when positive, streams a list or dict result to the host
+	// in chunks of this many elements, resolving the call with null.
+	// It overrides binary and lazy for the result.
+	chunkSize int
+	// maxSteps, when positive, fails the execution once its threads have
+	// executed more than this many steps in all.
+	maxSteps uint64
+	// maxResultSize, when positive, fails the conversion of a result once
+	// it passes this many bytes, as counted by resultSizeOf.
+	maxResultSize int
+	// maxValueSize and maxTotalSize, when positive, fail the execution once
+	// a value its variables hold, or all of them together, are larger than
+	// this, as measured by sizeOf.
+	maxValueSize int
+	maxTotalSize int
+	// maxModules and maxSourceSize, when positive, fail the loads of an
+	// execution once it has loaded this many modules from the loader, or
+	// once the bytes of their source add up to more than this.
+	maxModules    int
+	maxSourceSize int
+	// maxCallRate, when positive, fails the execution once it calls host
+	// builtins more than this many times a second, beyond bursts of up to
+	// callBurst calls; see callLimiter.
+	maxCallRate float64
+	callBurst   int
+	// meter counts what the execution does under the cost model of
+	// meter.go, in its stats, which it implies.
+	meter bool
+	// breakpoints, when not nil, turns on debug mode, pausing the execution
+	// at these lines.
+	breakpoints breakpoints
+	// watches, when not nil, are expressions to evaluate in the paused
+	// frame at every pause, and at every new line if watchOn is
+	// watchOnLine. They turn on debug mode too.
+	watches []string
+	watchOn string
+	// cacheGlobals reuses the globals of cached modules, skipping their
+	// top-level code, instead of only their compiled programs.
+	cacheGlobals bool
+	// strict makes lossy conversions errors instead of warnings.
+	strict bool
+	// extendedTypes converts tuples, sets, bytes, big ints and dicts with
+	// keys other than strings to and from the JS values closest to them.
+	extendedTypes bool
+	// maxErrorLength limits the size of the error quoted in error messages,
+	// in bytes; 0 disables the limit.
+	maxErrorLength int
+	// onHostError is the policy for host callbacks that throw, one of the
+	// hostPolicy constants.
+	onHostError string
+	// sessionId identifies the host environment the execution belongs to,
+	// and is attached to its diagnostics alongside the execution id.
+	sessionId string
+	// labels are the host's own tags for the execution, such as its tenant
+	// or feature, attached to its diagnostics, stats and trace events, and
+	// totalled by starlark.usage().
+	labels map[string]string
+	// allowBuiltins, if set, is the only host builtins the execution may
+	// call: the runner's own, such as emit, and those of plugins. Calls to
+	// the others fail with a PermissionError.
+	allowBuiltins map[string]bool
+	// builtins, if not nil, removes builtins from the environment of the
+	// execution's modules, or replaces them with host functions.
+	builtins *builtinsOption
+	// hostFunctions are the host functions the execution's modules call as
+	// builtins, by name.
+	hostFunctions map[string]js.Value
+	// dialect, when not nil, is the language features and predeclared
+	// modules of the execution's modules, and dialectErr why the dialect
+	// option could not be read.
+	dialect    *dialect
+	dialectErr error
+	// printPolicy is what becomes of the execution's print and eprint
+	// output, one of the printPolicy constants.
+	printPolicy string
+	// verifyModules has the verify callback on the namespace's global
+	// object approve each module before it runs, as a run's own verify
+	// does.
+	verifyModules bool
+	// secrets are the values of the secrets global, by name, which the
+	// execution's redactor hides from what the host is given.
+	secrets map[string]string
+	// lockfile, if not nil, is the only place the execution's loads
+	// resolve from: the URL and hash of each module it may load, by name.
+	lockfile map[string]lockedModule
+	// loads, when not nil, is the modules the execution's load statements
+	// may load, and loadsErr why the allowLoads or denyLoads option could
+	// not be read.
+	loads    *loadPolicy
+	loadsErr error
+	// share is how many steps the execution's threads run in each turn
+	// they are given, as a multiple of the usual, so that several busy
+	// executions progress in proportion to their shares.
+	share float64
+	// priority is the class of the execution, priorityInteractive or
+	// priorityBatch, whose threads wait while interactive runs are in
+	// progress.
+	priority string
+	// memoryWatermarks are the fractions of maxTotalSize at which the
+	// execution has the host told of its values' size, or nil for the
+	// default ones.
+	memoryWatermarks []float64
+	// retainResult keeps the outcome of the execution for this long after
+	// it settles, for starlark.result to return.
+	retainResult time.Duration
+	// retryKey names the attempts of a run the host retries, whose time
+	// adds up against retryBudget, or else against the time limit of each.
+	retryKey    string
+	retryBudget time.Duration
+	// locale is the language of the runner's own error messages, which are
+	// English unless the host added messages for it; see setMessages.
+	locale string
+	// callbacks holds the print, printError, printBatch, emit, load and
+	// verify functions given with the run, which take the place of those on
+	// globalThis.starlark; see hostCallback.
+	callbacks js.Value
+}
+
+func parseRunOptions(value js.Value) runOptions {
+	options := runOptions{maxErrorLength: defaultMaxErrorLength, printFlushInterval: defaultPrintFlushInterval, share: 1}
+	// The global host functions apply to runs given no options too.
+	options.hostFunctions = parseHostFunctions(value)
+	options.dialect, options.dialectErr = parseDialect(value)
+	if value.Type() != js.TypeObject {
+		return options
+	}
+	options.envelope = optionBool(value, "envelope")
+	options.printPositions = optionBool(value, "printPositions")
+	options.captureOutput = optionBool(value, "captureOutput")
+	options.settle = optionBool(value, "settle")
+	options.captureLocals = optionBool(value, "captureLocals")
+	options.trace = optionBool(value, "trace")
+	options.profile = optionBool(value, "profile")
+	options.strict = optionBool(value, "strict")
+	options.extendedTypes = optionBool(value, "extendedTypes")
+	options.binary = optionBool(value, "binary")
+	options.cacheGlobals = optionBool(value, "cacheGlobals")
+	options.lazy = optionBool(value, "lazy")
+	options.record = optionBool(value, "record")
+	options.audit = optionBool(value, "audit")
+	options.meter = optionBool(value, "meter")
+	options.verifyModules = optionBool(value, "verifyModules")
+	options.callbacks = value
+	options.replay, options.replayErr = parseRecording(value.Get("replay"))
+	if maxErrorLength := value.Get("maxErrorLength"); maxErrorLength.Type() == js.TypeNumber {
+		options.maxErrorLength = maxErrorLength.Int()
+	}
+	if profileLines := value.Get("profileLines"); profileLines.Type() == js.TypeNumber {
+		options.profileLines = profileLines.Int()
+	}
+	if maxSteps := value.Get("maxSteps"); maxSteps.Type() == js.TypeNumber && maxSteps.Float() > 0 {
+		options.maxSteps = uint64(maxSteps.Float())
+	}
+	if maxResultSize := value.Get("maxResultSize"); maxResultSize.Type() == js.TypeNumber {
+		options.maxResultSize = maxResultSize.Int()
+	}
+	if maxValueSize := value.Get("maxValueSize"); maxValueSize.Type() == js.TypeNumber {
+		options.maxValueSize = maxValueSize.Int()
+	}
+	if maxTotalSize := value.Get("maxTotalSize"); maxTotalSize.Type() == js.TypeNumber {
+		options.maxTotalSize = maxTotalSize.Int()
+	}
+	if maxModules := value.Get("maxModules"); maxModules.Type() == js.TypeNumber {
+		options.maxModules = maxModules.Int()
+	}
+	if maxSourceSize := value.Get("maxSourceSize"); maxSourceSize.Type() == js.TypeNumber {
+		options.maxSourceSize = maxSourceSize.Int()
+	}
+	if maxCallRate := value.Get("maxCallRate"); maxCallRate.Type() == js.TypeNumber {
+		options.maxCallRate = maxCallRate.Float()
+	}
+	if callBurst := value.Get("callBurst"); callBurst.Type() == js.TypeNumber {
+		options.callBurst = callBurst.Int()
+	}
+	if chunkSize := value.Get("chunkSize"); chunkSize.Type() == js.TypeNumber {
+		options.chunkSize = chunkSize.Int()
+	}
+	if printBatchSize := value.Get("printBatchSize"); printBatchSize.Type() == js.TypeNumber {
+		options.printBatchSize = printBatchSize.Int()
+	}
+	if printFlushInterval := value.Get("printFlushInterval"); printFlushInterval.Type() == js.TypeNumber {
+		options.printFlushInterval = time.Duration(printFlushInterval.Float() * float64(time.Millisecond))
+	}
+	if maxUnackedOutput := value.Get("maxUnackedOutput"); maxUnackedOutput.Type() == js.TypeNumber {
+		options.maxUnackedOutput = maxUnackedOutput.Int()
+	}
+	options.breakpoints = parseBreakpoints(value.Get("breakpoints"))
+	options.watches = parseWatches(value.Get("watch"))
+	if watchOn := value.Get("watchOn"); watchOn.Type() == js.TypeString {
+		options.watchOn = watchOn.String()
+	}
+	if options.watches != nil && options.breakpoints == nil {
+		options.breakpoints = make(breakpoints)
+	}
+	if onHostError := value.Get("onHostError"); onHostError.Type() == js.TypeString {
+		options.onHostError = onHostError.String()
+	}
+	if sessionId := value.Get("sessionId"); sessionId.Type() == js.TypeString {
+		options.sessionId = sessionId.String()
+	}
+	options.labels = parseLabels(value.Get("labels"))
+	if allow := value.Get("allowBuiltins"); allow.Type() == js.TypeObject && allow.InstanceOf(jsArray) {
+		options.allowBuiltins = make(map[string]bool, allow.Length())
+		for i := 0; i < allow.Length(); i++ {
+			if name := allow.Index(i); name.Type() == js.TypeString {
+				options.allowBuiltins[name.String()] = true
 			}
-			return dict
 		}
-	default:
-		return starlark.None
-	}
-}
-
-func convertToJSValue(value starlark.Value) js.Value {
-	switch v := value.(type) {
-	case starlark.Bool:
-		return js.ValueOf(bool(v))
-	case starlark.Float:
-		return js.ValueOf(float64(v))
-	case starlark.String:
-		return js.ValueOf(string(v))
-	case starlark.Int:
-		intVal, _ := v.Int64()
-		return js.ValueOf(intVal)
-	case *starlark.List:
-		array := js.Global().Get("Array").New(v.Len())
-		for i := 0; i < v.Len(); i++ {
-			array.SetIndex(i, convertToJSValue(v.Index(i)))
+	}
+	options.builtins = parseBuiltinsOption(value.Get("builtins"))
+	options.secrets = parseSecrets(value.Get("secrets"))
+	options.lockfile = parseLockfile(value.Get("lockfile"))
+	options.loads, options.loadsErr = parseLoadPolicy(value)
+	if printPolicy := value.Get("printPolicy"); printPolicy.Type() == js.TypeString {
+		options.printPolicy = printPolicy.String()
+	}
+	if share := value.Get("share"); share.Type() == js.TypeNumber && share.Float() > 0 {
+		options.share = share.Float()
+	}
+	options.memoryWatermarks = parseWatermarks(value.Get("memoryWatermarks"))
+	if priority := value.Get("priority"); priority.Type() == js.TypeString {
+		options.priority = priority.String()
+	}
+	if retainResult := value.Get("retainResult"); retainResult.Type() == js.TypeNumber {
+		options.retainResult = time.Duration(retainResult.Float() * float64(time.Millisecond))
+	}
+	if retryKey := value.Get("retryKey"); retryKey.Type() == js.TypeString {
+		options.retryKey = retryKey.String()
+	}
+	if retryBudget := value.Get("retryBudget"); retryBudget.Type() == js.TypeNumber && retryBudget.Float() > 0 {
+		options.retryBudget = time.Duration(retryBudget.Float() * float64(time.Millisecond))
+	}
+	if locale := value.Get("locale"); locale.Type() == js.TypeString {
+		options.locale = locale.String()
+	}
+	if options.captureOutput || options.settle || options.profile || options.profileLines > 0 || options.record || options.audit || options.meter {
+		options.envelope = true
+	}
+	return options
+}
+
+// optionBool reads a boolean property, treating anything else as false.
+func optionBool(value js.Value, name string) bool {
+	option := value.Get(name)
+	return option.Type() == js.TypeBoolean && option.Bool()
+}
+
+// execution is the state of a single wasm_runner call.
+type execution struct {
+	id      string
+	options runOptions
+
+	mu       sync.Mutex
+	warnings []warning
+	output   []outputLine
+	batch    printBatch
+	locals   map[*starlark.EvalError][][]capturedLocal
+	timings  timings
+	memory   memoryUsage
+	// generations are the generations of the cached globals used for each
+	// module, with the cacheGlobals option.
+	generations map[string]uint64
+
+	// threads are all the threads created for the execution, so that they
+	// can be cancelled together.
+	threads      []*starlark.Thread
+	cancelReason string
+	// cancelled is closed once the execution is cancelled, for threads
+	// waiting on something else to stop waiting.
+	cancelled chan struct{}
+	// cancelledAt is the first error raised by a thread after cancellation,
+	// which records where that thread was interrupted.
+	cancelledAt *starlark.EvalError
+	// hostErr is the host callback failure that aborted the execution.
+	hostErr *hostError
+	// cancelErr is the first error a hook failed a thread with, which it
+	// can only report by cancelling the thread, kept for its code.
+	cancelErr error
+	// overBudget is set once the execution has run past the maxSteps
+	// option, and was cancelled for it.
+	overBudget bool
+	// limiter bounds the rate of the execution's calls of host builtins,
+	// with the maxCallRate option, and throttleErr is the first call it
+	// failed.
+	limiter     *callLimiter
+	throttleErr *throttleError
+	// debugger pauses the execution at breakpoints, in debug mode.
+	debugger *debugger
+	// tracer buffers the trace events of the execution, with the trace
+	// option.
+	tracer *tracer
+	// lineProfiler samples the lines the execution runs, with the
+	// profileLines option.
+	lineProfiler *lineProfiler
+	// recording logs the host responses of the execution, with the record
+	// option.
+	recording *hostRecording
+	// audit logs the host crossings of the execution, with the audit
+	// option.
+	audit *auditLog
+	// iterator receives the values the execution emits, with the iterate
+	// option.
+	iterator *emitIterator
+	// calledAt is when the host made the call, which may have waited before
+	// the execution started, and timeline the phases it went through.
+	// startedAt is when it started, once it had a slot; it is set with
+	// executions.mu held.
+	calledAt  time.Time
+	startedAt time.Time
+	timeline  []timelinePhase
+	// stackWanted is set while starlark.stack waits for a thread to take a
+	// snapshot of its stack, which it hands to each of stackWaiters.
+	stackWanted  atomic.Bool
+	stackWaiters []chan js.Value
+	// synchronous is set for the runs of starlark.runSync, which return
+	// before the host's event loop runs again, and so must never yield to
+	// it or wait on it. deadline, if set, is when such a run times out.
+	synchronous bool
+	deadline    time.Time
+	// grading is set for the runs of starlark.grade, whose threads each
+	// run a case with a maxSteps of its own.
+	grading bool
+	// modules and sourceSize count what the execution has asked the host to
+	// load, against the maxModules and maxSourceSize options.
+	modules    int
+	sourceSize int
+	// entrySource is the source of the module a synchronous run starts
+	// with, which it is given rather than loading.
+	entrySource *string
+	// aborter is the AbortController whose signal the execution's loads are
+	// given, made on the first load, and aborted once the execution is
+	// cancelled or over.
+	aborter js.Value
+	// progressAt is when the execution last reported its progress.
+	progressAt time.Time
+	// unackedOutput counts the lines printed the host has not acknowledged,
+	// with the maxUnackedOutput option, and outputAcked wakes a thread
+	// waiting for it to acknowledge more.
+	unackedOutput int
+	outputAcked   chan struct{}
+	// loads and hostCalls count the modules loaded from the host and the
+	// calls made to its callbacks, and quota is the quota of the tenant they
+	// are charged to, if it has one.
+	loads     atomic.Uint64
+	hostCalls atomic.Uint64
+	quota     *quota
+	// retryLimited is the budget of the execution's retry key, if that is
+	// what limits its time.
+	retryLimited time.Duration
+	// watermarks is how many of the memory watermarks the execution's
+	// values were at or over when last measured.
+	watermarks int
+	// meter counts the costs of the execution, with the meter option.
+	meter *meter
+	// env is the environment the execution's modules are initialized
+	// with, which its builtins and secrets options may change.
+	env starlark.StringDict
+	// redactor hides the execution's secrets, if it has any.
+	redactor *redactor
+}
+
+// cancel stops every thread of the execution at its next step, and aborts
+// the loads it is waiting on.
+func (e *execution) cancel(reason string) {
+	e.mu.Lock()
+	if e.cancelReason == "" {
+		e.cancelReason = reason
+		close(e.cancelled)
+		logf(logInfo, logCancel, "execution %s cancelled: %s", e.id, reason)
+	}
+	for _, thread := range e.threads {
+		thread.Cancel(reason)
+	}
+	if e.debugger != nil {
+		e.debugger.interrupt()
+	}
+	e.mu.Unlock()
+	e.wakeOutput()
+	// The abort listeners run at once, and may call back into the runner.
+	e.abort(reason)
+}
+
+// abortSignal returns the signal of the execution's AbortController, for a
+// load to stop fetching once it fires. It is undefined where the host has no
+// AbortController.
+func (e *execution) abortSignal() js.Value {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.aborter.IsUndefined() {
+		constructor := js.Global().Get("AbortController")
+		if constructor.Type() != js.TypeFunction {
+			return js.Undefined()
 		}
-		return array
-	case *starlark.Dict:
-		obj := js.Global().Get("Object").New()
-		for _, item := range v.Items() {
-			key := item[0].(starlark.String)
-			obj.Set(string(key), convertToJSValue(item[1]))
+		e.aborter = constructor.New()
+		if e.cancelReason != "" {
+			// Cancelled before the load began.
+			e.aborter.Call("abort", jsErrorConstructor.New(e.cancelReason))
+		}
+	}
+	return e.aborter.Get("signal")
+}
+
+// abort aborts the signal given to the execution's loads, if any were given
+// it, with the reason as an Error.
+func (e *execution) abort(reason string) {
+	e.mu.Lock()
+	aborter := e.aborter
+	e.mu.Unlock()
+	if aborter.IsUndefined() || aborter.Get("signal").Get("aborted").Bool() {
+		return
+	}
+	logf(logDebug, logCancel, "execution %s aborting its loads: %s", e.id, reason)
+	aborter.Call("abort", jsErrorConstructor.New(reason))
+}
+
+// steps returns the number of steps executed by all threads of the
+// execution.
+func (e *execution) steps() uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var steps uint64
+	for _, thread := range e.threads {
+		steps += thread.ExecutionSteps()
+	}
+	return steps
+}
+
+// stepBudget is the step count at which the thread first runs over the
+// maxSteps option, given the steps its other threads have executed. Only one
+// thread of an execution steps at a time: the others are waiting on the
+// loads they started.
+func (e *execution) stepBudget(thread *starlark.Thread) uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var others uint64
+	for _, t := range e.threads {
+		if t != thread {
+			others += t.ExecutionSteps()
 		}
-		return obj
-	default:
-		return js.Null()
 	}
+	if others > e.options.maxSteps {
+		return 0
+	}
+	return e.options.maxSteps - others + 1
+}
+
+// exceedStepBudget cancels the execution, which has run past the maxSteps
+// option.
+func (e *execution) exceedStepBudget(*starlark.Thread) {
+	e.mu.Lock()
+	e.overBudget = true
+	e.mu.Unlock()
+	e.cancel(fmt.Sprintf("exceeded the budget of %d steps", e.options.maxSteps))
+}
+
+// failThread fails a thread from a hook, which cannot return an error, by
+// cancelling it, keeping the error for its code.
+func (e *execution) failThread(thread *starlark.Thread, err error) {
+	e.mu.Lock()
+	if e.cancelErr == nil {
+		e.cancelErr = err
+	}
+	e.mu.Unlock()
+	thread.Cancel(err.Error())
 }
 
+// recordError notes an error returned by one of the execution's threads,
+// before its details are lost to unwinding or wrapping by load.
+func (e *execution) recordError(thread *starlark.Thread, err error) {
+	e.recordLocals(thread, err)
+
+	evalErr, ok := err.(*starlark.EvalError)
+	if !ok {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// The innermost thread returns first, so the first error is the most
+	// precise location.
+	if e.cancelReason != "" && e.cancelledAt == nil {
+		e.cancelledAt = evalErr
+	}
+}
+
+// outputLine is a line of output buffered by the captureOutput option.
+type outputLine struct {
+	stream  string
+	message string
+	pos     *syntax.Position
+}
+
+func (l outputLine) toJSValue() js.Value {
+	obj := jsObject.New()
+	obj.Set("stream", l.stream)
+	obj.Set("message", l.message)
+	if l.pos != nil {
+		obj.Set("position", printPositionToJSValue(*l.pos))
+	}
+	return obj
+}
+
+func (e *execution) outputToJSValue() js.Value {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	array := jsArray.New(len(e.output))
+	for i, line := range e.output {
+		array.SetIndex(i, line.toJSValue())
+	}
+	return array
+}
+
+func newExecution(id string, options runOptions, calledAt time.Time) *execution {
+	e := &execution{id: id, options: options, calledAt: calledAt, outputAcked: make(chan struct{}, 1), cancelled: make(chan struct{})}
+	e.env = e.newEnvironment()
+	e.redactor = newRedactor(options.secrets)
+	e.limiter = newCallLimiter(options.maxCallRate, options.callBurst)
+	if options.trace {
+		e.tracer = &tracer{start: time.Now()}
+	}
+	if options.profileLines > 0 {
+		e.lineProfiler = newLineProfiler()
+	}
+	if options.meter {
+		e.meter = &meter{}
+	}
+	if options.audit {
+		e.audit = newAuditLog()
+	}
+	if options.record && options.replay == nil {
+		e.recording = &hostRecording{}
+	}
+	return e
+}
+
+// tag marks a diagnostic object with the execution that produced it, so that
+// hosts running several executions at once can tell them apart, redacting
+// the execution's secrets from it.
+func (e *execution) tag(obj js.Value) js.Value {
+	e.redactor.redactJS(obj)
+	obj.Set("instanceId", instanceId)
+	obj.Set("executionId", e.id)
+	if e.options.sessionId != "" {
+		obj.Set("sessionId", e.options.sessionId)
+	}
+	if e.options.labels != nil {
+		obj.Set("labels", labelsToJSValue(e.options.labels))
+	}
+	return obj
+}
+
+// jsAwait waits for a value a host callback returned. A promise, or any
+// other thenable, is waited on until it settles; anything else is the result
+// as it is, so that callbacks may answer synchronously.
 func jsAwait(promise js.Value) (js.Value, error) {
+	if promise.Type() != js.TypeObject || promise.Get("then").Type() != js.TypeFunction {
+		return promise, nil
+	}
+
 	done := make(chan struct{})
 	var result js.Value
 	var err error
@@ -98,7 +658,9 @@ func jsAwait(promise js.Value) (js.Value, error) {
 		close(done)
 		return nil
 	}), js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-		err = fmt.Errorf(args[0].String())
+		// String gives an Error's name and message, where String() on the
+		// js.Value only gives "<object>".
+		err = errors.New(js.Global().Call("String", args[0]).String())
 		close(done)
 		return nil
 	}))
@@ -107,125 +669,272 @@ func jsAwait(promise js.Value) (js.Value, error) {
 	return result, err
 }
 
-func loadFile(filename string, executionId string) (string, error) {
-	starlarkObj := js.Global().Get("starlark")
-	if starlarkObj.IsUndefined() || starlarkObj.IsNull() {
-		return "", fmt.Errorf("Error: window.starlark is not defined.")
+// loadFile fetches a module from the host's load callback, the run's own or
+// the global one, which resolves to its source, or to {source, hash} to name
+// the version of the module for the compile cache, the source perhaps in
+// chunks. The hash is empty if the host did not give one. The callback is
+// given the signal too, which aborts if the execution is cancelled.
+func loadFile(callbacks js.Value, filename string, executionId string, signal js.Value, wait bool) (source string, hash string, err error) {
+	loadFn := runCallback(callbacks, "load")
+	if loadFn.Type() != js.TypeFunction {
+		if result, ok, err := loadSync(filename, executionId); ok {
+			if err != nil {
+				return "", "", newMessageError("", codeLoadFailed, "file", fmt.Sprintf("%q", filename), "cause", fmt.Sprintf("%q", err))
+			}
+			return loadedModule(filename, result, wait)
+		}
+		loadFn = hostCallback(callbacks, "load")
+	}
+	if loadFn.Type() != js.TypeFunction {
+		return "", "", newMessageError("", codeNoLoader, "file", fmt.Sprintf("%q", filename), "namespace", hostGlobalName())
 	}
 
-	loadPromise := starlarkObj.Get("load").Invoke(filename, executionId)
+	loadPromise, err := invokeHost(loadFn, filename, executionId, signal)
+	if err != nil {
+		return "", "", newMessageError("", codeLoadFailed, "file", fmt.Sprintf("%q", filename), "cause", fmt.Sprintf("%q", err))
+	}
 
+	if !wait && loadPromise.Type() == js.TypeObject && loadPromise.Get("then").Type() == js.TypeFunction {
+		return "", "", newMessageError("", codeLoadNotAwaited, "file", fmt.Sprintf("%q", filename))
+	}
 	// Wait for the promise to resolve.
 	result, err := jsAwait(loadPromise)
 	if err != nil {
-		return "", fmt.Errorf("Error: failed to load the file %q. Error: %q", filename, err)
+		return "", "", newMessageError("", codeLoadFailed, "file", fmt.Sprintf("%q", filename), "cause", fmt.Sprintf("%q", err))
 	}
 
-	return result.String(), nil
+	return loadedModule(filename, result, wait)
 }
 
-func jsPrint(msg string, executionId string) {
-	starlarkObj := js.Global().Get("starlark")
-	if starlarkObj.IsUndefined() || starlarkObj.IsNull() {
-		fmt.Println(msg)
+// loadedModule reads the source and hash of a module the host loaded. The
+// source may be in chunks, as sourceFromJS reads them, and may only be a
+// stream if wait is set.
+func loadedModule(filename string, result js.Value, wait bool) (source string, hash string, err error) {
+	value := result
+	if result.Type() == js.TypeObject && !result.Get("source").IsUndefined() {
+		value = result.Get("source")
+		if jsHash := result.Get("hash"); jsHash.Type() == js.TypeString {
+			hash = jsHash.String()
+		}
 	}
-
-	starlarkObj.Get("print").Invoke(msg, executionId)
+	source, ok, err := sourceFromJS(value, wait)
+	if !ok {
+		return "", "", newMessageError("", codeLoadInvalid, "file", fmt.Sprintf("%q", filename), "type", jsTypeName(value))
+	}
+	if err != nil {
+		return "", "", newMessageError("", codeLoadFailed, "file", fmt.Sprintf("%q", filename), "cause", fmt.Sprintf("%q", err))
+	}
+	return source, hash, nil
 }
 
-func runStarlarkCode(executionId string, filename string, funcName string, args []starlark.Value, kwargs []starlark.Tuple) (starlark.Value, error) {
-	print := func(_ *starlark.Thread, msg string) {
-		jsPrint(msg, executionId)
+// jsPrint forwards output to the host: print() output goes to the "stdout"
+// stream and the print callback, while eprint() output goes to the "stderr"
+// stream and the printError callback, falling back to print. The callbacks
+// are the run's own, or else those on globalThis.starlark, and without any
+// the output goes to Go's own stream. pos is the position of the call when
+// the printPositions option is set, and nil otherwise. It returns what the
+// callback throws.
+func jsPrint(callbacks js.Value, stream string, msg string, executionId string, pos *syntax.Position) error {
+	printFn := js.Undefined()
+	if stream == "stderr" {
+		printFn = hostCallback(callbacks, "printError")
+	}
+	if printFn.Type() != js.TypeFunction {
+		printFn = hostCallback(callbacks, "print")
+	}
+	if printFn.Type() != js.TypeFunction {
+		out := os.Stdout
+		if stream == "stderr" {
+			out = os.Stderr
+		}
+		fmt.Fprintln(out, msg)
+		return nil
 	}
 
-	type entry struct {
-		globals starlark.StringDict
-		err     error
+	var err error
+	if pos == nil {
+		_, err = invokeHost(printFn, msg, executionId)
+	} else {
+		_, err = invokeHost(printFn, msg, executionId, printPositionToJSValue(*pos))
 	}
-	cache := make(map[string]*entry)
+	return err
+}
 
-	var load func(_ *starlark.Thread, module string) (starlark.StringDict, error)
-	load = func(_ *starlark.Thread, module string) (starlark.StringDict, error) {
-		e, ok := cache[module]
-		if e == nil {
-			if ok {
-				// request for package whose loading is in progress
-				return nil, fmt.Errorf("cycle in load graph")
-			}
-			// Add a placeholder to indicate "load in progress".
-			cache[module] = nil
+// jsEmit forwards a value from emit() to the host, if it has an emit
+// callback. It returns what the callback throws.
+func jsEmit(callbacks js.Value, value js.Value, executionId string) error {
+	if emitFn := hostCallback(callbacks, "emit"); emitFn.Type() == js.TypeFunction {
+		_, err := invokeHost(emitFn, value, executionId)
+		return err
+	}
+	return nil
+}
 
-			// Load and initialize the module in a new thread.
-			data, err := loadFile(module, executionId)
-			fileOptions := syntax.FileOptions{} // zero value for default behavior. TODO: add support for custom file options.
+func printPositionToJSValue(pos syntax.Position) js.Value {
+	position := positionToJSValue(pos)
+	position.Set("filename", pos.Filename())
+	return position
+}
 
-			thread := &starlark.Thread{Name: executionId + " exec " + module, Load: load, Print: print}
-			globals, err := starlark.ExecFileOptions(&fileOptions, thread, module, data, nil)
-			e = &entry{globals, err}
+// The ways of handling the output of print and eprint, chosen by the
+// printPolicy option.
+const (
+	// printPolicyAllow delivers it to the host, as usual.
+	printPolicyAllow = "allow"
+	// printPolicyDiscard drops it, as if the script had not printed.
+	printPolicyDiscard = "discard"
+	// printPolicyDeny fails the call that printed with a PermissionError.
+	printPolicyDeny = "deny"
+)
 
-			// Update the cache.
-			cache[module] = e
+// print writes a line of output on one of the execution's streams. It
+// returns an error if the host's print callback failed and the onHostError
+// policy says to stop, or if the printPolicy option denies output.
+func (e *execution) print(thread *starlark.Thread, stream string, msg string) error {
+	switch e.options.printPolicy {
+	case printPolicyDiscard:
+		return nil
+	case printPolicyDeny:
+		function := "print"
+		if stream == "stderr" {
+			function = "eprint"
 		}
-		return e.globals, e.err
+		e.notifyCapabilityDenied(function, codePrintDenied)
+		return e.messageErr(codePrintDenied)
 	}
-
-	globals, err := load(nil, filename)
-	if err != nil {
-		err := fmt.Errorf("Error: unable to evaluate the starlark code. %q", err)
-		return nil, err
+	e.meter.countCall()
+	msg = e.redactor.string(msg)
+	if err := e.tracePrint(thread, stream); err != nil {
+		return err
 	}
-	starlarkFn, ok := globals[funcName]
-	if !ok {
-		err := fmt.Errorf("Error: the function %q is missing.", funcName)
-		return nil, err
+	var pos *syntax.Position
+	if e.options.printPositions && thread != nil {
+		// Frame 0 is the print builtin itself; frame 1 is the code that
+		// called it.
+		callerPos := thread.CallFrame(1).Pos
+		pos = &callerPos
 	}
+	e.notify(eventPrint, outputLine{stream: stream, message: msg, pos: pos}.toJSValue)
 
-	// Call the function.
-	thread := &starlark.Thread{Name: executionId, Load: load, Print: print}
-	returnValue, err := starlark.Call(thread, starlarkFn, args, kwargs)
-	if err != nil {
-		err := fmt.Errorf("Error: unable to execute the starlark code. %q", err)
-		return nil, err
+	if e.options.captureOutput || e.options.settle {
+		e.mu.Lock()
+		e.output = append(e.output, outputLine{stream: stream, message: msg, pos: pos})
+		e.mu.Unlock()
+		if e.options.captureOutput {
+			return nil
+		}
+	}
+	if e.options.maxUnackedOutput > 0 {
+		if err := e.awaitOutputWindow(); err != nil {
+			return err
+		}
+	}
+	if e.options.printBatchSize > 1 {
+		return e.queueOutput(outputLine{stream: stream, message: msg, pos: pos})
+	}
+	callback := "print"
+	if stream == "stderr" {
+		callback = "printError"
+	}
+	if err := e.audited(callback, func() string { return msg }, func() error { return jsPrint(e.options.callbacks, stream, msg, e.id, pos) }); err != nil {
+		return e.hostFailure(callback, err)
 	}
-	return returnValue, nil
+	return nil
 }
 
-func runStarlarkCodeWithTimeout(executionId string, filename string, funcName string, args []starlark.Value, kwargs []starlark.Tuple, maxExecutionTime int) (starlark.Value, error) {
-	if maxExecutionTime <= 0 {
-		return runStarlarkCode(executionId, filename, funcName, args, kwargs)
+// newThread creates a thread to run part of the execution.
+func (e *execution) newThread(name string, load func(*starlark.Thread, string) (starlark.StringDict, error)) *starlark.Thread {
+	thread := &starlark.Thread{
+		Name: name,
+		Load: load,
+		Print: func(thread *starlark.Thread, msg string) {
+			// The print hook cannot return an error, so fail the call by
+			// cancelling the thread instead.
+			if err := e.print(thread, "stdout", msg); err != nil {
+				e.failThread(thread, err)
+			}
+		},
 	}
+	thread.SetLocal(executionKey, e)
+	e.recordClock(thread)
+	hooks := []runner.StepHook{{Interval: runner.YieldInterval, Fn: e.sampleStack}, {Interval: runner.YieldInterval, Fn: e.progressHook()}, {Interval: runner.YieldInterval, Fn: e.sampleInstanceMemory}}
+	if !e.synchronous {
+		// The scheduler's turns go round the busy threads in order, so the
+		// steps a thread runs in each is its share of the progress made.
+		hooks = append(hooks, runner.StepHook{Interval: runner.SliceSteps(e.options.share), Fn: runner.Yielder()})
+		if e.options.priority == priorityBatch {
+			hooks = append(hooks, runner.StepHook{Interval: runner.SliceSteps(e.options.share), Fn: e.waitForInteractive})
+		}
+	}
+	if !e.deadline.IsZero() {
+		// No timer can fire during a synchronous run, so its threads watch
+		// the clock themselves.
+		hooks = append(hooks, runner.StepHook{Interval: runner.YieldInterval, Fn: func(thread *starlark.Thread) {
+			if time.Now().After(e.deadline) {
+				e.cancel("timeout")
+			}
+		}})
+	}
+	if e.options.captureLocals {
+		recorder := &localsRecorder{}
+		thread.SetLocal(localsRecorderKey, recorder)
+		hooks = append(hooks, runner.StepHook{Interval: 1, Fn: recorder.record})
+	}
+	if e.debugger != nil {
+		hooks = append(hooks, runner.StepHook{Interval: 1, Fn: e.debugger.stepHook()})
+	}
+	hooks = append(hooks, e.traceThread(thread)...)
+	if e.lineProfiler != nil {
+		hooks = append(hooks, runner.StepHook{Interval: lineSampleInterval, Fn: e.lineProfiler.stepHook()})
+	}
+	if e.options.maxSteps > 0 {
+		hooks = append(hooks, runner.StepHook{At: e.stepBudget, Fn: e.exceedStepBudget})
+	}
+	if e.grading {
+		hooks = append(hooks, runner.StepHook{At: caseStepBudget, Fn: exceedCaseSteps})
+	}
+	if e.options.maxValueSize > 0 || e.options.maxTotalSize > 0 || e.meter != nil {
+		hooks = append(hooks, e.sizeHook())
+	}
+	if e.options.printBatchSize > 1 && !e.options.captureOutput {
+		// Deliver output that has waited too long even if the script has
+		// stopped printing, failing the thread as the print hook would.
+		hooks = append(hooks, runner.StepHook{Interval: runner.YieldInterval, Fn: func(thread *starlark.Thread) {
+			if err := e.flushOutputIfDue(); err != nil {
+				thread.Cancel(err.Error())
+			}
+		}})
+	}
+	runner.InstallStepHooks(thread, hooks)
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(maxExecutionTime)*time.Second)
-	defer cancel()
-
-	resultChan := make(chan struct {
-		value starlark.Value
-		err   error
-	})
-
-	go func() {
-		value, err := runStarlarkCode(executionId, filename, funcName, args, kwargs)
-		resultChan <- struct {
-			value starlark.Value
-			err   error
-		}{value, err}
-	}()
+	e.mu.Lock()
+	e.threads = append(e.threads, thread)
+	if e.cancelReason != "" {
+		thread.Cancel(e.cancelReason)
+	}
+	e.mu.Unlock()
+	return thread
+}
 
-	select {
-	case <-ctx.Done():
-		return nil, fmt.Errorf("Error: execution timed out")
-	case result := <-resultChan:
-		return result.value, result.err
+// checkModuleCount fails the load of a module once the execution has loaded
+// as many as the maxModules option allows.
+func (e *execution) checkModuleCount(module string, modules int) error {
+	if limit := e.options.maxModules; limit > 0 && modules >= limit {
+		return e.messageErr(codeTooManyModules, "file", fmt.Sprintf("%q", module), "limit", strconv.Itoa(limit))
 	}
+	return nil
 }
 
-func runStarlarkCodeJs(args []js.Value) (js.Value, error) {
-	if len(args) < 3 {
-		err := fmt.Errorf("Error: requires executionId, filename, and functionName as arguments.")
-		return js.Null(), err
+// checkSourceSize fails the load of a module that took the source loaded by
+// the execution past the maxSourceSize option.
+func (e *execution) checkSourceSize(module string, size int) error {
+	if limit := e.options.maxSourceSize; limit > 0 && size > limit {
+		return e.messageErr(codeSourceTooLarge, "file", fmt.Sprintf("%q", module), "size", strconv.Itoa(size), "limit", strconv.Itoa(limit))
 	}
+	return nil
+}
 
-	executionId := args[0].String()
+func runStarlarkCodeJs(exec *execution, args []js.Value) (js.Value, error) {
 	filename := args[1].String()
 	funcName := args[2].String()
 
@@ -240,65 +949,348 @@ func runStarlarkCodeJs(args []js.Value) (js.Value, error) {
 	}
 
 	maxExecutionTime := 0
-	if len(args) > 5 {
+	if len(args) > 5 && args[5].Type() == js.TypeNumber {
 		maxExecutionTime = args[5].Int()
 	}
 
-	starlarkArgs := []starlark.Value{}
-	starlarkKwargs := []starlark.Tuple{}
+	conv := &converter{exec: exec}
 
-	if jsArgs.Type() == js.TypeObject && jsArgs.InstanceOf(js.Global().Get("Array")) {
-		for i := 0; i < jsArgs.Length(); i++ {
-			starlarkArgs = append(starlarkArgs, convertToStarlarkValue(jsArgs.Index(i)))
-		}
+	if exec.options.envelope {
+		runtime.ReadMemStats(&exec.memory.start)
 	}
-
-	if jsKwargs.Type() == js.TypeObject {
-		keys := js.Global().Get("Object").Call("keys", jsKwargs)
-		for i := 0; i < keys.Length(); i++ {
-			key := keys.Index(i).String()
-			starlarkKwargs = append(starlarkKwargs, starlark.Tuple{starlark.String(key), convertToStarlarkValue(jsKwargs.Get(key))})
-		}
+	phaseStart := time.Now()
+	var starlarkArgs []starlark.Value
+	var starlarkKwargs []starlark.Tuple
+	var err error
+	if exec.options.binary {
+		starlarkArgs, starlarkKwargs, err = conv.decodeBinaryArgs(jsArgs, jsKwargs)
+	} else {
+		starlarkArgs, starlarkKwargs, err = conv.convertArgs(jsArgs, jsKwargs)
+	}
+	exec.timings.convertArgs = time.Since(phaseStart)
+	exec.addPhase(phaseConvertArgs, "", phaseStart)
+	if err != nil {
+		return js.Null(), err
 	}
 
-	returnValue, err := runStarlarkCodeWithTimeout(executionId, filename, funcName, starlarkArgs, starlarkKwargs, maxExecutionTime)
+	return runToJS(exec, conv, func() (starlark.Value, error) {
+		return exec.execute(filename, funcName, starlarkArgs, starlarkKwargs, time.Duration(maxExecutionTime)*time.Second)
+	})
+}
 
+// runToJS calls run, profiling it if asked, and converts its return value to
+// what the runner resolves with.
+func runToJS(exec *execution, conv *converter, run func() (starlark.Value, error)) (js.Value, error) {
+	var returnValue starlark.Value
+	var profile []byte
+	var err error
+	phaseStart := time.Now()
+	if exec.options.profile {
+		returnValue, profile, err = profileRun(run)
+	} else {
+		returnValue, err = run()
+	}
+	exec.mu.Lock()
+	exec.timings.execute = time.Since(phaseStart) - exec.timings.load
+	exec.mu.Unlock()
 	if err != nil {
 		return js.Null(), err
+	}
+	returnValue = exec.redactor.value(returnValue)
+
+	var jsReturnValue js.Value
+	phaseStart = time.Now()
+	if exec.options.chunkSize > 0 && streamable(returnValue) {
+		jsReturnValue, err = js.Null(), conv.streamValue(returnValue, "result", exec.options.chunkSize)
+	} else if exec.options.binary {
+		jsReturnValue, err = conv.encodeValue(returnValue, "result")
+	} else if exec.options.lazy {
+		jsReturnValue, err = conv.convertToLazyJSValue(returnValue, "result")
 	} else {
-		return convertToJSValue(returnValue), nil
+		jsReturnValue, err = conv.convertToJSValue(returnValue, "result")
+	}
+	exec.timings.convertResult = time.Since(phaseStart)
+	exec.addPhase(phaseConvertResult, "", phaseStart)
+	if err != nil {
+		return js.Null(), err
 	}
+	if !exec.options.envelope {
+		return jsReturnValue, nil
+	}
+	runtime.ReadMemStats(&exec.memory.end)
+
+	envelope := exec.newEnvelope()
+	envelope.Set("value", jsReturnValue)
+	if exec.options.profile {
+		folded, err := foldProfile(profile)
+		if err != nil {
+			return js.Null(), fmt.Errorf("Error: unable to fold the profile. %w", err)
+		}
+		envelope.Set("profile", bytesToJS(profile))
+		envelope.Set("foldedProfile", folded)
+	}
+	if exec.lineProfiler != nil {
+		envelope.Set("lineProfile", exec.lineProfiler.toJSValue(exec.options.profileLines))
+	}
+	if exec.recording != nil {
+		envelope.Set("recording", exec.recording.toJSValue())
+	}
+	return envelope, nil
+}
+
+// newEnvelope returns the envelope of the execution, with what it holds
+// whether or not the call succeeded.
+func (e *execution) newEnvelope() js.Value {
+	envelope := jsObject.New()
+	if e.options.settle {
+		envelope.Set("ok", true)
+	}
+	envelope.Set("warnings", e.warningsToJSValue())
+	envelope.Set("stats", e.statsToJSValue())
+	if e.options.captureOutput {
+		envelope.Set("output", e.outputToJSValue())
+	}
+	if e.options.settle {
+		envelope.Set("logs", e.outputToJSValue())
+	}
+	return envelope
+}
+
+// failedEnvelope returns the envelope a call with the settle option
+// resolves with when it fails with rejection.
+func (e *execution) failedEnvelope(rejection js.Value) js.Value {
+	runtime.ReadMemStats(&e.memory.end)
+	envelope := e.newEnvelope()
+	envelope.Set("ok", false)
+	envelope.Set("value", js.Null())
+	envelope.Set("error", rejection)
+	return envelope
+}
+
+// convertArgs converts the positional and keyword arguments of a call from
+// JS values.
+func (c *converter) convertArgs(jsArgs js.Value, jsKwargs js.Value) (starlark.Tuple, []starlark.Tuple, error) {
+	n := 0
+	if jsArgs.Type() == js.TypeObject && jsArgs.InstanceOf(jsArray) {
+		n = jsArgs.Length()
+	}
+	var entries []kwargsEntry
+	if !jsKwargs.IsNull() && !jsKwargs.IsUndefined() {
+		var err error
+		if entries, err = kwargsEntries(jsKwargs); err != nil {
+			return nil, nil, err
+		}
+	}
+	keys := make([]string, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.key
+	}
+	arg := func(i int, path string) (starlark.Value, error) {
+		return c.convertArgument(jsArgs.Index(i), path)
+	}
+	kwarg := func(i int, path string) (starlark.Value, error) {
+		if entries[i].value.IsUndefined() {
+			// Leave the parameter to its default, as for an omitted property.
+			return nil, c.lossy("dropped_undefined", path, "undefined keyword argument omitted")
+		}
+		return c.convertArgument(entries[i].value, path)
+	}
+	return runner.ConvertArgs(n, arg, keys, kwarg)
 }
 
+// jsAsyncStarlarkRunner is wasm_runner, which returns a promise of the
+// result of a run, or with the iterate option, an iterator over the values
+// it emits that ends with the result; see iterateAsync.
 func jsAsyncStarlarkRunner() js.Func {
 	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-		return js.Global().Get("Promise").New(js.FuncOf(func(this js.Value, promiseArgs []js.Value) interface{} {
-			resolve := promiseArgs[0]
-			reject := promiseArgs[1]
-			go func() {
-				defer func() {
-					if r := recover(); r != nil {
-						reject.Invoke(r)
-					}
-				}()
-				returnValue, err := runStarlarkCodeJs(args)
-				if err != nil {
-					reject.Invoke(err.Error())
-				} else {
-					resolve.Invoke(returnValue)
-				}
-			}()
-			return nil
-		}))
+		if len(args) < 3 {
+			return rejected(fmt.Errorf("Error: requires executionId, filename, and functionName as arguments."))
+		}
+		options := js.Undefined()
+		if len(args) > 6 {
+			options = args[6]
+		}
+		run := func(exec *execution) (js.Value, error) {
+			return runStarlarkCodeJs(exec, args)
+		}
+		if options.Type() == js.TypeObject && optionBool(options, "iterate") {
+			return iterateAsync(args[0].String(), options, run)
+		}
+		return runAsync(args[0].String(), options, run)
 	})
 }
 
+// rejected returns a promise rejected with err.
+func rejected(err error) js.Value {
+	return jsPromise.Call("reject", errorToJSValue(err))
+}
+
+// runAsync starts an execution with the given id and options in a new
+// goroutine, returning a promise of the result of run.
+func runAsync(executionId string, options js.Value, run func(exec *execution) (js.Value, error)) js.Value {
+	return jsPromise.New(js.FuncOf(func(this js.Value, promiseArgs []js.Value) interface{} {
+		resolve := promiseArgs[0]
+		reject := promiseArgs[1]
+		go settleExecution(executionId, options, time.Now(), run, resolve, reject)
+		return nil
+	}))
+}
+
+// settleExecution runs an execution with the given id and options, called
+// for at calledAt, resolving or rejecting a promise with the outcome of run.
+// With the settle option, a failure resolves it too, with the envelope.
+func settleExecution(executionId string, options js.Value, calledAt time.Time, run func(exec *execution) (js.Value, error), resolve js.Value, reject js.Value) {
+	exec := newExecution(executionId, parseRunOptions(options), calledAt)
+	fail := func(rejection js.Value) {
+		exec.notifyDone(rejection)
+		if exec.options.settle {
+			// Resolve with the failure, in the envelope, instead.
+			envelope := exec.failedEnvelope(rejection)
+			exec.attachAudit(envelope)
+			exec.storeResult("fulfilled", envelope)
+			resolve.Invoke(envelope)
+			return
+		}
+		exec.storeResult("rejected", rejection)
+		reject.Invoke(rejection)
+	}
+	if exec.options.replayErr != nil {
+		fail(exec.tag(errorToJSValue(exec.options.replayErr)))
+		return
+	}
+	if exec.options.dialectErr != nil {
+		fail(exec.tag(errorToJSValue(exec.options.dialectErr)))
+		return
+	}
+	if exec.options.loadsErr != nil {
+		fail(exec.tag(errorToJSValue(exec.options.loadsErr)))
+		return
+	}
+	// The time waiting for a slot counts as queued, but not against the
+	// time limit, which starts with the run.
+	err := acquireSlot(exec)
+	exec.addPhase(phaseQueued, "", calledAt)
+	if err != nil {
+		fail(exec.tag(errorToJSValue(err)))
+		return
+	}
+	defer releaseSlot()
+	if err := beginExecution(exec); err != nil {
+		fail(exec.tag(errorToJSValue(err)))
+		return
+	}
+	defer endExecution(exec)
+	if exec.options.breakpoints != nil {
+		defer exec.attachDebugger()()
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			fail(exec.tag(errorToJSValue(newInternalError(r, panicStack()))))
+		}
+	}()
+	returnValue, err := run(exec)
+	// Deliver any batched output before the outcome.
+	if flushErr := exec.flushOutput(); flushErr != nil && err == nil {
+		err = flushErr
+	}
+	if traceErr := exec.finishTrace(); traceErr != nil && err == nil {
+		err = traceErr
+	}
+	if err != nil {
+		rejection := exec.tag(errorToJSValue(err))
+		exec.attachAudit(rejection)
+		fail(rejection)
+	} else {
+		exec.attachAudit(returnValue)
+		exec.notifyDone(js.Undefined())
+		exec.storeResult("fulfilled", returnValue)
+		resolve.Invoke(returnValue)
+	}
+}
+
+// initRunner sets up what every execution relies on: the namespace of the
+// host's globals, the instance id, and the environment, with the builtins
+// of plugins.
+func initRunner() {
+	initHostNamespace()
+	initInstanceId()
+	for name, value := range runner.PluginBuiltins() {
+		if predeclared.Has(name) {
+			panic(fmt.Sprintf("a plugin adds the builtin %q, which the runner has already", name))
+		}
+		predeclared[name] = guardBuiltin(value)
+	}
+	initEnvironment()
+}
+
 func main() {
-	starlarkObj := js.Global().Get("starlark")
+	initRunner()
+	starlarkObj := hostGlobal()
 	if starlarkObj.IsUndefined() || starlarkObj.IsNull() {
-		starlarkObj = js.Global().Get("Object").New()
-		js.Global().Set("starlark", starlarkObj)
+		starlarkObj = jsObject.New()
+		js.Global().Set(hostNamespace, starlarkObj)
 	}
 	starlarkObj.Set("wasm_runner", jsAsyncStarlarkRunner())
+	starlarkObj.Set("run", jsRun())
+	starlarkObj.Set("runSync", jsRunSync())
+	starlarkObj.Set("lint", jsLint())
+	starlarkObj.Set("analyze", jsAnalyze())
+	starlarkObj.Set("disassemble", jsDisassemble())
+	starlarkObj.Set("complete", jsComplete())
+	starlarkObj.Set("signatureHelp", jsSignatureHelp())
+	starlarkObj.Set("rename", jsRename())
+	starlarkObj.Set("tokenize", jsTokenize())
+	starlarkObj.Set("format", jsFormat())
+	starlarkObj.Set("errorFromJSON", jsErrorFromJSON())
+	starlarkObj.Set("serve", jsServe())
+	starlarkObj.Set("repl", jsRepl())
+	starlarkObj.Set("sessionCall", jsSessionCall())
+	starlarkObj.Set("evaluate", jsEvaluate())
+	starlarkObj.Set("exec", jsExec())
+	starlarkObj.Set("eval", jsEval())
+	starlarkObj.Set("closeSession", jsCloseSession())
+	starlarkObj.Set("setSessionPolicy", jsSetSessionPolicy())
+	starlarkObj.Set("setMemoryBudget", jsSetMemoryBudget())
+	starlarkObj.Set("reset", jsReset())
+	starlarkObj.Set("metrics", jsMetrics())
+	starlarkObj.Set("benchmark", jsBenchmark())
+	starlarkObj.Set("golden", jsGolden())
+	starlarkObj.Set("grade", jsGrade())
+	starlarkObj.Set("render", jsRender())
+	starlarkObj.Set("renderDiff", jsRenderDiff())
+	starlarkObj.Set("precompile", jsPrecompile())
+	starlarkObj.Set("clearCache", jsClearCache())
+	starlarkObj.Set("cacheStats", jsCacheStats())
+	starlarkObj.Set("instanceId", instanceId)
+	starlarkObj.Set("usage", jsUsage())
+	starlarkObj.Set("capabilities", jsCapabilities())
+	starlarkObj.Set("setMessages", jsSetMessages())
+	starlarkObj.Set("resume", jsResume())
+	starlarkObj.Set("setBreakpoints", jsSetBreakpoints())
+	starlarkObj.Set("setWatches", jsSetWatches())
+	starlarkObj.Set("inspect", jsInspect())
+	starlarkObj.Set("stack", jsStack())
+	starlarkObj.Set("setLogLevel", jsSetLogLevel())
+	starlarkObj.Set("ackOutput", jsAckOutput())
+	starlarkObj.Set("cancel", jsCancel())
+	starlarkObj.Set("setConcurrency", jsSetConcurrency())
+	starlarkObj.Set("listExecutions", jsListExecutions())
+	starlarkObj.Set("result", jsResult())
+	starlarkObj.Set("setQuota", jsSetQuota())
+	starlarkObj.Set("quota", jsQuota())
+	starlarkObj.Set("resetQuota", jsResetQuota())
+	off := jsOff()
+	starlarkObj.Set("on", jsOn(off))
+	starlarkObj.Set("off", off)
+	// A level set before the module started applies from the start.
+	if name := starlarkObj.Get("logLevel"); name.Type() == js.TypeString {
+		if level, err := parseLogLevel(name.String()); err == nil {
+			setLogLevel(level)
+		} else {
+			logf(logError, logInit, "%s", err)
+		}
+	}
+	logf(logInfo, logInit, "instance %s ready, built with %s, %d bundled modules", instanceId, runtime.Version(), len(runner.BundledModuleNames()))
 	<-make(chan bool)
 }
@@ -0,0 +1,226 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"syscall/js"
+)
+
+// The codes of the runner's own errors that a script's user may see. Each
+// names a message of the catalog, and is reported with the error as its
+// code, which stays the same whatever the language of the message.
+const (
+	codeTimeout         = "timeout"
+	codeMissingFunction = "missingFunction"
+	codeEvalFailed      = "evalFailed"
+	codeExecFailed      = "execFailed"
+	codeLoadFailed      = "loadFailed"
+	codeNoLoader        = "noLoader"
+	codeLoadNotAwaited  = "loadNotAwaited"
+	codeLoadInvalid     = "loadInvalid"
+	// permissionDenied is a call to a builtin the allowBuiltins option
+	// does not grant.
+	codePermissionDenied = "permissionDenied"
+	// printDenied is a print or eprint under the printPolicy "deny".
+	codePrintDenied = "printDenied"
+	// valueTooLarge and totalTooLarge are values over the maxValueSize and
+	// maxTotalSize options.
+	codeValueTooLarge = "valueTooLarge"
+	codeTotalTooLarge = "totalTooLarge"
+	// tooManyModules and sourceTooLarge are loads past the maxModules and
+	// maxSourceSize options.
+	codeTooManyModules = "tooManyModules"
+	codeSourceTooLarge = "sourceTooLarge"
+	// noVerifier, verifyFailed and notApproved are modules the host's
+	// verify callback did not approve to run.
+	codeNoVerifier   = "noVerifier"
+	codeVerifyFailed = "verifyFailed"
+	codeNotApproved  = "notApproved"
+	// notLocked and lockDrift are loads the lockfile option does not pin,
+	// or whose source no longer has the hash it pins.
+	codeNotLocked = "notLocked"
+	codeLockDrift = "lockDrift"
+	// loadForbidden is a load the allowLoads or denyLoads options forbid.
+	codeLoadForbidden = "loadForbidden"
+	// retryBudget is a timeout of a run whose retry key has used up the
+	// time its retries share.
+	codeRetryBudget = "retryBudget"
+	// stepLimit is a run past the maxSteps option.
+	codeStepLimit = "stepLimit"
+	// throttled is a call of a host builtin past the maxCallRate option.
+	codeThrottled = "throttled"
+	// atPosition adds where the script was to an error, such as a timeout.
+	codeAtPosition = "atPosition"
+)
+
+// defaultLocale is the language of the built-in messages, used for any
+// message a host's catalog lacks.
+const defaultLocale = "en"
+
+// englishMessages are the built-in messages. A placeholder such as {file}
+// stands for an argument of the error; braces around anything else are
+// kept as they are.
+var englishMessages = map[string]string{
+	codeTimeout:          "Error: execution timed out",
+	codeMissingFunction:  "Error: the function {function} is missing.",
+	codeEvalFailed:       "Error: unable to evaluate the starlark code.",
+	codeExecFailed:       "Error: unable to execute the starlark code.",
+	codeLoadFailed:       "Error: failed to load the file {file}. Error: {cause}",
+	codeNoLoader:         "Error: unable to load the file {file}, as there is no load callback in the options or on {namespace}.",
+	codeLoadNotAwaited:   "Error: failed to load the file {file}. A synchronous run cannot wait for the promise the loader returned.",
+	codeLoadInvalid:      "Error: failed to load the file {file}. The loader gave {type}, rather than its source or {source, hash}.",
+	codeAtPosition:       "{error} at {position}",
+	codePermissionDenied: "PermissionError: this script is not allowed to call {function}.",
+	codePrintDenied:      "PermissionError: this script is not allowed to print.",
+	codeValueTooLarge:    "Error: the {type} in {name} has a size of {size}, over the limit of {limit}.",
+	codeTotalTooLarge:    "Error: the values held by the script's variables have a size of {size}, over the limit of {limit}.",
+	codeTooManyModules:   "Error: unable to load the file {file}, as the execution may load no more than {limit} modules.",
+	codeSourceTooLarge:   "Error: failed to load the file {file}, which takes the source the execution loaded to {size} bytes, over the limit of {limit}.",
+	codeNoVerifier:       "Error: unable to verify the file {file}, as there is no verify callback in the options or on {namespace}.",
+	codeVerifyFailed:     "Error: failed to verify the file {file}. Error: {cause}",
+	codeNotApproved:      "PermissionError: the file {file}, of hash {hash}, was not approved to run.",
+	codeRetryBudget:      "Error: execution timed out, as the runs of {key} have used up their budget of {limit} ms.",
+	codeNotLocked:        "Error: unable to load the file {file}, as the lockfile has no entry for it.",
+	codeLockDrift:        "Error: failed to load the file {file}, whose source has the hash {hash} rather than the {locked} of the lockfile.",
+	codeLoadForbidden:    "PermissionError: this script is not allowed to load {file}.",
+	codeStepLimit:        "Error: the execution exceeded its budget of {limit} steps",
+	codeThrottled:        "Error: the execution called {builtin} faster than its limit of {rate} a second, with bursts of up to {burst}.",
+}
+
+// messageCatalogs holds the messages of each locale the host added, by
+// code.
+var messageCatalogs = struct {
+	mu       sync.RWMutex
+	byLocale map[string]map[string]string
+}{byLocale: make(map[string]map[string]string)}
+
+// catalogMessage returns the template of a message in the locale, trying
+// the locale's language alone, as "pt" for "pt-BR", and then English, which
+// the host may reword too.
+func catalogMessage(locale string, code string) string {
+	messageCatalogs.mu.RLock()
+	defer messageCatalogs.mu.RUnlock()
+	for _, candidate := range []string{locale, strings.SplitN(locale, "-", 2)[0], defaultLocale} {
+		if message, ok := messageCatalogs.byLocale[candidate][code]; ok {
+			return message
+		}
+	}
+	return englishMessages[code]
+}
+
+// messageError is one of the runner's own errors, its message in the
+// locale it was made for.
+type messageError struct {
+	code    string
+	args    []string
+	message string
+}
+
+// newMessageError makes the error with the code, given its arguments as
+// pairs of placeholder and text, in the locale.
+func newMessageError(locale string, code string, args ...string) *messageError {
+	return &messageError{code: code, args: args, message: localize(locale, code, args...)}
+}
+
+// localize fills in the template of a message in the locale.
+func localize(locale string, code string, args ...string) string {
+	return strings.NewReplacer(placeholders(args)...).Replace(catalogMessage(locale, code))
+}
+
+// placeholders turns the pairs of placeholder and text into the pairs
+// strings.NewReplacer takes.
+func placeholders(args []string) []string {
+	pairs := make([]string, len(args))
+	for i := 0; i+1 < len(args); i += 2 {
+		pairs[i], pairs[i+1] = "{"+args[i]+"}", args[i+1]
+	}
+	return pairs
+}
+
+func (e *messageError) Error() string {
+	return e.message
+}
+
+// in returns the error again with its message in the locale.
+func (e *messageError) in(locale string) *messageError {
+	return newMessageError(locale, e.code, e.args...)
+}
+
+// message fills in a message in the execution's locale.
+func (e *execution) message(code string, args ...string) string {
+	return localize(e.options.locale, code, args...)
+}
+
+// messageErr makes an error with a message in the execution's locale.
+func (e *execution) messageErr(code string, args ...string) error {
+	return newMessageError(e.options.locale, code, args...)
+}
+
+// localizeErr puts one of the runner's own errors, made where the
+// execution's locale was not known, in that locale.
+func (e *execution) localizeErr(err error) error {
+	if msgErr, ok := err.(*messageError); ok && e.options.locale != "" {
+		return msgErr.in(e.options.locale)
+	}
+	return err
+}
+
+// errorCode returns the code of the runner's own error at the root of err,
+// or fallback if there is none.
+func errorCode(err error, fallback string) string {
+	var msgErr *messageError
+	if errors.As(err, &msgErr) {
+		return msgErr.code
+	}
+	return fallback
+}
+
+// setMessages adds the messages of a locale, an object of templates by
+// code, to those runs can choose with their locale option.
+func setMessages(locale string, catalog js.Value) error {
+	messages := make(map[string]string)
+	keys := jsObjectKeys.Invoke(catalog)
+	for i := 0; i < keys.Length(); i++ {
+		code := keys.Index(i).String()
+		message := catalog.Get(code)
+		if message.Type() != js.TypeString {
+			return fmt.Errorf("Error: the message %q must be a string.", code)
+		}
+		messages[code] = message.String()
+	}
+	messageCatalogs.mu.Lock()
+	defer messageCatalogs.mu.Unlock()
+	messageCatalogs.byLocale[locale] = messages
+	return nil
+}
+
+// jsSetMessages implements starlark.setMessages(locale, messages).
+func jsSetMessages() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 2 || args[0].Type() != js.TypeString || args[1].Type() != js.TypeObject {
+			return jsErrorConstructor.New("Error: requires a locale and an object of messages as arguments.")
+		}
+		if err := setMessages(args[0].String(), args[1]); err != nil {
+			return jsErrorConstructor.New(err.Error())
+		}
+		return js.Undefined()
+	})
+}
@@ -0,0 +1,89 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync/atomic"
+	"syscall/js"
+)
+
+// meterModel is the version of the cost model of the meter option. The
+// weights below, and what each count covers, only change with it, and it
+// only changes with a major release.
+const meterModel = 1
+
+// The units a run is charged for each thing it does.
+const (
+	meterStepUnits       = 1
+	meterCallUnits       = 100
+	meterLoadUnits       = 1000
+	meterAllocationUnits = 1
+)
+
+// meter counts what an execution does in terms that do not depend on the
+// machine, its load, the host's configuration or the cache, so that the
+// same script, arguments and modules always cost the same.
+type meter struct {
+	// calls counts the lines printed and the values emitted, which cross
+	// to the host however the output is delivered or batched.
+	calls atomic.Uint64
+	// loads counts the modules loaded, each once, whether or not they were
+	// compiled already. Bundled modules are free.
+	loads atomic.Uint64
+	// allocations is the most the script's variables held at once, as
+	// maxTotalSize measures it, at the size checks.
+	allocations atomic.Int64
+}
+
+func (m *meter) countCall() {
+	if m != nil {
+		m.calls.Add(1)
+	}
+}
+
+func (m *meter) countLoad() {
+	if m != nil {
+		m.loads.Add(1)
+	}
+}
+
+// sampleHeld notes the total size of the values a thread's variables hold.
+func (m *meter) sampleHeld(total int) {
+	if m == nil {
+		return
+	}
+	for {
+		peak := m.allocations.Load()
+		if int64(total) <= peak || m.allocations.CompareAndSwap(peak, int64(total)) {
+			return
+		}
+	}
+}
+
+// toJSValue returns the counts with the units they cost, given the steps
+// the execution took.
+func (m *meter) toJSValue(steps uint64) js.Value {
+	calls, loads, allocations := m.calls.Load(), m.loads.Load(), uint64(m.allocations.Load())
+	obj := jsObject.New()
+	obj.Set("model", meterModel)
+	obj.Set("steps", steps)
+	obj.Set("calls", calls)
+	obj.Set("loads", loads)
+	obj.Set("allocations", allocations)
+	obj.Set("units", steps*meterStepUnits+calls*meterCallUnits+loads*meterLoadUnits+allocations*meterAllocationUnits)
+	return obj
+}
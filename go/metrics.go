@@ -0,0 +1,180 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall/js"
+	"time"
+)
+
+// metricBuckets are the upper bounds, in seconds, of the buckets the
+// durations of runs and host calls are counted in.
+var metricBuckets = [...]float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// histogram counts durations into metricBuckets, the last count being of
+// those longer than every bound.
+type histogram struct {
+	counts [len(metricBuckets) + 1]uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(metricBuckets[:], seconds)
+	h.counts[i]++
+	h.sum += seconds
+	h.count++
+}
+
+// metrics holds the totals of the runs that have ended since the instance
+// started, for starlark.metrics(): how many there were, the errors they
+// failed with by kind, the steps they took and how long they took, and
+// how long each kind of host call took. A reset keeps them.
+var metrics = struct {
+	mu        sync.Mutex
+	ended     uint64
+	errors    map[string]uint64
+	steps     uint64
+	durations histogram
+	hostCalls map[string]*histogram
+}{errors: make(map[string]uint64), hostCalls: make(map[string]*histogram)}
+
+// countOutcome adds the execution, as it settles, to the metrics: rejection
+// is what it was rejected with, or undefined if it succeeded.
+func (e *execution) countOutcome(rejection js.Value) {
+	steps, elapsed := e.steps(), time.Since(e.calledAt)
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	metrics.ended++
+	metrics.steps += steps
+	metrics.durations.observe(elapsed)
+	if !rejection.IsUndefined() {
+		kind := "error"
+		if rejection.Type() == js.TypeObject && rejection.Get("kind").Type() == js.TypeString {
+			kind = rejection.Get("kind").String()
+		}
+		metrics.errors[kind]++
+	}
+}
+
+// countHostCall adds a call to a host callback to the metrics.
+func countHostCall(callback string, d time.Duration) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	h := metrics.hostCalls[callback]
+	if h == nil {
+		h = &histogram{}
+		metrics.hostCalls[callback] = h
+	}
+	h.observe(d)
+}
+
+// metricsWriter writes metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	strings.Builder
+}
+
+func (w *metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (w *metricsWriter) sample(name, labels string, value float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (w *metricsWriter) histogram(name, labels string, h *histogram) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cumulative uint64
+	for i, bound := range metricBuckets {
+		cumulative += h.counts[i]
+		w.sample(name+"_bucket", labels+sep+`le="`+strconv.FormatFloat(bound, 'g', -1, 64)+`"`, float64(cumulative))
+	}
+	w.sample(name+"_bucket", labels+sep+`le="+Inf"`, float64(h.count))
+	w.sample(name+"_sum", labels, h.sum)
+	w.sample(name+"_count", labels, float64(h.count))
+}
+
+// metricLabel returns a label, its value escaped as the format requires.
+func metricLabel(name, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return name + `="` + value + `"`
+}
+
+// metricsText returns the metrics, and the gauges of the executions
+// running and the modules cached, in the Prometheus text format.
+func metricsText() string {
+	executions.mu.Lock()
+	active := executions.active
+	executions.mu.Unlock()
+
+	var w metricsWriter
+	w.header("starlark_executions_active", "gauge", "Executions running.")
+	w.sample("starlark_executions_active", "", float64(active))
+
+	metrics.mu.Lock()
+	w.header("starlark_executions_total", "counter", "Executions that have ended.")
+	w.sample("starlark_executions_total", "", float64(metrics.ended))
+	w.header("starlark_execution_errors_total", "counter", "Executions that failed, by the kind of their error.")
+	kinds := make([]string, 0, len(metrics.errors))
+	for kind := range metrics.errors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		w.sample("starlark_execution_errors_total", metricLabel("kind", kind), float64(metrics.errors[kind]))
+	}
+	w.header("starlark_execution_steps_total", "counter", "Steps taken by executions that have ended.")
+	w.sample("starlark_execution_steps_total", "", float64(metrics.steps))
+	w.header("starlark_execution_duration_seconds", "histogram", "How long executions took, from the call to settling.")
+	w.histogram("starlark_execution_duration_seconds", "", &metrics.durations)
+	w.header("starlark_host_call_duration_seconds", "histogram", "How long calls to host callbacks took, by callback.")
+	callbacks := make([]string, 0, len(metrics.hostCalls))
+	for callback := range metrics.hostCalls {
+		callbacks = append(callbacks, callback)
+	}
+	sort.Strings(callbacks)
+	for _, callback := range callbacks {
+		w.histogram("starlark_host_call_duration_seconds", metricLabel("callback", callback), metrics.hostCalls[callback])
+	}
+	metrics.mu.Unlock()
+
+	w.header("starlark_module_cache_modules", "gauge", "Compiled modules cached.")
+	w.sample("starlark_module_cache_modules", "", float64(moduleCache.size.Load()))
+	w.header("starlark_module_cache_lookups_total", "counter", "Lookups of the module cache.")
+	w.sample("starlark_module_cache_lookups_total", "", float64(moduleCache.lookups.Load()))
+	w.header("starlark_module_cache_hits_total", "counter", "Lookups of the module cache that found the module.")
+	w.sample("starlark_module_cache_hits_total", "", float64(moduleCache.hits.Load()))
+	return w.String()
+}
+
+func jsMetrics() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		return metricsText()
+	})
+}
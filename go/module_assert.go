@@ -0,0 +1,98 @@
+//go:build js && !starlark_no_assert
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"dcollien.com/starlark-wasm/internal/runner"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+func init() {
+	runner.RegisterModule("assert", func() starlark.StringDict {
+		return starlark.StringDict{
+			"assert": &starlarkstruct.Module{
+				Name: "assert",
+				Members: starlark.StringDict{
+					"eq":   starlark.NewBuiltin("assert.eq", assertEq),
+					"ne":   starlark.NewBuiltin("assert.ne", assertNe),
+					"true": starlark.NewBuiltin("assert.true", assertTrue),
+				},
+			},
+		}
+	})
+}
+
+// assertMessage returns the prefix of a failed assertion's message: the
+// name of the assertion, and the script's own message, if it passed one.
+func assertMessage(b *starlark.Builtin, msg starlark.Value) string {
+	if msg == nil || msg == starlark.None {
+		return b.Name() + ": "
+	}
+	if s, ok := starlark.AsString(msg); ok {
+		return b.Name() + ": " + s + ": "
+	}
+	return b.Name() + ": " + msg.String() + ": "
+}
+
+// assertEq implements assert.eq(actual, expected, msg=None), which fails
+// listing where the values differ: the paths into them of what was added,
+// removed or changed.
+func assertEq(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var actual, expected, msg starlark.Value
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "actual", &actual, "expected", &expected, "msg?", &msg); err != nil {
+		return nil, err
+	}
+	d := &valueDiffer{}
+	if err := d.compare("", actual, expected); err != nil {
+		return nil, err
+	}
+	if d.total > 0 {
+		return nil, newAssertionError(assertMessage(b, msg), d.diffs, d.total)
+	}
+	return starlark.None, nil
+}
+
+// assertNe implements assert.ne(actual, unexpected, msg=None).
+func assertNe(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var actual, unexpected, msg starlark.Value
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "actual", &actual, "unexpected", &unexpected, "msg?", &msg); err != nil {
+		return nil, err
+	}
+	eq, err := starlark.Equal(actual, unexpected)
+	if err != nil {
+		return nil, err
+	}
+	if eq {
+		return nil, fmt.Errorf("%sgot %s, want anything else", assertMessage(b, msg), boundedRepr(actual, assertionReprLimit))
+	}
+	return starlark.None, nil
+}
+
+// assertTrue implements assert.true(cond, msg=None).
+func assertTrue(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var cond, msg starlark.Value
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "cond", &cond, "msg?", &msg); err != nil {
+		return nil, err
+	}
+	if !cond.Truth() {
+		return nil, fmt.Errorf("%sgot %s, want a true value", assertMessage(b, msg), boundedRepr(cond, assertionReprLimit))
+	}
+	return starlark.None, nil
+}
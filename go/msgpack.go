@@ -0,0 +1,538 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"syscall/js"
+
+	"go.starlark.net/starlark"
+)
+
+// The binary transport passes arguments and results as MessagePack instead
+// of as JS values, so that a call costs one copy across the bridge rather
+// than a syscall/js round trip for every property. Values follow the same
+// rules as convertToStarlarkValue and convertToJSValue, with two extension
+// types standing in for JS values MessagePack has no encoding for.
+const (
+	// msgpackExtUndefined is undefined, with a single zero byte of data.
+	msgpackExtUndefined = 0
+	// msgpackExtUnsupported is a value of any other unsupported type, with
+	// its type name as data.
+	msgpackExtUnsupported = 1
+)
+
+// msgpackDecoder decodes MessagePack from the host into Starlark values.
+type msgpackDecoder struct {
+	conv *converter
+	data []byte
+	pos  int
+}
+
+func (d *msgpackDecoder) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("invalid MessagePack at byte %d: %s", d.pos, fmt.Sprintf(format, args...))
+}
+
+// next returns the next n bytes.
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.data) {
+		return nil, d.errorf("unexpected end of data")
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// uint reads a big-endian unsigned integer of n bytes.
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+// length reads the length of a str, bin, array or map whose header is tag,
+// given the tags of its 8, 16 and 32 bit forms (0 for forms that do not
+// exist).
+func (d *msgpackDecoder) length(tag byte, tag8 byte, tag16 byte, tag32 byte) (int, error) {
+	var n uint64
+	var err error
+	switch tag {
+	case tag8:
+		n, err = d.uint(1)
+	case tag16:
+		n, err = d.uint(2)
+	case tag32:
+		n, err = d.uint(4)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d.data)) {
+		// Every element takes at least a byte, so this cannot be right.
+		return 0, d.errorf("length %d exceeds the data", n)
+	}
+	return int(n), nil
+}
+
+// header reads a tag, returning it with its kind ('a' for arrays, 'm' for
+// maps, 's' for strings, and 0 for everything else) and length.
+func (d *msgpackDecoder) header() (tag byte, kind byte, n int, err error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	tag = b[0]
+	switch {
+	case tag >= 0x80 && tag <= 0x8f:
+		return tag, 'm', int(tag & 0x0f), nil
+	case tag >= 0x90 && tag <= 0x9f:
+		return tag, 'a', int(tag & 0x0f), nil
+	case tag >= 0xa0 && tag <= 0xbf:
+		return tag, 's', int(tag & 0x1f), nil
+	case tag == 0xd9 || tag == 0xda || tag == 0xdb:
+		n, err = d.length(tag, 0xd9, 0xda, 0xdb)
+		return tag, 's', n, err
+	case tag == 0xdc || tag == 0xdd:
+		n, err = d.length(tag, 0, 0xdc, 0xdd)
+		return tag, 'a', n, err
+	case tag == 0xde || tag == 0xdf:
+		n, err = d.length(tag, 0, 0xde, 0xdf)
+		return tag, 'm', n, err
+	}
+	return tag, 0, 0, nil
+}
+
+// str reads a string, such as a map key.
+func (d *msgpackDecoder) str() (string, error) {
+	tag, kind, n, err := d.header()
+	if err != nil {
+		return "", err
+	}
+	if kind != 's' {
+		return "", d.errorf("expected a string, got tag 0x%02x", tag)
+	}
+	b, err := d.next(n)
+	return string(b), err
+}
+
+// key reads the key of a map entry, interned as for convertToStarlarkValue.
+func (d *msgpackDecoder) key() (starlark.Value, error) {
+	tag, kind, n, err := d.header()
+	if err != nil {
+		return nil, err
+	}
+	if kind != 's' {
+		return nil, d.errorf("expected a string, got tag 0x%02x", tag)
+	}
+	b, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	if key, ok := d.conv.keys[string(b)]; ok {
+		return key, nil
+	}
+	return d.conv.internKey(string(b)), nil
+}
+
+// value reads a value. undefined is returned as a nil value and no error,
+// for the caller to handle as convertToStarlarkValue would.
+func (d *msgpackDecoder) value(path string) (starlark.Value, error) {
+	tag, kind, n, err := d.header()
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case 's':
+		b, err := d.next(n)
+		return starlark.String(b), err
+	case 'a':
+		list := make([]starlark.Value, 0, n)
+		for i := 0; i < n; i++ {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			item, err := d.value(itemPath)
+			if err != nil {
+				return nil, err
+			}
+			if item == nil {
+				return nil, fmt.Errorf("%s is undefined", itemPath)
+			}
+			list = append(list, item)
+		}
+		return starlark.NewList(list), nil
+	case 'm':
+		dict := starlark.NewDict(n)
+		for i := 0; i < n; i++ {
+			starlarkKey, err := d.key()
+			if err != nil {
+				return nil, err
+			}
+			key := string(starlarkKey.(starlark.String))
+			itemPath := fmt.Sprintf("%s[%q]", path, key)
+			item, err := d.value(itemPath)
+			if err != nil {
+				return nil, err
+			}
+			if item == nil {
+				// Match JSON.stringify, which omits undefined properties.
+				if err := d.conv.lossy("dropped_undefined", itemPath, "undefined property omitted"); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			dict.SetKey(starlarkKey, item)
+		}
+		return dict, nil
+	}
+
+	switch {
+	case tag <= 0x7f:
+		return starlark.MakeInt(int(tag)), nil
+	case tag >= 0xe0:
+		return starlark.MakeInt(int(int8(tag))), nil
+	}
+	switch tag {
+	case 0xc0:
+		return starlark.None, nil
+	case 0xc2:
+		return starlark.False, nil
+	case 0xc3:
+		return starlark.True, nil
+	case 0xca:
+		bits, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return d.conv.numberToStarlarkValue(float64(math.Float32frombits(uint32(bits))), path)
+	case 0xcb:
+		bits, err := d.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return d.conv.numberToStarlarkValue(math.Float64frombits(bits), path)
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := d.uint(1 << (tag - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		return starlark.MakeUint64(v), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (tag - 0xd0)
+		v, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		// Sign-extend from the encoded size.
+		shift := 64 - 8*size
+		return starlark.MakeInt64(int64(v<<shift) >> shift), nil
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xc7, 0xc8, 0xc9:
+		return d.ext(tag, path)
+	}
+	return nil, d.errorf("unsupported tag 0x%02x at %s", tag, path)
+}
+
+// ext reads one of the extension types standing in for JS values.
+func (d *msgpackDecoder) ext(tag byte, path string) (starlark.Value, error) {
+	var n int
+	switch tag {
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		n = 1 << (tag - 0xd4)
+	default:
+		size, err := d.uint(1 << (tag - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		n = int(size)
+	}
+	extType, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	data, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	switch int8(extType[0]) {
+	case msgpackExtUndefined:
+		return nil, nil
+	case msgpackExtUnsupported:
+		return nil, fmt.Errorf("%s has unsupported type %s", path, data)
+	}
+	return nil, d.errorf("unsupported extension type %d at %s", int8(extType[0]), path)
+}
+
+// decodeArgs decodes the MessagePack array of positional arguments.
+func (c *converter) decodeArgs(data []byte) ([]starlark.Value, error) {
+	d := &msgpackDecoder{conv: c, data: data}
+	tag, kind, n, err := d.header()
+	if err != nil {
+		return nil, err
+	}
+	if kind != 'a' {
+		return nil, d.errorf("expected an array of arguments, got tag 0x%02x", tag)
+	}
+	args := make([]starlark.Value, 0, n)
+	for i := 0; i < n; i++ {
+		path := fmt.Sprintf("args[%d]", i)
+		arg, err := d.value(path)
+		if err != nil {
+			return nil, fmt.Errorf("Error: unable to convert argument %d. %w", i, err)
+		}
+		if arg == nil {
+			return nil, fmt.Errorf("Error: unable to convert argument %d. %s is undefined", i, path)
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// decodeKwargs decodes the MessagePack map of keyword arguments.
+func (c *converter) decodeKwargs(data []byte) ([]starlark.Tuple, error) {
+	d := &msgpackDecoder{conv: c, data: data}
+	tag, kind, n, err := d.header()
+	if err != nil {
+		return nil, err
+	}
+	if kind != 'm' {
+		return nil, d.errorf("expected a map of keyword arguments, got tag 0x%02x", tag)
+	}
+	kwargs := make([]starlark.Tuple, 0, n)
+	for i := 0; i < n; i++ {
+		key, err := d.str()
+		if err != nil {
+			return nil, err
+		}
+		path := fmt.Sprintf("kwargs[%q]", key)
+		kwarg, err := d.value(path)
+		if err != nil {
+			return nil, fmt.Errorf("Error: unable to convert keyword argument %q. %w", key, err)
+		}
+		if kwarg == nil {
+			// Leave the parameter to its default, as for an omitted property.
+			if err := c.lossy("dropped_undefined", path, "undefined keyword argument omitted"); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		kwargs = append(kwargs, starlark.Tuple{starlark.String(key), kwarg})
+	}
+	return kwargs, nil
+}
+
+// msgpackEncoder encodes Starlark values as MessagePack for the host.
+type msgpackEncoder struct {
+	conv *converter
+	buf  []byte
+	// active holds the lists and dicts being encoded, to catch cycles,
+	// which MessagePack cannot represent.
+	active map[starlark.Value]bool
+}
+
+func (e *msgpackEncoder) header(fix byte, fixMax int, tag16 byte, tag32 byte, n int) {
+	switch {
+	case n <= fixMax:
+		e.buf = append(e.buf, fix|byte(n))
+	case n <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, tag16), uint16(n))
+	default:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, tag32), uint32(n))
+	}
+}
+
+func (e *msgpackEncoder) str(s string) {
+	if len(s) > 31 && len(s) <= math.MaxUint8 {
+		e.buf = append(e.buf, 0xd9, byte(len(s)))
+	} else {
+		e.header(0xa0, 31, 0xda, 0xdb, len(s))
+	}
+	e.buf = append(e.buf, s...)
+}
+
+func (e *msgpackEncoder) int(v int64) {
+	switch {
+	case v >= 0 && v <= 0x7f:
+		e.buf = append(e.buf, byte(v))
+	case v < 0 && v >= -32:
+		e.buf = append(e.buf, byte(int8(v)))
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		e.buf = append(e.buf, 0xd0, byte(int8(v)))
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, 0xd1), uint16(v))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xd2), uint32(v))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xd3), uint64(v))
+	}
+}
+
+func (e *msgpackEncoder) float(v float64) {
+	e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xcb), math.Float64bits(v))
+}
+
+// value encodes a value, with the same conversions and warnings as
+// convertToJSValue.
+func (e *msgpackEncoder) value(value starlark.Value, path string) error {
+	switch value.(type) {
+	case *starlark.List, *starlark.Dict:
+		if e.active[value] {
+			return fmt.Errorf("Error: %s contains itself, which the binary transport cannot encode.", path)
+		}
+		e.active[value] = true
+		defer delete(e.active, value)
+	}
+	if err := e.conv.countResult(resultSizeOf(value), path); err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case starlark.NoneType:
+		e.buf = append(e.buf, 0xc0)
+	case starlark.Bool:
+		if v {
+			e.buf = append(e.buf, 0xc3)
+		} else {
+			e.buf = append(e.buf, 0xc2)
+		}
+	case starlark.Float:
+		e.float(float64(v))
+	case starlark.String:
+		e.str(string(v))
+	case starlark.Int:
+		intVal, ok := v.Int64()
+		if !ok || intVal > maxSafeInteger || intVal < -maxSafeInteger {
+			if err := e.conv.lossy("lossy_conversion", path, fmt.Sprintf("integer %s exceeds the precision of a JS number", v)); err != nil {
+				return err
+			}
+			e.float(float64(v.Float()))
+			return nil
+		}
+		e.int(intVal)
+	case *starlark.List:
+		e.header(0x90, 15, 0xdc, 0xdd, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			if err := e.value(v.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case *starlark.Dict:
+		items := make([]starlark.Tuple, 0, v.Len())
+		for _, item := range v.Items() {
+			if _, ok := item[0].(starlark.String); !ok {
+				if err := e.conv.lossy("unsupported_type", path, fmt.Sprintf("entry with %s key %s omitted", item[0].Type(), item[0])); err != nil {
+					return err
+				}
+				continue
+			}
+			items = append(items, item)
+		}
+		e.header(0x80, 15, 0xde, 0xdf, len(items))
+		for _, item := range items {
+			key := string(item[0].(starlark.String))
+			itemPath := fmt.Sprintf("%s[%q]", path, key)
+			if err := e.conv.countResult(len(key), itemPath); err != nil {
+				return err
+			}
+			e.str(key)
+			if err := e.value(item[1], itemPath); err != nil {
+				return err
+			}
+		}
+	default:
+		if err := e.conv.lossy("unsupported_type", path, fmt.Sprintf("%s value converted to null", value.Type())); err != nil {
+			return err
+		}
+		e.buf = append(e.buf, 0xc0)
+	}
+	return nil
+}
+
+// encodeValue encodes a value for the host as MessagePack, in a Uint8Array.
+func (c *converter) encodeValue(value starlark.Value, path string) (js.Value, error) {
+	e := encoderPool.Get().(*msgpackEncoder)
+	buf := getBuffer()
+	e.conv, e.buf = c, *buf
+	defer func() {
+		*buf = e.buf
+		putBuffer(buf)
+		e.conv, e.buf = nil, nil
+		clear(e.active)
+		encoderPool.Put(e)
+	}()
+
+	if err := e.value(value, path); err != nil {
+		return js.Null(), err
+	}
+	return bytesToJS(e.buf), nil
+}
+
+// decodeBinaryArgs decodes the arguments of a call made with the binary
+// option, which passes them as Uint8Arrays of MessagePack. Either may be
+// null or undefined for no arguments.
+func (c *converter) decodeBinaryArgs(jsArgs js.Value, jsKwargs js.Value) ([]starlark.Value, []starlark.Tuple, error) {
+	var args []starlark.Value
+	if !jsArgs.IsNull() && !jsArgs.IsUndefined() {
+		data, err := bytesFromJS(jsArgs, "args")
+		if err != nil {
+			return nil, nil, err
+		}
+		args, err = c.decodeArgs(*data)
+		putBuffer(data)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var kwargs []starlark.Tuple
+	if !jsKwargs.IsNull() && !jsKwargs.IsUndefined() {
+		data, err := bytesFromJS(jsKwargs, "kwargs")
+		if err != nil {
+			return nil, nil, err
+		}
+		kwargs, err = c.decodeKwargs(*data)
+		putBuffer(data)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return args, kwargs, nil
+}
+
+// bytesFromJS copies the contents of a Uint8Array into a pooled buffer, for
+// the caller to return to the pool once done with it. Decoding copies the
+// strings it reads, so nothing decoded refers to the buffer.
+func bytesFromJS(value js.Value, name string) (*[]byte, error) {
+	if value.Type() != js.TypeObject || !value.InstanceOf(jsUint8Array) {
+		return nil, fmt.Errorf("Error: with the binary option, %s must be a Uint8Array, not %s.", name, jsTypeName(value))
+	}
+	data := getSizedBuffer(value.Length())
+	js.CopyBytesToGo(*data, value)
+	return data, nil
+}
+
+// bytesToJS copies data into a new Uint8Array.
+func bytesToJS(data []byte) js.Value {
+	array := jsUint8Array.New(len(data))
+	js.CopyBytesToJS(array, data)
+	return array
+}
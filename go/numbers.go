@@ -0,0 +1,136 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+	"syscall/js"
+
+	"go.starlark.net/starlark"
+)
+
+// Converting a long array of numbers one element at a time takes a call into
+// the host per element. Instead, arrays and lists holding only numbers are
+// copied across as the bytes of a single Float64Array.
+
+// minNumericArray is the length below which arrays are converted element by
+// element, as checking them costs more than it saves.
+const minNumericArray = 16
+
+// numericArraySource returns the bytes of a Float64Array of value's elements
+// if they are all numbers, and null otherwise.
+const numericArraySource = `
+for (let i = 0; i < value.length; i++) {
+	if (typeof value[i] !== "number") {
+		return null;
+	}
+}
+return new Uint8Array(Float64Array.from(value).buffer);
+`
+
+// arrayFromBytesSource returns an array of the numbers in bytes, the bytes of
+// a Float64Array.
+const arrayFromBytesSource = `
+return Array.from(new Float64Array(bytes.buffer, bytes.byteOffset, bytes.byteLength / 8));
+`
+
+var (
+	numericArrayOnce sync.Once
+	numericArrayFn   js.Value
+	arrayFromBytesFn js.Value
+)
+
+// numericArrayFuncs returns the JS functions compiled from
+// numericArraySource and arrayFromBytesSource.
+func numericArrayFuncs() (numericArray js.Value, arrayFromBytes js.Value) {
+	numericArrayOnce.Do(func() {
+		function := js.Global().Get("Function")
+		numericArrayFn = function.New("value", numericArraySource)
+		arrayFromBytesFn = function.New("bytes", arrayFromBytesSource)
+	})
+	return numericArrayFn, arrayFromBytesFn
+}
+
+// numericArrayToStarlark converts a JS array of numbers in one copy, or
+// returns false if the array is short or holds anything else. Integral
+// numbers become ints, as in numberToStarlarkValue.
+func (c *converter) numericArrayToStarlark(value js.Value, length int, path string) (starlark.Value, bool, error) {
+	if length < minNumericArray {
+		return nil, false, nil
+	}
+	numericArray, _ := numericArrayFuncs()
+	jsBytes := numericArray.Invoke(value)
+	if jsBytes.IsNull() {
+		return nil, false, nil
+	}
+	buf := getSizedBuffer(8 * length)
+	defer putBuffer(buf)
+	js.CopyBytesToGo(*buf, jsBytes)
+
+	list := make([]starlark.Value, length)
+	for i := range list {
+		// Typed arrays use the platform's byte order, which for wasm is
+		// little-endian.
+		floatVal := math.Float64frombits(binary.LittleEndian.Uint64((*buf)[8*i:]))
+		if floatVal == math.Trunc(floatVal) && math.Abs(floatVal) <= maxSafeInteger {
+			list[i] = starlark.MakeInt64(int64(floatVal))
+			continue
+		}
+		// Only format the path for the numbers that may need it.
+		item, err := c.numberToStarlarkValue(floatVal, fmt.Sprintf("%s[%d]", path, i))
+		if err != nil {
+			return nil, true, err
+		}
+		list[i] = item
+	}
+	return starlark.NewList(list), true, nil
+}
+
+// numericListToJS converts a list of floats and ints in one copy, or returns
+// false if the list is short or holds anything else, including ints too
+// large for a JS number, which need a warning.
+func numericListToJS(list *starlark.List) (js.Value, bool) {
+	length := list.Len()
+	if length < minNumericArray {
+		return js.Value{}, false
+	}
+	buf := getSizedBuffer(8 * length)
+	defer putBuffer(buf)
+	for i := 0; i < length; i++ {
+		var floatVal float64
+		switch v := list.Index(i).(type) {
+		case starlark.Float:
+			floatVal = float64(v)
+		case starlark.Int:
+			intVal, ok := v.Int64()
+			if !ok || intVal > maxSafeInteger || intVal < -maxSafeInteger {
+				return js.Value{}, false
+			}
+			floatVal = float64(intVal)
+		default:
+			return js.Value{}, false
+		}
+		binary.LittleEndian.PutUint64((*buf)[8*i:], math.Float64bits(floatVal))
+	}
+	jsBytes := jsUint8Array.New(8 * length)
+	js.CopyBytesToJS(jsBytes, *buf)
+	_, arrayFromBytes := numericArrayFuncs()
+	return arrayFromBytes.Invoke(jsBytes), true
+}
@@ -0,0 +1,144 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"syscall/js"
+
+	"go.starlark.net/starlark"
+)
+
+// The host can keep what the runner compiles beyond the life of the wasm
+// module, such as in IndexedDB, so that the first run after a page load need
+// not compile every module again. It gives two callbacks, with the run or on
+// globalThis.starlark, which may answer synchronously or with a promise:
+//
+//	cacheGet(key, executionId) returns what was put under key, or undefined
+//	cachePut(key, value, executionId) keeps value under key
+//
+// The runner puts each module it compiles twice: its compiled program, a
+// Uint8Array, under "program/" and a hash of its filename, version and the
+// builtins it was compiled against, and its source, as {source, hash}, under
+// "source/" and its filename, for a loader to answer with while offline.
+// Only programs are read back. The cache is a hint: a program it has that
+// does not decode, or a callback that fails, only costs a compile.
+
+// persistentCache returns the cacheGet and cachePut callbacks of the
+// execution, which are undefined if the host gave none.
+func (e *execution) persistentCache() (get js.Value, put js.Value) {
+	get = hostCallback(e.options.callbacks, "cacheGet")
+	put = hostCallback(e.options.callbacks, "cachePut")
+	if get.Type() != js.TypeFunction || put.Type() != js.TypeFunction {
+		return js.Undefined(), js.Undefined()
+	}
+	return get, put
+}
+
+// programCacheKey is the key a module's compiled program is persisted
+// under. A program resolves the names of the builtins and host functions it
+// was compiled against, and its dialect decides how it compiles, so those
+// are part of it.
+func programCacheKey(key moduleKey) string {
+	names := defaultEnvironment.Keys()
+	sort.Strings(names)
+	h := sha256.New()
+	h.Write([]byte(key.filename + "\x00" + key.hash + "\x00" + strings.Join(names, ",")))
+	if key.hostFunctions != "" {
+		h.Write([]byte("\x00" + key.hostFunctions))
+	}
+	if key.dialect != "" {
+		h.Write([]byte("\x00dialect " + key.dialect))
+	}
+	return "program/" + hex.EncodeToString(h.Sum(nil))
+}
+
+// persistedProgram reads a module's compiled program from the host's cache,
+// returning nil if it has none.
+func (e *execution) persistedProgram(key moduleKey) *starlark.Program {
+	get, _ := e.persistentCache()
+	if get.Type() != js.TypeFunction {
+		return nil
+	}
+	result, err := invokeHost(get, programCacheKey(key), e.id)
+	if err == nil && result.Type() == js.TypeObject && result.Get("then").Type() == js.TypeFunction {
+		if e.synchronous {
+			// A synchronous run cannot wait for it.
+			return nil
+		}
+		result, err = jsAwait(result)
+	}
+	if err != nil {
+		logf(logWarn, logCache, "%s: cacheGet failed: %v", key.filename, err)
+		return nil
+	}
+	if result.Type() != js.TypeObject || !result.InstanceOf(jsUint8Array) {
+		return nil
+	}
+	data := make([]byte, result.Length())
+	js.CopyBytesToGo(data, result)
+	program, err := starlark.CompiledProgram(bytes.NewReader(data))
+	if err != nil {
+		logf(logWarn, logCache, "%s: the persisted program does not decode, compiling it: %v", key.filename, err)
+		return nil
+	}
+	logf(logDebug, logCache, "%s: reusing its persisted program", key.filename)
+	return program
+}
+
+// persistModule puts a module the execution compiled into the host's cache,
+// without waiting for the host to store it.
+func (e *execution) persistModule(key moduleKey, source string, program *starlark.Program) {
+	_, put := e.persistentCache()
+	if put.Type() != js.TypeFunction {
+		return
+	}
+	var buf bytes.Buffer
+	if err := program.Write(&buf); err != nil {
+		logf(logWarn, logCache, "%s: could not encode its program: %v", key.filename, err)
+		return
+	}
+	loaded := jsObject.New()
+	loaded.Set("source", source)
+	loaded.Set("hash", key.hash)
+	for _, entry := range []struct {
+		key   string
+		value js.Value
+	}{
+		{programCacheKey(key), bytesToJS(buf.Bytes())},
+		{"source/" + key.filename, loaded},
+	} {
+		result, err := invokeHost(put, entry.key, entry.value, e.id)
+		if err == nil && result.Type() == js.TypeObject && result.Get("then").Type() == js.TypeFunction {
+			result.Call("then", nil, jsIgnoreRejection)
+		}
+		if err != nil {
+			logf(logWarn, logCache, "%s: cachePut failed: %v", key.filename, err)
+			return
+		}
+	}
+}
+
+// jsIgnoreRejection handles the rejection of a promise no one waits for.
+var jsIgnoreRejection = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+	logf(logWarn, logCache, "cachePut failed: %s", js.Global().Call("String", args[0]).String())
+	return nil
+})
@@ -0,0 +1,92 @@
+//go:build starlark_plugin_base64
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"dcollien.com/starlark-wasm/internal/runner"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// base64Plugin is an example of a plugin, compiled in with the
+// starlark_plugin_base64 build tag. It bundles @std/base64, with
+// base64.encode(data, url=False) and base64.decode(text, url=False).
+type base64Plugin struct{}
+
+func init() {
+	runner.RegisterPlugin(base64Plugin{})
+}
+
+func (base64Plugin) Name() string { return "base64" }
+
+func (base64Plugin) Modules() map[string]func() starlark.StringDict {
+	return map[string]func() starlark.StringDict{
+		"base64": func() starlark.StringDict {
+			return starlark.StringDict{"base64": &starlarkstruct.Module{
+				Name: "base64",
+				Members: starlark.StringDict{
+					"encode": starlark.NewBuiltin("base64.encode", base64Encode),
+					"decode": starlark.NewBuiltin("base64.decode", base64Decode),
+				},
+			}}
+		},
+	}
+}
+
+func (base64Plugin) Builtins() starlark.StringDict { return nil }
+
+// base64Encoding returns the standard encoding, or the URL-safe one.
+func base64Encoding(url bool) *base64.Encoding {
+	if url {
+		return base64.URLEncoding
+	}
+	return base64.StdEncoding
+}
+
+func base64Encode(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var data starlark.Value
+	var url bool
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "data", &data, "url?", &url); err != nil {
+		return nil, err
+	}
+	var raw string
+	switch data := data.(type) {
+	case starlark.String:
+		raw = string(data)
+	case starlark.Bytes:
+		raw = string(data)
+	default:
+		return nil, fmt.Errorf("%s: got %s, want string or bytes", b.Name(), data.Type())
+	}
+	return starlark.String(base64Encoding(url).EncodeToString([]byte(raw))), nil
+}
+
+func base64Decode(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var text string
+	var url bool
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "text", &text, "url?", &url); err != nil {
+		return nil, err
+	}
+	raw, err := base64Encoding(url).DecodeString(text)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return starlark.Bytes(raw), nil
+}
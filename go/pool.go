@@ -0,0 +1,70 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+
+	"go.starlark.net/starlark"
+)
+
+// Every call converts its arguments and result, and under sustained load the
+// buffers and wrappers this allocates each time keep the garbage collector
+// busy. The ones that do not outlive a call are reused instead.
+//
+// Threads are not pooled: a starlark.Thread keeps its step count,
+// cancellation and thread-locals, and has no way to reset them.
+
+// maxPooledBuffer is the capacity above which buffers are left to the garbage
+// collector, so that one huge call does not pin its memory for good.
+const maxPooledBuffer = 4 << 20
+
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new([]byte) },
+}
+
+// getBuffer returns an empty buffer from the pool.
+func getBuffer() *[]byte {
+	buf := bufferPool.Get().(*[]byte)
+	*buf = (*buf)[:0]
+	return buf
+}
+
+// getSizedBuffer returns a buffer of length n from the pool.
+func getSizedBuffer(n int) *[]byte {
+	buf := getBuffer()
+	if cap(*buf) < n {
+		*buf = make([]byte, n)
+	}
+	*buf = (*buf)[:n]
+	return buf
+}
+
+// putBuffer returns a buffer to the pool. Nothing may refer to its contents
+// afterwards.
+func putBuffer(buf *[]byte) {
+	if cap(*buf) > maxPooledBuffer {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+var encoderPool = sync.Pool{
+	New: func() interface{} {
+		return &msgpackEncoder{active: make(map[starlark.Value]bool)}
+	},
+}
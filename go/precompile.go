@@ -0,0 +1,132 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"syscall/js"
+
+	"dcollien.com/starlark-wasm/internal/runner"
+)
+
+// precompiled lists the modules a precompile reached: those it compiled, or
+// took from the host's persistent cache, and those already cached.
+type precompiled struct {
+	compiled, cached []string
+}
+
+func (p precompiled) toJSValue() js.Value {
+	obj := jsObject.New()
+	obj.Set("compiled", stringsToJSArray(p.compiled))
+	obj.Set("cached", stringsToJSArray(p.cached))
+	return obj
+}
+
+// precompileModules warms the module cache with a module and the modules it
+// loads, directly or not, asking the loader for each as a run would, and
+// compiling those not yet cached, without running any of them. Bundled
+// modules are compiled into the runner and skipped.
+func precompileModules(exec *execution, filename string) (precompiled, error) {
+	var result precompiled
+	seen := map[string]bool{filename: true}
+	for queue := []string{filename}; len(queue) > 0; queue = queue[1:] {
+		name := queue[0]
+		if _, ok, _ := runner.BundledModule(name); ok {
+			continue
+		}
+		source, hash, err := exec.lockedLoad(name)
+		if err != nil {
+			return result, exec.wrapEvalError(codeEvalFailed, err)
+		}
+		key := exec.moduleKeyFor(name, source, hash)
+		module := cachedModuleFor(key)
+		if module != nil {
+			result.cached = append(result.cached, name)
+		} else {
+			if module, err = exec.compileModule(key, source); err != nil {
+				return result, exec.wrapEvalError(codeEvalFailed, withAllResolveErrors(err))
+			}
+			cacheModule(key, module)
+			result.compiled = append(result.compiled, name)
+		}
+		for i := 0; i < module.program.NumLoads(); i++ {
+			if load, _ := module.program.Load(i); !seen[load] {
+				seen[load] = true
+				queue = append(queue, load)
+			}
+		}
+	}
+	return result, nil
+}
+
+// dropCachedModule drops every cached version of a module, returning how
+// many there were.
+func dropCachedModule(filename string) int {
+	shard := shardFor(filename)
+	shard.lock()
+	defer shard.mu.Unlock()
+	kept := shard.order[:0]
+	dropped := 0
+	for _, key := range shard.order {
+		if key.filename == filename {
+			delete(shard.modules, key)
+			dropped++
+		} else {
+			kept = append(kept, key)
+		}
+	}
+	shard.order = kept
+	moduleCache.size.Add(int64(-dropped))
+	return dropped
+}
+
+// jsPrecompile implements starlark.precompile(executionId, filename,
+// options), which compiles a module and those it loads into the module
+// cache ahead of the runs that need them, and resolves with {compiled,
+// cached}: the filenames of the modules it compiled and of those already
+// cached. The loader and lockfile of the options apply as to a run.
+func jsPrecompile() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 2 || args[1].Type() != js.TypeString {
+			return rejected(fmt.Errorf("Error: requires executionId and a filename as arguments."))
+		}
+		options := js.Undefined()
+		if len(args) > 2 {
+			options = args[2]
+		}
+		return runAsync(args[0].String(), options, func(exec *execution) (js.Value, error) {
+			result, err := precompileModules(exec, args[1].String())
+			if err != nil {
+				return js.Null(), err
+			}
+			return result.toJSValue(), nil
+		})
+	})
+}
+
+// jsClearCache implements starlark.clearCache(filename), which drops the
+// cached versions of a module, or the whole module cache and its
+// measurements if no filename is given, returning how many modules it
+// dropped. Runs in flight keep the modules they have loaded.
+func jsClearCache() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) > 0 && args[0].Type() == js.TypeString {
+			return dropCachedModule(args[0].String())
+		}
+		return clearModuleCache()
+	})
+}
@@ -0,0 +1,88 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"syscall/js"
+)
+
+// awaitOutputWindow waits, with the maxUnackedOutput option, until the host
+// has acknowledged enough of the lines printed so far for one more to be
+// within the option, and counts that line. The batch waiting, if any, is
+// delivered first, as the host cannot acknowledge lines it has not seen. It
+// returns an error if the execution is cancelled while it waits.
+func (e *execution) awaitOutputWindow() error {
+	for {
+		e.mu.Lock()
+		if e.unackedOutput < e.options.maxUnackedOutput {
+			e.unackedOutput++
+			e.mu.Unlock()
+			return nil
+		}
+		reason := e.cancelReason
+		e.mu.Unlock()
+		if reason != "" {
+			return fmt.Errorf("%s", reason)
+		}
+		if err := e.flushOutput(); err != nil {
+			return err
+		}
+		<-e.outputAcked
+	}
+}
+
+// ackOutput acknowledges lines of the execution's output, letting it print
+// as many more.
+func (e *execution) ackOutput(lines int) {
+	e.mu.Lock()
+	e.unackedOutput -= lines
+	if e.unackedOutput < 0 {
+		e.unackedOutput = 0
+	}
+	e.mu.Unlock()
+	e.wakeOutput()
+}
+
+// wakeOutput wakes the thread waiting in awaitOutputWindow, if there is one.
+func (e *execution) wakeOutput() {
+	select {
+	case e.outputAcked <- struct{}{}:
+	default:
+	}
+}
+
+// jsAckOutput implements starlark.ackOutput(executionId, lines), which
+// acknowledges lines of a run's output, one if not given, for a run with the
+// maxUnackedOutput option. It returns whether the run is running.
+func jsAckOutput() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 1 || args[0].Type() != js.TypeString {
+			return jsErrorConstructor.New("Error: requires an executionId as argument.")
+		}
+		lines := 1
+		if len(args) > 1 && args[1].Type() == js.TypeNumber {
+			lines = args[1].Int()
+		}
+		e := runningExecution(args[0].String())
+		if e == nil {
+			return false
+		}
+		e.ackOutput(lines)
+		return true
+	})
+}
@@ -0,0 +1,99 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"syscall/js"
+	"time"
+)
+
+// defaultPrintFlushInterval is how long batched output may wait before it is
+// delivered, unless the printFlushInterval option says otherwise.
+const defaultPrintFlushInterval = 50 * time.Millisecond
+
+// printBatch is output waiting to be delivered to the host in one call.
+type printBatch struct {
+	lines []outputLine
+	// since is when the oldest waiting line was printed.
+	since time.Time
+}
+
+// queueOutput adds a line to the batch, delivering the batch if it is full or
+// has waited long enough.
+func (e *execution) queueOutput(line outputLine) error {
+	e.mu.Lock()
+	if len(e.batch.lines) == 0 {
+		e.batch.since = time.Now()
+	}
+	e.batch.lines = append(e.batch.lines, line)
+	due := len(e.batch.lines) >= e.options.printBatchSize || time.Since(e.batch.since) >= e.options.printFlushInterval
+	e.mu.Unlock()
+
+	if !due {
+		return nil
+	}
+	return e.flushOutput()
+}
+
+// flushOutputIfDue delivers the batch if it has waited long enough.
+func (e *execution) flushOutputIfDue() error {
+	e.mu.Lock()
+	due := len(e.batch.lines) > 0 && time.Since(e.batch.since) >= e.options.printFlushInterval
+	e.mu.Unlock()
+
+	if !due {
+		return nil
+	}
+	return e.flushOutput()
+}
+
+// flushOutput delivers the batch to the host. It returns an error if the
+// host's callback failed and the onHostError policy says to stop.
+func (e *execution) flushOutput() error {
+	e.mu.Lock()
+	lines := e.batch.lines
+	e.batch = printBatch{}
+	e.mu.Unlock()
+
+	if len(lines) == 0 {
+		return nil
+	}
+	if err := e.audited("printBatch", countSummary(len(lines), "line"), func() error { return jsPrintBatch(e.options.callbacks, lines, e.id) }); err != nil {
+		return e.hostFailure("print", err)
+	}
+	return nil
+}
+
+// jsPrintBatch forwards lines of output to the host's printBatch callback,
+// as the same objects the captureOutput option returns, or line by line
+// through jsPrint if it has none. It returns what the callback throws.
+func jsPrintBatch(callbacks js.Value, lines []outputLine, executionId string) error {
+	if printBatchFn := hostCallback(callbacks, "printBatch"); printBatchFn.Type() == js.TypeFunction {
+		array := jsArray.New(len(lines))
+		for i, line := range lines {
+			array.SetIndex(i, line.toJSValue())
+		}
+		_, err := invokeHost(printBatchFn, array, executionId)
+		return err
+	}
+	for _, line := range lines {
+		if err := jsPrint(callbacks, line.stream, line.message, executionId, line.pos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+
+	"go.starlark.net/starlark"
+)
+
+// The priority classes of runs, chosen by the priority option. The steps
+// of batch runs wait while any interactive run is in progress, so that
+// background work never holds up what a user is waiting for.
+const (
+	priorityInteractive = "interactive"
+	priorityBatch       = "batch"
+)
+
+// interactiveRuns counts the interactive executions in progress. idle is
+// closed while there are none, and replaced by an open channel while there
+// are, for batch threads to wait on.
+var interactiveRuns = struct {
+	mu     sync.Mutex
+	active int
+	idle   chan struct{}
+}{idle: closedChannel()}
+
+func closedChannel() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+// holdsBatch reports whether the execution keeps batch runs waiting: an
+// interactive run the host is waiting for. Synchronous runs finish before
+// any other could step, so they need not.
+func (e *execution) holdsBatch() bool {
+	return e.options.priority != priorityBatch && !e.synchronous
+}
+
+// beginInteractive counts the execution among the interactive runs in
+// progress, if it is one.
+func (e *execution) beginInteractive() {
+	if !e.holdsBatch() {
+		return
+	}
+	interactiveRuns.mu.Lock()
+	defer interactiveRuns.mu.Unlock()
+	if interactiveRuns.active == 0 {
+		interactiveRuns.idle = make(chan struct{})
+	}
+	interactiveRuns.active++
+}
+
+// endInteractive undoes beginInteractive, letting batch runs go on once
+// the last interactive run has ended.
+func (e *execution) endInteractive() {
+	if !e.holdsBatch() {
+		return
+	}
+	interactiveRuns.mu.Lock()
+	defer interactiveRuns.mu.Unlock()
+	interactiveRuns.active--
+	if interactiveRuns.active == 0 {
+		close(interactiveRuns.idle)
+	}
+}
+
+// waitForInteractive is the step hook of batch threads, which waits until
+// no interactive run is in progress, or the execution is cancelled.
+func (e *execution) waitForInteractive(*starlark.Thread) {
+	interactiveRuns.mu.Lock()
+	idle := interactiveRuns.idle
+	interactiveRuns.mu.Unlock()
+	select {
+	case <-idle:
+	case <-e.cancelled:
+	}
+}
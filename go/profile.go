@@ -0,0 +1,349 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// Starlark's profiler is global: while it runs it samples every thread, and
+// starting or stopping it while another thread is executing can corrupt the
+// profile or crash that thread. So a profiled execution must have the runner
+// to itself, and is refused, as are other executions while it runs, rather
+// than made to wait, which would deadlock a run started from a host callback
+// of another.
+var executions struct {
+	mu sync.Mutex
+	// active is the number of executions running, and started the number
+	// begun since the instance started.
+	active  int
+	started uint64
+	// profiled is set while a profiled execution runs.
+	profiled bool
+	// byId holds the executions running, for starlark.stack to find.
+	byId map[string]*execution
+}
+
+// beginExecution registers an execution as running, failing if it and the
+// executions already running cannot overlap, or its tenant has used up its
+// quota, which the quotaExceeded handlers are told of.
+func beginExecution(e *execution) error {
+	err := registerExecution(e)
+	var exceeded *quotaError
+	if errors.As(err, &exceeded) {
+		// Told once the locks are released, as handlers may call back into
+		// the runner.
+		e.notifyQuotaExceeded(exceeded)
+	}
+	return err
+}
+
+func registerExecution(e *execution) error {
+	executions.mu.Lock()
+	defer executions.mu.Unlock()
+	if executions.profiled {
+		return fmt.Errorf("Error: another execution is being profiled.")
+	}
+	if e.options.profile && executions.active > 0 {
+		return fmt.Errorf("Error: a profiled execution cannot overlap other executions.")
+	}
+	if err := e.checkQuota(); err != nil {
+		return err
+	}
+	executions.active++
+	executions.started++
+	e.startedAt = time.Now()
+	e.beginInteractive()
+	executions.profiled = e.options.profile
+	if executions.byId == nil {
+		executions.byId = make(map[string]*execution)
+	}
+	executions.byId[e.id] = e
+	return nil
+}
+
+// endExecution unregisters an execution registered by beginExecution.
+func endExecution(e *execution) {
+	// Loads still in flight, of a run that timed out say, are not needed.
+	e.abort("the execution is over")
+	e.accountLabels()
+	e.chargeQuota()
+	e.chargeRetry()
+	e.endInteractive()
+	executions.mu.Lock()
+	defer executions.mu.Unlock()
+	executions.active--
+	if e.options.profile {
+		executions.profiled = false
+	}
+	if executions.byId[e.id] == e {
+		delete(executions.byId, e.id)
+	}
+}
+
+// runningExecution returns the running execution with the given id, or nil.
+func runningExecution(id string) *execution {
+	executions.mu.Lock()
+	defer executions.mu.Unlock()
+	return executions.byId[id]
+}
+
+// profileRun runs fn with Starlark's profiler enabled, and returns the
+// profile it produced: a gzipped pprof protocol buffer of the wall time spent
+// in each Starlark function.
+func profileRun(fn func() (starlark.Value, error)) (starlark.Value, []byte, error) {
+	var buf bytes.Buffer
+	if err := starlark.StartProfile(&buf); err != nil {
+		return nil, nil, fmt.Errorf("Error: unable to start the profiler. %w", err)
+	}
+	value, err := fn()
+	if stopErr := starlark.StopProfile(); stopErr != nil && err == nil {
+		err = fmt.Errorf("Error: unable to complete the profile. %w", stopErr)
+	}
+	return value, buf.Bytes(), err
+}
+
+// protoField is a field of a protocol buffer message: its number, and either
+// its varint value or, for a length-delimited field, its bytes.
+type protoField struct {
+	number int
+	value  uint64
+	data   []byte
+}
+
+// protoFields splits a protocol buffer message into its fields. Only varint
+// and length-delimited fields are expected, as those are all the profiler
+// writes.
+func protoFields(msg []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return nil, fmt.Errorf("truncated field key")
+		}
+		msg = msg[n:]
+		field := protoField{number: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			field.value, n = binary.Uvarint(msg)
+			if n <= 0 {
+				return nil, fmt.Errorf("truncated varint")
+			}
+			msg = msg[n:]
+		case 2:
+			length, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < length {
+				return nil, fmt.Errorf("truncated field")
+			}
+			field.data = msg[n : n+int(length)]
+			msg = msg[n+int(length):]
+		default:
+			return nil, fmt.Errorf("unexpected wire type %d", key&7)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// protoVarints returns the values of a repeated varint field, which may be
+// packed into one length-delimited field.
+func protoVarints(field protoField) ([]uint64, error) {
+	if field.data == nil {
+		return []uint64{field.value}, nil
+	}
+	var values []uint64
+	for data := field.data; len(data) > 0; {
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("truncated packed varint")
+		}
+		values = append(values, value)
+		data = data[n:]
+	}
+	return values, nil
+}
+
+// foldProfile converts a profile produced by profileRun to the folded stack
+// format flame graph tools read: a line per distinct stack, its frames
+// outermost first and separated by semicolons, then a space and the wall
+// time spent in it, in nanoseconds. Functions defined in a module are shown
+// with where, so that those of the same name in different modules stay
+// apart; modules' top-level code is shown as the module's filename.
+func foldProfile(profile []byte) (string, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(profile))
+	if err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		return "", err
+	}
+	fields, err := protoFields(data)
+	if err != nil {
+		return "", err
+	}
+
+	// Field numbers from pprof's profile.proto.
+	const (
+		profileSample      = 2
+		profileLocation    = 4
+		profileFunction    = 5
+		profileStringTable = 6
+		sampleLocationId   = 1
+		sampleValue        = 2
+		locationId         = 1
+		locationLine       = 4
+		lineFunctionId     = 1
+		functionId         = 1
+		functionName       = 2
+		functionFilename   = 4
+		functionStartLine  = 5
+	)
+	var strs []string
+	type function struct{ name, filename, startLine uint64 }
+	functions := make(map[uint64]function)
+	// locations holds the function of each location. The profiler gives
+	// each location a single line.
+	locations := make(map[uint64]uint64)
+	var samples [][]protoField
+	for _, field := range fields {
+		switch field.number {
+		case profileStringTable:
+			strs = append(strs, string(field.data))
+		case profileSample:
+			sample, err := protoFields(field.data)
+			if err != nil {
+				return "", err
+			}
+			samples = append(samples, sample)
+		case profileFunction:
+			msg, err := protoFields(field.data)
+			if err != nil {
+				return "", err
+			}
+			var id uint64
+			var fn function
+			for _, f := range msg {
+				switch f.number {
+				case functionId:
+					id = f.value
+				case functionName:
+					fn.name = f.value
+				case functionFilename:
+					fn.filename = f.value
+				case functionStartLine:
+					fn.startLine = f.value
+				}
+			}
+			functions[id] = fn
+		case profileLocation:
+			msg, err := protoFields(field.data)
+			if err != nil {
+				return "", err
+			}
+			var id, fn uint64
+			for _, f := range msg {
+				switch f.number {
+				case locationId:
+					id = f.value
+				case locationLine:
+					line, err := protoFields(f.data)
+					if err != nil {
+						return "", err
+					}
+					for _, l := range line {
+						if l.number == lineFunctionId {
+							fn = l.value
+						}
+					}
+				}
+			}
+			locations[id] = fn
+		}
+	}
+	str := func(i uint64) string {
+		if i < uint64(len(strs)) {
+			return strs[i]
+		}
+		return ""
+	}
+	frameName := func(location uint64) string {
+		fn := functions[locations[location]]
+		name, filename := str(fn.name), str(fn.filename)
+		// Builtins have no position, nor do modules' top levels need one.
+		if fn.startLine > 0 && name != filename {
+			name = fmt.Sprintf("%s (%s:%d)", name, filename, fn.startLine)
+		}
+		// Semicolons separate the frames.
+		return strings.ReplaceAll(name, ";", ":")
+	}
+
+	totals := make(map[string]int64)
+	for _, sample := range samples {
+		var stack []uint64
+		var value int64
+		for _, f := range sample {
+			switch f.number {
+			case sampleLocationId:
+				ids, err := protoVarints(f)
+				if err != nil {
+					return "", err
+				}
+				stack = append(stack, ids...)
+			case sampleValue:
+				values, err := protoVarints(f)
+				if err != nil {
+					return "", err
+				}
+				for _, v := range values {
+					value += int64(v)
+				}
+			}
+		}
+		if len(stack) == 0 {
+			continue
+		}
+		// Samples list their locations innermost first.
+		names := make([]string, len(stack))
+		for i, location := range stack {
+			names[len(stack)-1-i] = frameName(location)
+		}
+		totals[strings.Join(names, ";")] += value
+	}
+
+	stacks := make([]string, 0, len(totals))
+	for stack := range totals {
+		stacks = append(stacks, stack)
+	}
+	sort.Strings(stacks)
+	var folded strings.Builder
+	for _, stack := range stacks {
+		fmt.Fprintf(&folded, "%s %d\n", stack, totals[stack])
+	}
+	return folded.String(), nil
+}
@@ -0,0 +1,242 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"syscall/js"
+	"time"
+)
+
+// quotaLimits bounds the cumulative use of a tenant's runs. A zero limit is
+// no limit.
+type quotaLimits struct {
+	steps     uint64
+	time      time.Duration
+	loads     uint64
+	hostCalls uint64
+}
+
+// quotaUsage adds up what a tenant's runs used, once they ended.
+type quotaUsage struct {
+	runs      uint64
+	steps     uint64
+	time      time.Duration
+	loads     uint64
+	hostCalls uint64
+}
+
+// quota is the limits and usage of a tenant.
+type quota struct {
+	limits quotaLimits
+	usage  quotaUsage
+}
+
+// quotas holds the quota of each tenant the host set one for. A run belongs
+// to the tenant named by its tenant label, or else to the tenant whose name
+// is the longest prefix of its execution id, as "acme:" for "acme:42".
+var quotas = struct {
+	mu       sync.Mutex
+	byTenant map[string]*quota
+}{byTenant: make(map[string]*quota)}
+
+// tenantOf returns the tenant the execution belongs to, and its quota, or
+// nil if it has none. It must be called with quotas.mu held.
+func tenantOf(e *execution) (string, *quota) {
+	if tenant, ok := e.options.labels["tenant"]; ok {
+		if q := quotas.byTenant[tenant]; q != nil {
+			return tenant, q
+		}
+	}
+	best := ""
+	for tenant := range quotas.byTenant {
+		if strings.HasPrefix(e.id, tenant) && len(tenant) > len(best) {
+			best = tenant
+		}
+	}
+	if best == "" {
+		return "", nil
+	}
+	return best, quotas.byTenant[best]
+}
+
+// checkQuota fails if the execution's tenant has used up any of its quota,
+// and otherwise notes the quota to charge the execution to when it ends.
+func (e *execution) checkQuota() error {
+	quotas.mu.Lock()
+	defer quotas.mu.Unlock()
+	tenant, q := tenantOf(e)
+	if q == nil {
+		return nil
+	}
+	l, u := q.limits, q.usage
+	switch {
+	case l.steps > 0 && u.steps >= l.steps:
+		return &quotaError{tenant: tenant, resource: "steps", used: float64(u.steps), limit: float64(l.steps)}
+	case l.time > 0 && u.time >= l.time:
+		return &quotaError{tenant: tenant, resource: "time", used: milliseconds(u.time), limit: milliseconds(l.time)}
+	case l.loads > 0 && u.loads >= l.loads:
+		return &quotaError{tenant: tenant, resource: "loads", used: float64(u.loads), limit: float64(l.loads)}
+	case l.hostCalls > 0 && u.hostCalls >= l.hostCalls:
+		return &quotaError{tenant: tenant, resource: "hostCalls", used: float64(u.hostCalls), limit: float64(l.hostCalls)}
+	}
+	e.quota = q
+	return nil
+}
+
+// chargeQuota adds what the execution used, once it has ended, to the
+// usage of its tenant's quota.
+func (e *execution) chargeQuota() {
+	if e.quota == nil {
+		return
+	}
+	steps, elapsed := e.steps(), time.Since(e.calledAt)
+	quotas.mu.Lock()
+	defer quotas.mu.Unlock()
+	u := &e.quota.usage
+	u.runs++
+	u.steps += steps
+	u.time += elapsed
+	u.loads += e.loads.Load()
+	u.hostCalls += e.hostCalls.Load()
+}
+
+// parseQuotaLimits reads limits given as {steps, time, loads, hostCalls},
+// with time in milliseconds.
+func parseQuotaLimits(value js.Value) quotaLimits {
+	var l quotaLimits
+	count := func(name string) uint64 {
+		if v := value.Get(name); v.Type() == js.TypeNumber && v.Float() > 0 {
+			return uint64(v.Float())
+		}
+		return 0
+	}
+	l.steps = count("steps")
+	l.loads = count("loads")
+	l.hostCalls = count("hostCalls")
+	if v := value.Get("time"); v.Type() == js.TypeNumber && v.Float() > 0 {
+		l.time = time.Duration(v.Float() * float64(time.Millisecond))
+	}
+	return l
+}
+
+func (l quotaLimits) toJSValue() js.Value {
+	obj := jsObject.New()
+	set := func(name string, limit float64) {
+		if limit > 0 {
+			obj.Set(name, limit)
+		}
+	}
+	set("steps", float64(l.steps))
+	set("time", milliseconds(l.time))
+	set("loads", float64(l.loads))
+	set("hostCalls", float64(l.hostCalls))
+	return obj
+}
+
+func (u quotaUsage) toJSValue() js.Value {
+	obj := jsObject.New()
+	obj.Set("runs", u.runs)
+	obj.Set("steps", u.steps)
+	obj.Set("time", milliseconds(u.time))
+	obj.Set("loads", u.loads)
+	obj.Set("hostCalls", u.hostCalls)
+	return obj
+}
+
+// setQuota sets the limits of a tenant, keeping the usage so far, or
+// removes its quota when value is null or undefined.
+func setQuota(tenant string, value js.Value) {
+	quotas.mu.Lock()
+	defer quotas.mu.Unlock()
+	if value.Type() != js.TypeObject {
+		delete(quotas.byTenant, tenant)
+		return
+	}
+	q := quotas.byTenant[tenant]
+	if q == nil {
+		q = &quota{}
+		quotas.byTenant[tenant] = q
+	}
+	q.limits = parseQuotaLimits(value)
+}
+
+// resetQuota forgets the usage of a tenant, as at the start of a new
+// billing period, reporting whether it has a quota.
+func resetQuota(tenant string) bool {
+	quotas.mu.Lock()
+	defer quotas.mu.Unlock()
+	q := quotas.byTenant[tenant]
+	if q == nil {
+		return false
+	}
+	q.usage = quotaUsage{}
+	return true
+}
+
+// quotaToJSValue returns the {tenant, limits, usage} of a tenant, or
+// undefined if it has no quota.
+func quotaToJSValue(tenant string) js.Value {
+	quotas.mu.Lock()
+	defer quotas.mu.Unlock()
+	q := quotas.byTenant[tenant]
+	if q == nil {
+		return js.Undefined()
+	}
+	obj := jsObject.New()
+	obj.Set("tenant", tenant)
+	obj.Set("limits", q.limits.toJSValue())
+	obj.Set("usage", q.usage.toJSValue())
+	return obj
+}
+
+// jsSetQuota implements starlark.setQuota(tenant, limits), where limits is
+// {steps?, time?, loads?, hostCalls?}, or null to remove the quota.
+func jsSetQuota() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 1 || args[0].Type() != js.TypeString {
+			return jsErrorConstructor.New("Error: requires a tenant as argument.")
+		}
+		limits := js.Null()
+		if len(args) > 1 {
+			limits = args[1]
+		}
+		setQuota(args[0].String(), limits)
+		return nil
+	})
+}
+
+// jsQuota implements starlark.quota(tenant).
+func jsQuota() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 1 || args[0].Type() != js.TypeString {
+			return jsErrorConstructor.New("Error: requires a tenant as argument.")
+		}
+		return quotaToJSValue(args[0].String())
+	})
+}
+
+// jsResetQuota implements starlark.resetQuota(tenant).
+func jsResetQuota() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 1 || args[0].Type() != js.TypeString {
+			return jsErrorConstructor.New("Error: requires a tenant as argument.")
+		}
+		return resetQuota(args[0].String())
+	})
+}
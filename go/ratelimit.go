@@ -0,0 +1,83 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// callLimiter bounds the rate of an execution's calls of host builtins, with
+// the maxCallRate option. It is a token bucket: it holds up to burst calls,
+// starting full, and refills at rate calls a second, so a script may make a
+// burst of calls at once but no more than rate a second for long.
+type callLimiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newCallLimiter returns the limiter of an execution with these options, or
+// nil if its calls are not limited. A burst of 0 or less is one second's
+// worth of calls, and at least one.
+func newCallLimiter(rate float64, burst int) *callLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	b := float64(burst)
+	if burst <= 0 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &callLimiter{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+// take counts a call, reporting whether the bucket had room for it.
+func (l *callLimiter) take() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// throttle counts a call of the host builtin with the given name, failing
+// it, and with it the execution, once the calls come faster than the
+// maxCallRate option allows.
+func (e *execution) throttle(name string) error {
+	if e.limiter == nil || e.limiter.take() {
+		return nil
+	}
+	rate, burst := e.limiter.rate, int(e.limiter.burst)
+	message := e.message(codeThrottled, "builtin", name, "rate", strconv.FormatFloat(rate, 'g', -1, 64), "burst", strconv.Itoa(burst))
+	err := &throttleError{message: message, locale: e.options.locale, builtin: name, rate: rate, burst: burst}
+	e.mu.Lock()
+	if e.throttleErr == nil {
+		e.throttleErr = err
+	}
+	e.mu.Unlock()
+	return err
+}
@@ -0,0 +1,274 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"syscall/js"
+	"unicode/utf8"
+
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// renameEdit replaces the text between two positions of the source.
+type renameEdit struct {
+	start, end syntax.Position
+	newText    string
+}
+
+func (e renameEdit) toJSValue() js.Value {
+	obj := jsObject.New()
+	obj.Set("start", positionToJSValue(e.start))
+	obj.Set("end", positionToJSValue(e.end))
+	obj.Set("newText", e.newText)
+	return obj
+}
+
+// identEnd returns the position just past an identifier.
+func identEnd(id *syntax.Ident) syntax.Position {
+	return syntax.MakePosition(nil, id.NamePos.Line, id.NamePos.Col+int32(utf8.RuneCountInString(id.Name)))
+}
+
+// isIdentifier reports whether name can be bound by a Starlark program.
+func isIdentifier(name string) bool {
+	if name == "" || starlarkKeywords[name] {
+		return false
+	}
+	for i, r := range name {
+		if !isIdentRune(r) || i == 0 && r >= '0' && r <= '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// renameSymbol computes the edits that rename the name bound by the
+// identifier at a 1-based line and column, and all its uses, to newName.
+//
+// The rename follows the resolver: a local only changes within its
+// function, and a name that shadows another leaves that one alone. A name
+// loaded without an alias gets one, as load("m", "x") becomes
+// load("m", y = "x"), and renaming a parameter also renames the keyword
+// arguments of the calls to its function by name. It is refused if newName
+// would take the place of another name anywhere the renamed one is seen,
+// or the other way round.
+func renameSymbol(filename string, source string, line int32, col int32, newName string) ([]renameEdit, error) {
+	fileOptions := syntax.FileOptions{}
+	f, err := fileOptions.Parse(filename, source, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Error: unable to rename in source that does not parse. %s", err)
+	}
+	// Undefined names only fail the file; they are all still resolved.
+	resolve.File(f, func(string) bool { return false }, starlark.Universe.Has)
+	if !isIdentifier(newName) {
+		return nil, fmt.Errorf("Error: %q is not a valid identifier.", newName)
+	}
+
+	// Find the identifier at the cursor, and all the identifiers.
+	var idents []*syntax.Ident
+	seen := make(map[*syntax.Ident]bool)
+	var target *syntax.Ident
+	shorthandLoads := make(map[*syntax.Ident]bool)
+	var functions []syntax.Node
+	walkSyntax(f, func(n syntax.Node) bool {
+		switch n := n.(type) {
+		case *syntax.Ident:
+			// Walked twice for load("m", "x"), where From and To share an
+			// Ident.
+			if seen[n] {
+				return true
+			}
+			seen[n] = true
+			idents = append(idents, n)
+			if n.NamePos.Line == line && n.NamePos.Col <= col && col <= identEnd(n).Col {
+				target = n
+			}
+		case *syntax.LoadStmt:
+			for i := range n.To {
+				if n.From[i] == n.To[i] {
+					shorthandLoads[n.To[i]] = true
+				}
+			}
+		case *syntax.DefStmt, *syntax.LambdaExpr:
+			functions = append(functions, n)
+		}
+		return true
+	})
+	if target == nil {
+		return nil, fmt.Errorf("Error: there is no name to rename at %d:%d.", line, col)
+	}
+	binding, _ := target.Binding.(*resolve.Binding)
+	if binding == nil || binding.First == nil {
+		if binding != nil && (binding.Scope == resolve.Universal || binding.Scope == resolve.Predeclared) {
+			return nil, fmt.Errorf("Error: %s is a builtin, which cannot be renamed.", target.Name)
+		}
+		return nil, fmt.Errorf("Error: %s is not bound in this file, so cannot be renamed here.", target.Name)
+	}
+	first := binding.First
+	if newName == first.Name {
+		return []renameEdit{}, nil
+	}
+
+	// The renamed name is seen within the function its binding is local
+	// to, or in the whole file.
+	scopeStart, scopeEnd := f.Span()
+	var owner *resolve.Function
+	for _, fn := range functions {
+		var resolved *resolve.Function
+		switch fn := fn.(type) {
+		case *syntax.DefStmt:
+			resolved, _ = fn.Function.(*resolve.Function)
+		case *syntax.LambdaExpr:
+			resolved, _ = fn.Function.(*resolve.Function)
+		}
+		if resolved == nil {
+			continue
+		}
+		for _, local := range resolved.Locals {
+			if local.First == first {
+				owner = resolved
+				scopeStart, scopeEnd = fn.Span()
+			}
+		}
+	}
+	inScope := func(id *syntax.Ident) bool {
+		return spanContains(scopeStart, scopeEnd, id.NamePos.Line, id.NamePos.Col)
+	}
+
+	lines := strings.Split(source, "\n")
+	var edits []renameEdit
+	for _, id := range idents {
+		b, _ := id.Binding.(*resolve.Binding)
+		if b != nil && b.First == first {
+			if shorthandLoads[id] {
+				// Replace the quoted name with an alias of it.
+				quoteStart := syntax.MakePosition(nil, id.NamePos.Line, id.NamePos.Col-1)
+				quoteEnd := syntax.MakePosition(nil, id.NamePos.Line, identEnd(id).Col+1)
+				quote := "\""
+				if lineText := []rune(lines[id.NamePos.Line-1]); id.NamePos.Col >= 2 && lineText[id.NamePos.Col-2] == '\'' {
+					quote = "'"
+				}
+				edits = append(edits, renameEdit{quoteStart, quoteEnd, newName + " = " + quote + id.Name + quote})
+			} else {
+				edits = append(edits, renameEdit{id.NamePos, identEnd(id), newName})
+			}
+			continue
+		}
+		if id.Name == newName && b != nil && inScope(id) {
+			return nil, fmt.Errorf("Error: renaming %s to %s would change what %s refers to at %d:%d.", first.Name, newName, newName, id.NamePos.Line, id.NamePos.Col)
+		}
+	}
+
+	// The keyword arguments of calls by name to the function of a renamed
+	// parameter.
+	if owner != nil && isParam(owner, first) {
+		walkSyntax(f, func(n syntax.Node) bool {
+			call, ok := n.(*syntax.CallExpr)
+			if !ok {
+				return true
+			}
+			fn, ok := call.Fn.(*syntax.Ident)
+			if !ok {
+				return true
+			}
+			b, _ := fn.Binding.(*resolve.Binding)
+			if b == nil || b.First == nil || !definesFunction(f, b.First, owner) {
+				return true
+			}
+			for _, arg := range call.Args {
+				if kwarg, ok := arg.(*syntax.BinaryExpr); ok && kwarg.Op == syntax.EQ {
+					if id, ok := kwarg.X.(*syntax.Ident); ok && id.Name == first.Name {
+						edits = append(edits, renameEdit{id.NamePos, identEnd(id), newName})
+					}
+				}
+			}
+			return true
+		})
+	}
+
+	sort.Slice(edits, func(i, j int) bool {
+		a, b := edits[i].start, edits[j].start
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Col < b.Col
+	})
+	return edits, nil
+}
+
+// isParam reports whether the binding identifier is a parameter of fn.
+func isParam(fn *resolve.Function, first *syntax.Ident) bool {
+	for _, param := range fn.Params {
+		switch param := param.(type) {
+		case *syntax.Ident:
+			if param == first {
+				return true
+			}
+		case *syntax.BinaryExpr:
+			if param.X == first {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// definesFunction reports whether name is that of the def of fn.
+func definesFunction(f *syntax.File, name *syntax.Ident, fn *resolve.Function) bool {
+	found := false
+	walkSyntax(f, func(n syntax.Node) bool {
+		if def, ok := n.(*syntax.DefStmt); ok && def.Name == name && def.Function == fn {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// jsRename implements starlark.rename(source, position, newName, filename?),
+// which returns the edits that rename the name at a position, {line,
+// column}, everywhere it is used, in the order they appear.
+func jsRename() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) (result interface{}) {
+		defer func() {
+			if r := recover(); r != nil {
+				result = errorToJSValue(newInternalError(r, panicStack()))
+			}
+		}()
+
+		if len(args) < 3 || args[0].Type() != js.TypeString || args[1].Type() != js.TypeObject || args[2].Type() != js.TypeString ||
+			args[1].Get("line").Type() != js.TypeNumber || args[1].Get("column").Type() != js.TypeNumber {
+			return jsErrorConstructor.New("Error: rename requires the source code, a position {line, column} and a new name as arguments.")
+		}
+		filename := "<rename>"
+		if len(args) > 3 && args[3].Type() == js.TypeString {
+			filename = args[3].String()
+		}
+		edits, err := renameSymbol(filename, args[0].String(), int32(args[1].Get("line").Int()), int32(args[1].Get("column").Int()), args[2].String())
+		if err != nil {
+			return jsErrorConstructor.New(err.Error())
+		}
+		array := jsArray.New(len(edits))
+		for i, edit := range edits {
+			array.SetIndex(i, edit.toJSValue())
+		}
+		return array
+	})
+}
@@ -0,0 +1,172 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"syscall/js"
+
+	starjson "go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+)
+
+// renderSpec is what starlark.render is asked to render.
+type renderSpec struct {
+	filename string
+	// global names the one global to render, if the whole module is not.
+	global           string
+	indent           int
+	maxExecutionTime int
+}
+
+func parseRenderSpec(value js.Value) (renderSpec, error) {
+	var spec renderSpec
+	filename := value.Get("filename")
+	if filename.Type() != js.TypeString {
+		return spec, fmt.Errorf("Error: the render spec requires a filename.")
+	}
+	spec.filename = filename.String()
+	switch global := value.Get("global"); global.Type() {
+	case js.TypeUndefined:
+	case js.TypeString:
+		spec.global = global.String()
+	default:
+		return spec, fmt.Errorf("Error: the global of the render spec must be a string.")
+	}
+	if indent := value.Get("indent"); indent.Type() == js.TypeNumber {
+		spec.indent = max(indent.Int(), 0)
+	}
+	if maxExecutionTime := value.Get("maxExecutionTime"); maxExecutionTime.Type() == js.TypeNumber {
+		spec.maxExecutionTime = maxExecutionTime.Int()
+	}
+	return spec, nil
+}
+
+// encodeJSON encodes a value as Starlark's json.encode does.
+func encodeJSON(thread *starlark.Thread, value starlark.Value) (string, error) {
+	encoded, err := starlark.Call(thread, starjson.Module.Members["encode"], starlark.Tuple{value}, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded.(starlark.String)), nil
+}
+
+// renderGlobals loads a module with load and encodes on thread its globals as one JSON object,
+// their names sorted, or only the global named, if any. The module's private
+// globals, whose names begin with an underscore, are left out, as are those
+// with no JSON encoding, such as its functions: their names are returned as
+// skipped.
+func renderGlobals(exec *execution, thread *starlark.Thread, load func(*starlark.Thread, string) (starlark.StringDict, error), filename string, global string) (document string, skipped []string, err error) {
+	globals, err := load(nil, filename)
+	if err != nil {
+		return "", nil, exec.wrapEvalError(codeEvalFailed, err)
+	}
+	if global != "" {
+		value, ok := globals[global]
+		if !ok {
+			return "", nil, fmt.Errorf("Error: the module %q has no global %q.", filename, global)
+		}
+		if document, err = encodeJSON(thread, value); err != nil {
+			return "", nil, exec.wrapEvalError(codeExecFailed, err)
+		}
+		return document, nil, nil
+	}
+	var b strings.Builder
+	b.WriteString("{")
+	for _, name := range globals.Keys() {
+		if strings.HasPrefix(name, "_") {
+			continue
+		}
+		encoded, err := encodeJSON(thread, globals[name])
+		if err != nil {
+			skipped = append(skipped, name)
+			continue
+		}
+		if b.Len() > 1 {
+			b.WriteString(",")
+		}
+		key, _ := json.Marshal(name)
+		b.Write(key)
+		b.WriteString(":")
+		b.WriteString(encoded)
+	}
+	b.WriteString("}")
+	return b.String(), skipped, nil
+}
+
+// renderModule runs the spec's module and renders its globals, or the one
+// global the spec names, as renderGlobals does, indenting the document as
+// the spec asks.
+func renderModule(exec *execution, spec renderSpec) (document string, skipped []string, err error) {
+	_, err = runWithTimeout(exec, spec.maxExecutionTime, func() (starlark.Value, error) {
+		thread := exec.newThread(exec.id+" render", nil)
+		document, skipped, err = renderGlobals(exec, thread, exec.loader(), spec.filename, spec.global)
+		if err != nil {
+			return nil, err
+		}
+		return starlark.None, nil
+	})
+	if err != nil || spec.indent == 0 {
+		return document, skipped, err
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, []byte(document), "", strings.Repeat(" ", spec.indent)); err != nil {
+		return "", nil, err
+	}
+	return buf.String(), skipped, nil
+}
+
+// jsRender implements starlark.render(executionId, spec, options), where
+// spec names the module to render and how: {filename, global?, indent?,
+// maxExecutionTime}. It runs the module, as a configuration written in
+// Starlark, and resolves with {json, skipped}: the JSON document of its
+// globals, or of the one global named, and the names of those left out for
+// having no JSON encoding.
+func jsRender() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 2 || args[1].Type() != js.TypeObject {
+			return rejected(fmt.Errorf("Error: requires executionId and a render spec as arguments."))
+		}
+		options := js.Undefined()
+		if len(args) > 2 {
+			options = args[2]
+		}
+		return runAsync(args[0].String(), options, func(exec *execution) (js.Value, error) {
+			spec, err := parseRenderSpec(args[1])
+			if err != nil {
+				return js.Null(), err
+			}
+			document, skipped, err := renderModule(exec, spec)
+			if err != nil {
+				return js.Null(), err
+			}
+			// The document is returned as text, so its secrets are redacted
+			// as those of output are.
+			jsSkipped := jsArray.New(len(skipped))
+			for i, name := range skipped {
+				jsSkipped.SetIndex(i, exec.redactor.string(name))
+			}
+			result := jsObject.New()
+			result.Set("json", exec.redactor.string(document))
+			result.Set("skipped", jsSkipped)
+			return result, nil
+		})
+	})
+}
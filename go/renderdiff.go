@@ -0,0 +1,223 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"syscall/js"
+
+	starjson "go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+)
+
+// maxRenderChanges is the most changes a render diff reports; the rest are
+// only counted.
+const maxRenderChanges = 1000
+
+// renderSide is one of the two renders starlark.renderDiff compares: a
+// module's globals, the one global named, or what that global returns when
+// called with args and kwargs.
+type renderSide struct {
+	filename string
+	global   string
+	args     js.Value
+	kwargs   js.Value
+}
+
+// call reports whether the side's global is called, rather than rendered.
+func (s renderSide) call() bool {
+	return !s.args.IsUndefined() || !s.kwargs.IsUndefined()
+}
+
+// renderDiffSpec is what starlark.renderDiff is asked to compare.
+type renderDiffSpec struct {
+	before           renderSide
+	after            renderSide
+	maxExecutionTime int
+}
+
+// parseRenderSide parses a side of a render diff spec, which takes the
+// filename and global it does not give from the spec.
+func parseRenderSide(spec js.Value, name string) (renderSide, error) {
+	value := spec.Get(name)
+	if value.Type() != js.TypeObject {
+		return renderSide{}, fmt.Errorf("Error: the render diff spec requires %s to be an object.", name)
+	}
+	side := renderSide{args: value.Get("args"), kwargs: value.Get("kwargs")}
+	for _, field := range []struct {
+		name string
+		dest *string
+	}{{"filename", &side.filename}, {"global", &side.global}} {
+		v := value.Get(field.name)
+		if v.IsUndefined() {
+			v = spec.Get(field.name)
+		}
+		switch v.Type() {
+		case js.TypeUndefined:
+		case js.TypeString:
+			*field.dest = v.String()
+		default:
+			return side, fmt.Errorf("Error: the %s of %s in the render diff spec must be a string.", field.name, name)
+		}
+	}
+	if side.filename == "" {
+		return side, fmt.Errorf("Error: the render diff spec requires a filename for %s.", name)
+	}
+	if side.call() && side.global == "" {
+		return side, fmt.Errorf("Error: the render diff spec requires a global to call with the arguments of %s.", name)
+	}
+	return side, nil
+}
+
+func parseRenderDiffSpec(value js.Value) (renderDiffSpec, error) {
+	var spec renderDiffSpec
+	var err error
+	if spec.before, err = parseRenderSide(value, "before"); err != nil {
+		return spec, err
+	}
+	if spec.after, err = parseRenderSide(value, "after"); err != nil {
+		return spec, err
+	}
+	if maxExecutionTime := value.Get("maxExecutionTime"); maxExecutionTime.Type() == js.TypeNumber {
+		spec.maxExecutionTime = maxExecutionTime.Int()
+	}
+	return spec, nil
+}
+
+// renderSide renders a side of a render diff and decodes the document it
+// renders, so that the sides are compared as the JSON they render to:
+// tuples as lists and structs as dicts, say.
+func (e *execution) renderSide(thread *starlark.Thread, load func(*starlark.Thread, string) (starlark.StringDict, error), side renderSide) (starlark.Value, error) {
+	var document string
+	if side.call() {
+		globals, err := load(nil, side.filename)
+		if err != nil {
+			return nil, e.wrapEvalError(codeEvalFailed, err)
+		}
+		fn, ok := globals[side.global]
+		if !ok {
+			return nil, e.messageErr(codeMissingFunction, "function", fmt.Sprintf("%q", side.global))
+		}
+		conv := &converter{exec: e}
+		args, kwargs, err := conv.convertArgs(side.args, side.kwargs)
+		if err != nil {
+			return nil, err
+		}
+		result, err := starlark.Call(thread, fn, args, kwargs)
+		if err != nil {
+			e.recordError(thread, err)
+			return nil, e.wrapEvalError(codeExecFailed, err)
+		}
+		if document, err = encodeJSON(thread, result); err != nil {
+			return nil, e.wrapEvalError(codeExecFailed, err)
+		}
+	} else {
+		var err error
+		if document, _, err = renderGlobals(e, thread, load, side.filename, side.global); err != nil {
+			return nil, err
+		}
+	}
+	return starlark.Call(thread, starjson.Module.Members["decode"], starlark.Tuple{starlark.String(document)}, nil)
+}
+
+// runRenderDiff renders both sides of the spec, with one loader so that a
+// module they share is run once, and compares them.
+func runRenderDiff(exec *execution, spec renderDiffSpec) (*valueDiffer, error) {
+	d := &valueDiffer{limit: maxRenderChanges}
+	_, err := runWithTimeout(exec, spec.maxExecutionTime, func() (starlark.Value, error) {
+		load := exec.loader()
+		thread := exec.newThread(exec.id+" render", nil)
+		before, err := exec.renderSide(thread, load, spec.before)
+		if err != nil {
+			return nil, err
+		}
+		after, err := exec.renderSide(thread, load, spec.after)
+		if err != nil {
+			return nil, err
+		}
+		return starlark.None, d.compare("", after, before)
+	})
+	return d, err
+}
+
+// renderChangeToJSValue converts a difference between the renders to
+// {path, kind, old?, new?}, where old is the value before and new the value
+// after, with their secrets redacted, as are those of the path, since a dict
+// key can hold one.
+func renderChangeToJSValue(conv *converter, d valueDiff) (js.Value, error) {
+	redactor := conv.exec.redactor
+	obj := jsObject.New()
+	obj.Set("path", redactor.string(d.path))
+	obj.Set("kind", d.kind)
+	for _, value := range []struct {
+		name  string
+		value starlark.Value
+	}{{"old", d.expected}, {"new", d.actual}} {
+		if value.value == nil {
+			continue
+		}
+		v, err := conv.convertToJSValue(redactor.value(value.value), redactor.string(d.path))
+		if err != nil {
+			return js.Null(), err
+		}
+		obj.Set(value.name, v)
+	}
+	return obj, nil
+}
+
+// jsRenderDiff implements starlark.renderDiff(executionId, spec, options),
+// where spec gives the two renders to compare: {filename?, global?, before,
+// after, maxExecutionTime}, whose before and after are each {filename?,
+// global?, args?, kwargs?}, taking the filename and global they do not give
+// from the spec. A side with args or kwargs renders what its global returns
+// when called with them. It resolves with {changes, total}: the first 1000
+// changes from before to after, each {path, kind, old?, new?}, and the
+// number of them.
+func jsRenderDiff() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 2 || args[1].Type() != js.TypeObject {
+			return rejected(fmt.Errorf("Error: requires executionId and a render diff spec as arguments."))
+		}
+		options := js.Undefined()
+		if len(args) > 2 {
+			options = args[2]
+		}
+		return runAsync(args[0].String(), options, func(exec *execution) (js.Value, error) {
+			spec, err := parseRenderDiffSpec(args[1])
+			if err != nil {
+				return js.Null(), err
+			}
+			d, err := runRenderDiff(exec, spec)
+			if err != nil {
+				return js.Null(), err
+			}
+			conv := &converter{exec: exec}
+			changes := jsArray.New(len(d.diffs))
+			for i, diff := range d.diffs {
+				change, err := renderChangeToJSValue(conv, diff)
+				if err != nil {
+					return js.Null(), err
+				}
+				changes.SetIndex(i, change)
+			}
+			result := jsObject.New()
+			result.Set("changes", changes)
+			result.Set("total", d.total)
+			return result, nil
+		})
+	})
+}
@@ -0,0 +1,225 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"sync"
+	"syscall/js"
+	"time"
+
+	startime "go.starlark.net/lib/time"
+	"go.starlark.net/starlark"
+)
+
+// recordingVersion is the version of the format of recordings, bumped when
+// a change to it would make older ones replay differently.
+const recordingVersion = 1
+
+// The types of host response a recording holds.
+const (
+	// recordedLoad is a module served by the host's load callback, or the
+	// error it failed with.
+	recordedLoad = "load"
+	// recordedNow is a reading of the clock by time.now().
+	recordedNow = "now"
+)
+
+// hostResponse is an answer from the host that the execution depended on.
+type hostResponse struct {
+	kind     string
+	filename string
+	source   string
+	hash     string
+	err      string
+	time     time.Time
+}
+
+func (r hostResponse) toJSValue() js.Value {
+	obj := jsObject.New()
+	obj.Set("type", r.kind)
+	switch r.kind {
+	case recordedLoad:
+		obj.Set("filename", r.filename)
+		if r.err != "" {
+			obj.Set("error", r.err)
+			break
+		}
+		obj.Set("source", r.source)
+		if r.hash != "" {
+			obj.Set("hash", r.hash)
+		}
+	case recordedNow:
+		obj.Set("time", r.time.Format(time.RFC3339Nano))
+	}
+	return obj
+}
+
+// hostRecording logs the host responses of an execution with the record
+// option, or serves those of an earlier one with the replay option, so that
+// a run can be reproduced without the host that made it.
+type hostRecording struct {
+	mu      sync.Mutex
+	entries []hostResponse
+	// loads holds the recorded loads by filename, and next the index of the
+	// next clock reading, when replaying.
+	loads map[string]hostResponse
+	next  int
+}
+
+// parseRecording reads the replay option, a recording returned by an earlier
+// run. It returns nil unless the option is set.
+func parseRecording(value js.Value) (*hostRecording, error) {
+	if value.Type() != js.TypeObject {
+		return nil, nil
+	}
+	if version := value.Get("version"); version.Type() != js.TypeNumber || version.Int() != recordingVersion {
+		return nil, fmt.Errorf("Error: the replay option is not a recording of version %d.", recordingVersion)
+	}
+	entries := value.Get("entries")
+	if entries.Type() != js.TypeObject || !entries.InstanceOf(jsArray) {
+		return nil, fmt.Errorf("Error: the recording has no entries.")
+	}
+	r := &hostRecording{loads: make(map[string]hostResponse)}
+	for i := 0; i < entries.Length(); i++ {
+		entry := entries.Index(i)
+		if entry.Type() != js.TypeObject {
+			return nil, fmt.Errorf("Error: entry %d of the recording is not an object.", i)
+		}
+		response := hostResponse{kind: optionString(entry, "type")}
+		switch response.kind {
+		case recordedLoad:
+			response.filename = optionString(entry, "filename")
+			response.source = optionString(entry, "source")
+			response.hash = optionString(entry, "hash")
+			response.err = optionString(entry, "error")
+			r.loads[response.filename] = response
+		case recordedNow:
+			t, err := time.Parse(time.RFC3339Nano, optionString(entry, "time"))
+			if err != nil {
+				return nil, fmt.Errorf("Error: entry %d of the recording has an invalid time. %s", i, err)
+			}
+			_, offset := t.Zone()
+			if _, local := t.In(time.Local).Zone(); offset == local {
+				// Read the clock in the local zone, as time.now() does,
+				// if it is the zone the reading was taken in.
+				t = t.In(time.Local)
+			}
+			response.time = t
+		default:
+			// A type of response this version does not make; a script
+			// that came to need it fails on the miss.
+			continue
+		}
+		r.entries = append(r.entries, response)
+	}
+	return r, nil
+}
+
+// optionString reads a string property, treating anything else as empty.
+func optionString(value js.Value, name string) string {
+	option := value.Get(name)
+	if option.Type() != js.TypeString {
+		return ""
+	}
+	return option.String()
+}
+
+// record logs a host response.
+func (r *hostRecording) record(response hostResponse) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, response)
+}
+
+// replayLoad serves a load from the recording.
+func (r *hostRecording) replayLoad(filename string) (source string, hash string, err error) {
+	r.mu.Lock()
+	response, ok := r.loads[filename]
+	r.mu.Unlock()
+	if !ok {
+		return "", "", fmt.Errorf("Error: the recording has no response to the load of %q.", filename)
+	}
+	if response.err != "" {
+		return "", "", fmt.Errorf("%s", response.err)
+	}
+	return response.source, response.hash, nil
+}
+
+// replayNow serves the next clock reading from the recording. Readings are
+// replayed in the order they were taken, whichever thread takes them.
+func (r *hostRecording) replayNow() (time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.next < len(r.entries) {
+		response := r.entries[r.next]
+		r.next++
+		if response.kind == recordedNow {
+			return response.time, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Error: the recording has no more readings of time.now().")
+}
+
+func (r *hostRecording) toJSValue() js.Value {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries := jsArray.New(len(r.entries))
+	for i, response := range r.entries {
+		entries.SetIndex(i, response.toJSValue())
+	}
+	obj := jsObject.New()
+	obj.Set("version", recordingVersion)
+	obj.Set("entries", entries)
+	return obj
+}
+
+// hostLoad loads a module as loadFile does, recording the response with
+// the record option, or serving it from the recording with replay.
+func (e *execution) hostLoad(filename string) (source string, hash string, err error) {
+	if e.options.replay != nil {
+		return e.options.replay.replayLoad(filename)
+	}
+	e.loads.Add(1)
+	err = e.audited("load", func() string { return filename }, func() error {
+		source, hash, err = loadFile(e.options.callbacks, filename, e.id, e.abortSignal(), !e.synchronous)
+		err = e.localizeErr(err)
+		return err
+	})
+	if e.recording != nil {
+		response := hostResponse{kind: recordedLoad, filename: filename, source: source, hash: hash}
+		if err != nil {
+			response = hostResponse{kind: recordedLoad, filename: filename, err: err.Error()}
+		}
+		e.recording.record(response)
+	}
+	return source, hash, err
+}
+
+// recordClock makes time.now() on the thread record its readings with the
+// record option, or serve them from the recording with replay.
+func (e *execution) recordClock(thread *starlark.Thread) {
+	switch {
+	case e.options.replay != nil:
+		startime.SetNow(thread, e.options.replay.replayNow)
+	case e.recording != nil:
+		startime.SetNow(thread, func() (time.Time, error) {
+			now := time.Now()
+			e.recording.record(hostResponse{kind: recordedNow, time: now})
+			return now, nil
+		})
+	}
+}
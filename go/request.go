@@ -0,0 +1,175 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall/js"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// starlark.run(request) is wasm_runner with its arguments named, in a
+// single object that can grow without breaking callers:
+//
+//	{file, entry?, args?, kwargs?, timeoutMs?, limits?, io?, session?, id?, options?}
+//
+// It always resolves with a StarlarkResult, the envelope of wasm_runner.
+// limits holds maxSteps, maxResultSize, maxValueSize, maxTotalSize,
+// maxModules, maxSourceSize, maxCallRate, callBurst and maxErrorLength; io the load, print, printError, printBatch and emit
+// callbacks; session the sessionId; and options any other run options. A request without an entry only runs
+// its file, and results in None.
+
+// runRequestLimits and runRequestIO are the run options that limits and io
+// may hold.
+var (
+	runRequestLimits = []string{"maxSteps", "maxResultSize", "maxValueSize", "maxTotalSize", "maxModules", "maxSourceSize", "maxCallRate", "callBurst", "maxErrorLength"}
+	runRequestIO     = []string{"load", "print", "printError", "printBatch", "emit"}
+)
+
+// lastRunRequest numbers the requests not given an id.
+var lastRunRequest atomic.Uint64
+
+// runRequest is a parsed starlark.run request.
+type runRequest struct {
+	id           string
+	file         string
+	entry        string
+	args, kwargs js.Value
+	timeLimit    time.Duration
+	// options are the run options the request amounts to.
+	options js.Value
+}
+
+// parseRunRequest reads a starlark.run request, failing on any field of the
+// wrong type, or any it does not know, so that a mistake is not ignored.
+func parseRunRequest(value js.Value) (runRequest, error) {
+	if value.Type() != js.TypeObject {
+		return runRequest{}, fmt.Errorf("Error: run requires a request object.")
+	}
+	req := runRequest{
+		id:      fmt.Sprintf("run-%d", lastRunRequest.Add(1)),
+		args:    value.Get("args"),
+		kwargs:  value.Get("kwargs"),
+		options: jsObject.Call("assign", jsObject.New(), value.Get("options")),
+	}
+	if err := checkKeys(value, "request", []string{"file", "entry", "args", "kwargs", "timeoutMs", "limits", "io", "session", "id", "options"}); err != nil {
+		return runRequest{}, err
+	}
+	file := value.Get("file")
+	if file.Type() != js.TypeString {
+		return runRequest{}, fmt.Errorf("Error: request.file must be a string.")
+	}
+	req.file = file.String()
+	for name, field := range map[string]*string{"entry": &req.entry, "id": &req.id} {
+		switch v := value.Get(name); v.Type() {
+		case js.TypeUndefined:
+		case js.TypeString:
+			*field = v.String()
+		default:
+			return runRequest{}, fmt.Errorf("Error: request.%s must be a string.", name)
+		}
+	}
+	switch timeout := value.Get("timeoutMs"); timeout.Type() {
+	case js.TypeUndefined:
+	case js.TypeNumber:
+		req.timeLimit = time.Duration(timeout.Float() * float64(time.Millisecond))
+	default:
+		return runRequest{}, fmt.Errorf("Error: request.timeoutMs must be a number.")
+	}
+	switch session := value.Get("session"); session.Type() {
+	case js.TypeUndefined:
+	case js.TypeString:
+		req.options.Set("sessionId", session)
+	default:
+		return runRequest{}, fmt.Errorf("Error: request.session must be a string.")
+	}
+	for _, group := range []struct {
+		name  string
+		allow []string
+	}{{"limits", runRequestLimits}, {"io", runRequestIO}} {
+		fields := value.Get(group.name)
+		if fields.IsUndefined() {
+			continue
+		}
+		if fields.Type() != js.TypeObject {
+			return runRequest{}, fmt.Errorf("Error: request.%s must be an object.", group.name)
+		}
+		if err := checkKeys(fields, "request."+group.name, group.allow); err != nil {
+			return runRequest{}, err
+		}
+		jsObject.Call("assign", req.options, fields)
+	}
+	// The result is always the envelope, of values converted one by one.
+	req.options.Set("envelope", true)
+	req.options.Set("binary", false)
+	return req, nil
+}
+
+// checkKeys fails if the object has a key not in allow.
+func checkKeys(value js.Value, name string, allow []string) error {
+	keys := jsObjectKeys.Invoke(value)
+	var unknown []string
+	for i := 0; i < keys.Length(); i++ {
+		key := keys.Index(i).String()
+		known := false
+		for _, allowed := range allow {
+			known = known || key == allowed
+		}
+		if !known {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	return fmt.Errorf("Error: unknown %s fields %s. Expected: %s.", name, strings.Join(unknown, ", "), strings.Join(allow, ", "))
+}
+
+// jsRun implements starlark.run(request).
+func jsRun() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		request := js.Undefined()
+		if len(args) > 0 {
+			request = args[0]
+		}
+		req, err := parseRunRequest(request)
+		if err != nil {
+			return rejected(err)
+		}
+		return runAsync(req.id, req.options, func(exec *execution) (js.Value, error) {
+			runtime.ReadMemStats(&exec.memory.start)
+			conv := &converter{exec: exec}
+			phaseStart := time.Now()
+			starlarkArgs, starlarkKwargs, err := conv.convertArgs(req.args, req.kwargs)
+			exec.timings.convertArgs = time.Since(phaseStart)
+			exec.addPhase(phaseConvertArgs, "", phaseStart)
+			if err != nil {
+				return js.Null(), err
+			}
+			return runToJS(exec, conv, func() (starlark.Value, error) {
+				return exec.execute(req.file, req.entry, starlarkArgs, starlarkKwargs, req.timeLimit)
+			})
+		})
+	})
+}
@@ -0,0 +1,140 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"runtime/debug"
+	"syscall/js"
+	"time"
+
+	"dcollien.com/starlark-wasm/internal/runner"
+)
+
+// A reset brings the instance back to the state it started in, without the
+// host having to fetch and instantiate the wasm module again: it cancels
+// every run, closes every REPL session, and drops the compiled modules,
+// kept results, lazy values and retry budgets, then returns the memory
+// they held. What the host configured stays as it is: subscriptions,
+// message catalogs, quotas, the session policy and the memory budget.
+
+// resetReason is what the runs a reset cancels are cancelled with.
+const resetReason = "reset"
+
+// resetCounts counts what a reset dropped.
+type resetCounts struct {
+	cancelled, sessions, modules, results int
+}
+
+func (c resetCounts) toJSValue() js.Value {
+	obj := jsObject.New()
+	obj.Set("cancelled", c.cancelled)
+	obj.Set("sessions", c.sessions)
+	obj.Set("modules", c.modules)
+	obj.Set("results", c.results)
+	return obj
+}
+
+// resetInstance resets the instance, waiting up to runner.CancelGracePeriod for
+// the runs it cancels to end before dropping what they may still use.
+func resetInstance() resetCounts {
+	var counts resetCounts
+	counts.sessions = closeAllSessions()
+
+	executions.mu.Lock()
+	running := make([]*execution, 0, len(executions.byId))
+	for _, e := range executions.byId {
+		running = append(running, e)
+	}
+	executions.mu.Unlock()
+	// Those waiting for a slot are cancelled too, or they would start once
+	// the others end.
+	running = append(running, queuedExecutions()...)
+	for _, e := range running {
+		e.cancel(resetReason)
+	}
+	counts.cancelled = len(running)
+	for deadline := time.Now().Add(runner.CancelGracePeriod); time.Now().Before(deadline); {
+		executions.mu.Lock()
+		active := executions.active
+		executions.mu.Unlock()
+		if active == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	counts.modules = clearModuleCache()
+	counts.results = clearResultStore()
+	lazyValues.mu.Lock()
+	clear(lazyValues.values)
+	lazyValues.mu.Unlock()
+	retries.mu.Lock()
+	clear(retries.byKey)
+	retries.mu.Unlock()
+	instanceMemory.mu.Lock()
+	instanceMemory.crossed = 0
+	instanceMemory.mu.Unlock()
+
+	debug.FreeOSMemory()
+	logf(logInfo, logCancel, "instance reset: %d runs cancelled, %d sessions closed, %d modules dropped", counts.cancelled, counts.sessions, counts.modules)
+	return counts
+}
+
+// clearModuleCache drops every compiled module, and the measurements of
+// the cache, returning how many modules there were.
+func clearModuleCache() int {
+	for i := range moduleCache.shards {
+		shard := &moduleCache.shards[i]
+		shard.lock()
+		clear(shard.modules)
+		shard.order = nil
+		shard.mu.Unlock()
+	}
+	dropped := moduleCache.size.Swap(0)
+	moduleCache.lookups.Store(0)
+	moduleCache.hits.Store(0)
+	moduleCache.contended.Store(0)
+	moduleCache.waited.Store(0)
+	return int(dropped)
+}
+
+// clearResultStore drops every kept result, returning how many there were.
+func clearResultStore() int {
+	resultStore.mu.Lock()
+	defer resultStore.mu.Unlock()
+	n := len(resultStore.byId)
+	for id, r := range resultStore.byId {
+		r.expiry.Stop()
+		delete(resultStore.byId, id)
+	}
+	return n
+}
+
+// jsReset implements starlark.reset(), which resolves with {cancelled,
+// sessions, modules, results}, the counts of what was dropped, once the
+// instance is reset.
+func jsReset() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		return jsPromise.New(js.FuncOf(func(this js.Value, promiseArgs []js.Value) interface{} {
+			resolve := promiseArgs[0]
+			go func() {
+				resolve.Invoke(resetInstance().toJSValue())
+			}()
+			return nil
+		}))
+	})
+}
@@ -0,0 +1,96 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"syscall/js"
+	"time"
+)
+
+// storedResult is the outcome of an execution with the retainResult
+// option, kept for the host to read back by its execution id, should the
+// code that awaited the run be gone by the time it settles.
+type storedResult struct {
+	// status is "fulfilled" or "rejected", as Promise.allSettled has it.
+	status    string
+	value     js.Value
+	settledAt time.Time
+	expiry    *time.Timer
+}
+
+// resultStore holds the stored results, by execution id, until their
+// retention window ends.
+var resultStore = struct {
+	mu   sync.Mutex
+	byId map[string]*storedResult
+}{byId: make(map[string]*storedResult)}
+
+// storeResult keeps the outcome of the execution, if its retainResult
+// option asks to, replacing any kept for an execution of the same id.
+func (e *execution) storeResult(status string, value js.Value) {
+	if e.options.retainResult <= 0 {
+		return
+	}
+	r := &storedResult{status: status, value: value, settledAt: time.Now()}
+	resultStore.mu.Lock()
+	defer resultStore.mu.Unlock()
+	if old := resultStore.byId[e.id]; old != nil {
+		old.expiry.Stop()
+	}
+	resultStore.byId[e.id] = r
+	r.expiry = time.AfterFunc(e.options.retainResult, func() {
+		resultStore.mu.Lock()
+		defer resultStore.mu.Unlock()
+		if resultStore.byId[e.id] == r {
+			delete(resultStore.byId, e.id)
+		}
+	})
+}
+
+// storedResultToJSValue returns the stored outcome of an execution, as
+// {status: "fulfilled", value} or {status: "rejected", reason}, with its
+// executionId and when it settled, or undefined if none is kept.
+func storedResultToJSValue(executionId string) js.Value {
+	resultStore.mu.Lock()
+	r := resultStore.byId[executionId]
+	resultStore.mu.Unlock()
+	if r == nil {
+		return js.Undefined()
+	}
+	obj := jsObject.New()
+	obj.Set("status", r.status)
+	if r.status == "fulfilled" {
+		obj.Set("value", r.value)
+	} else {
+		obj.Set("reason", r.value)
+	}
+	obj.Set("executionId", executionId)
+	obj.Set("settledAt", float64(r.settledAt.UnixNano())/1e6)
+	return obj
+}
+
+// jsResult implements starlark.result(executionId), which returns the
+// outcome of a run with the retainResult option while it is kept.
+func jsResult() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 1 || args[0].Type() != js.TypeString {
+			return jsErrorConstructor.New("Error: requires an executionId as argument.")
+		}
+		return storedResultToJSValue(args[0].String())
+	})
+}
@@ -0,0 +1,114 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A host that retries a failed run can give its attempts the same retry
+// key, an idempotency token, so that together they get one time budget
+// rather than a full timeout each.
+
+// retryIdle is how long the time spent under a retry key is remembered
+// after the last of its runs ends.
+const retryIdle = 10 * time.Minute
+
+// retrySpend is the time the runs with a retry key have spent.
+type retrySpend struct {
+	spent time.Duration
+	// endedAt is when the last of the runs ended.
+	endedAt time.Time
+}
+
+// retries holds the spending of each retry key in use.
+var retries = struct {
+	mu    sync.Mutex
+	byKey map[string]*retrySpend
+}{byKey: make(map[string]*retrySpend)}
+
+// retryLimit returns the time limit of the execution, given its own: the
+// time left of the budget of its retry key, where that is less. The budget
+// is the retryBudget option, or else the execution's own limit, so that
+// retries share a single timeout. It fails with a timeoutError if nothing
+// is left.
+func (e *execution) retryLimit(limit time.Duration) (time.Duration, error) {
+	key, budget := e.options.retryKey, e.options.retryBudget
+	if budget <= 0 {
+		budget = limit
+	}
+	if key == "" || budget <= 0 {
+		return limit, nil
+	}
+	retries.mu.Lock()
+	var spent time.Duration
+	if r := retries.byKey[key]; r != nil {
+		spent = r.spent
+	}
+	retries.mu.Unlock()
+	left := budget - spent
+	if limit > 0 && limit <= left {
+		return limit, nil
+	}
+	e.retryLimited = budget
+	if left <= 0 {
+		return 0, e.timedOut()
+	}
+	return left, nil
+}
+
+// chargeRetry adds the time the execution took, once it has ended, to what
+// its retry key has spent, forgetting keys that have been idle too long.
+func (e *execution) chargeRetry() {
+	key := e.options.retryKey
+	if key == "" {
+		return
+	}
+	now := time.Now()
+	retries.mu.Lock()
+	defer retries.mu.Unlock()
+	for k, r := range retries.byKey {
+		if now.Sub(r.endedAt) > retryIdle {
+			delete(retries.byKey, k)
+		}
+	}
+	r := retries.byKey[key]
+	if r == nil {
+		r = &retrySpend{}
+		retries.byKey[key] = r
+	}
+	r.spent += now.Sub(e.calledAt)
+	r.endedAt = now
+}
+
+// timedOut returns the error of the execution once it has run out of
+// time, saying where it was stopped, and whether it was the budget of its
+// retry key that ran out.
+func (e *execution) timedOut() *timeoutError {
+	e.mu.Lock()
+	cancelledAt := e.cancelledAt
+	e.mu.Unlock()
+	err := &timeoutError{message: e.message(codeTimeout), locale: e.options.locale, err: cancelledAt, steps: e.steps(), code: codeTimeout}
+	if e.retryLimited > 0 {
+		err.code = codeRetryBudget
+		err.message = e.message(codeRetryBudget, "key", fmt.Sprintf("%q", e.options.retryKey), "limit", strconv.FormatFloat(milliseconds(e.retryLimited), 'f', -1, 64))
+	}
+	return err
+}
@@ -0,0 +1,175 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"syscall/js"
+	"time"
+
+	"dcollien.com/starlark-wasm/internal/runner"
+	"go.starlark.net/starlark"
+)
+
+// A synchronous run evaluates a script within the call that asks for it,
+// returning its result rather than a promise. It serves hosts that must
+// answer before their event loop runs again, such as a Service Worker's
+// fetch handler deciding how to respond. Nothing it does may wait on the
+// host: its loads must be answered as they are asked for, and it cannot be
+// debugged, profiled or have its result streamed.
+
+// lastSyncRun numbers the synchronous runs not given an executionId.
+var lastSyncRun atomic.Uint64
+
+// jsRunSync implements starlark.runSync(source, options), which runs the
+// module source and, if options.functionName is set, calls that function of
+// it with options.args and options.kwargs. The source may be in chunks, as a
+// loaded module's may be, but not a stream. The other options are those of
+// wasm_runner, along with filename, executionId and maxExecutionTime, in
+// seconds. It returns {value} with the result, or {error} with what the
+// runner would have rejected with, since either may be any object.
+func jsRunSync() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) (result interface{}) {
+		defer func() {
+			if r := recover(); r != nil {
+				result = syncOutcome("error", errorToJSValue(newInternalError(r, panicStack())))
+			}
+		}()
+
+		if len(args) < 1 {
+			return syncOutcome("error", errorToJSValue(fmt.Errorf("Error: runSync requires the source code, as a string, a Uint8Array or an array of chunks.")))
+		}
+		source, ok, err := sourceFromJS(args[0], false)
+		if !ok {
+			return syncOutcome("error", errorToJSValue(fmt.Errorf("Error: runSync requires the source code, as a string, a Uint8Array or an array of chunks.")))
+		}
+		if err != nil {
+			return syncOutcome("error", errorToJSValue(fmt.Errorf("Error: %s.", err)))
+		}
+		value := js.Undefined()
+		if len(args) > 1 && args[1].Type() == js.TypeObject {
+			value = args[1]
+		}
+		return runSync(source, value)
+	})
+}
+
+// runSync runs a synchronous execution of source with the given options.
+func runSync(source string, value js.Value) js.Value {
+	calledAt := time.Now()
+	filename := "<runSync>"
+	executionId := fmt.Sprintf("sync-%d", lastSyncRun.Add(1))
+	funcName := ""
+	jsArgs, jsKwargs := js.Null(), js.Null()
+	var maxExecutionTime float64
+	if value.Type() == js.TypeObject {
+		if v := value.Get("filename"); v.Type() == js.TypeString {
+			filename = v.String()
+		}
+		if v := value.Get("executionId"); v.Type() == js.TypeString {
+			executionId = v.String()
+		}
+		if v := value.Get("functionName"); v.Type() == js.TypeString {
+			funcName = v.String()
+		}
+		if v := value.Get("maxExecutionTime"); v.Type() == js.TypeNumber {
+			maxExecutionTime = v.Float()
+		}
+		jsArgs, jsKwargs = value.Get("args"), value.Get("kwargs")
+	}
+
+	options := parseRunOptions(value)
+	if options.breakpoints != nil || options.profile || options.chunkSize > 0 || options.lazy || options.maxUnackedOutput > 0 {
+		return syncOutcome("error", errorToJSValue(fmt.Errorf("Error: a synchronous run cannot be debugged, profiled, streamed, lazy or wait for its output to be acknowledged.")))
+	}
+	exec := newExecution(executionId, options, calledAt)
+	exec.synchronous = true
+	limit, err := exec.retryLimit(time.Duration(maxExecutionTime * float64(time.Second)))
+	if err != nil {
+		return syncOutcome("error", exec.tag(errorToJSValue(err)))
+	}
+	if limit > 0 {
+		exec.deadline = calledAt.Add(limit)
+	}
+	if exec.options.replayErr != nil {
+		return syncOutcome("error", exec.tag(errorToJSValue(exec.options.replayErr)))
+	}
+	if exec.options.dialectErr != nil {
+		return syncOutcome("error", exec.tag(errorToJSValue(exec.options.dialectErr)))
+	}
+	if exec.options.loadsErr != nil {
+		return syncOutcome("error", exec.tag(errorToJSValue(exec.options.loadsErr)))
+	}
+	if err := acquireSlot(exec); err != nil {
+		return syncOutcome("error", exec.tag(errorToJSValue(err)))
+	}
+	defer releaseSlot()
+	if err := beginExecution(exec); err != nil {
+		return syncOutcome("error", exec.tag(errorToJSValue(err)))
+	}
+	defer endExecution(exec)
+
+	conv := &converter{exec: exec}
+	returnValue, err := func() (js.Value, error) {
+		starlarkArgs, starlarkKwargs, err := conv.convertArgs(jsArgs, jsKwargs)
+		if err != nil {
+			return js.Null(), err
+		}
+		return runToJS(exec, conv, func() (starlark.Value, error) {
+			value, err := runSyncSource(exec, filename, source, funcName, starlarkArgs, starlarkKwargs)
+			if err != nil && !exec.deadline.IsZero() && time.Now().After(exec.deadline) {
+				return nil, exec.timedOut()
+			}
+			return value, err
+		})
+	}()
+	if flushErr := exec.flushOutput(); flushErr != nil && err == nil {
+		err = flushErr
+	}
+	if traceErr := exec.finishTrace(); traceErr != nil && err == nil {
+		err = traceErr
+	}
+	if err != nil {
+		rejection := exec.tag(errorToJSValue(err))
+		exec.attachAudit(rejection)
+		exec.notifyDone(rejection)
+		if exec.options.settle {
+			envelope := exec.failedEnvelope(rejection)
+			exec.attachAudit(envelope)
+			return syncOutcome("value", envelope)
+		}
+		return syncOutcome("error", rejection)
+	}
+	exec.attachAudit(returnValue)
+	exec.notifyDone(js.Undefined())
+	return syncOutcome("value", returnValue)
+}
+
+// syncOutcome returns the object runSync returns, with value under key.
+func syncOutcome(key string, value js.Value) js.Value {
+	outcome := jsObject.New()
+	outcome.Set(key, value)
+	return outcome
+}
+
+// runSyncSource runs the module source as wasm_runner runs a loaded one,
+// calling funcName if it is set, and returning None if not.
+func runSyncSource(exec *execution, filename string, source string, funcName string, args []starlark.Value, kwargs []starlark.Tuple) (starlark.Value, error) {
+	exec.entrySource = &source
+	return runner.Execute(runner.Run{Host: exec.host(), Filename: filename, Name: exec.id, Function: funcName, Args: args, Kwargs: kwargs})
+}
@@ -0,0 +1,264 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/url"
+	"sort"
+	"strings"
+	"syscall/js"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// secretsName is the predeclared global holding the secrets option's values,
+// as the attributes of a struct, so that modules are compiled the same
+// whether or not a run has secrets.
+const secretsName = "secrets"
+
+// redacted is what a secret is replaced with in what the host is given.
+const redacted = "[REDACTED]"
+
+// minSecretLength is the shortest secret that is redacted. Shorter ones
+// would match too much of the text around them to be worth hiding.
+const minSecretLength = 4
+
+// maxRedactDepth is how deep redactJS looks into the objects of an error.
+const maxRedactDepth = 8
+
+// noSecrets is what secrets holds in a run given none.
+var noSecrets = starlarkstruct.FromStringDict(starlarkstruct.Default, nil)
+
+func init() {
+	predeclared[secretsName] = noSecrets
+}
+
+// parseSecrets reads the secrets option, an object of strings. Anything
+// else in it is ignored.
+func parseSecrets(value js.Value) map[string]string {
+	if value.Type() != js.TypeObject {
+		return nil
+	}
+	secrets := make(map[string]string)
+	keys := jsObjectKeys.Invoke(value)
+	for i := 0; i < keys.Length(); i++ {
+		name := keys.Index(i).String()
+		if secret := value.Get(name); secret.Type() == js.TypeString {
+			secrets[name] = secret.String()
+		}
+	}
+	return secrets
+}
+
+// secretsStruct returns the value of secrets for a run given these.
+func secretsStruct(secrets map[string]string) *starlarkstruct.Struct {
+	members := make(starlark.StringDict, len(secrets))
+	for name, secret := range secrets {
+		members[name] = starlark.String(secret)
+	}
+	s := starlarkstruct.FromStringDict(starlarkstruct.Default, members)
+	s.Freeze()
+	return s
+}
+
+// A redactor replaces the secrets of an execution, and the forms of them a
+// script is most likely to make, in what it prints, returns and fails with.
+// A nil redactor, for a run without secrets, changes nothing.
+type redactor struct {
+	replacer *strings.Replacer
+}
+
+// newRedactor returns the redactor of a run given these secrets, or nil.
+func newRedactor(secrets map[string]string) *redactor {
+	forms := make(map[string]bool)
+	for _, secret := range secrets {
+		if len(secret) < minSecretLength {
+			continue
+		}
+		for _, form := range secretForms(secret) {
+			forms[form] = true
+		}
+	}
+	if len(forms) == 0 {
+		return nil
+	}
+	// The replacer tries its patterns in order, so a form that contains
+	// another, such as a longer secret, is tried first.
+	sorted := make([]string, 0, len(forms))
+	for form := range forms {
+		sorted = append(sorted, form)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if len(sorted[i]) != len(sorted[j]) {
+			return len(sorted[i]) > len(sorted[j])
+		}
+		return sorted[i] < sorted[j]
+	})
+	pairs := make([]string, 0, 2*len(sorted))
+	for _, form := range sorted {
+		pairs = append(pairs, form, redacted)
+	}
+	return &redactor{replacer: strings.NewReplacer(pairs...)}
+}
+
+// secretForms returns a secret as it is, and as a script would commonly
+// derive it: upper or lower case, quoted, URL-encoded, hex or base64.
+func secretForms(secret string) []string {
+	return []string{
+		secret,
+		strings.ToUpper(secret),
+		strings.ToLower(secret),
+		strings.Trim(starlark.String(secret).String(), `"`),
+		url.QueryEscape(secret),
+		url.PathEscape(secret),
+		hex.EncodeToString([]byte(secret)),
+		strings.ToUpper(hex.EncodeToString([]byte(secret))),
+		base64.StdEncoding.EncodeToString([]byte(secret)),
+		base64.RawStdEncoding.EncodeToString([]byte(secret)),
+		base64.URLEncoding.EncodeToString([]byte(secret)),
+		base64.RawURLEncoding.EncodeToString([]byte(secret)),
+	}
+}
+
+// string redacts a string.
+func (r *redactor) string(s string) string {
+	if r == nil {
+		return s
+	}
+	return r.replacer.Replace(s)
+}
+
+// value returns a copy of a result with its strings redacted, keeping the
+// lists, dicts and sets it shares, cycles included, shared. Only the types
+// results are converted from are looked into: those of extendedTypes, and
+// structs, which the JSON of render and golden tests converts, included.
+func (r *redactor) value(v starlark.Value) starlark.Value {
+	if r == nil {
+		return v
+	}
+	return r.redactValue(v, make(map[starlark.Value]starlark.Value))
+}
+
+func (r *redactor) redactValue(v starlark.Value, seen map[starlark.Value]starlark.Value) starlark.Value {
+	switch v := v.(type) {
+	case starlark.String:
+		return starlark.String(r.string(string(v)))
+	case starlark.Bytes:
+		return starlark.Bytes(r.string(string(v)))
+	case starlark.Tuple:
+		tuple := make(starlark.Tuple, len(v))
+		for i, elem := range v {
+			tuple[i] = r.redactValue(elem, seen)
+		}
+		return tuple
+	case *starlark.List:
+		if copied, ok := seen[v]; ok {
+			return copied
+		}
+		list := starlark.NewList(make([]starlark.Value, 0, v.Len()))
+		seen[v] = list
+		for i := 0; i < v.Len(); i++ {
+			list.Append(r.redactValue(v.Index(i), seen))
+		}
+		return list
+	case *starlark.Dict:
+		if copied, ok := seen[v]; ok {
+			return copied
+		}
+		dict := starlark.NewDict(v.Len())
+		seen[v] = dict
+		for _, item := range v.Items() {
+			// Keys are strings or other hashable values, which redacting
+			// leaves hashable.
+			dict.SetKey(r.redactValue(item[0], seen), r.redactValue(item[1], seen))
+		}
+		return dict
+	case *starlark.Set:
+		if copied, ok := seen[v]; ok {
+			return copied
+		}
+		set := starlark.NewSet(v.Len())
+		seen[v] = set
+		iter := v.Iterate()
+		defer iter.Done()
+		var elem starlark.Value
+		for iter.Next(&elem) {
+			set.Insert(r.redactValue(elem, seen))
+		}
+		return set
+	case *starlarkstruct.Struct:
+		if copied, ok := seen[v]; ok {
+			return copied
+		}
+		members := make(starlark.StringDict, len(v.AttrNames()))
+		for _, name := range v.AttrNames() {
+			member, err := v.Attr(name)
+			if err != nil || member == nil {
+				continue
+			}
+			members[name] = r.redactValue(member, seen)
+		}
+		copied := starlarkstruct.FromStringDict(v.Constructor(), members)
+		seen[v] = copied
+		return copied
+	}
+	return v
+}
+
+// redactJS redacts the strings of an error or diagnostic object in place,
+// and of the arrays and plain objects within it, such as its frames.
+func (r *redactor) redactJS(obj js.Value) {
+	if r != nil {
+		r.redactJSObject(obj, 0)
+	}
+}
+
+func (r *redactor) redactJSObject(obj js.Value, depth int) {
+	if obj.Type() != js.TypeObject || depth > maxRedactDepth {
+		return
+	}
+	redactProperty := func(get func() js.Value, set func(js.Value)) {
+		switch value := get(); value.Type() {
+		case js.TypeString:
+			if s := value.String(); r.string(s) != s {
+				set(js.ValueOf(r.string(s)))
+			}
+		case js.TypeObject:
+			if value.InstanceOf(jsArray) || isPlainObject(value) || value.InstanceOf(jsErrorConstructor) {
+				r.redactJSObject(value, depth+1)
+			}
+		}
+	}
+	if obj.InstanceOf(jsArray) {
+		for i := 0; i < obj.Length(); i++ {
+			redactProperty(func() js.Value { return obj.Index(i) }, func(v js.Value) { obj.SetIndex(i, v) })
+		}
+		return
+	}
+	// message and stack are an Error's own properties, but not enumerable.
+	names := []string{"message", "stack"}
+	keys := jsObjectKeys.Invoke(obj)
+	for i := 0; i < keys.Length(); i++ {
+		names = append(names, keys.Index(i).String())
+	}
+	for _, name := range names {
+		redactProperty(func() js.Value { return obj.Get(name) }, func(v js.Value) { obj.Set(name, v) })
+	}
+}
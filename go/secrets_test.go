@@ -0,0 +1,76 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+func TestRedactValue(t *testing.T) {
+	const secret = "hunter2secret"
+	r := newRedactor(map[string]string{"key": secret})
+	tests := []struct {
+		name  string
+		value starlark.Value
+		want  string
+	}{
+		{name: "string", value: starlark.String("token " + secret), want: `"token [REDACTED]"`},
+		{name: "list", value: starlark.NewList([]starlark.Value{starlark.String(secret)}), want: `["[REDACTED]"]`},
+		{name: "tuple", value: starlark.Tuple{starlark.String(secret), starlark.MakeInt(1)}, want: `("[REDACTED]", 1)`},
+		{name: "bytes", value: starlark.Bytes(secret), want: `b"[REDACTED]"`},
+		{name: "set", value: func() starlark.Value {
+			set := starlark.NewSet(1)
+			set.Insert(starlark.String(secret))
+			return set
+		}(), want: `set(["[REDACTED]"])`},
+		{name: "struct", value: starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"token": starlark.String(secret),
+			"n":     starlark.MakeInt(2),
+		}), want: `struct(n = 2, token = "[REDACTED]")`},
+		{name: "nested", value: starlark.Tuple{starlark.NewList([]starlark.Value{starlark.Bytes(secret)})}, want: `([b"[REDACTED]"],)`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := r.value(test.value).String(); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRedactValueSharesCycles(t *testing.T) {
+	r := newRedactor(map[string]string{"key": "hunter2secret"})
+	list := starlark.NewList(nil)
+	set := starlark.NewSet(1)
+	set.Insert(starlark.String("hunter2secret"))
+	list.Append(set)
+	list.Append(set)
+	list.Append(list)
+	copied := r.value(list).(*starlark.List)
+	if copied.Index(0) != copied.Index(1) {
+		t.Errorf("the set shared by the list was copied twice")
+	}
+	if copied.Index(2) != copied {
+		t.Errorf("the cycle was not kept")
+	}
+	if got, want := copied.Index(0).String(), `set(["[REDACTED]"])`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
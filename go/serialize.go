@@ -0,0 +1,67 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"syscall/js"
+)
+
+// errorKinds are the kinds of error object a call can be rejected with.
+var errorKinds = map[string]bool{"error": true, "eval": true, "syntax": true, "timeout": true, "conversion": true, "host": true, "internal": true, "resultSize": true, "steps": true, "quota": true, "throttled": true}
+
+// errorToJSON is the toJSON method of error objects. It returns a plain copy
+// of the object, which JSON.stringify and postMessage handle alike.
+var errorToJSON = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+	return jsObject.Call("assign", jsObject.New(), this)
+})
+
+// attachErrorMethods gives an error object its toJSON method. The method is
+// not enumerable, so it is skipped by the structured clone algorithm, which
+// would otherwise refuse to copy the object across a worker boundary.
+func attachErrorMethods(obj js.Value) js.Value {
+	descriptor := jsObject.New()
+	descriptor.Set("value", errorToJSON)
+	descriptor.Set("writable", true)
+	descriptor.Set("configurable", true)
+	jsObject.Call("defineProperty", obj, "toJSON", descriptor)
+	return obj
+}
+
+// jsErrorFromJSON rebuilds an error object from its JSON string, or from the
+// plain object it was turned into, e.g. by postMessage.
+func jsErrorFromJSON() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) (result interface{}) {
+		defer func() {
+			if r := recover(); r != nil {
+				result = jsErrorConstructor.New("Error: invalid starlark error.")
+			}
+		}()
+
+		if len(args) < 1 {
+			return jsErrorConstructor.New("Error: errorFromJSON requires a JSON string or an object.")
+		}
+		value := args[0]
+		if value.Type() == js.TypeString {
+			value = js.Global().Get("JSON").Call("parse", value)
+		}
+		if !isPlainObject(value) || value.Get("kind").Type() != js.TypeString || !errorKinds[value.Get("kind").String()] || value.Get("message").Type() != js.TypeString {
+			return jsErrorConstructor.New("Error: invalid starlark error.")
+		}
+		obj := jsObject.Call("assign", jsObject.New(), value)
+		return attachErrorMethods(obj)
+	})
+}
@@ -0,0 +1,526 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sync"
+	"syscall/js"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// replFilename is the filename of REPL chunks, as it appears in errors.
+const replFilename = "<repl>"
+
+// A session holds the globals of a REPL between the chunks entered into it,
+// so that each chunk is parsed and resolved alone, against the bindings of
+// the statements before it, rather than with the whole history.
+//
+// Each session has a goroutine of its own that runs its chunks one after the
+// other, in the order they were entered, rather than a goroutine per chunk.
+type session struct {
+	id string
+	// mu guards the globals. The session's goroutine only ever runs one
+	// chunk at a time, but a chunk that timed out may still be unwinding.
+	mu      sync.Mutex
+	globals starlark.StringDict
+
+	// queueMu guards the jobs waiting for the session's goroutine, which
+	// wake wakes, and closed, which is set once the session is closed. It
+	// guards too whether a job is running, when the last one ended, the
+	// executionId of its chunk, and the timer that evicts the session once
+	// it has been idle for the idleTimeout of the session policy. dropped
+	// is set once a reset has closed the session, whose chunks still
+	// waiting then fail rather than run.
+	queueMu       sync.Mutex
+	jobs          []func()
+	wake          chan struct{}
+	closed        bool
+	dropped       bool
+	busy          bool
+	lastUsed      time.Time
+	lastExecution string
+	evictTimer    *time.Timer
+}
+
+// sessions holds the open REPL sessions, by session id, and the policy
+// that evicts those the host abandoned: sessions idle for idleTimeout are
+// closed, as is the one idle the longest when opening another would make
+// more than maxSessions. Zero is no limit.
+var sessions = struct {
+	mu          sync.Mutex
+	byId        map[string]*session
+	idleTimeout time.Duration
+	maxSessions int
+}{byId: make(map[string]*session)}
+
+// The reasons a session is evicted, as the sessionEvicted event gives them.
+const (
+	evictedIdle  = "idle"
+	evictedLimit = "limit"
+)
+
+// sessionFor returns the session with the given id, opening it if need be.
+func sessionFor(id string) *session {
+	sessions.mu.Lock()
+	s := sessions.byId[id]
+	var evicted *session
+	if s == nil {
+		if max := sessions.maxSessions; max > 0 && len(sessions.byId) >= max {
+			evicted = leastRecentlyUsed()
+			if evicted != nil {
+				evicted.evict()
+			}
+		}
+		// The REPL resolver has no separate predeclared environment, so the
+		// builtins start out as globals, the universal ones too, so that
+		// the builtins option of a chunk can change them; see withBuiltins.
+		s = &session{id: id, globals: make(starlark.StringDict, len(defaultEnvironment)), wake: make(chan struct{}, 1), lastUsed: time.Now()}
+		for name, value := range defaultEnvironment {
+			s.globals[name] = value
+		}
+		sessions.byId[id] = s
+		go s.serve()
+	}
+	sessions.mu.Unlock()
+	if evicted != nil {
+		evicted.notifyEvicted(evictedLimit)
+	}
+	return s
+}
+
+// leastRecentlyUsed returns the idle session whose last chunk ended the
+// longest ago, or nil if every session is busy. It must be called with
+// sessions.mu held.
+func leastRecentlyUsed() *session {
+	var oldest *session
+	var oldestUse time.Time
+	for _, s := range sessions.byId {
+		s.queueMu.Lock()
+		idle, used := !s.busy && len(s.jobs) == 0, s.lastUsed
+		s.queueMu.Unlock()
+		if idle && (oldest == nil || used.Before(oldestUse)) {
+			oldest, oldestUse = s, used
+		}
+	}
+	return oldest
+}
+
+// evict closes the session and drops it from sessions. It must be called
+// with sessions.mu held.
+func (s *session) evict() {
+	s.close()
+	delete(sessions.byId, s.id)
+}
+
+// scheduleEviction sets the session to be evicted once it has been idle
+// for the idleTimeout of the policy, if it has one.
+func (s *session) scheduleEviction() {
+	sessions.mu.Lock()
+	idleTimeout := sessions.idleTimeout
+	sessions.mu.Unlock()
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	if s.evictTimer != nil {
+		s.evictTimer.Stop()
+		s.evictTimer = nil
+	}
+	if idleTimeout <= 0 || s.closed {
+		return
+	}
+	s.evictTimer = time.AfterFunc(idleTimeout-time.Since(s.lastUsed), s.evictIfIdle)
+}
+
+// evictIfIdle evicts the session if it is still open and has been idle for
+// the idleTimeout of the policy.
+func (s *session) evictIfIdle() {
+	sessions.mu.Lock()
+	idleTimeout := sessions.idleTimeout
+	s.queueMu.Lock()
+	idle := !s.busy && len(s.jobs) == 0 && time.Since(s.lastUsed) >= idleTimeout
+	s.queueMu.Unlock()
+	if idleTimeout <= 0 || !idle || sessions.byId[s.id] != s {
+		sessions.mu.Unlock()
+		return
+	}
+	s.evict()
+	sessions.mu.Unlock()
+	s.notifyEvicted(evictedIdle)
+}
+
+// notifyEvicted tells the handlers of the sessionEvicted event that the
+// session was evicted, so that the host can keep what it needs of it:
+// {sessionId, reason, idle, globals}, where idle is the milliseconds since
+// its last chunk ended and globals holds the values of its globals that
+// convert to JS without loss, leaving out functions, modules and builtins.
+// The handlers are given the executionId of its last chunk.
+func (s *session) notifyEvicted(reason string) {
+	s.queueMu.Lock()
+	lastUsed, executionId := s.lastUsed, s.lastExecution
+	s.queueMu.Unlock()
+	e := newExecution(executionId, runOptions{sessionId: s.id, strict: true}, time.Now())
+	e.notify(eventSessionEvicted, func() js.Value {
+		obj := jsObject.New()
+		obj.Set("reason", reason)
+		obj.Set("idle", milliseconds(time.Since(lastUsed)))
+		obj.Set("globals", s.globalsToJSValue(&converter{exec: e}))
+		return obj
+	})
+}
+
+// globalsToJSValue converts the session's own globals, those that can be.
+func (s *session) globalsToJSValue(conv *converter) js.Value {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj := jsObject.New()
+	for name, value := range s.globals {
+		if identical(value, defaultEnvironment[name]) {
+			continue
+		}
+		switch value.(type) {
+		case starlark.NoneType, starlark.Bool, starlark.Int, starlark.Float, starlark.String, *starlark.List, *starlark.Dict:
+			if jsValue, err := conv.convertToJSValue(conv.exec.redactor.value(value), name); err == nil {
+				obj.Set(name, jsValue)
+			}
+		}
+	}
+	return obj
+}
+
+// setSessionPolicy sets the eviction policy of sessions, from
+// {idleTimeout?, maxSessions?} with idleTimeout in milliseconds, or removes
+// it when value is null or undefined. Sessions already idle are evicted once
+// they have been so for the new idleTimeout.
+func setSessionPolicy(value js.Value) {
+	sessions.mu.Lock()
+	sessions.idleTimeout, sessions.maxSessions = 0, 0
+	if value.Type() == js.TypeObject {
+		if v := value.Get("idleTimeout"); v.Type() == js.TypeNumber && v.Float() > 0 {
+			sessions.idleTimeout = time.Duration(v.Float() * float64(time.Millisecond))
+		}
+		if v := value.Get("maxSessions"); v.Type() == js.TypeNumber && v.Int() > 0 {
+			sessions.maxSessions = v.Int()
+		}
+	}
+	open := make([]*session, 0, len(sessions.byId))
+	for _, s := range sessions.byId {
+		open = append(open, s)
+	}
+	sessions.mu.Unlock()
+	for _, s := range open {
+		s.scheduleEviction()
+	}
+}
+
+// enqueue adds a job to the session's queue, reporting false if the session
+// has been closed. It never blocks, as it is called from JS.
+func (s *session) enqueue(job func()) bool {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.jobs = append(s.jobs, job)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// serve runs the session's jobs in order until the session is closed and
+// they have all run.
+func (s *session) serve() {
+	for {
+		s.queueMu.Lock()
+		if len(s.jobs) == 0 {
+			closed := s.closed
+			s.queueMu.Unlock()
+			if closed {
+				return
+			}
+			<-s.wake
+			continue
+		}
+		job := s.jobs[0]
+		s.jobs[0] = nil
+		s.jobs = s.jobs[1:]
+		s.busy = true
+		s.queueMu.Unlock()
+		job()
+		s.queueMu.Lock()
+		s.busy = false
+		s.lastUsed = time.Now()
+		s.queueMu.Unlock()
+		s.scheduleEviction()
+	}
+}
+
+// close stops the session from taking more jobs. Those already queued still
+// run.
+func (s *session) close() {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	s.closed = true
+	if s.evictTimer != nil {
+		s.evictTimer.Stop()
+		s.evictTimer = nil
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// closeSession drops the session with the given id, reporting whether it was
+// open.
+func closeSession(id string) bool {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	s, ok := sessions.byId[id]
+	if ok {
+		s.close()
+		delete(sessions.byId, id)
+	}
+	return ok
+}
+
+// execChunk runs a chunk of source in the session. If the chunk ends with an
+// expression, its value is returned, as a REPL would show it; otherwise None.
+func (s *session) execChunk(exec *execution, source string) (starlark.Value, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.withBuiltins(exec)()
+
+	parseStart := time.Now()
+	// Load bindings are global in a REPL, so that later chunks can use them.
+	fileOptions := exec.fileOptions()
+	fileOptions.LoadBindsGlobally = true
+	f, err := fileOptions.Parse(replFilename, source, 0)
+	exec.addLoadTime(parseStart)
+	exec.addPhase(phaseCompile, replFilename, parseStart)
+	if err != nil {
+		return nil, exec.wrapEvalError(codeEvalFailed, err)
+	}
+	var last syntax.Expr
+	if n := len(f.Stmts); n > 0 {
+		if stmt, ok := f.Stmts[n-1].(*syntax.ExprStmt); ok {
+			last = stmt.X
+			f.Stmts = f.Stmts[:n-1]
+		}
+	}
+
+	thread := exec.newThread(exec.id, exec.loader())
+	execStart := time.Now()
+	defer exec.addPhase(phaseExecute, "", execStart)
+	if err := starlark.ExecREPLChunk(f, thread, s.globals); err != nil {
+		exec.recordError(thread, err)
+		return nil, exec.wrapEvalError(codeExecFailed, withAllResolveErrors(err))
+	}
+	if last == nil {
+		return starlark.None, nil
+	}
+	value, err := starlark.EvalExprOptions(f.Options, thread, last, s.globals)
+	if err != nil {
+		exec.recordError(thread, err)
+		return nil, exec.wrapEvalError(codeExecFailed, withAllResolveErrors(err))
+	}
+	return value, nil
+}
+
+// callFunction calls a function that the session's chunks defined, as
+// starlark.run calls the function of a module.
+func (s *session) callFunction(exec *execution, name string, args []starlark.Value, kwargs []starlark.Tuple) (starlark.Value, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fn, ok := s.globals[name].(starlark.Callable)
+	if !ok {
+		return nil, exec.messageErr(codeMissingFunction, "function", fmt.Sprintf("%q", name))
+	}
+	thread := exec.newThread(exec.id, exec.loader())
+	callStart := time.Now()
+	defer exec.addPhase(phaseExecute, "", callStart)
+	value, err := starlark.Call(thread, fn, args, kwargs)
+	if err != nil {
+		exec.recordError(thread, err)
+		return nil, exec.wrapEvalError(codeExecFailed, err)
+	}
+	return value, nil
+}
+
+// withBuiltins puts the builtins that the chunk's builtins option removes or
+// replaces, the secrets its secrets option gives, and its host functions, in
+// place of the session's for the chunk, returning the function that puts
+// back those the chunk did not rebind. It must be called with s.mu held.
+func (s *session) withBuiltins(exec *execution) func() {
+	if !exec.ownsEnvironment() {
+		return func() {}
+	}
+	changed := make(map[string]starlark.Value)
+	for name, value := range exec.env {
+		current, bound := s.globals[name]
+		if exec.changesEnvironment(name) && (!bound || identical(current, defaultEnvironment[name])) {
+			changed[name] = value
+			s.globals[name] = value
+		}
+	}
+	return func() {
+		for name, value := range changed {
+			if !identical(s.globals[name], value) {
+				continue
+			}
+			if builtin, ok := defaultEnvironment[name]; ok {
+				s.globals[name] = builtin
+			} else {
+				delete(s.globals, name)
+			}
+		}
+	}
+}
+
+// identical reports whether a and b are the same value, as opposed to equal
+// ones: a chunk that rebinds a builtin keeps its own value.
+func identical(a, b starlark.Value) bool {
+	t := reflect.TypeOf(a)
+	return t == reflect.TypeOf(b) && t != nil && t.Comparable() && a == b
+}
+
+// jsRepl implements starlark.repl(executionId, source, options), which
+// queues a chunk of source to run in the session named by the sessionId
+// option, and resolves with the value of the expression it ends with, if
+// any. maxExecutionTime may be given as an option.
+func jsRepl() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 3 || args[1].Type() != js.TypeString || args[2].Type() != js.TypeObject {
+			return rejected(fmt.Errorf("Error: requires executionId, source, and options as arguments."))
+		}
+		source := args[1].String()
+		return inSession(args[0].String(), args[2], func(s *session, exec *execution) (starlark.Value, error) {
+			return s.execChunk(exec, source)
+		})
+	})
+}
+
+// jsSessionCall implements starlark.sessionCall(executionId, functionName,
+// args, kwargs, options), which queues a call of a function defined in the
+// session named by the sessionId option, and resolves with what it
+// returns. maxExecutionTime may be given as an option.
+func jsSessionCall() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 5 || args[1].Type() != js.TypeString || args[4].Type() != js.TypeObject {
+			return rejected(fmt.Errorf("Error: requires executionId, functionName, args, kwargs, and options as arguments."))
+		}
+		name, jsArgs, jsKwargs := args[1].String(), args[2], args[3]
+		return inSession(args[0].String(), args[4], func(s *session, exec *execution) (starlark.Value, error) {
+			starlarkArgs, starlarkKwargs, err := (&converter{exec: exec}).convertArgs(jsArgs, jsKwargs)
+			if err != nil {
+				return nil, err
+			}
+			return s.callFunction(exec, name, starlarkArgs, starlarkKwargs)
+		})
+	})
+}
+
+// inSession queues a job on the session named by the sessionId option,
+// running it under the execution's time limit, and returns a promise of
+// its outcome.
+func inSession(executionId string, options js.Value, job func(s *session, exec *execution) (starlark.Value, error)) js.Value {
+	sessionId := options.Get("sessionId")
+	if sessionId.Type() != js.TypeString || sessionId.String() == "" {
+		return rejected(fmt.Errorf("Error: the sessionId option is required."))
+	}
+	maxExecutionTime := 0
+	if value := options.Get("maxExecutionTime"); value.Type() == js.TypeNumber {
+		maxExecutionTime = value.Int()
+	}
+	session := sessionFor(sessionId.String())
+	run := func(exec *execution) (js.Value, error) {
+		if exec.options.envelope {
+			runtime.ReadMemStats(&exec.memory.start)
+		}
+		return runToJS(exec, &converter{exec: exec}, func() (starlark.Value, error) {
+			return runWithTimeout(exec, maxExecutionTime, func() (starlark.Value, error) {
+				return job(session, exec)
+			})
+		})
+	}
+	return jsPromise.New(js.FuncOf(func(this js.Value, promiseArgs []js.Value) interface{} {
+		resolve, reject := promiseArgs[0], promiseArgs[1]
+		calledAt := time.Now()
+		queued := func() {
+			session.queueMu.Lock()
+			session.lastExecution = executionId
+			dropped := session.dropped
+			session.queueMu.Unlock()
+			if dropped {
+				reject.Invoke(errorToJSValue(fmt.Errorf("Error: the session was reset.")))
+				return
+			}
+			settleExecution(executionId, options, calledAt, run, resolve, reject)
+		}
+		if !session.enqueue(queued) {
+			reject.Invoke(errorToJSValue(fmt.Errorf("Error: the session was closed.")))
+		}
+		return nil
+	}))
+}
+
+// closeAllSessions drops every session, for a reset, returning how many
+// were open.
+func closeAllSessions() int {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	n := len(sessions.byId)
+	for id, s := range sessions.byId {
+		s.queueMu.Lock()
+		s.dropped = true
+		s.queueMu.Unlock()
+		s.close()
+		delete(sessions.byId, id)
+	}
+	return n
+}
+
+// jsSetSessionPolicy implements starlark.setSessionPolicy(policy), where
+// policy is {idleTimeout?, maxSessions?}, or null to remove it.
+func jsSetSessionPolicy() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		policy := js.Null()
+		if len(args) > 0 {
+			policy = args[0]
+		}
+		setSessionPolicy(policy)
+		return nil
+	})
+}
+
+// jsCloseSession implements starlark.closeSession(sessionId), which drops a
+// REPL session and its globals, returning whether it was open.
+func jsCloseSession() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 1 || args[0].Type() != js.TypeString {
+			return jsErrorConstructor.New("Error: requires a sessionId as argument.")
+		}
+		return closeSession(args[0].String())
+	})
+}
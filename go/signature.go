@@ -0,0 +1,438 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"regexp"
+	"strings"
+	"syscall/js"
+
+	"go.starlark.net/syntax"
+)
+
+// The kinds of parameters, in the order a function declares them.
+const (
+	paramPositional = "positional"
+	paramOptional   = "optional"
+	paramVarargs    = "varargs"
+	paramKwonly     = "kwonly"
+	paramKwargs     = "kwargs"
+)
+
+// keywordArgPattern matches the start of a keyword argument.
+var keywordArgPattern = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)\s*=($|[^=])`)
+
+// openCall is a call whose arguments the cursor is among.
+type openCall struct {
+	// callee is the dotted name called, or "" if it is not a name.
+	callee string
+	// args are the text of the arguments up to the cursor, the last one
+	// being the one the cursor is in.
+	args []string
+}
+
+// cursorCall finds the innermost call whose parentheses are open at the
+// cursor, at a rune offset of text, skipping strings and comments. closers
+// are the brackets that would close all those open there.
+func cursorCall(text []rune, cursor int) (call *openCall, closers string) {
+	type bracket struct {
+		open     rune
+		at       int
+		argStart int
+		args     []string
+	}
+	var stack []*bracket
+	for i := 0; i < cursor; {
+		r := text[i]
+		switch {
+		case r == '#':
+			for i < cursor && text[i] != '\n' {
+				i++
+			}
+			continue
+		case stringStart(text, i) >= 0:
+			i += stringLength(text, i, stringStart(text, i))
+			continue
+		case r == '(' || r == '[' || r == '{':
+			stack = append(stack, &bracket{open: r, at: i, argStart: i + 1})
+		case r == ')' || r == ']' || r == '}':
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case r == ',' && len(stack) > 0:
+			top := stack[len(stack)-1]
+			top.args = append(top.args, string(text[top.argStart:i]))
+			top.argStart = i + 1
+		}
+		i++
+	}
+	if cursor > len(text) {
+		return nil, ""
+	}
+
+	var b strings.Builder
+	for i := len(stack) - 1; i >= 0; i-- {
+		b.WriteRune(map[rune]rune{'(': ')', '[': ']', '{': '}'}[stack[i].open])
+	}
+	for i := len(stack) - 1; i >= 0; i-- {
+		top := stack[i]
+		if top.open != '(' {
+			// A list or dict, perhaps in an argument of a call around it.
+			continue
+		}
+		// The callee is the dotted name just before the parenthesis.
+		end := top.at
+		for end > 0 && (text[end-1] == ' ' || text[end-1] == '\t') {
+			end--
+		}
+		start := end
+		for start > 0 && (isIdentRune(text[start-1]) || text[start-1] == '.') {
+			start--
+		}
+		callee := string(text[start:end])
+		if callee == "" || starlarkKeywords[callee] || strings.HasPrefix(callee, ".") {
+			return nil, b.String()
+		}
+		// The parameters of a def being written are not a call.
+		if before := strings.TrimRight(string(text[:start]), " \t"); strings.HasSuffix(before, "def") {
+			if defStart := len([]rune(before)) - 3; defStart == 0 || !isIdentRune(text[defStart-1]) {
+				return nil, b.String()
+			}
+		}
+		args := append(top.args, string(text[top.argStart:cursor]))
+		return &openCall{callee: callee, args: args}, b.String()
+	}
+	return nil, b.String()
+}
+
+// runeOffset returns the rune offset of a 1-based line and column of text,
+// or -1 if there is none.
+func runeOffset(text []rune, line int, col int) int {
+	l, c := 1, 1
+	for i := 0; i <= len(text); i++ {
+		if l == line && c == col {
+			return i
+		}
+		if i == len(text) {
+			break
+		}
+		if text[i] == '\n' {
+			if l == line {
+				return -1
+			}
+			l, c = l+1, 1
+		} else {
+			c++
+		}
+	}
+	return -1
+}
+
+// sourceSpan returns the text of source between two positions.
+func sourceSpan(text []rune, start syntax.Position, end syntax.Position) string {
+	from, to := runeOffset(text, int(start.Line), int(start.Col)), runeOffset(text, int(end.Line), int(end.Col))
+	if from < 0 || to < from {
+		return ""
+	}
+	return string(text[from:to])
+}
+
+// signatureParam is a parameter of a signature.
+type signatureParam struct {
+	name string
+	kind string
+	// defaultValue is the source of an optional parameter's default.
+	defaultValue string
+}
+
+func (p signatureParam) label() string {
+	switch p.kind {
+	case paramVarargs:
+		return "*" + p.name
+	case paramKwargs:
+		return "**" + p.name
+	}
+	if p.defaultValue != "" {
+		return p.name + "=" + p.defaultValue
+	}
+	return p.name
+}
+
+// signature describes the function a call is to, and which of its
+// parameters the argument at the cursor is for, or -1 if none.
+type signature struct {
+	name   string
+	doc    string
+	params []signatureParam
+	active int
+}
+
+// paramsOf returns the parameters a def or lambda declares.
+func paramsOf(text []rune, params []syntax.Expr) []signatureParam {
+	var result []signatureParam
+	kwonly := false
+	for _, param := range params {
+		switch param := param.(type) {
+		case *syntax.Ident:
+			kind := paramPositional
+			if kwonly {
+				kind = paramKwonly
+			}
+			result = append(result, signatureParam{name: param.Name, kind: kind})
+		case *syntax.BinaryExpr:
+			id, _ := param.X.(*syntax.Ident)
+			if id == nil {
+				continue
+			}
+			kind := paramOptional
+			if kwonly {
+				kind = paramKwonly
+			}
+			start, end := param.Y.Span()
+			result = append(result, signatureParam{name: id.Name, kind: kind, defaultValue: sourceSpan(text, start, end)})
+		case *syntax.UnaryExpr:
+			kwonly = true
+			id, _ := param.X.(*syntax.Ident)
+			if id == nil {
+				// A bare *, which only separates the keyword-only
+				// parameters.
+				continue
+			}
+			kind := paramVarargs
+			if param.Op == syntax.STARSTAR {
+				kind = paramKwargs
+			}
+			result = append(result, signatureParam{name: id.Name, kind: kind})
+		}
+	}
+	return result
+}
+
+// docOf returns the docstring of a function body, if it has one.
+func docOf(body []syntax.Stmt) string {
+	if len(body) == 0 {
+		return ""
+	}
+	if expr, ok := body[0].(*syntax.ExprStmt); ok {
+		if lit, ok := expr.X.(*syntax.Literal); ok && lit.Token == syntax.STRING {
+			return lit.Value.(string)
+		}
+	}
+	return ""
+}
+
+// findSignature finds the def, or lambda assigned to a name, that a call to
+// name at the cursor calls: one nested in a function around the cursor, the
+// innermost first, or else one of the module's.
+func findSignature(f *syntax.File, text []rune, name string, line int32, col int32) *signature {
+	type candidate struct {
+		start, end syntax.Position
+		sig        *signature
+	}
+	var candidates []candidate
+	var functions []syntax.Node
+	walkSyntax(f, func(n syntax.Node) bool {
+		switch n := n.(type) {
+		case *syntax.DefStmt:
+			functions = append(functions, n)
+			if n.Name.Name == name {
+				start, end := n.Span()
+				candidates = append(candidates, candidate{start, end, &signature{name: name, doc: docOf(n.Body), params: paramsOf(text, n.Params)}})
+			}
+		case *syntax.AssignStmt:
+			id, ok := n.LHS.(*syntax.Ident)
+			lambda, isLambda := n.RHS.(*syntax.LambdaExpr)
+			if ok && isLambda && id.Name == name && n.Op == syntax.EQ {
+				start, end := n.Span()
+				candidates = append(candidates, candidate{start, end, &signature{name: name, params: paramsOf(text, lambda.Params)}})
+			}
+		case *syntax.LambdaExpr:
+			functions = append(functions, n)
+		}
+		return true
+	})
+
+	// A candidate is in scope if the function it is nested in, if any, is
+	// around the cursor. The deepest such function wins.
+	var best *signature
+	bestDepth := -1
+	for _, c := range candidates {
+		depth := 0
+		inScope := true
+		for _, fn := range functions {
+			start, end := fn.Span()
+			contains := (start.Line < c.start.Line || start.Line == c.start.Line && start.Col < c.start.Col) &&
+				(c.end.Line < end.Line || c.end.Line == end.Line && c.end.Col <= end.Col)
+			if !contains {
+				continue
+			}
+			if !containsCursor(fn, line, col) {
+				inScope = false
+				break
+			}
+			depth++
+		}
+		if inScope && depth > bestDepth {
+			best, bestDepth = c.sig, depth
+		}
+	}
+	return best
+}
+
+// activeParam returns the index of the parameter the last of the arguments
+// is for, or -1 if none is.
+func activeParam(params []signatureParam, args []string) int {
+	find := func(kind string) int {
+		for i, p := range params {
+			if p.kind == kind {
+				return i
+			}
+		}
+		return -1
+	}
+	current := strings.TrimSpace(args[len(args)-1])
+	switch {
+	case strings.HasPrefix(current, "**"):
+		return find(paramKwargs)
+	case strings.HasPrefix(current, "*"):
+		return find(paramVarargs)
+	}
+	if m := keywordArgPattern.FindStringSubmatch(current); m != nil {
+		for i, p := range params {
+			if p.name == m[1] && p.kind != paramVarargs && p.kind != paramKwargs {
+				return i
+			}
+		}
+		return find(paramKwargs)
+	}
+
+	positional := 0
+	for _, arg := range args[:len(args)-1] {
+		arg = strings.TrimSpace(arg)
+		if !strings.HasPrefix(arg, "*") && !keywordArgPattern.MatchString(arg) {
+			positional++
+		}
+	}
+	for i, p := range params {
+		if p.kind != paramPositional && p.kind != paramOptional {
+			break
+		}
+		if i == positional {
+			return i
+		}
+	}
+	return find(paramVarargs)
+}
+
+// signatureHelp describes the call whose arguments the cursor, at a 1-based
+// line and column, is among, or returns nil if it is not in a call to a
+// function the file defines.
+func signatureHelp(filename string, source string, line int, col int) *signature {
+	text := []rune(source)
+	cursor := runeOffset(text, line, col)
+	if cursor < 0 {
+		return nil
+	}
+	call, closers := cursorCall(text, cursor)
+	if call == nil || strings.Contains(call.callee, ".") {
+		return nil
+	}
+
+	// Try the source with the placeholder at the cursor, then with the call
+	// and everything else open there closed and what follows dropped, and
+	// then the fallbacks of completion.
+	fileOptions := syntax.FileOptions{}
+	f, err := fileOptions.Parse(filename, string(text[:cursor])+completionPlaceholder+string(text[cursor:]), 0)
+	if err != nil {
+		f, err = fileOptions.Parse(filename, string(text[:cursor])+completionPlaceholder+closers, 0)
+	}
+	if err != nil {
+		f = parseForCompletion(filename, source, line, col)
+	}
+	if f == nil {
+		return nil
+	}
+	sig := findSignature(f, text, call.callee, int32(line), int32(col))
+	if sig == nil {
+		return nil
+	}
+	sig.active = activeParam(sig.params, call.args)
+	return sig
+}
+
+func (s *signature) toJSValue() js.Value {
+	labels := make([]string, len(s.params))
+	params := jsArray.New(len(s.params))
+	for i, p := range s.params {
+		labels[i] = p.label()
+		param := jsObject.New()
+		param.Set("name", p.name)
+		param.Set("kind", p.kind)
+		param.Set("label", labels[i])
+		if p.defaultValue != "" {
+			param.Set("default", p.defaultValue)
+		}
+		params.SetIndex(i, param)
+	}
+	// Put the bare * back before keyword-only parameters without *args.
+	for i, p := range s.params {
+		if p.kind == paramVarargs {
+			break
+		}
+		if p.kind == paramKwonly {
+			labels = append(labels[:i], append([]string{"*"}, labels[i:]...)...)
+			break
+		}
+	}
+
+	obj := jsObject.New()
+	obj.Set("name", s.name)
+	obj.Set("label", s.name+"("+strings.Join(labels, ", ")+")")
+	if s.doc != "" {
+		obj.Set("doc", s.doc)
+	}
+	obj.Set("parameters", params)
+	obj.Set("activeParameter", s.active)
+	return obj
+}
+
+// jsSignatureHelp implements starlark.signatureHelp(source, line, column,
+// filename?), which describes the function called by the call whose
+// arguments a 1-based line and column are among: its parameters, and which
+// of them the argument there is for. It returns null outside a call, or for
+// a call to a function the file does not define.
+func jsSignatureHelp() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) (result interface{}) {
+		defer func() {
+			if r := recover(); r != nil {
+				result = errorToJSValue(newInternalError(r, panicStack()))
+			}
+		}()
+
+		if len(args) < 3 || args[0].Type() != js.TypeString || args[1].Type() != js.TypeNumber || args[2].Type() != js.TypeNumber {
+			return jsErrorConstructor.New("Error: signatureHelp requires the source code, a line and a column as arguments.")
+		}
+		filename := "<signatureHelp>"
+		if len(args) > 3 && args[3].Type() == js.TypeString {
+			filename = args[3].String()
+		}
+		sig := signatureHelp(filename, args[0].String(), args[1].Int(), args[2].Int())
+		if sig == nil {
+			return js.Null()
+		}
+		return sig.toJSValue()
+	})
+}
@@ -0,0 +1,267 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"strconv"
+
+	"dcollien.com/starlark-wasm/internal/runner"
+	"go.starlark.net/starlark"
+)
+
+// sizeCheckInterval is the most steps between two checks of the sizes of an
+// execution's values, with the maxValueSize or maxTotalSize option, unless
+// the last check walked more values than that. A check walks every value
+// the thread's variables hold, so the next one waits at least as many steps
+// as the last one walked, keeping the cost of the checks in proportion to
+// the steps. Values growing towards a limit are checked sooner; see
+// sizeCheckSteps.
+const sizeCheckInterval = 100
+
+// sizeCheckFirst is the steps before the first check of sizes. The interval
+// doubles from it up to sizeCheckInterval, so that a value growing fast
+// from the start is seen growing before it has grown far.
+const sizeCheckFirst = 8
+
+// sizeWalk measures the values held by a thread's variables: the bytes of
+// strings and the elements of lists, tuples, dicts and sets, each counted
+// once however many variables share it.
+type sizeWalk struct {
+	seen  map[starlark.Value]bool
+	total int
+	// largest is the size of the largest value, against maxValueSize.
+	largest int
+	// walked counts the values visited, for the scheduling of the next
+	// check.
+	walked int
+}
+
+// sizeOf is the size of a value against the maxValueSize option, leaving
+// out its elements.
+func sizeOf(value starlark.Value) int {
+	switch v := value.(type) {
+	case starlark.String:
+		return len(v)
+	case starlark.Bytes:
+		return len(v)
+	case starlark.Tuple:
+		return len(v)
+	case *starlark.List:
+		return v.Len()
+	case *starlark.Dict:
+		return v.Len()
+	case *starlark.Set:
+		return v.Len()
+	}
+	return 0
+}
+
+// walk adds the size of value and of everything it holds to the total,
+// returning the first value over maxValueSize, if any, and its size.
+func (w *sizeWalk) walk(value starlark.Value, maxValueSize int) (starlark.Value, int) {
+	stack := []starlark.Value{value}
+	for len(stack) > 0 {
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		switch v.(type) {
+		case *starlark.List, *starlark.Dict, *starlark.Set:
+			// Only these can be shared, or hold themselves.
+			if w.seen[v] {
+				continue
+			}
+			w.seen[v] = true
+		}
+		w.walked++
+		size := sizeOf(v)
+		if maxValueSize > 0 && size > maxValueSize {
+			return v, size
+		}
+		w.largest = max(w.largest, size)
+		w.total += size
+		switch v := v.(type) {
+		case starlark.Tuple:
+			stack = append(stack, v...)
+		case *starlark.List:
+			for i := 0; i < v.Len(); i++ {
+				stack = append(stack, v.Index(i))
+			}
+		case *starlark.Dict:
+			for _, item := range v.Items() {
+				stack = append(stack, item[0], item[1])
+			}
+		case *starlark.Set:
+			iter := v.Iterate()
+			var elem starlark.Value
+			for iter.Next(&elem) {
+				stack = append(stack, elem)
+			}
+			iter.Done()
+		}
+	}
+	return nil, 0
+}
+
+// sizeHook returns the step hook that fails a thread once one of the values
+// its variables hold is over the maxValueSize option, or all of them
+// together are over maxTotalSize, and that samples their size for the
+// meter and the memory watermarks. Variables are the locals and free
+// variables of each frame and the globals of each module on the stack, so a
+// value is only seen once it is assigned to one: a list being built by a
+// comprehension is not, until the comprehension is over.
+func (e *execution) sizeHook() runner.StepHook {
+	schedule := newSizeSchedule()
+	return runner.StepHook{
+		At: func(*starlark.Thread) uint64 { return schedule.next },
+		Fn: func(thread *starlark.Thread) {
+			w, err := e.checkSizes(thread)
+			e.meter.sampleHeld(w.total)
+			if err == nil {
+				e.checkWatermarks(w.total)
+			}
+			schedule.checked(thread.ExecutionSteps(), w.walked, e.sizeFill(w))
+			if err != nil {
+				e.failThread(thread, err)
+			}
+		},
+	}
+}
+
+// sizeSchedule decides when the sizes of a thread's values are checked next.
+type sizeSchedule struct {
+	// next is the steps at which the next check is due, and interval the
+	// usual steps between checks, doubling up to sizeCheckInterval.
+	next     uint64
+	interval uint64
+	// last and lastFill are the steps and the fill of the last check, and
+	// growth the rate the fill has been growing at.
+	last     uint64
+	lastFill float64
+	growth   float64
+}
+
+func newSizeSchedule() *sizeSchedule {
+	return &sizeSchedule{next: sizeCheckFirst, interval: sizeCheckFirst}
+}
+
+// checked schedules the next check after one at steps, which walked values
+// and found the limits filled to fill.
+func (s *sizeSchedule) checked(steps uint64, walked int, fill float64) {
+	s.growth = sizeGrowth(s.growth, s.lastFill, fill, steps-s.last)
+	s.interval = max(min(2*s.interval, sizeCheckInterval), uint64(walked))
+	s.next = steps + sizeCheckSteps(s.interval, walked, fill, s.growth)
+	s.last, s.lastFill = steps, fill
+}
+
+// sizeFill is how close the values of a walk are to their limits, as the
+// larger of the fractions of maxValueSize and maxTotalSize they have
+// reached, or 0 without limits.
+func (e *execution) sizeFill(w *sizeWalk) float64 {
+	fill := 0.0
+	if limit := e.options.maxValueSize; limit > 0 {
+		fill = max(fill, float64(w.largest)/float64(limit))
+	}
+	if limit := e.options.maxTotalSize; limit > 0 {
+		fill = max(fill, float64(w.total)/float64(limit))
+	}
+	return fill
+}
+
+// sizeGrowth updates the rate the fill of the limits grows at, as the log of
+// the factor it grows by in a step, with a check that found it went from
+// lastFill to fill over the elapsed steps. Growth is taken as a factor,
+// which covers a string doubling every few steps as well as a list growing
+// by an element a step. A check that found no growth halves the rate, as a
+// value may be growing between checks that land within one loop iteration,
+// and one that found the values shrink forgets it.
+func sizeGrowth(growth float64, lastFill float64, fill float64, elapsed uint64) float64 {
+	switch {
+	case lastFill <= 0 || elapsed == 0 || fill < lastFill:
+		return 0
+	case fill == lastFill:
+		return growth / 2
+	}
+	return max(growth, math.Log(fill/lastFill)/float64(elapsed))
+}
+
+// sizeCheckSteps is how many steps to wait for the next check of sizes,
+// given the usual interval, how many values the last one walked, the fill it
+// found and the rate it grows at. The interval is never fewer steps than the
+// values walked, so that the checks cost no more than a value walked a
+// step, and is shortened if at that rate the fill reaches 1 sooner: to the
+// steps until then, but no fewer than the values walked, nor than one.
+func sizeCheckSteps(interval uint64, walked int, fill float64, growth float64) uint64 {
+	steps := interval
+	if growth <= 0 || fill <= 0 || fill >= 1 {
+		return steps
+	}
+	if until := math.Log(1/fill) / growth; until < float64(steps) {
+		steps = uint64(max(until, float64(walked), 1))
+	}
+	return steps
+}
+
+// checkSizes walks the values a thread's variables hold, returning the walk
+// and the error for the first limit they are over.
+func (e *execution) checkSizes(thread *starlark.Thread) (*sizeWalk, error) {
+	w := &sizeWalk{seen: make(map[starlark.Value]bool)}
+	maxValueSize, maxTotalSize := e.options.maxValueSize, e.options.maxTotalSize
+	check := func(name string, value starlark.Value) error {
+		if value == nil {
+			// Not yet assigned.
+			return nil
+		}
+		if v, size := w.walk(value, maxValueSize); v != nil {
+			return e.messageErr(codeValueTooLarge, "name", name, "type", v.Type(), "size", strconv.Itoa(size), "limit", strconv.Itoa(maxValueSize))
+		}
+		if maxTotalSize > 0 && w.total > maxTotalSize {
+			return e.messageErr(codeTotalTooLarge, "size", strconv.Itoa(w.total), "limit", strconv.Itoa(maxTotalSize))
+		}
+		return nil
+	}
+	modules := make(map[string]bool)
+	for i := 0; i < thread.CallStackDepth(); i++ {
+		fr := thread.DebugFrame(i)
+		for j := 0; j < fr.NumLocals(); j++ {
+			binding, value := fr.Local(j)
+			if err := check(binding.Name, value); err != nil {
+				return w, err
+			}
+		}
+		fn, ok := fr.Callable().(*starlark.Function)
+		if !ok {
+			continue
+		}
+		for j := 0; j < fn.NumFreeVars(); j++ {
+			binding, value := fn.FreeVar(j)
+			if err := check(binding.Name, value); err != nil {
+				return w, err
+			}
+		}
+		if module := fn.Position().Filename(); !modules[module] {
+			modules[module] = true
+			globals := fn.Globals()
+			// In order, so that the same script always fails the same way.
+			for _, name := range globals.Keys() {
+				if err := check(name, globals[name]); err != nil {
+					return w, err
+				}
+			}
+		}
+	}
+	return w, nil
+}
@@ -0,0 +1,82 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// simulateSizeChecks runs the schedule of sizeHook against a fill that is
+// fillAt(steps) at each step, returning the fill at the first check that
+// finds it over the limit, or 0 if none does within the steps.
+func simulateSizeChecks(fillAt func(steps uint64) float64, walked int, steps uint64) float64 {
+	schedule := newSizeSchedule()
+	for schedule.next <= steps {
+		fill := fillAt(schedule.next)
+		if fill > 1 {
+			return fill
+		}
+		schedule.checked(schedule.next, walked, fill)
+	}
+	return 0
+}
+
+func TestSizeChecksCatchDoubling(t *testing.T) {
+	tests := []struct {
+		name   string
+		fillAt func(steps uint64) float64
+		// most is the fill the values may reach before a check sees it.
+		most float64
+	}{
+		// A string doubled every 4 steps from a byte, against a limit of
+		// 10MB: s = s + s in a loop.
+		{name: "doubling", fillAt: func(steps uint64) float64 {
+			return math.Pow(2, float64(steps/4)) / 1e7
+		}, most: 4},
+		// The same, as a loop iteration of 11 steps.
+		{name: "slow doubling", fillAt: func(steps uint64) float64 {
+			return math.Pow(2, float64(steps/11)) / 1e7
+		}, most: 4},
+		// A list growing by an element a step.
+		{name: "linear", fillAt: func(steps uint64) float64 {
+			return float64(steps) / 1e6
+		}, most: 1.01},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := simulateSizeChecks(test.fillAt, 4, 1e7)
+			if got == 0 {
+				t.Fatalf("no check found the values over the limit")
+			}
+			if got > test.most {
+				t.Errorf("the values reached %g of the limit before a check, over %g", got, test.most)
+			}
+		})
+	}
+}
+
+func TestSizeCheckStepsKeepCostToWalk(t *testing.T) {
+	// However fast the values grow, a check waits as many steps as the last
+	// one walked values.
+	if got := sizeCheckSteps(5000, 5000, 0.9, 1); got != 5000 {
+		t.Errorf("got %d steps, want 5000", got)
+	}
+	if got := sizeCheckSteps(sizeCheckInterval, 3, 0.5, 0); got != sizeCheckInterval {
+		t.Errorf("without growth, got %d steps, want %d", got, sizeCheckInterval)
+	}
+}
@@ -0,0 +1,126 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"syscall/js"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// stackWaitTimeout is how long starlark.stack waits for the execution to
+// step before taking the snapshot itself. An execution that does not step is
+// waiting on the host, or paused by the debugger.
+const stackWaitTimeout = 100 * time.Millisecond
+
+// sampleStack is a step hook that answers the starlark.stack calls waiting
+// on the execution.
+func (e *execution) sampleStack(*starlark.Thread) {
+	if !e.stackWanted.Load() {
+		return
+	}
+	snapshot := e.stackSnapshot(false)
+	e.mu.Lock()
+	waiters := e.stackWaiters
+	e.stackWaiters = nil
+	e.stackWanted.Store(false)
+	e.mu.Unlock()
+	for _, waiter := range waiters {
+		waiter <- snapshot
+	}
+}
+
+// stackSnapshot captures the call stack of the execution: those of its
+// threads with frames, outermost first, which are the main thread and those
+// of the modules it is loading.
+func (e *execution) stackSnapshot(waiting bool) js.Value {
+	e.mu.Lock()
+	var stack starlark.CallStack
+	for _, thread := range e.threads {
+		stack = append(stack, thread.CallStack()...)
+	}
+	e.mu.Unlock()
+
+	snapshot := jsObject.New()
+	snapshot.Set("backtrace", callStackToJSValue(stack, nil))
+	snapshot.Set("steps", e.steps())
+	snapshot.Set("waiting", waiting)
+	return e.tag(snapshot)
+}
+
+// captureStack waits for the execution to take a snapshot of its stack at
+// its next step hook. If it is not stepping, the snapshot is taken from
+// here, which is safe as its threads are blocked in a call to the host and
+// their stacks are not changing.
+func (e *execution) captureStack() js.Value {
+	waiter := make(chan js.Value, 1)
+	e.mu.Lock()
+	e.stackWaiters = append(e.stackWaiters, waiter)
+	e.stackWanted.Store(true)
+	e.mu.Unlock()
+
+	timer := time.NewTimer(stackWaitTimeout)
+	defer timer.Stop()
+	select {
+	case snapshot := <-waiter:
+		return snapshot
+	case <-timer.C:
+	}
+
+	e.mu.Lock()
+	for i, w := range e.stackWaiters {
+		if w == waiter {
+			e.stackWaiters = append(e.stackWaiters[:i], e.stackWaiters[i+1:]...)
+			break
+		}
+	}
+	if len(e.stackWaiters) == 0 {
+		e.stackWanted.Store(false)
+	}
+	e.mu.Unlock()
+	select {
+	case snapshot := <-waiter:
+		// Taken just as the wait ran out.
+		return snapshot
+	default:
+		return e.stackSnapshot(true)
+	}
+}
+
+// jsStack implements starlark.stack(executionId), which resolves with a
+// snapshot of the call stack of a running execution, {backtrace, steps,
+// waiting}, without stopping it. waiting is set if the execution was blocked
+// on the host rather than stepping.
+func jsStack() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 1 || args[0].Type() != js.TypeString {
+			return rejected(fmt.Errorf("Error: requires an executionId as argument."))
+		}
+		e := runningExecution(args[0].String())
+		if e == nil {
+			return rejected(fmt.Errorf("Error: no execution %q is running.", args[0].String()))
+		}
+		return jsPromise.New(js.FuncOf(func(this js.Value, promiseArgs []js.Value) interface{} {
+			resolve := promiseArgs[0]
+			go func() {
+				resolve.Invoke(e.captureStack())
+			}()
+			return nil
+		}))
+	})
+}
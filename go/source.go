@@ -0,0 +1,93 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"syscall/js"
+)
+
+// A module's source can come from the host in pieces, so that a large one
+// need not be joined into one giant JS string first: as its UTF-8 in a
+// Uint8Array, as an array of chunks, each a string or a Uint8Array, or, for
+// runs that can wait, as a ReadableStream of chunks, such as the body of a
+// fetch Response. The runner assembles the chunks in Go memory.
+
+// sourceFromJS assembles a source given in any of these forms. It reports
+// false if value is none of them.
+func sourceFromJS(value js.Value, wait bool) (string, bool, error) {
+	switch {
+	case value.Type() == js.TypeString:
+		return value.String(), true, nil
+	case value.Type() != js.TypeObject:
+		return "", false, nil
+	case value.InstanceOf(jsUint8Array):
+		data := make([]byte, value.Length())
+		js.CopyBytesToGo(data, value)
+		return string(data), true, nil
+	case value.InstanceOf(jsArray):
+		var data []byte
+		for i := 0; i < value.Length(); i++ {
+			var err error
+			if data, err = appendSourceChunk(data, value.Index(i)); err != nil {
+				return "", true, err
+			}
+		}
+		return string(data), true, nil
+	case value.Get("getReader").Type() == js.TypeFunction:
+		if !wait {
+			return "", true, fmt.Errorf("a synchronous run cannot read a ReadableStream")
+		}
+		data, err := readSourceStream(value)
+		return string(data), true, err
+	}
+	return "", false, nil
+}
+
+// appendSourceChunk appends a chunk of a source, a string or a Uint8Array,
+// to data.
+func appendSourceChunk(data []byte, chunk js.Value) ([]byte, error) {
+	switch {
+	case chunk.Type() == js.TypeString:
+		return append(data, chunk.String()...), nil
+	case chunk.Type() == js.TypeObject && chunk.InstanceOf(jsUint8Array):
+		n := len(data)
+		data = append(data, make([]byte, chunk.Length())...)
+		js.CopyBytesToGo(data[n:], chunk)
+		return data, nil
+	}
+	return data, fmt.Errorf("a chunk of the source is %s, rather than a string or a Uint8Array", jsTypeName(chunk))
+}
+
+// readSourceStream reads a ReadableStream of chunks to its end.
+func readSourceStream(stream js.Value) ([]byte, error) {
+	reader := stream.Call("getReader")
+	defer reader.Call("releaseLock")
+	var data []byte
+	for {
+		result, err := jsAwait(reader.Call("read"))
+		if err != nil {
+			return nil, err
+		}
+		if result.Get("done").Truthy() {
+			return data, nil
+		}
+		if data, err = appendSourceChunk(data, result.Get("value")); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,23 @@
+//go:build tinygo
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// panicStack stands in for debug.Stack, which TinyGo cannot provide as it
+// does not keep the symbol tables needed to print a stack trace.
+func panicStack() []byte {
+	return []byte("stack traces are not available in TinyGo builds")
+}
@@ -0,0 +1,160 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"runtime"
+	"sort"
+	"syscall/js"
+	"time"
+)
+
+// timings is how long each phase of an execution took, as reported in the
+// stats of the envelope.
+type timings struct {
+	// convertArgs is spent converting the arguments from the host.
+	convertArgs time.Duration
+	// load is spent fetching modules from the host and compiling them.
+	load time.Duration
+	// execute is spent running Starlark code: the top-level code of modules
+	// and the call itself, less any loading done along the way.
+	execute time.Duration
+	// convertResult is spent converting the return value for the host.
+	convertResult time.Duration
+}
+
+// The phases of an execution's timeline.
+const (
+	// phaseQueued is the wait from the call until the execution starts,
+	// behind the chunks before it in a REPL session.
+	phaseQueued = "queued"
+	// phaseConvertArgs converts the arguments from the host.
+	phaseConvertArgs = "convertArgs"
+	// phaseLoad fetches a module from the host.
+	phaseLoad = "load"
+	// phaseCompile compiles a module that is not cached.
+	phaseCompile = "compile"
+	// phaseInit runs the top-level code of a module, including the loads of
+	// the modules it loads.
+	phaseInit = "init"
+	// phaseExecute runs the function called, or a REPL chunk.
+	phaseExecute = "execute"
+	// phaseConvertResult converts the return value for the host.
+	phaseConvertResult = "convertResult"
+)
+
+// timelinePhase is a span of time an execution spent in a phase, for one
+// module if the phase is per module.
+type timelinePhase struct {
+	phase      string
+	module     string
+	start, end time.Time
+}
+
+// addPhase adds a phase that began at start and has just ended to the
+// timeline.
+func (e *execution) addPhase(phase string, module string, start time.Time) {
+	end := time.Now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.timeline = append(e.timeline, timelinePhase{phase: phase, module: module, start: start, end: end})
+}
+
+// timelineToJSValue returns the timeline of the envelope's stats: origin,
+// the time of the call in milliseconds since the Unix epoch, and the phases
+// in the order they began, with their start and end in milliseconds since
+// origin. Phases nest: the loads of a module are within its init, and so
+// may be those of a call that loads modules itself. It must be called with
+// e.mu held.
+func (e *execution) timelineToJSValue() js.Value {
+	phases := append([]timelinePhase(nil), e.timeline...)
+	sort.SliceStable(phases, func(i, j int) bool { return phases[i].start.Before(phases[j].start) })
+	jsPhases := jsArray.New(len(phases))
+	for i, p := range phases {
+		jsPhase := jsObject.New()
+		jsPhase.Set("phase", p.phase)
+		if p.module != "" {
+			jsPhase.Set("module", p.module)
+		}
+		jsPhase.Set("start", milliseconds(p.start.Sub(e.calledAt)))
+		jsPhase.Set("end", milliseconds(p.end.Sub(e.calledAt)))
+		jsPhases.SetIndex(i, jsPhase)
+	}
+	timeline := jsObject.New()
+	timeline.Set("origin", float64(e.calledAt.UnixNano())/float64(time.Millisecond))
+	timeline.Set("phases", jsPhases)
+	return timeline
+}
+
+// memoryUsage is what the Go runtime reports of the heap, sampled at the
+// start and end of an execution.
+type memoryUsage struct {
+	start, end runtime.MemStats
+}
+
+// toJSValue returns the memory stats of the envelope. Allocations are
+// counted for the whole wasm instance, so they include those of any other
+// execution running at the same time.
+func (m *memoryUsage) toJSValue() js.Value {
+	memory := jsObject.New()
+	memory.Set("allocated", float64(m.end.TotalAlloc-m.start.TotalAlloc))
+	memory.Set("heapInUse", float64(m.end.HeapInuse))
+	memory.Set("heapInUseChange", float64(int64(m.end.HeapInuse)-int64(m.start.HeapInuse)))
+	return memory
+}
+
+// addLoadTime counts the time since start as spent loading modules.
+func (e *execution) addLoadTime(start time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.timings.load += time.Since(start)
+}
+
+// milliseconds converts a duration to the fractional milliseconds JS uses for
+// times.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// statsToJSValue returns the stats of the envelope: the steps executed, the
+// time spent in each phase, in milliseconds, and the memory used.
+func (e *execution) statsToJSValue() js.Value {
+	steps := e.steps()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	t := e.timings
+	jsTimings := jsObject.New()
+	jsTimings.Set("convertArgs", milliseconds(t.convertArgs))
+	jsTimings.Set("load", milliseconds(t.load))
+	jsTimings.Set("execute", milliseconds(t.execute))
+	jsTimings.Set("convertResult", milliseconds(t.convertResult))
+	jsTimings.Set("total", milliseconds(t.convertArgs+t.load+t.execute+t.convertResult))
+
+	stats := jsObject.New()
+	stats.Set("steps", steps)
+	stats.Set("timings", jsTimings)
+	stats.Set("memory", e.memory.toJSValue())
+	stats.Set("timeline", e.timelineToJSValue())
+	if e.options.labels != nil {
+		stats.Set("labels", labelsToJSValue(e.options.labels))
+	}
+	if e.meter != nil {
+		stats.Set("meter", e.meter.toJSValue(steps))
+	}
+	return stats
+}
@@ -0,0 +1,120 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"syscall/js"
+
+	"go.starlark.net/starlark"
+)
+
+// streamable reports whether streamValue can stream a value: only lists and
+// dicts can be, and anything else is converted as usual.
+func streamable(value starlark.Value) bool {
+	switch value.(type) {
+	case *starlark.List, *starlark.Dict:
+		return true
+	}
+	return false
+}
+
+// streamValue delivers a list or dict result to the host's chunk callback in
+// chunks of up to size elements, rather than converting it in one go: a list
+// as arrays of its elements, and a dict as objects holding some of its
+// entries. If the callback returns a promise, the next chunk waits for it, so
+// that the host can apply backpressure. The maxResultSize option applies to
+// each chunk.
+func (c *converter) streamValue(value starlark.Value, path string, size int) error {
+	switch v := value.(type) {
+	case *starlark.List:
+		for start := 0; start < v.Len(); start += size {
+			end := min(start+size, v.Len())
+			chunk := jsArray.New(end - start)
+			c.resultSize = 0
+			for i := start; i < end; i++ {
+				item, err := c.convertToJSValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i))
+				if err != nil {
+					return err
+				}
+				chunk.SetIndex(i-start, item)
+			}
+			if err := c.exec.deliverChunk(chunk); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *starlark.Dict:
+		items := v.Items()
+		for start := 0; start < len(items); start += size {
+			end := min(start+size, len(items))
+			chunk := jsObject.New()
+			c.resultSize = 0
+			for _, item := range items[start:end] {
+				key, ok := item[0].(starlark.String)
+				if !ok {
+					if err := c.lossy("unsupported_type", path, fmt.Sprintf("entry with %s key %s omitted", item[0].Type(), item[0])); err != nil {
+						return err
+					}
+					continue
+				}
+				itemPath := fmt.Sprintf("%s[%q]", path, string(key))
+				if err := c.countResult(len(key), itemPath); err != nil {
+					return err
+				}
+				jsItem, err := c.convertToJSValue(item[1], itemPath)
+				if err != nil {
+					return err
+				}
+				chunk.Set(string(key), jsItem)
+			}
+			if err := c.exec.deliverChunk(chunk); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// deliverChunk passes a chunk of the result to globalThis.starlark.chunk, and
+// waits for the promise it returns, if any. It returns an error if the
+// callback failed and the onHostError policy says to stop.
+func (e *execution) deliverChunk(chunk js.Value) error {
+	starlarkObj := hostGlobal()
+	if starlarkObj.Type() != js.TypeObject || starlarkObj.Get("chunk").Type() != js.TypeFunction {
+		return fmt.Errorf("Error: %s.chunk is not defined.", hostGlobalName())
+	}
+	summary := func() string {
+		n := chunk.Length()
+		if !chunk.InstanceOf(jsArray) {
+			n = jsObject.Call("keys", chunk).Length()
+		}
+		return countSummary(n, "item")()
+	}
+	err := e.audited("chunk", summary, func() error {
+		result, err := invokeHost(starlarkObj.Get("chunk"), chunk, e.id)
+		if err == nil && result.Type() == js.TypeObject && result.Get("then").Type() == js.TypeFunction {
+			_, err = jsAwait(result)
+		}
+		return err
+	})
+	if err != nil {
+		return e.hostFailure("chunk", err)
+	}
+	return nil
+}
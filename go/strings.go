@@ -0,0 +1,154 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"syscall/js"
+)
+
+// Reading a string out of a js.Value takes two calls into the host, which
+// dominates the conversion of arguments holding many strings. Instead, the
+// strings of an argument are collected on the JS side, in the order
+// convertToStarlarkValue will meet them, and copied across as a single
+// TextEncoder-encoded buffer.
+
+// collectStringsSource walks a value exactly as convertToStarlarkValue does,
+// with or without the extendedTypes option, and returns [bytes, lengths]: the UTF-8 of every object key and string
+// value, concatenated, and the byte length of each.
+const collectStringsSource = `
+const strings = [];
+let size = 0;
+const walk = (value) => {
+	if (typeof value === "string") {
+		strings.push(value);
+		size += value.length;
+		return;
+	}
+	if (value === null || typeof value !== "object") {
+		return;
+	}
+	if (extended) {
+		if (value instanceof Map) {
+			for (const [key, item] of value) {
+				walk(key);
+				walk(item);
+			}
+			return;
+		}
+		if (value instanceof Set) {
+			for (const item of value) {
+				walk(item);
+			}
+			return;
+		}
+		if (value instanceof Uint8Array) {
+			return;
+		}
+	}
+	if (value instanceof Array) {
+		for (let i = 0; i < value.length; i++) {
+			walk(value[i]);
+		}
+		return;
+	}
+	for (const key of Object.keys(value)) {
+		strings.push(key);
+		size += key.length;
+		const item = value[key];
+		if (item !== undefined) {
+			walk(item);
+		}
+	}
+};
+walk(value);
+
+const encoder = new TextEncoder();
+const bytes = new Uint8Array(size * 3);
+const lengths = new Uint32Array(strings.length);
+let offset = 0;
+for (let i = 0; i < strings.length; i++) {
+	lengths[i] = encoder.encodeInto(strings[i], bytes.subarray(offset)).written;
+	offset += lengths[i];
+}
+return [bytes.subarray(0, offset), new Uint8Array(lengths.buffer)];
+`
+
+var (
+	collectStringsOnce sync.Once
+	collectStringsFn   js.Value
+)
+
+// collectStrings returns the JS function compiled from collectStringsSource.
+func collectStrings() js.Value {
+	collectStringsOnce.Do(func() {
+		collectStringsFn = js.Global().Get("Function").New("value", "extended", collectStringsSource)
+	})
+	return collectStringsFn
+}
+
+// stringTable holds the strings collected from a value being converted, in
+// pooled buffers that release returns.
+type stringTable struct {
+	data    *[]byte
+	lengths *[]byte
+	offset  int
+	next    int
+}
+
+// newStringTable collects the strings of value from the host.
+func newStringTable(value js.Value, extended bool) *stringTable {
+	result := collectStrings().Invoke(value, extended)
+	jsData, jsLengths := result.Index(0), result.Index(1)
+	t := &stringTable{
+		data:    getSizedBuffer(jsData.Length()),
+		lengths: getSizedBuffer(jsLengths.Length()),
+	}
+	js.CopyBytesToGo(*t.data, jsData)
+	js.CopyBytesToGo(*t.lengths, jsLengths)
+	return t
+}
+
+// release returns the table's buffers to the pool. take copies the strings
+// it returns, so they stay valid.
+func (t *stringTable) release() {
+	putBuffer(t.data)
+	putBuffer(t.lengths)
+	t.data, t.lengths = nil, nil
+}
+
+// take returns the next string, or false if there are none left.
+func (t *stringTable) take() (string, bool) {
+	b, ok := t.takeBytes()
+	return string(b), ok
+}
+
+// takeBytes is take without the copy: the bytes are only valid until the
+// table is released.
+func (t *stringTable) takeBytes() ([]byte, bool) {
+	if t.lengths == nil || 4*t.next >= len(*t.lengths) {
+		return nil, false
+	}
+	// Typed arrays use the platform's byte order, which for wasm is
+	// little-endian.
+	n := int(binary.LittleEndian.Uint32((*t.lengths)[4*t.next:]))
+	b := (*t.data)[t.offset : t.offset+n]
+	t.next++
+	t.offset += n
+	return b, true
+}
@@ -0,0 +1,126 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"syscall/js"
+)
+
+// A run served over the worker protocol can come with a SharedArrayBuffer,
+// its channel, through which the host answers loads synchronously: the
+// worker posts the load message and blocks in Atomics.wait until the host
+// has written the module into the channel. This skips the round trip through
+// a promise, and the turns of the event loop it costs, for every load. While
+// it waits, nothing else runs in the worker.
+//
+// The channel starts with four Int32s: a state, 0 while waiting and 1 once
+// answered; a status, 0 for a module, 1 for an error and 2 for a module that
+// did not fit in the channel; and the byte lengths of the source, or error
+// message, and of the hash, or -1 if there is none. Their UTF-8 follows.
+
+// syncLoadSource posts a sync load message for filename on port, waits for
+// the answer in buffer, and returns it as a LoadedModule, {error}, or
+// undefined if the module did not fit.
+const syncLoadSource = `
+const header = new Int32Array(buffer, 0, 4);
+Atomics.store(header, 0, 0);
+port.postMessage({ type: "load", id, executionId, filename, sync: true });
+Atomics.wait(header, 0, 0);
+const status = header[1];
+const length = header[2];
+const hashLength = header[3];
+// TextDecoder refuses views of shared memory, so copy the answer out first.
+const bytes = new Uint8Array(buffer, 16, length + Math.max(hashLength, 0)).slice();
+Atomics.store(header, 0, 0);
+
+const decoder = new TextDecoder();
+if (status === 1) {
+	return { error: decoder.decode(bytes) };
+}
+if (status === 2) {
+	return undefined;
+}
+const source = decoder.decode(bytes.subarray(0, length));
+if (hashLength < 0) {
+	return source;
+}
+return { source, hash: decoder.decode(bytes.subarray(length)) };
+`
+
+var (
+	syncLoadOnce sync.Once
+	syncLoadFn   js.Value
+)
+
+// syncLoadFunc returns the JS function compiled from syncLoadSource.
+func syncLoadFunc() js.Value {
+	syncLoadOnce.Do(func() {
+		syncLoadFn = js.Global().Get("Function").New("port", "buffer", "id", "executionId", "filename", syncLoadSource)
+	})
+	return syncLoadFn
+}
+
+// syncChannel is the channel of a run, and the server it came through.
+type syncChannel struct {
+	server *workerServer
+	buffer js.Value
+}
+
+// syncChannels are the channels of the runs in flight, by execution id.
+var syncChannels = struct {
+	mu       sync.Mutex
+	channels map[string]syncChannel
+}{channels: make(map[string]syncChannel)}
+
+func setSyncChannel(executionId string, channel syncChannel) {
+	syncChannels.mu.Lock()
+	defer syncChannels.mu.Unlock()
+	syncChannels.channels[executionId] = channel
+}
+
+func deleteSyncChannel(executionId string) {
+	syncChannels.mu.Lock()
+	defer syncChannels.mu.Unlock()
+	delete(syncChannels.channels, executionId)
+}
+
+// loadSync loads a module through the execution's channel. It returns false
+// if the execution has no channel, or the module did not fit in it, for the
+// caller to load it asynchronously instead.
+func loadSync(filename string, executionId string) (js.Value, bool, error) {
+	syncChannels.mu.Lock()
+	channel, ok := syncChannels.channels[executionId]
+	syncChannels.mu.Unlock()
+	if !ok {
+		return js.Undefined(), false, nil
+	}
+
+	id := channel.server.newLoadId()
+	result, err := invokeHost(syncLoadFunc(), channel.server.port, channel.buffer, id, executionId, filename)
+	if err != nil {
+		return js.Undefined(), true, err
+	}
+	if result.IsUndefined() {
+		return js.Undefined(), false, nil
+	}
+	if result.Type() == js.TypeObject && result.Get("error").Type() == js.TypeString {
+		return js.Undefined(), true, fmt.Errorf("%s", result.Get("error").String())
+	}
+	return result, true, nil
+}
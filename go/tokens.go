@@ -0,0 +1,365 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"strings"
+	"syscall/js"
+	"unicode"
+
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// The types of semantic tokens. Identifiers are classified by what binds
+// them, which takes a file that parses; in one that does not, they are all
+// tokenIdentifier.
+const (
+	tokenKeyword    = "keyword"
+	tokenComment    = "comment"
+	tokenString     = "string"
+	tokenNumber     = "number"
+	tokenOperator   = "operator"
+	tokenIdentifier = "identifier"
+	tokenParameter  = "parameter"
+	tokenLocal      = "local"
+	tokenGlobal     = "global"
+	tokenFunction   = "function"
+	tokenLoad       = "load"
+	tokenBuiltin    = "builtin"
+	// tokenPredeclared is a global the host provides.
+	tokenPredeclared = "predeclared"
+	tokenUndefined   = "undefined"
+	tokenAttribute   = "attribute"
+	// tokenArgument is the name of a keyword argument of a call.
+	tokenArgument = "argument"
+)
+
+// starlarkKeywords are the keywords of Starlark and the words it reserves,
+// which are highlighted alike.
+var starlarkKeywords = map[string]bool{
+	"and": true, "break": true, "continue": true, "def": true, "elif": true,
+	"else": true, "for": true, "if": true, "in": true, "lambda": true,
+	"load": true, "not": true, "or": true, "pass": true, "return": true,
+	"while": true,
+	"as":    true, "async": true, "await": true, "class": true, "del": true,
+	"except": true, "finally": true, "from": true, "global": true,
+	"import": true, "is": true, "nonlocal": true, "raise": true, "try": true,
+	"with": true, "yield": true,
+}
+
+// starlarkOperators are the operators, longest first so that the longest
+// match wins. Brackets and other punctuation are not tokens of their own.
+var starlarkOperators = []string{
+	"//=", "<<=", ">>=",
+	"**", "//", "<<", ">>", "==", "!=", "<=", ">=",
+	"+=", "-=", "*=", "/=", "%=", "&=", "|=", "^=",
+	"+", "-", "*", "/", "%", "&", "|", "^", "~", "<", ">", "=",
+}
+
+// semanticToken is a classified span of the source. Lines and columns count
+// from 1, columns in runes, and end is just past the token.
+type semanticToken struct {
+	kind       string
+	start, end syntax.Position
+	// definition is set on the identifier that binds a name.
+	definition bool
+}
+
+func (t semanticToken) toJSValue() js.Value {
+	obj := jsObject.New()
+	obj.Set("type", t.kind)
+	obj.Set("start", positionToJSValue(t.start))
+	obj.Set("end", positionToJSValue(t.end))
+	if t.definition {
+		obj.Set("definition", true)
+	}
+	return obj
+}
+
+// identifierClass is how an identifier is highlighted.
+type identifierClass struct {
+	kind       string
+	definition bool
+}
+
+// tokenPos is the line and column of a token.
+type tokenPos struct{ line, col int32 }
+
+// classifyIdentifiers resolves a file and classifies its identifiers, by
+// position.
+func classifyIdentifiers(f *syntax.File, isPredeclared func(string) bool) map[tokenPos]identifierClass {
+	// Report undefined names as such, but carry on resolving past them.
+	resolve.File(f, isPredeclared, starlark.Universe.Has)
+
+	// What bound each name, by its binding identifier.
+	bound := make(map[*syntax.Ident]string)
+	var functions []*resolve.Function
+	walkSyntax(f, func(n syntax.Node) bool {
+		switch n := n.(type) {
+		case *syntax.LoadStmt:
+			for _, to := range n.To {
+				bound[to] = tokenLoad
+			}
+		case *syntax.DefStmt:
+			bound[n.Name] = tokenFunction
+			if fn, ok := n.Function.(*resolve.Function); ok {
+				functions = append(functions, fn)
+			}
+		case *syntax.LambdaExpr:
+			if fn, ok := n.Function.(*resolve.Function); ok {
+				functions = append(functions, fn)
+			}
+		}
+		return true
+	})
+	for _, fn := range functions {
+		for _, param := range fn.Params {
+			switch param := param.(type) {
+			case *syntax.Ident:
+				bound[param] = tokenParameter
+			case *syntax.BinaryExpr:
+				if id, ok := param.X.(*syntax.Ident); ok {
+					bound[id] = tokenParameter
+				}
+			case *syntax.UnaryExpr:
+				if id, ok := param.X.(*syntax.Ident); ok {
+					bound[id] = tokenParameter
+				}
+			}
+		}
+	}
+
+	classes := make(map[tokenPos]identifierClass)
+	walkSyntax(f, func(n syntax.Node) bool {
+		switch n := n.(type) {
+		case *syntax.DotExpr:
+			classes[tokenPos{n.Name.NamePos.Line, n.Name.NamePos.Col}] = identifierClass{kind: tokenAttribute}
+		case *syntax.CallExpr:
+			for _, arg := range n.Args {
+				if kwarg, ok := arg.(*syntax.BinaryExpr); ok && kwarg.Op == syntax.EQ {
+					if id, ok := kwarg.X.(*syntax.Ident); ok {
+						classes[tokenPos{id.NamePos.Line, id.NamePos.Col}] = identifierClass{kind: tokenArgument}
+					}
+				}
+			}
+		case *syntax.Ident:
+			binding, ok := n.Binding.(*resolve.Binding)
+			if !ok {
+				return true
+			}
+			var kind string
+			switch binding.Scope {
+			case resolve.Universal:
+				kind = tokenBuiltin
+			case resolve.Predeclared:
+				kind = tokenPredeclared
+				if predeclared.Has(n.Name) {
+					kind = tokenBuiltin
+				}
+			case resolve.Undefined:
+				kind = tokenUndefined
+			case resolve.Global:
+				kind = tokenGlobal
+			default:
+				kind = tokenLocal
+			}
+			if b, ok := bound[binding.First]; ok && binding.First != nil {
+				kind = b
+			}
+			pos := tokenPos{n.NamePos.Line, n.NamePos.Col}
+			if _, ok := classes[pos]; !ok {
+				classes[pos] = identifierClass{kind: kind, definition: binding.First == n}
+			}
+		}
+		return true
+	})
+	return classes
+}
+
+// tokenizeSource splits source into semantic tokens, leaving out whitespace
+// and punctuation.
+func tokenizeSource(filename string, source string, isPredeclared func(string) bool) []semanticToken {
+	var classes map[tokenPos]identifierClass
+	fileOptions := syntax.FileOptions{}
+	if f, err := fileOptions.Parse(filename, source, 0); err == nil {
+		classes = classifyIdentifiers(f, isPredeclared)
+	}
+
+	text := []rune(source)
+	tokens := []semanticToken{}
+	line, col := int32(1), int32(1)
+	i := 0
+	// advance moves past n runes, following newlines.
+	advance := func(n int) {
+		for ; n > 0 && i < len(text); n-- {
+			if text[i] == '\n' {
+				line, col = line+1, 1
+			} else {
+				col++
+			}
+			i++
+		}
+	}
+	emit := func(kind string, n int, definition bool) {
+		start := syntax.MakePosition(nil, line, col)
+		advance(n)
+		tokens = append(tokens, semanticToken{kind: kind, start: start, end: syntax.MakePosition(nil, line, col), definition: definition})
+	}
+	hasPrefix := func(at int, s string) bool {
+		return strings.HasPrefix(string(text[at:min(len(text), at+len(s))]), s)
+	}
+
+	for i < len(text) {
+		r := text[i]
+		switch {
+		case r == '#':
+			n := 0
+			for i+n < len(text) && text[i+n] != '\n' {
+				n++
+			}
+			emit(tokenComment, n, false)
+
+		case stringStart(text, i) >= 0:
+			emit(tokenString, stringLength(text, i, stringStart(text, i)), false)
+
+		case unicode.IsDigit(r) || r == '.' && i+1 < len(text) && unicode.IsDigit(text[i+1]):
+			n := 1
+			hex := r == '0' && i+1 < len(text) && (text[i+1] == 'x' || text[i+1] == 'X')
+			for i+n < len(text) {
+				c := text[i+n]
+				exponentSign := (c == '+' || c == '-') && !hex && (text[i+n-1] == 'e' || text[i+n-1] == 'E')
+				if !isIdentRune(c) && c != '.' && !exponentSign {
+					break
+				}
+				n++
+			}
+			emit(tokenNumber, n, false)
+
+		case isIdentRune(r):
+			n := 1
+			for i+n < len(text) && isIdentRune(text[i+n]) {
+				n++
+			}
+			word := string(text[i : i+n])
+			if starlarkKeywords[word] {
+				emit(tokenKeyword, n, false)
+				continue
+			}
+			class, ok := classes[tokenPos{line, col}]
+			if !ok {
+				class.kind = tokenIdentifier
+			}
+			emit(class.kind, n, class.definition)
+
+		default:
+			matched := false
+			for _, op := range starlarkOperators {
+				if hasPrefix(i, op) {
+					emit(tokenOperator, len(op), false)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				advance(1)
+			}
+		}
+	}
+	return tokens
+}
+
+// stringStart returns the length of the prefix of the string literal that
+// starts at i, such as 1 for r"...", or -1 if none does.
+func stringStart(text []rune, i int) int {
+	for n := 0; n <= 2 && i+n < len(text); n++ {
+		switch c := unicode.ToLower(text[i+n]); {
+		case c == '"' || c == '\'':
+			if n < 2 || unicode.ToLower(text[i]) != unicode.ToLower(text[i+1]) {
+				return n
+			}
+			return -1
+		case c != 'r' && c != 'b':
+			return -1
+		}
+	}
+	return -1
+}
+
+// stringLength returns the length of the string literal with a prefix of
+// prefix runes starting at i. An unterminated literal runs to the end of its
+// line, or of the source if it is triple-quoted.
+func stringLength(text []rune, i int, prefix int) int {
+	j := i + prefix
+	quote := text[j]
+	triple := j+2 < len(text) && text[j+1] == quote && text[j+2] == quote
+	if triple {
+		j += 3
+	} else {
+		j++
+	}
+	for j < len(text) {
+		switch c := text[j]; {
+		case c == '\\':
+			j += 2
+			continue
+		case c == '\n' && !triple:
+			return j - i
+		case c == quote && !triple:
+			return j + 1 - i
+		case c == quote && j+2 < len(text) && text[j+1] == quote && text[j+2] == quote:
+			return j + 3 - i
+		}
+		j++
+	}
+	return len(text) - i
+}
+
+// jsTokenize implements starlark.tokenize(source, filename?, predeclared?),
+// which splits source into tokens classified for highlighting, in order.
+// predeclared lists the global names the host will provide.
+func jsTokenize() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) (result interface{}) {
+		defer func() {
+			if r := recover(); r != nil {
+				result = errorToJSValue(newInternalError(r, panicStack()))
+			}
+		}()
+
+		if len(args) < 1 || args[0].Type() != js.TypeString {
+			return jsErrorConstructor.New("Error: tokenize requires the source code as a string.")
+		}
+		filename := "<tokenize>"
+		if len(args) > 1 && args[1].Type() == js.TypeString {
+			filename = args[1].String()
+		}
+		hostPredeclared := make(map[string]bool)
+		if len(args) > 2 && args[2].InstanceOf(jsArray) {
+			for i := 0; i < args[2].Length(); i++ {
+				hostPredeclared[args[2].Index(i).String()] = true
+			}
+		}
+
+		isPredeclared := func(name string) bool { return hostPredeclared[name] || predeclared.Has(name) }
+		tokens := tokenizeSource(filename, args[0].String(), isPredeclared)
+		array := jsArray.New(len(tokens))
+		for i, token := range tokens {
+			array.SetIndex(i, token.toJSValue())
+		}
+		return array
+	})
+}
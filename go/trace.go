@@ -0,0 +1,287 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"sync"
+	"syscall/js"
+	"time"
+
+	"dcollien.com/starlark-wasm/internal/runner"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// traceBatchSize is the most trace events buffered before they are delivered
+// to the host.
+const traceBatchSize = 1000
+
+const threadTracerKey = "starlark_wasm.threadTracer"
+
+// The kinds of trace event.
+const (
+	traceCall    = "call"
+	traceReturn  = "return"
+	traceLoad    = "load"
+	traceLoaded  = "loaded"
+	tracePrint   = "print"
+	traceBuiltin = "builtin"
+)
+
+// traceEvent is something an execution did, at time since it started.
+type traceEvent struct {
+	kind string
+	time time.Duration
+	// name is the function or builtin called or returned from, the module
+	// loaded, or the stream printed to.
+	name   string
+	thread string
+	// depth is the depth of the stack the frame called or returned from,
+	// for call and return events.
+	depth int
+	pos   *syntax.Position
+	// duration is the time a builtin call took.
+	duration time.Duration
+}
+
+func (ev *traceEvent) toJSValue() js.Value {
+	obj := jsObject.New()
+	obj.Set("type", ev.kind)
+	obj.Set("time", float64(ev.time)/float64(time.Millisecond))
+	obj.Set("name", ev.name)
+	if ev.thread != "" {
+		obj.Set("thread", ev.thread)
+	}
+	if ev.depth > 0 {
+		obj.Set("depth", ev.depth)
+	}
+	if ev.pos != nil {
+		obj.Set("position", printPositionToJSValue(*ev.pos))
+	}
+	if ev.kind == traceBuiltin {
+		obj.Set("duration", float64(ev.duration)/float64(time.Millisecond))
+	}
+	return obj
+}
+
+// tracer buffers the trace events of an execution with the trace option.
+type tracer struct {
+	start time.Time
+
+	mu     sync.Mutex
+	events []traceEvent
+}
+
+// traceEvent records an event, timestamped now, delivering the buffered
+// events to the host once there are traceBatchSize of them.
+func (e *execution) traceEvent(ev traceEvent) error {
+	t := e.tracer
+	ev.time = time.Since(t.start)
+	t.mu.Lock()
+	t.events = append(t.events, ev)
+	full := len(t.events) >= traceBatchSize
+	t.mu.Unlock()
+	if full {
+		return e.flushTrace()
+	}
+	return nil
+}
+
+// flushTrace delivers the buffered trace events to the host's trace
+// callback, which is optional.
+func (e *execution) flushTrace() error {
+	t := e.tracer
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	events := t.events
+	t.events = nil
+	t.mu.Unlock()
+	trace := hostGlobal().Get("trace")
+	if len(events) == 0 || trace.Type() != js.TypeFunction {
+		return nil
+	}
+	array := jsArray.New(len(events))
+	labels := js.Undefined()
+	if e.options.labels != nil {
+		labels = labelsToJSValue(e.options.labels)
+	}
+	for i := range events {
+		event := events[i].toJSValue()
+		if !labels.IsUndefined() {
+			event.Set("labels", labels)
+		}
+		array.SetIndex(i, event)
+	}
+	err := e.audited("trace", countSummary(len(events), "event"), func() error {
+		_, err := invokeHost(trace, array, e.id)
+		return err
+	})
+	if err != nil {
+		return e.hostFailure("trace", err)
+	}
+	return nil
+}
+
+// finishTrace records the returns of the frames still on the stacks of the
+// execution's threads, which the step hook never sees return, and delivers
+// the events.
+func (e *execution) finishTrace() error {
+	if e.tracer == nil {
+		return nil
+	}
+	e.mu.Lock()
+	threads := append([]*starlark.Thread(nil), e.threads...)
+	e.mu.Unlock()
+	for i := len(threads) - 1; i >= 0; i-- {
+		if tt, ok := threads[i].Local(threadTracerKey).(*threadTracer); ok {
+			tt.returnTo(threads[i], 0)
+		}
+	}
+	return e.flushTrace()
+}
+
+// threadTracer follows the calls and returns of a thread.
+type threadTracer struct {
+	exec *execution
+	// names holds the name of each frame on the stack, outermost first.
+	names []string
+}
+
+// step is a step hook that records the frames called and returned from
+// since the thread's last step. Starlark has no hook for calls, so they show
+// as the stack growing at the callee's first step, and returns as it
+// shrinking by the caller's next one. Builtins only take steps if they call
+// back into Starlark, so the frames of the others are not seen, and the
+// calls a builtin makes back into Starlark one after another, such as the
+// key function of sorted, show as one.
+func (tt *threadTracer) step(thread *starlark.Thread) {
+	depth := thread.CallStackDepth()
+	if err := tt.returnTo(thread, depth); err != nil {
+		thread.Cancel(err.Error())
+		return
+	}
+	for i := len(tt.names); i < depth; i++ {
+		fr := thread.CallFrame(depth - 1 - i)
+		tt.names = append(tt.names, fr.Name)
+		pos := fr.Pos
+		if err := tt.exec.traceEvent(traceEvent{kind: traceCall, name: fr.Name, thread: thread.Name, depth: i + 1, pos: &pos}); err != nil {
+			thread.Cancel(err.Error())
+			return
+		}
+	}
+}
+
+// returnTo records returns from the frames above depth.
+func (tt *threadTracer) returnTo(thread *starlark.Thread, depth int) error {
+	for len(tt.names) > depth {
+		name := tt.names[len(tt.names)-1]
+		tt.names = tt.names[:len(tt.names)-1]
+		if err := tt.exec.traceEvent(traceEvent{kind: traceReturn, name: name, thread: thread.Name, depth: len(tt.names) + 1}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// traceThread follows the calls and returns of a new thread, with the trace
+// option.
+func (e *execution) traceThread(thread *starlark.Thread) []runner.StepHook {
+	if e.tracer == nil {
+		return nil
+	}
+	tt := &threadTracer{exec: e}
+	thread.SetLocal(threadTracerKey, tt)
+	return []runner.StepHook{{Interval: 1, Fn: tt.step}}
+}
+
+// traceLoad records the loading of a module on the caller's thread, and
+// returns a function that records its completion, along with the returns of
+// its top-level code.
+func (e *execution) traceLoad(caller *starlark.Thread, module string) func(thread *starlark.Thread) {
+	if e.tracer == nil {
+		return func(*starlark.Thread) {}
+	}
+	name := ""
+	if caller != nil {
+		name = caller.Name
+	}
+	e.traceEvent(traceEvent{kind: traceLoad, name: module, thread: name})
+	return func(thread *starlark.Thread) {
+		if tt, ok := thread.Local(threadTracerKey).(*threadTracer); ok {
+			tt.returnTo(thread, 0)
+		}
+		e.traceEvent(traceEvent{kind: traceLoaded, name: module, thread: name})
+	}
+}
+
+// tracePrint records a line of output.
+func (e *execution) tracePrint(thread *starlark.Thread, stream string) error {
+	if e.tracer == nil || thread == nil {
+		return nil
+	}
+	pos := thread.CallFrame(1).Pos
+	return e.traceEvent(traceEvent{kind: tracePrint, name: stream, thread: thread.Name, pos: &pos})
+}
+
+// tracedBuiltin wraps a builtin of a bundled module to record its calls,
+// with how long they took. The universal builtins, such as len, cannot be
+// traced: modules are compiled to call them directly, and their compiled
+// programs are shared with executions that are not traced.
+func tracedBuiltin(b *starlark.Builtin) *starlark.Builtin {
+	return starlark.NewBuiltin(b.Name(), func(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		e, ok := thread.Local(executionKey).(*execution)
+		if !ok || e.tracer == nil {
+			return b.CallInternal(thread, args, kwargs)
+		}
+		start := time.Now()
+		result, err := b.CallInternal(thread, args, kwargs)
+		if traceErr := e.traceBuiltinCall(thread, b.Name(), start); traceErr != nil && err == nil {
+			err = traceErr
+		}
+		return result, err
+	})
+}
+
+// traceBuiltinCall records a call of a builtin that started at start and
+// has just returned.
+func (e *execution) traceBuiltinCall(thread *starlark.Thread, name string, start time.Time) error {
+	// Frame 0 is the builtin itself; frame 1 is the code that called it.
+	pos := thread.CallFrame(1).Pos
+	return e.traceEvent(traceEvent{kind: traceBuiltin, name: name, thread: thread.Name, pos: &pos, duration: time.Since(start)})
+}
+
+// traceMembers returns the members of a bundled module with their builtins,
+// and those of the modules among them, wrapped by tracedBuiltin.
+func traceMembers(members starlark.StringDict) starlark.StringDict {
+	traced := make(starlark.StringDict, len(members))
+	for name, member := range members {
+		traced[name] = traceValue(member)
+	}
+	return traced
+}
+
+func traceValue(v starlark.Value) starlark.Value {
+	switch v := v.(type) {
+	case *starlark.Builtin:
+		return tracedBuiltin(v)
+	case *starlarkstruct.Module:
+		return &starlarkstruct.Module{Name: v.Name, Members: traceMembers(v.Members)}
+	}
+	return v
+}
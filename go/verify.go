@@ -0,0 +1,74 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"syscall/js"
+)
+
+// verifier returns the callback that approves the modules of the execution
+// before they run: the run's own verify, or the one on the namespace's
+// global object with the verifyModules option. It is undefined if modules
+// are not verified.
+func (e *execution) verifier() js.Value {
+	if fn := runCallback(e.options.callbacks, "verify"); fn.Type() == js.TypeFunction {
+		return fn
+	}
+	if !e.options.verifyModules {
+		return js.Undefined()
+	}
+	return hostCallback(e.options.callbacks, "verify")
+}
+
+// verifyModule asks the host whether a module may run, calling its verify
+// callback with (filename, hash, executionId), where hash is the SHA-256 of
+// the source, in hex, whatever the loader said: the hash a signature would
+// be made over. Only true, or a promise of it, approves the module, so a
+// verifier that is missing, throws or answers anything else keeps it from
+// running.
+func (e *execution) verifyModule(filename string, source string) error {
+	fn := e.verifier()
+	if fn.Type() != js.TypeFunction {
+		if !e.options.verifyModules {
+			return nil
+		}
+		return e.messageErr(codeNoVerifier, "file", fmt.Sprintf("%q", filename), "namespace", hostNamespace)
+	}
+	hash := contentHash(source)
+	var approved js.Value
+	err := e.audited("verify", func() string { return filename + " " + hash }, func() error {
+		var err error
+		approved, err = invokeHost(fn, filename, hash, e.id)
+		if err != nil || approved.Type() != js.TypeObject || approved.Get("then").Type() != js.TypeFunction {
+			return err
+		}
+		if e.synchronous {
+			return fmt.Errorf("a synchronous run cannot wait for the promise the verifier returned")
+		}
+		approved, err = jsAwait(approved)
+		return err
+	})
+	if err != nil {
+		return e.messageErr(codeVerifyFailed, "file", fmt.Sprintf("%q", filename), "cause", fmt.Sprintf("%q", err.Error()))
+	}
+	if approved.Type() != js.TypeBoolean || !approved.Bool() {
+		e.notifyLoadDenied(filename, codeNotApproved, hash, "")
+		return e.messageErr(codeNotApproved, "file", fmt.Sprintf("%q", filename), "hash", hash)
+	}
+	return nil
+}
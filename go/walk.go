@@ -0,0 +1,166 @@
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "go.starlark.net/syntax"
+
+// walkSyntax traverses a syntax tree in depth-first order, calling f for each
+// node and descending into its children while f returns true. It mirrors
+// syntax.Walk, which panics on while statements.
+func walkSyntax(n syntax.Node, f func(syntax.Node) bool) {
+	if !f(n) {
+		return
+	}
+
+	switch n := n.(type) {
+	case *syntax.File:
+		walkStmts(n.Stmts, f)
+
+	case *syntax.ExprStmt:
+		walkSyntax(n.X, f)
+
+	case *syntax.BranchStmt:
+		// no-op
+
+	case *syntax.IfStmt:
+		walkSyntax(n.Cond, f)
+		walkStmts(n.True, f)
+		walkStmts(n.False, f)
+
+	case *syntax.AssignStmt:
+		walkSyntax(n.LHS, f)
+		walkSyntax(n.RHS, f)
+
+	case *syntax.DefStmt:
+		walkSyntax(n.Name, f)
+		for _, param := range n.Params {
+			walkSyntax(param, f)
+		}
+		walkStmts(n.Body, f)
+
+	case *syntax.ForStmt:
+		walkSyntax(n.Vars, f)
+		walkSyntax(n.X, f)
+		walkStmts(n.Body, f)
+
+	case *syntax.WhileStmt:
+		walkSyntax(n.Cond, f)
+		walkStmts(n.Body, f)
+
+	case *syntax.ReturnStmt:
+		if n.Result != nil {
+			walkSyntax(n.Result, f)
+		}
+
+	case *syntax.LoadStmt:
+		walkSyntax(n.Module, f)
+		for _, from := range n.From {
+			walkSyntax(from, f)
+		}
+		for _, to := range n.To {
+			walkSyntax(to, f)
+		}
+
+	case *syntax.Ident, *syntax.Literal:
+		// no-op
+
+	case *syntax.ListExpr:
+		for _, x := range n.List {
+			walkSyntax(x, f)
+		}
+
+	case *syntax.ParenExpr:
+		walkSyntax(n.X, f)
+
+	case *syntax.CondExpr:
+		walkSyntax(n.Cond, f)
+		walkSyntax(n.True, f)
+		walkSyntax(n.False, f)
+
+	case *syntax.IndexExpr:
+		walkSyntax(n.X, f)
+		walkSyntax(n.Y, f)
+
+	case *syntax.DictEntry:
+		walkSyntax(n.Key, f)
+		walkSyntax(n.Value, f)
+
+	case *syntax.SliceExpr:
+		walkSyntax(n.X, f)
+		if n.Lo != nil {
+			walkSyntax(n.Lo, f)
+		}
+		if n.Hi != nil {
+			walkSyntax(n.Hi, f)
+		}
+		if n.Step != nil {
+			walkSyntax(n.Step, f)
+		}
+
+	case *syntax.Comprehension:
+		walkSyntax(n.Body, f)
+		for _, clause := range n.Clauses {
+			walkSyntax(clause, f)
+		}
+
+	case *syntax.IfClause:
+		walkSyntax(n.Cond, f)
+
+	case *syntax.ForClause:
+		walkSyntax(n.Vars, f)
+		walkSyntax(n.X, f)
+
+	case *syntax.TupleExpr:
+		for _, x := range n.List {
+			walkSyntax(x, f)
+		}
+
+	case *syntax.DictExpr:
+		for _, entry := range n.List {
+			walkSyntax(entry, f)
+		}
+
+	case *syntax.UnaryExpr:
+		if n.X != nil {
+			walkSyntax(n.X, f)
+		}
+
+	case *syntax.BinaryExpr:
+		walkSyntax(n.X, f)
+		walkSyntax(n.Y, f)
+
+	case *syntax.DotExpr:
+		walkSyntax(n.X, f)
+		walkSyntax(n.Name, f)
+
+	case *syntax.CallExpr:
+		walkSyntax(n.Fn, f)
+		for _, arg := range n.Args {
+			walkSyntax(arg, f)
+		}
+
+	case *syntax.LambdaExpr:
+		for _, param := range n.Params {
+			walkSyntax(param, f)
+		}
+		walkSyntax(n.Body, f)
+	}
+}
+
+func walkStmts(stmts []syntax.Stmt, f func(syntax.Node) bool) {
+	for _, stmt := range stmts {
+		walkSyntax(stmt, f)
+	}
+}
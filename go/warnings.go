@@ -0,0 +1,80 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"syscall/js"
+)
+
+// warning is a non-fatal diagnostic raised while servicing a call, such as a
+// value that could not be converted without losing information.
+type warning struct {
+	code    string
+	path    string
+	message string
+}
+
+func (w warning) toJSValue() js.Value {
+	obj := jsObject.New()
+	obj.Set("code", w.code)
+	obj.Set("path", w.path)
+	obj.Set("message", w.message)
+	return obj
+}
+
+// warn records a warning on the execution and forwards it to the host's
+// globalThis.starlark.warn callback, if there is one.
+func (e *execution) warn(code string, path string, message string) {
+	w := warning{code: code, path: path, message: message}
+
+	e.mu.Lock()
+	e.warnings = append(e.warnings, w)
+	e.mu.Unlock()
+	e.notify(eventWarning, func() js.Value {
+		obj := jsObject.New()
+		obj.Set("warning", w.toJSValue())
+		return obj
+	})
+
+	starlarkObj := hostGlobal()
+	if starlarkObj.IsUndefined() || starlarkObj.IsNull() {
+		return
+	}
+	if warnFn := starlarkObj.Get("warn"); warnFn.Type() == js.TypeFunction {
+		// A failing warning callback must not break the execution, whatever
+		// the onHostError policy.
+		err := e.audited("warn", func() string { return code + ": " + message }, func() error {
+			_, err := invokeHost(warnFn, e.tag(w.toJSValue()), e.id)
+			return err
+		})
+		if err != nil {
+			js.Global().Get("console").Call("error", fmt.Sprintf("Error: the warn callback failed. %s", err))
+		}
+	}
+}
+
+func (e *execution) warningsToJSValue() js.Value {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	array := jsArray.New(len(e.warnings))
+	for i, w := range e.warnings {
+		array.SetIndex(i, e.tag(w.toJSValue()))
+	}
+	return array
+}
@@ -0,0 +1,266 @@
+//go:build wasip1
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	"dcollien.com/starlark-wasm/internal/runner"
+	"go.starlark.net/starlark"
+)
+
+// The WASI build (GOOS=wasip1) runs scripts for hosts without JavaScript,
+// such as wasmtime, or a proxy's wasm filter. In place of syscall/js it
+// speaks a protocol of JSON messages, one to a line, over stdin and stdout:
+//
+//	{"type": "run", "id", "filename", "function"?, "args"?, "kwargs"?, "maxExecutionTime"?, "priority"?}
+//	  -> {"type": "result", "id", "value"} or {"type": "error", "id", "error": {"message", "backtrace"?}}
+//	{"type": "load", "id", "filename"}, from the runner
+//	  -> {"type": "loaded", "id", "source"} or {"type": "loaded", "id", "error"}
+//
+// and writes the output of a run as {"type": "print", "id", "stream",
+// "message"}, with the id of the run. Runs are taken one at a time, in the
+// order they arrive, except that of those that arrived while a run was
+// loading a module, the ones with the priority "batch" wait until the
+// others have run; a run without a function only executes its module, and
+// results in null. Values cross as JSON, converted by runner.DecodeJSON and
+// runner.EncodeJSON. The ids of runs are chosen by
+// the host, and may be any JSON value, and those of loads by the runner.
+
+// wasiMessage is a message from the host.
+type wasiMessage struct {
+	Type     string          `json:"type"`
+	Id       json.RawMessage `json:"id"`
+	Filename string          `json:"filename"`
+	Function string          `json:"function"`
+	Args     json.RawMessage `json:"args"`
+	Kwargs   json.RawMessage `json:"kwargs"`
+	// MaxExecutionTime is in seconds, as for wasm_runner; 0 for no limit.
+	MaxExecutionTime float64 `json:"maxExecutionTime"`
+	Source           *string `json:"source"`
+	Error            *string `json:"error"`
+	// Priority is "interactive", the default, or "batch".
+	Priority string `json:"priority"`
+}
+
+// wasiServer is the state of the protocol on stdin and stdout.
+type wasiServer struct {
+	in  *bufio.Reader
+	out *json.Encoder
+	// queued holds the runs that arrived while another was loading a module.
+	queued   []wasiMessage
+	nextLoad int
+}
+
+// dequeue takes the next of the queued runs: the first that is not a
+// batch run, or else the first.
+func (s *wasiServer) dequeue() wasiMessage {
+	next := 0
+	for i, msg := range s.queued {
+		if msg.Priority != "batch" {
+			next = i
+			break
+		}
+	}
+	msg := s.queued[next]
+	s.queued = append(s.queued[:next], s.queued[next+1:]...)
+	return msg
+}
+
+// post writes a message of the given type to the host.
+func (s *wasiServer) post(msgType string, fields map[string]interface{}) error {
+	fields["type"] = msgType
+	return s.out.Encode(fields)
+}
+
+// receive reads the next message from the host. Lines that are not
+// messages are skipped, and io.EOF is returned once stdin is closed.
+func (s *wasiServer) receive() (wasiMessage, error) {
+	var line []byte
+	for {
+		chunk, err := s.in.ReadBytes('\n')
+		line = append(line, chunk...)
+		if errors.Is(err, syscall.EAGAIN) {
+			// Some hosts, such as Node's WASI, hand over a stdin that does
+			// not block.
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		if len(line) == 0 && err != nil {
+			return wasiMessage{}, err
+		}
+		var msg wasiMessage
+		if json.Unmarshal(line, &msg) == nil && msg.Type != "" {
+			return msg, nil
+		}
+		line = nil
+	}
+}
+
+// hostLoad asks the host for the source of a module, and waits for the
+// answer. Runs that arrive meanwhile wait their turn.
+func (s *wasiServer) hostLoad(filename string) (string, error) {
+	s.nextLoad++
+	id := s.nextLoad
+	if err := s.post("load", map[string]interface{}{"id": id, "filename": filename}); err != nil {
+		return "", fmt.Errorf("Error: failed to load the file %q. Error: %q", filename, err)
+	}
+	for {
+		msg, err := s.receive()
+		if err != nil {
+			return "", fmt.Errorf("Error: failed to load the file %q. Error: %q", filename, err)
+		}
+		switch msg.Type {
+		case "run":
+			s.queued = append(s.queued, msg)
+			continue
+		case "loaded":
+			var loadId int
+			if json.Unmarshal(msg.Id, &loadId) != nil || loadId != id {
+				continue
+			}
+		default:
+			continue
+		}
+		if msg.Error != nil {
+			return "", fmt.Errorf("Error: failed to load the file %q. Error: %q", filename, *msg.Error)
+		}
+		if msg.Source == nil {
+			return "", fmt.Errorf("Error: failed to load the file %q. The host gave no source.", filename)
+		}
+		return *msg.Source, nil
+	}
+}
+
+// wasiHost is the runner's host for a run: its output goes to the host as
+// print messages with the id of the run, and its loads as load messages.
+type wasiHost struct {
+	server *wasiServer
+	id     json.RawMessage
+}
+
+func (h *wasiHost) Load(filename string) (string, error) {
+	return h.server.hostLoad(filename)
+}
+
+func (h *wasiHost) Print(stream string, message string) {
+	h.server.post("print", map[string]interface{}{"id": h.id, "stream": stream, "message": message})
+}
+
+func (h *wasiHost) Now() time.Time { return time.Now() }
+
+func (h *wasiHost) Rand() uint64 {
+	var b [8]byte
+	rand.Read(b[:])
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+// run runs the function a message asks for, returning its result as JSON.
+func (s *wasiServer) run(msg wasiMessage) (json.RawMessage, error) {
+	run := runner.Run{
+		Host:             &wasiHost{server: s, id: msg.Id},
+		Filename:         msg.Filename,
+		Function:         msg.Function,
+		MaxExecutionTime: time.Duration(msg.MaxExecutionTime * float64(time.Second)),
+		Hooks:            []runner.StepHook{{Interval: runner.YieldInterval, Fn: runner.Yielder()}},
+	}
+	var args []json.RawMessage
+	if len(msg.Args) > 0 && json.Unmarshal(msg.Args, &args) != nil {
+		return nil, fmt.Errorf("Error: args must be an array.")
+	}
+	var kwargs []starlark.Tuple
+	if len(msg.Kwargs) > 0 {
+		value, err := runner.DecodeJSON(msg.Kwargs, "kwargs")
+		dict, ok := value.(*starlark.Dict)
+		if err != nil || !ok {
+			return nil, fmt.Errorf("Error: kwargs must be an object.")
+		}
+		kwargs = dict.Items()
+	}
+	keys := make([]string, len(kwargs))
+	for i, kwarg := range kwargs {
+		keys[i] = string(kwarg[0].(starlark.String))
+	}
+	var err error
+	run.Args, run.Kwargs, err = runner.ConvertArgs(len(args), func(i int, path string) (starlark.Value, error) {
+		return runner.DecodeJSON(args[i], path)
+	}, keys, func(i int, path string) (starlark.Value, error) {
+		return kwargs[i][1], nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := runner.Execute(run)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := runner.EncodeJSON(value, "result")
+	if err != nil {
+		return nil, fmt.Errorf("Error: unable to convert the result to JSON. %s", err)
+	}
+	return encoded, nil
+}
+
+// answer runs the run a message asks for, and posts its outcome.
+func (s *wasiServer) answer(msg wasiMessage) {
+	if msg.Filename == "" {
+		s.post("error", map[string]interface{}{"id": msg.Id, "error": map[string]interface{}{"message": "Error: requires a filename."}})
+		return
+	}
+	value, err := s.run(msg)
+	if err != nil {
+		reply := map[string]interface{}{"message": err.Error()}
+		var evalErr *starlark.EvalError
+		if errors.As(err, &evalErr) {
+			reply["backtrace"] = evalErr.Backtrace()
+		}
+		s.post("error", map[string]interface{}{"id": msg.Id, "error": reply})
+		return
+	}
+	s.post("result", map[string]interface{}{"id": msg.Id, "value": value})
+}
+
+func main() {
+	s := &wasiServer{in: bufio.NewReader(os.Stdin), out: json.NewEncoder(os.Stdout)}
+	for {
+		var msg wasiMessage
+		if len(s.queued) > 0 {
+			msg = s.dequeue()
+		} else {
+			var err error
+			if msg, err = s.receive(); err != nil {
+				if err != io.EOF {
+					fmt.Fprintln(os.Stderr, err)
+				}
+				return
+			}
+		}
+		if msg.Type == "run" {
+			s.answer(msg)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"syscall/js"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// watchStepLimit bounds the steps each evaluation of a watch expression may
+// take, so that one that loops cannot hang the execution.
+const watchStepLimit = 100000
+
+// The points at which watch expressions are evaluated, chosen by the
+// watchOn option.
+const (
+	// watchOnPause evaluates them at each pause, for the paused event.
+	watchOnPause = "pause"
+	// watchOnLine also evaluates them at each new line reached, and
+	// streams them to the host's watch callback.
+	watchOnLine = "line"
+)
+
+// parseWatches reads the watch option, an array of expressions. It returns
+// nil unless the option is an array.
+func parseWatches(value js.Value) []string {
+	if value.Type() != js.TypeObject || !value.InstanceOf(jsArray) {
+		return nil
+	}
+	watches := []string{}
+	for i := 0; i < value.Length(); i++ {
+		if expr := value.Index(i); expr.Type() == js.TypeString {
+			watches = append(watches, expr.String())
+		}
+	}
+	return watches
+}
+
+// evalWatches evaluates the expressions in the innermost frame of the
+// thread, seeing its locals and the globals of its module, and returns the
+// results as [{expression, type, value}] or [{expression, error}], with
+// values as their repr.
+//
+// Each runs on a thread of its own, which can neither load nor print, within
+// watchStepLimit steps. Nothing stops an expression from changing the values
+// it sees, e.g. by appending to a list, so watches should only read them.
+func evalWatches(thread *starlark.Thread, expressions []string) js.Value {
+	env := starlark.StringDict{}
+	if thread.CallStackDepth() > 0 {
+		fr := thread.DebugFrame(0)
+		if fn, ok := fr.Callable().(*starlark.Function); ok {
+			for name, value := range fn.Globals() {
+				env[name] = value
+			}
+		}
+		for i := 0; i < fr.NumLocals(); i++ {
+			if binding, value := fr.Local(i); value != nil {
+				env[binding.Name] = value
+			}
+		}
+	}
+
+	results := jsArray.New(len(expressions))
+	for i, expr := range expressions {
+		result := jsObject.New()
+		result.Set("expression", expr)
+		value, err := evalWatch(thread.Name, expr, env)
+		if err != nil {
+			result.Set("error", err.Error())
+		} else {
+			result.Set("type", value.Type())
+			result.Set("value", boundedRepr(value, maxCapturedLocalLength))
+		}
+		results.SetIndex(i, result)
+	}
+	return results
+}
+
+func evalWatch(name string, expr string, env starlark.StringDict) (starlark.Value, error) {
+	thread := &starlark.Thread{
+		Name:  name + " watch",
+		Print: func(*starlark.Thread, string) {},
+	}
+	thread.SetMaxExecutionSteps(watchStepLimit)
+	return starlark.EvalOptions(&syntax.FileOptions{}, thread, "<watch>", expr, env)
+}
+
+// streamWatches passes the results of the watch expressions at a new line
+// to the host's watch callback, as {position, watches}.
+func (d *debugger) streamWatches(thread *starlark.Thread, watches []string) error {
+	watch := hostGlobal().Get("watch")
+	if watch.Type() != js.TypeFunction {
+		return fmt.Errorf("Error: %s.watch is not defined.", hostGlobalName())
+	}
+	pos := thread.CallFrame(0).Pos
+	event := jsObject.New()
+	event.Set("position", printPositionToJSValue(pos))
+	event.Set("watches", evalWatches(thread, watches))
+	err := d.exec.audited("watch", func() string { return pos.String() }, func() error {
+		_, err := invokeHost(watch, d.exec.tag(event), d.exec.id)
+		return err
+	})
+	if err != nil {
+		return d.exec.hostFailure("watch", err)
+	}
+	return nil
+}
+
+// setWatches replaces the watch expressions of a running execution in debug
+// mode, reporting whether there was one.
+func setWatches(executionId string, watches []string) bool {
+	debuggers.mu.Lock()
+	d := debuggers.byId[executionId]
+	debuggers.mu.Unlock()
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.watches = watches
+	return true
+}
+
+// jsSetWatches implements starlark.setWatches(executionId, expressions),
+// which replaces the watch expressions of a run in debug mode while it runs,
+// returning whether it is running.
+func jsSetWatches() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 2 || args[0].Type() != js.TypeString {
+			return jsErrorConstructor.New("Error: requires an executionId and expressions as arguments.")
+		}
+		watches := parseWatches(args[1])
+		if watches == nil {
+			return jsErrorConstructor.New("Error: expressions must be an array.")
+		}
+		return setWatches(args[0].String(), watches)
+	})
+}
@@ -0,0 +1,203 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall/js"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// The memory watermarks are the fractions of a memory budget at which the
+// host is told, with a memoryWatermark event, that a run, or the instance,
+// is using more of it, so that it can warn the user, or cancel runs that
+// can wait, before the budget, or the wasm module's memory, runs out. An
+// execution's budget is its maxTotalSize option, and the instance's the
+// heap size the host gives setMemoryBudget.
+
+// defaultWatermarks are the levels of a run without the memoryWatermarks
+// option.
+var defaultWatermarks = []float64{0.7, 0.9}
+
+// The scopes of memoryWatermark events.
+const (
+	watermarkExecution = "execution"
+	watermarkInstance  = "instance"
+)
+
+// memorySampleInterval is how often the heap is measured against the
+// instance's budget, while a run is executing.
+const memorySampleInterval = 100 * time.Millisecond
+
+// instanceMemory is the instance's memory budget, in bytes of heap in use,
+// and its levels, and how many of them the heap had crossed when it was
+// last measured.
+var instanceMemory = struct {
+	mu        sync.Mutex
+	limit     atomic.Uint64
+	levels    []float64
+	crossed   int
+	sampledAt time.Time
+}{}
+
+// parseWatermarks reads levels given as an array of fractions of a budget,
+// between 0 and 1, sorting them and leaving out anything else.
+func parseWatermarks(value js.Value) []float64 {
+	if value.Type() != js.TypeObject || !value.InstanceOf(jsArray) {
+		return nil
+	}
+	levels := make([]float64, 0, value.Length())
+	for i := 0; i < value.Length(); i++ {
+		if level := value.Index(i); level.Type() == js.TypeNumber && level.Float() > 0 && level.Float() <= 1 {
+			levels = append(levels, level.Float())
+		}
+	}
+	sort.Float64s(levels)
+	return levels
+}
+
+// levelsCrossed counts the levels that used is at or over, of limit.
+func levelsCrossed(levels []float64, used, limit float64) int {
+	n := 0
+	for n < len(levels) && used >= levels[n]*limit {
+		n++
+	}
+	return n
+}
+
+// checkWatermarks tells the host of each level of the execution's budget
+// that its values have risen to since the last check. A level is told
+// again once they have fallen back under it and risen once more.
+func (e *execution) checkWatermarks(total int) {
+	limit := e.options.maxTotalSize
+	if limit <= 0 {
+		return
+	}
+	levels := e.options.memoryWatermarks
+	if levels == nil {
+		levels = defaultWatermarks
+	}
+	crossed := levelsCrossed(levels, float64(total), float64(limit))
+	for _, level := range levels[min(e.watermarks, crossed):crossed] {
+		e.notifyWatermark(watermarkExecution, level, uint64(total), uint64(limit), nil)
+	}
+	e.watermarks = crossed
+}
+
+// sampleInstanceMemory is the step hook that measures the heap against the
+// instance's budget, if it has one, at most every memorySampleInterval
+// across all threads, telling the host of the levels it has risen to, as
+// checkWatermarks does, through the execution being run.
+func (e *execution) sampleInstanceMemory(*starlark.Thread) {
+	limit := instanceMemory.limit.Load()
+	if limit == 0 {
+		return
+	}
+	now := time.Now()
+	instanceMemory.mu.Lock()
+	if now.Sub(instanceMemory.sampledAt) < memorySampleInterval {
+		instanceMemory.mu.Unlock()
+		return
+	}
+	instanceMemory.sampledAt = now
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	levels := instanceMemory.levels
+	crossed := levelsCrossed(levels, float64(stats.HeapInuse), float64(limit))
+	risen := levels[min(instanceMemory.crossed, crossed):crossed]
+	instanceMemory.crossed = crossed
+	instanceMemory.mu.Unlock()
+	if len(risen) == 0 {
+		return
+	}
+	running := runningExecutionIds()
+	for _, level := range risen {
+		e.notifyWatermark(watermarkInstance, level, stats.HeapInuse, limit, running)
+	}
+}
+
+// notifyWatermark sends a memoryWatermark event, {scope, level, used,
+// limit}, with the executionIds of the runs in progress for the instance.
+func (e *execution) notifyWatermark(scope string, level float64, used, limit uint64, running []string) {
+	e.notify(eventMemoryWatermark, func() js.Value {
+		obj := jsObject.New()
+		obj.Set("scope", scope)
+		obj.Set("level", level)
+		obj.Set("used", float64(used))
+		obj.Set("limit", float64(limit))
+		if running != nil {
+			ids := jsArray.New(len(running))
+			for i, id := range running {
+				ids.SetIndex(i, id)
+			}
+			obj.Set("executions", ids)
+		}
+		return obj
+	})
+}
+
+// runningExecutionIds returns the ids of the executions in progress,
+// sorted.
+func runningExecutionIds() []string {
+	executions.mu.Lock()
+	defer executions.mu.Unlock()
+	ids := make([]string, 0, len(executions.byId))
+	for id := range executions.byId {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// setMemoryBudget sets the instance's budget of heap in use, in bytes, and
+// its levels, the default ones if levels is not an array, or removes the
+// budget when limit is 0.
+func setMemoryBudget(limit float64, levels js.Value) {
+	instanceMemory.mu.Lock()
+	defer instanceMemory.mu.Unlock()
+	instanceMemory.levels = parseWatermarks(levels)
+	if instanceMemory.levels == nil {
+		instanceMemory.levels = defaultWatermarks
+	}
+	instanceMemory.crossed = 0
+	instanceMemory.sampledAt = time.Time{}
+	instanceMemory.limit.Store(uint64(max(limit, 0)))
+}
+
+// jsSetMemoryBudget implements starlark.setMemoryBudget(bytes, levels?),
+// where bytes is null to remove the budget.
+func jsSetMemoryBudget() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 1 || (args[0].Type() != js.TypeNumber && !args[0].IsNull() && !args[0].IsUndefined()) {
+			return jsErrorConstructor.New("Error: requires a number of bytes, or null, as argument.")
+		}
+		limit, levels := 0.0, js.Undefined()
+		if args[0].Type() == js.TypeNumber {
+			limit = args[0].Float()
+		}
+		if len(args) > 1 {
+			levels = args[1]
+		}
+		setMemoryBudget(limit, levels)
+		return nil
+	})
+}
@@ -0,0 +1,545 @@
+//go:build js
+
+// Copyright 2024 David Collien
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"syscall/js"
+)
+
+// The worker protocol runs the wasm module inside a Web Worker, so that
+// scripts never block the main thread. serve listens for messages on a port,
+// by default the worker's global scope, and answers them with messages:
+//
+//	{type: "run", id, executionId, filename, functionName, args, kwargs, maxExecutionTime, options, channel?}
+//	  -> {type: "result", id, value} or {type: "error", id, error}
+//	{type: "request", id, request, channel?}
+//	  -> the same, for a starlark.run request, run under request.id
+//	{type: "loaded", id, source} or {type: "loaded", id, error}
+//	  answers a {type: "load", id, executionId, filename} message, unless
+//	  the worker gives up on it first with {type: "abortLoad", id,
+//	  executionId, reason}, as the run is cancelled
+//	{type: "verified", id, approved} or {type: "verified", id, error}
+//	  answers a {type: "verify", id, executionId, filename, hash} message,
+//	  from a run with the verifyModules option
+//
+// and forwards the host callbacks of runs as messages of the same names:
+// {type: "print", executionId, stream, message, position?}, {type:
+// "printBatch", executionId, lines}, {type: "emit", executionId, value},
+// {type: "trace", executionId, events} and {type: "warn", executionId,
+// warning}. Runs in debug mode also forward
+// {type: "paused", executionId, event} and {type: "watch", executionId,
+// event}, and take
+//
+//	{type: "resume", executionId, command}
+//	{type: "setBreakpoints", executionId, breakpoints}
+//	{type: "setWatches", executionId, watches}
+//	{type: "inspect", id, executionId, request}
+//	  -> {type: "inspected", id, executionId, value} or {..., error}
+//
+// A run with the maxUnackedOutput option takes {type: "ackOutput",
+// executionId, lines}, any run can be cancelled with {type: "cancel",
+// executionId, reason}, and asked for a snapshot of its stack:
+//
+//	{type: "stack", id, executionId}
+//	  -> {type: "snapshot", id, executionId, value} or {..., error}
+//
+// The worker's internal log is switched with {type: "setLogLevel", level}, and
+// written to its own console, or to a starlark.log the worker defines. The
+// messages of a locale are added with {type: "setMessages", locale,
+// messages}. Events are forwarded once subscribed to with {type: "on",
+// event}, until {type: "off", event}, as {type: "event", executionId,
+// event}.
+//
+// Every message the worker posts carries its instanceId, beginning with
+// {type: "ready", instanceId}, posted once it is serving, and it measures
+// itself, and reports what it was built with, on request:
+//
+//	{type: "usage", id} -> {type: "usage", id, value}
+//	{type: "capabilities", id} -> {type: "capabilities", id, value}
+//	{type: "metrics", id} -> {type: "metrics", id, value}
+//
+// and hands back the kept outcome of a run with the retainResult option:
+//
+//	{type: "storedResult", id, executionId} -> {type: "storedResult", id, value}
+//
+// Its tenants' quotas are set with {type: "setQuota", tenant, limits} and
+// {type: "resetQuota", tenant}, and read with
+//
+//	{type: "quota", id, tenant} -> {type: "quota", id, value}
+//
+// Its memory budget is set with {type: "setMemoryBudget", bytes,
+// levels?}, with bytes null to remove it.
+//
+// It is reset, as by starlark.reset, with
+//
+//	{type: "reset", id} -> {type: "reset", id, value}
+//
+// and its module cache is cleared, as by starlark.clearCache, with
+//
+//	{type: "clearCache", id, filename?} -> {type: "clearCache", id, value}
+//
+// The number of runs it runs at once is limited with {type:
+// "setConcurrency", limit}, and those running and waiting are listed with
+//
+//	{type: "listExecutions", id} -> {type: "listExecutions", id, value}
+//
+// Any message may also be sent as {id, cmd, payload}, where cmd is the
+// type and payload holds the other fields, as {id: 1, cmd: "run", payload:
+// {filename, functionName, args}}; a run sent so without an executionId is
+// given its id as one.
+//
+// The ids of runs and inspections are chosen by the host, and those of loads
+// by the worker. A run's channel, if it has one, is a SharedArrayBuffer to
+// answer its loads through synchronously; see loadSync.
+
+// workerServer is the state of a port being served.
+type workerServer struct {
+	port js.Value
+
+	mu       sync.Mutex
+	nextLoad int
+	// loads are the resolve and reject functions of the load and verify
+	// promises waiting on the host, by id.
+	loads map[int][2]js.Value
+	// events are the handlers forwarding the events the host subscribed
+	// to, by event.
+	events map[string]js.Func
+}
+
+// jsServe serves the worker protocol on the port passed, or on the global
+// scope.
+func jsServe() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		port := js.Global()
+		if len(args) > 0 && args[0].Type() == js.TypeObject {
+			port = args[0]
+		}
+		s := &workerServer{port: port, loads: make(map[int][2]js.Value), events: make(map[string]js.Func)}
+		s.installCallbacks(hostGlobal())
+		port.Call("addEventListener", "message", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			s.receive(args[0].Get("data"))
+			return nil
+		}))
+		s.post("ready", map[string]interface{}{})
+		return nil
+	})
+}
+
+// post sends a message of the given type to the host.
+func (s *workerServer) post(msgType string, fields map[string]interface{}) error {
+	msg := jsObject.New()
+	msg.Set("type", msgType)
+	msg.Set("instanceId", instanceId)
+	for key, value := range fields {
+		msg.Set(key, value)
+	}
+	_, err := invokeHost(s.port.Get("postMessage").Call("bind", s.port), msg)
+	return err
+}
+
+// installCallbacks replaces the host callbacks of globalThis.starlark with ones
+// that forward to the host as messages.
+func (s *workerServer) installCallbacks(starlarkObj js.Value) {
+	forward := func(msgType string, names ...string) js.Func {
+		return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			fields := make(map[string]interface{})
+			for i, name := range names {
+				if i < len(args) && !args[i].IsUndefined() {
+					fields[name] = args[i]
+				}
+			}
+			return s.post(msgType, fields) == nil
+		})
+	}
+	printTo := func(stream string) js.Func {
+		return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			fields := map[string]interface{}{"stream": stream, "message": args[0], "executionId": args[1]}
+			if len(args) > 2 {
+				fields["position"] = args[2]
+			}
+			return s.post("print", fields) == nil
+		})
+	}
+
+	starlarkObj.Set("load", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		filename, executionId := args[0], args[1]
+		signal := js.Undefined()
+		if len(args) > 2 && args[2].Type() == js.TypeObject {
+			signal = args[2]
+		}
+		return jsPromise.New(js.FuncOf(func(this js.Value, promiseArgs []js.Value) interface{} {
+			id := s.newLoadId()
+			s.mu.Lock()
+			s.loads[id] = [2]js.Value{promiseArgs[0], promiseArgs[1]}
+			s.mu.Unlock()
+			if !signal.IsUndefined() {
+				if signal.Get("aborted").Bool() {
+					s.settleLoad(id, js.Undefined(), js.Global().Call("String", signal.Get("reason")).String())
+					return nil
+				}
+				s.abortLoadOnSignal(id, executionId, signal)
+			}
+			if err := s.post("load", map[string]interface{}{"id": id, "executionId": executionId, "filename": filename}); err != nil {
+				s.settleLoad(id, js.Undefined(), err.Error())
+			}
+			return nil
+		}))
+	}))
+	starlarkObj.Set("verify", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		filename, hash, executionId := args[0], args[1], args[2]
+		return jsPromise.New(js.FuncOf(func(this js.Value, promiseArgs []js.Value) interface{} {
+			id := s.newLoadId()
+			s.mu.Lock()
+			s.loads[id] = [2]js.Value{promiseArgs[0], promiseArgs[1]}
+			s.mu.Unlock()
+			if err := s.post("verify", map[string]interface{}{"id": id, "executionId": executionId, "filename": filename, "hash": hash}); err != nil {
+				s.settleLoad(id, js.Undefined(), err.Error())
+			}
+			return nil
+		}))
+	}))
+	starlarkObj.Set("print", printTo("stdout"))
+	starlarkObj.Set("printError", printTo("stderr"))
+	starlarkObj.Set("printBatch", forward("printBatch", "lines", "executionId"))
+	starlarkObj.Set("emit", forward("emit", "value", "executionId"))
+	starlarkObj.Set("chunk", forward("chunk", "chunk", "executionId"))
+	starlarkObj.Set("paused", forward("paused", "event", "executionId"))
+	starlarkObj.Set("watch", forward("watch", "event", "executionId"))
+	starlarkObj.Set("trace", forward("trace", "events", "executionId"))
+	starlarkObj.Set("warn", forward("warn", "warning", "executionId"))
+}
+
+// newLoadId returns the id of a new load or verify message.
+func (s *workerServer) newLoadId() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextLoad++
+	return s.nextLoad
+}
+
+// abortLoadOnSignal makes the load with the given id fail once the signal
+// aborts, if it is still waiting, and tells the host to abort its loader with
+// an abortLoad message. The signal of an execution with loads always aborts,
+// once the execution is over if not before, which releases the listener.
+func (s *workerServer) abortLoadOnSignal(id int, executionId js.Value, signal js.Value) {
+	var onAbort js.Func
+	onAbort = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		defer onAbort.Release()
+		s.mu.Lock()
+		_, waiting := s.loads[id]
+		s.mu.Unlock()
+		if !waiting {
+			return nil
+		}
+		reason := js.Global().Call("String", signal.Get("reason")).String()
+		s.post("abortLoad", map[string]interface{}{"id": id, "executionId": executionId, "reason": reason})
+		s.settleLoad(id, js.Undefined(), reason)
+		return nil
+	})
+	options := jsObject.New()
+	options.Set("once", true)
+	signal.Call("addEventListener", "abort", onAbort, options)
+}
+
+// settleLoad resolves the load promise with the given id with source, or
+// rejects it if errMessage is set.
+func (s *workerServer) settleLoad(id int, source js.Value, errMessage string) {
+	s.mu.Lock()
+	load, ok := s.loads[id]
+	delete(s.loads, id)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	if errMessage != "" {
+		load[1].Invoke(jsErrorConstructor.New(errMessage))
+		return
+	}
+	load[0].Invoke(source)
+}
+
+// inspect answers an inspect message with the variables it asks for.
+func (s *workerServer) inspect(msg js.Value) {
+	executionId := msg.Get("executionId").String()
+	fields := map[string]interface{}{"id": msg.Get("id"), "executionId": executionId}
+	req, err := parseInspectRequest(msg.Get("request"))
+	if err == nil {
+		fields["value"], err = inspectExecution(executionId, req)
+	}
+	if err != nil {
+		delete(fields, "value")
+		fields["error"] = errorToJSValue(err)
+	}
+	s.post("inspected", fields)
+}
+
+// stack answers a stack message with a snapshot of the run's stack, once it
+// is taken.
+func (s *workerServer) stack(msg js.Value) {
+	executionId := msg.Get("executionId").String()
+	fields := map[string]interface{}{"id": msg.Get("id"), "executionId": executionId}
+	e := runningExecution(executionId)
+	if e == nil {
+		fields["error"] = errorToJSValue(fmt.Errorf("Error: no execution %q is running.", executionId))
+		s.post("snapshot", fields)
+		return
+	}
+	go func() {
+		fields["value"] = e.captureStack()
+		s.post("snapshot", fields)
+	}()
+}
+
+// fromCommand rewrites a message in the {id, cmd, payload} form into the
+// fields of the protocol above: payload's, with cmd as the type. A run that
+// names no executionId takes its id, so that what it forwards is tagged
+// with the id too.
+func fromCommand(msg js.Value) js.Value {
+	fields := jsObject.Call("assign", jsObject.New(), msg.Get("payload"))
+	fields.Set("type", msg.Get("cmd"))
+	fields.Set("id", msg.Get("id"))
+	if fields.Get("type").String() == "run" && fields.Get("executionId").Type() != js.TypeString {
+		fields.Set("executionId", js.Global().Call("String", msg.Get("id")))
+	}
+	return fields
+}
+
+// receive handles a message from the host. Unknown messages are ignored, as
+// the port may be shared with other traffic.
+func (s *workerServer) receive(msg js.Value) {
+	if msg.Type() == js.TypeObject && msg.Get("type").IsUndefined() && msg.Get("cmd").Type() == js.TypeString {
+		msg = fromCommand(msg)
+	}
+	if msg.Type() != js.TypeObject || msg.Get("type").Type() != js.TypeString {
+		return
+	}
+	switch msg.Get("type").String() {
+	case "run":
+		s.run(msg)
+	case "request":
+		s.request(msg)
+	case "loaded":
+		errMessage := ""
+		if jsErr := msg.Get("error"); !jsErr.IsUndefined() && !jsErr.IsNull() {
+			errMessage = jsErr.String()
+		}
+		s.settleLoad(msg.Get("id").Int(), msg.Get("source"), errMessage)
+	case "verified":
+		errMessage := ""
+		if jsErr := msg.Get("error"); !jsErr.IsUndefined() && !jsErr.IsNull() {
+			errMessage = jsErr.String()
+		}
+		s.settleLoad(msg.Get("id").Int(), msg.Get("approved"), errMessage)
+	case "resume":
+		command := debugContinue
+		if msg.Get("command").Type() == js.TypeString {
+			command = msg.Get("command").String()
+		}
+		resumeExecution(msg.Get("executionId").String(), command)
+	case "ackOutput":
+		lines := 1
+		if msg.Get("lines").Type() == js.TypeNumber {
+			lines = msg.Get("lines").Int()
+		}
+		if e := runningExecution(msg.Get("executionId").String()); e != nil {
+			e.ackOutput(lines)
+		}
+	case "cancel":
+		reason := ""
+		if msg.Get("reason").Type() == js.TypeString {
+			reason = msg.Get("reason").String()
+		}
+		cancelExecution(msg.Get("executionId").String(), reason)
+	case "setBreakpoints":
+		if b := parseBreakpoints(msg.Get("breakpoints")); b != nil {
+			setBreakpoints(msg.Get("executionId").String(), b)
+		}
+	case "setWatches":
+		if watches := parseWatches(msg.Get("watches")); watches != nil {
+			setWatches(msg.Get("executionId").String(), watches)
+		}
+	case "inspect":
+		s.inspect(msg)
+	case "stack":
+		s.stack(msg)
+	case "usage":
+		s.post("usage", map[string]interface{}{"id": msg.Get("id"), "value": usageToJSValue()})
+	case "capabilities":
+		s.post("capabilities", map[string]interface{}{"id": msg.Get("id"), "value": capabilitiesToJSValue()})
+	case "metrics":
+		s.post("metrics", map[string]interface{}{"id": msg.Get("id"), "value": metricsText()})
+	case "clearCache":
+		var dropped int
+		if filename := msg.Get("filename"); filename.Type() == js.TypeString {
+			dropped = dropCachedModule(filename.String())
+		} else {
+			dropped = clearModuleCache()
+		}
+		s.post("clearCache", map[string]interface{}{"id": msg.Get("id"), "value": dropped})
+	case "setConcurrency":
+		limit := 0
+		if value := msg.Get("limit"); value.Type() == js.TypeNumber {
+			limit = value.Int()
+		}
+		setConcurrency(limit)
+	case "listExecutions":
+		s.post("listExecutions", map[string]interface{}{"id": msg.Get("id"), "value": executionsToJSValue()})
+	case "setQuota":
+		if msg.Get("tenant").Type() == js.TypeString {
+			setQuota(msg.Get("tenant").String(), msg.Get("limits"))
+		}
+	case "resetQuota":
+		if msg.Get("tenant").Type() == js.TypeString {
+			resetQuota(msg.Get("tenant").String())
+		}
+	case "setMemoryBudget":
+		limit := 0.0
+		if bytes := msg.Get("bytes"); bytes.Type() == js.TypeNumber {
+			limit = bytes.Float()
+		}
+		setMemoryBudget(limit, msg.Get("levels"))
+	case "reset":
+		id := msg.Get("id")
+		go func() {
+			s.post("reset", map[string]interface{}{"id": id, "value": resetInstance().toJSValue()})
+		}()
+	case "quota":
+		s.post("quota", map[string]interface{}{"id": msg.Get("id"), "value": quotaToJSValue(msg.Get("tenant").String())})
+	case "storedResult":
+		s.post("storedResult", map[string]interface{}{"id": msg.Get("id"), "value": storedResultToJSValue(msg.Get("executionId").String())})
+	case "setLogLevel":
+		if msg.Get("level").Type() == js.TypeString {
+			if level, err := parseLogLevel(msg.Get("level").String()); err == nil {
+				setLogLevel(level)
+			}
+		}
+	case "setMessages":
+		if msg.Get("locale").Type() == js.TypeString && msg.Get("messages").Type() == js.TypeObject {
+			setMessages(msg.Get("locale").String(), msg.Get("messages"))
+		}
+	case "on":
+		if msg.Get("event").Type() == js.TypeString {
+			s.forwardEvent(msg.Get("event").String())
+		}
+	case "off":
+		if msg.Get("event").Type() == js.TypeString {
+			s.stopForwardingEvent(msg.Get("event").String())
+		}
+	}
+}
+
+// forwardEvent subscribes to an event, posting each as an event message.
+func (s *workerServer) forwardEvent(event string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.events[event]; ok {
+		return
+	}
+	handler := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		s.post("event", map[string]interface{}{"executionId": args[1], "event": args[0]})
+		return nil
+	})
+	if err := subscribe(event, handler.Value); err != nil {
+		handler.Release()
+		logf(logWarn, logInit, "%s", err)
+		return
+	}
+	s.events[event] = handler
+}
+
+// stopForwardingEvent unsubscribes from an event forwardEvent subscribed to.
+func (s *workerServer) stopForwardingEvent(event string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if handler, ok := s.events[event]; ok {
+		unsubscribe(event, handler.Value)
+		delete(s.events, event)
+		handler.Release()
+	}
+}
+
+// run starts the run a message asks for, and posts its outcome when it
+// settles.
+func (s *workerServer) run(msg js.Value) {
+	id := msg.Get("id")
+	executionId := msg.Get("executionId").String()
+	if channel := msg.Get("channel"); channel.Type() == js.TypeObject {
+		setSyncChannel(executionId, syncChannel{server: s, buffer: channel})
+	}
+
+	// Lazy results are proxies, which cannot be posted, and nor can the
+	// handle of the iterate option; emitted values are posted as they are.
+	options := jsObject.Call("assign", jsObject.New(), msg.Get("options"))
+	options.Set("lazy", false)
+	options.Set("iterate", false)
+
+	promise := hostGlobal().Get("wasm_runner").Invoke(
+		msg.Get("executionId"),
+		msg.Get("filename"),
+		msg.Get("functionName"),
+		msg.Get("args"),
+		msg.Get("kwargs"),
+		msg.Get("maxExecutionTime"),
+		options,
+	)
+	s.answer(id, executionId, promise)
+}
+
+// request starts the starlark.run request a message carries, as run does.
+func (s *workerServer) request(msg js.Value) {
+	id := msg.Get("id")
+	request := jsObject.Call("assign", jsObject.New(), msg.Get("request"))
+	if request.Get("id").Type() != js.TypeString {
+		request.Set("id", js.Global().Call("String", id))
+	}
+	executionId := request.Get("id").String()
+	if channel := msg.Get("channel"); channel.Type() == js.TypeObject {
+		setSyncChannel(executionId, syncChannel{server: s, buffer: channel})
+	}
+	options := jsObject.Call("assign", jsObject.New(), request.Get("options"))
+	options.Set("lazy", false)
+	request.Set("options", options)
+	s.answer(id, executionId, hostGlobal().Get("run").Invoke(request))
+}
+
+// answer posts the outcome of the run with the given ids when its promise
+// settles.
+func (s *workerServer) answer(id js.Value, executionId string, promise js.Value) {
+	var onResult, onError js.Func
+	settle := func(msgType string, key string, value js.Value) {
+		onResult.Release()
+		onError.Release()
+		deleteSyncChannel(executionId)
+		if err := s.post(msgType, map[string]interface{}{"id": id, key: value}); err != nil {
+			// The result could not be copied to the host.
+			reply := errorToJSValue(fmt.Errorf("Error: unable to post the result. %s", err))
+			reply.Set("executionId", executionId)
+			s.post("error", map[string]interface{}{"id": id, "error": reply})
+		}
+	}
+	onResult = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		settle("result", "value", args[0])
+		return nil
+	})
+	onError = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		settle("error", "error", args[0])
+		return nil
+	})
+	promise.Call("then", onResult, onError)
+}
@@ -0,0 +1,48 @@
+import type { LoadedModule, PersistentCache } from "./types.js";
+
+// A PersistentCache in an IndexedDB object store, which keeps what the
+// runner compiles across page loads, for pages and workers alike. A
+// database of its own is opened on first use, named "starlark-cache" unless
+// given another name.
+export class IndexedDBCache implements PersistentCache {
+  private name: string;
+  private store = "entries";
+  private db?: Promise<IDBDatabase>;
+
+  constructor(name = "starlark-cache") {
+    this.name = name;
+  }
+
+  async get(key: string): Promise<unknown> {
+    const request = (await this.transaction("readonly")).get(key);
+    return completed(request);
+  }
+
+  async put(key: string, value: Uint8Array | LoadedModule): Promise<void> {
+    const request = (await this.transaction("readwrite")).put(value, key);
+    await completed(request);
+  }
+
+  // Drop everything kept, such as after deploying a new build of the
+  // runner, whose programs would not decode anyway.
+  async clear(): Promise<void> {
+    const request = (await this.transaction("readwrite")).clear();
+    await completed(request);
+  }
+
+  private async transaction(mode: IDBTransactionMode): Promise<IDBObjectStore> {
+    this.db ??= new Promise((resolve, reject) => {
+      const request = indexedDB.open(this.name, 1);
+      request.onupgradeneeded = () => request.result.createObjectStore(this.store);
+      request.onsuccess = () => resolve(request.result);
+      request.onerror = () => reject(request.error);
+    });
+    return (await this.db).transaction(this.store, mode).objectStore(this.store);
+  }
+}
+
+const completed = <T>(request: IDBRequest<T>): Promise<T> =>
+  new Promise((resolve, reject) => {
+    request.onsuccess = () => resolve(request.result);
+    request.onerror = () => reject(request.error);
+  });
@@ -0,0 +1,310 @@
+import type { Starlark } from "./index.js";
+import type {
+  Breakpoint,
+  DebugCommand,
+  InspectRequest,
+  PausedEvent,
+  StarlarkCompatibleValue,
+  StarlarkConfig,
+  StarlarkKwargs,
+} from "./types.js";
+
+// A message of the Debug Adapter Protocol: a request from the editor, or a
+// response or event from the session.
+export interface DebugProtocolMessage {
+  seq: number;
+  type: "request" | "response" | "event";
+  [key: string]: any;
+}
+
+// The arguments of a launch request: the function to call and what with.
+export interface DebugLaunchArguments {
+  program: string;
+  function?: string;
+  args?: StarlarkCompatibleValue[];
+  kwargs?: StarlarkKwargs;
+  maxExecutionTime?: number;
+}
+
+// Scripts run on a single thread, as far as the editor can tell.
+const threadId = 1;
+
+// The requests that resume a paused execution, and the command each sends.
+const resumeCommands: { [request: string]: DebugCommand } = {
+  continue: "continue",
+  next: "next",
+  stepIn: "stepIn",
+  stepOut: "stepOut",
+};
+
+// Drives a Starlark run from an editor's debug UI, over the Debug Adapter
+// Protocol: feed it the editor's requests with handle, and it answers them,
+// and reports stops, output and the end of the run, through send.
+//
+// It supports breakpoints on lines, stepping, and the call stack with each
+// frame's locals, which are shown as their repr. The script runs on the
+// Starlark instance create returns for the config, to which the session adds
+// its own print, printError, onPaused and breakpoints.
+export class StarlarkDebugSession {
+  private config: StarlarkConfig;
+  private send: (message: DebugProtocolMessage) => void;
+  private create: (config: StarlarkConfig) => Starlark;
+  private seq = 1;
+  private starlark?: Starlark;
+  private breakpoints: { [filename: string]: Breakpoint[] } = {};
+  private launch?: DebugLaunchArguments;
+  private configured = false;
+  private stopping = false;
+  private paused?: { executionId: string; event: PausedEvent };
+  // What each variablesReference of the current pause lists, numbered from
+  // 1. They only last until the execution resumes.
+  private references: InspectRequest[] = [];
+
+  constructor(
+    config: StarlarkConfig,
+    send: (message: DebugProtocolMessage) => void,
+    create: (config: StarlarkConfig) => Starlark
+  ) {
+    this.config = config;
+    this.send = send;
+    this.create = create;
+  }
+
+  // Handle a request from the editor.
+  async handle(request: DebugProtocolMessage) {
+    const args = request.arguments || {};
+    try {
+      const body = await this.dispatch(request.command, args);
+      this.respond(request, true, body);
+    } catch (e) {
+      this.respond(request, false, undefined, String(e));
+    }
+    if (request.command === "initialize") {
+      this.event("initialized");
+    }
+  }
+
+  private async dispatch(command: string, args: any): Promise<object | undefined> {
+    if (command in resumeCommands) {
+      this.resume(resumeCommands[command]);
+      return command === "continue" ? { allThreadsContinued: true } : undefined;
+    }
+    switch (command) {
+      case "initialize":
+        return {
+          supportsConfigurationDoneRequest: true,
+          supportsTerminateRequest: true,
+        };
+      case "setBreakpoints":
+        return this.setBreakpoints(args.source.path, args.breakpoints || []);
+      case "launch":
+        this.launch = args;
+        this.start();
+        return;
+      case "configurationDone":
+        this.configured = true;
+        this.start();
+        return;
+      case "threads":
+        return { threads: [{ id: threadId, name: "main" }] };
+      case "stackTrace":
+        return this.stackTrace();
+      case "scopes":
+        return this.scopes(args.frameId);
+      case "variables":
+        return this.variables(args.variablesReference, args.start, args.count);
+      case "disconnect":
+      case "terminate":
+        this.stop();
+        return;
+    }
+    throw new Error("Unsupported request: " + command);
+  }
+
+  private setBreakpoints(filename: string, lines: { line: number }[]) {
+    this.breakpoints[filename] = lines.map(({ line }) => ({ filename, line }));
+    this.starlark?.setBreakpoints(this.allBreakpoints());
+    // Starlark cannot tell which lines have code: a breakpoint on a line
+    // without any pauses at the next one that does.
+    return {
+      breakpoints: lines.map(({ line }) => ({ verified: true, line })),
+    };
+  }
+
+  private allBreakpoints(): Breakpoint[] {
+    return Object.values(this.breakpoints).flat();
+  }
+
+  // Run the program once it is both launched and configured.
+  private start() {
+    const launch = this.launch;
+    if (!launch || !this.configured || this.starlark) {
+      return;
+    }
+    this.starlark = this.create({
+      ...this.config,
+      print: (message) => this.output("stdout", message),
+      printError: (message) => this.output("stderr", message),
+      breakpoints: this.allBreakpoints(),
+      onPaused: (event, executionId) => this.onPaused(event, executionId),
+    });
+    this.starlark
+      .run(
+        launch.program,
+        launch.function,
+        launch.args,
+        launch.kwargs,
+        launch.maxExecutionTime
+      )
+      .then(
+        () => this.event("exited", { exitCode: 0 }),
+        (error) => {
+          if (!this.stopping) {
+            this.output("stderr", error.message ?? String(error));
+          }
+          this.event("exited", { exitCode: 1 });
+        }
+      )
+      .finally(() => {
+        this.paused = undefined;
+        this.event("terminated");
+      });
+  }
+
+  private onPaused(event: PausedEvent, executionId: string) {
+    this.paused = { executionId, event };
+    if (this.stopping) {
+      this.resume("stop");
+      return;
+    }
+    this.event("stopped", {
+      reason: event.reason,
+      threadId,
+      allThreadsStopped: true,
+    });
+  }
+
+  // A run can only be cancelled while paused, so one asked to stop while
+  // running stops at its next pause.
+  private stop() {
+    this.stopping = true;
+    if (this.paused) {
+      this.resume("stop");
+    }
+  }
+
+  private resume(command: DebugCommand) {
+    const paused = this.paused;
+    if (!paused || !this.starlark) {
+      throw new Error("Not paused");
+    }
+    this.paused = undefined;
+    this.references = [];
+    this.starlark.resume(paused.executionId, command);
+  }
+
+  // The frames of the paused execution, innermost first as the protocol
+  // has them, numbered from 1.
+  private stackTrace() {
+    const backtrace = this.pausedEvent().backtrace;
+    const frames = backtrace
+      .map((frame, i) => ({
+        id: i + 1,
+        name: frame.name,
+        source: { name: frame.position.filename, path: frame.position.filename },
+        line: frame.position.line,
+        column: frame.position.column,
+      }))
+      .reverse();
+    return { stackFrames: frames, totalFrames: frames.length };
+  }
+
+  private scopes(frameId: number) {
+    const frame = frameId - 1;
+    if (!this.pausedEvent().backtrace[frame]) {
+      throw new Error("Unknown frame: " + frameId);
+    }
+    return {
+      scopes: [
+        {
+          name: "Locals",
+          variablesReference: this.reference({ frame, scope: "locals" }),
+          expensive: false,
+        },
+        {
+          name: "Globals",
+          variablesReference: this.reference({ frame, scope: "globals" }),
+          expensive: true,
+        },
+      ],
+    };
+  }
+
+  // List the variables of a reference, giving those with elements
+  // references of their own, so that the editor can expand them.
+  private async variables(reference: number, start?: number, count?: number) {
+    const request = this.references[reference - 1];
+    if (!request || !this.paused || !this.starlark) {
+      throw new Error("Unknown variables reference: " + reference);
+    }
+    const { variables } = await this.starlark.inspect(this.paused.executionId, {
+      ...request,
+      start,
+      count,
+    });
+    return {
+      variables: variables.map((variable, i) => {
+        const path = request.path
+          ? [...request.path, (start || 0) + i]
+          : [variable.name];
+        return {
+          name: variable.name,
+          value: variable.value,
+          type: variable.type,
+          variablesReference:
+            variable.elements === undefined
+              ? 0
+              : this.reference({ ...request, path: path as InspectRequest["path"] }),
+          indexedVariables: variable.elements,
+        };
+      }),
+    };
+  }
+
+  private reference(request: InspectRequest): number {
+    this.references.push(request);
+    return this.references.length;
+  }
+
+  private pausedEvent(): PausedEvent {
+    if (!this.paused) {
+      throw new Error("Not paused");
+    }
+    return this.paused.event;
+  }
+
+  private output(category: "stdout" | "stderr", message: string) {
+    this.event("output", { category, output: message + "\n" });
+  }
+
+  private respond(
+    request: DebugProtocolMessage,
+    success: boolean,
+    body?: object,
+    message?: string
+  ) {
+    this.send({
+      seq: this.seq++,
+      type: "response",
+      request_seq: request.seq,
+      command: request.command,
+      success,
+      body,
+      message,
+    });
+  }
+
+  private event(event: string, body?: object) {
+    this.send({ seq: this.seq++, type: "event", event, body });
+  }
+}
@@ -1,96 +1,1978 @@
 import {
+  AnalysisResult,
+  BenchmarkResult,
+  BenchmarkSpec,
+  Breakpoint,
+  CacheStats,
+  ChunkFn,
+  CompletionResult,
+  DebugCommand,
+  DetailsOptions,
+  DisassembledProgram,
+  EmitFn,
+  GoldenResult,
+  GoldenSpec,
+  GradeResult,
+  GradeSpec,
+  HostApi,
+  HostSupport,
+  InitOptions,
+  InstanceUsage,
+  Capabilities,
+  MessageCatalog,
+  InspectRequest,
+  InspectResult,
+  StackSnapshot,
   StarlarkInterface,
   StarlarkCompatibleDict,
   StarlarkCompatibleValue,
   StarlarkConfig,
   StarlarkGlobal,
+  StarlarkKwargs,
+  StarlarkResult,
+  StarlarkRunError,
+  StoredResult,
+  Quota,
+  QuotaLimits,
+  RenderDiffResult,
+  RenderDiffSpec,
+  RenderResult,
+  RenderSpec,
+  ResetResult,
+  ResolveFn,
+  WasmSource,
+  WorkerMessage,
+  WorkerPort,
+  LintFinding,
+  LoadedModule,
+  ModuleSource,
+  SourceChunks,
+  LogFn,
+  LogLevel,
   Loader,
+  PrecompileResult,
   PrintFn,
+  RunOptions,
+  RunRequest,
+  RunSyncOptions,
+  RunnerEventHandler,
+  RunnerEventName,
+  SessionPolicy,
+  StarlarkSession,
+  ExecutionInfo,
+  StarlarkIteration,
+  SettledResult,
+  SemanticToken,
+  SignatureHelp,
+  SourceEdit,
+  SourcePosition,
+  PausedFn,
+  TraceFn,
+  VerifyFn,
+  WatchFn,
+  WarningFn,
 } from "./types.js";
 
+import { decodeValue, encodeArgs, encodeKwargs } from "./msgpack.js";
 import "./wasm_exec.js";
 
+export type * from "./types.js";
+export { IndexedDBCache } from "./cache.js";
+export { StarlarkDebugSession } from "./debug.js";
+export type { DebugLaunchArguments, DebugProtocolMessage } from "./debug.js";
+
 const starlark: StarlarkGlobal = {
-  load: async (filename, executionId) => {
+  load: async (filename, executionId, signal) => {
     if (!starlark._executions[executionId]) {
       throw new Error("Unable to load. No execution found: " + executionId);
     }
-    return await starlark._executions[executionId].load(filename, executionId);
+    return await starlark._executions[executionId].load(filename, executionId, signal);
+  },
+  resolve: (names, executionId) => {
+    const resolve = starlark._executions[executionId]?.resolve;
+    if (!resolve) {
+      throw new Error("Unable to resolve. No resolver for execution: " + executionId);
+    }
+    return resolve(names, executionId);
+  },
+  verify: (filename, hash, executionId) => {
+    const verify = starlark._executions[executionId]?.verify;
+    if (!verify) {
+      throw new Error("Unable to verify. No verifier for execution: " + executionId);
+    }
+    return verify(filename, hash, executionId);
   },
-  print: (message, executionId) => {
+  print: (message, executionId, position) => {
     if (!starlark._executions[executionId]) {
       throw new Error("Unable to print. No execution found: " + executionId);
     }
-    starlark._executions[executionId].print(message, executionId);
+    starlark._executions[executionId].print(message, executionId, position);
+  },
+  printError: (message, executionId, position) => {
+    if (!starlark._executions[executionId]) {
+      throw new Error("Unable to print. No execution found: " + executionId);
+    }
+    starlark._executions[executionId].printError(
+      message,
+      executionId,
+      position
+    );
+  },
+  printBatch: (lines, executionId) => {
+    const execution = starlark._executions[executionId];
+    if (!execution) {
+      throw new Error("Unable to print. No execution found: " + executionId);
+    }
+    for (const line of lines) {
+      if (line.stream === "stderr") {
+        execution.printError(line.message, executionId, line.position);
+      } else {
+        execution.print(line.message, executionId, line.position);
+      }
+    }
+  },
+  emit: (value, executionId) => {
+    const onEmit = starlark._executions[executionId]?.onEmit;
+    if (onEmit) {
+      onEmit(value, executionId);
+    }
+  },
+  chunk: (chunk, executionId) => {
+    const execution = starlark._executions[executionId];
+    if (!execution?.chunk) {
+      throw new Error("Unable to stream. No execution found: " + executionId);
+    }
+    return execution.chunk(chunk, executionId);
+  },
+  paused: (event, executionId) => {
+    const onPaused = starlark._executions[executionId]?.onPaused;
+    if (!onPaused) {
+      throw new Error("Unable to pause. No onPaused callback for execution: " + executionId);
+    }
+    onPaused(event, executionId);
+  },
+  watch: (event, executionId) => {
+    const onWatch = starlark._executions[executionId]?.onWatch;
+    if (onWatch) {
+      onWatch(event, executionId);
+    }
+  },
+  trace: (events, executionId) => {
+    const onTrace = starlark._executions[executionId]?.onTrace;
+    if (onTrace) {
+      onTrace(events, executionId);
+    }
+  },
+  warn: (warning, executionId) => {
+    const onWarning = starlark._executions[executionId]?.onWarning;
+    if (onWarning) {
+      onWarning(warning, executionId);
+    }
   },
   _executions: {},
 };
 
-const init = async (wasmUrl: string) => {
-  const global = window as any;
-  global.starlark = starlark;
+// Check which of the optional APIs the runner uses the environment provides.
+// Those it cannot run without, such as crypto.getRandomValues, wasm_exec.js
+// checks for as it is imported.
+const detectHostSupport = (): HostSupport => {
+  const global = globalThis as any;
+  return {
+    fetch: typeof global.fetch === "function",
+    streaming: typeof WebAssembly.instantiateStreaming === "function",
+    sharedMemory:
+      typeof global.SharedArrayBuffer === "function" &&
+      typeof global.Atomics === "object" &&
+      // Node and Deno have no isolation to ask for, and always share memory.
+      (global.crossOriginIsolated ?? true),
+    messageChannel: typeof global.MessageChannel === "function",
+  };
+};
+
+// Instantiate the wasm module from a URL to fetch, a response, its bytes, or
+// a module compiled already.
+const instantiate = async (
+  wasm: WasmSource,
+  importObject: WebAssembly.Imports
+): Promise<WebAssembly.Instance> => {
+  const support = detectHostSupport();
+  if (wasm instanceof WebAssembly.Module) {
+    return WebAssembly.instantiate(wasm, importObject);
+  }
+  const isResponse =
+    typeof Response === "function" && wasm instanceof Response;
+  if (typeof wasm !== "string" && !(wasm instanceof URL) && !isResponse) {
+    return (await WebAssembly.instantiate(wasm as BufferSource, importObject)).instance;
+  }
+  if (!isResponse && !support.fetch) {
+    throw new Error("Unable to fetch the wasm module without fetch. Pass its bytes instead");
+  }
+  const response = isResponse ? (wasm as Response) : await fetch(wasm as string | URL);
+  // Streaming needs the application/wasm content type, which not every
+  // server sends.
+  if (
+    support.streaming &&
+    response.headers.get("Content-Type") === "application/wasm"
+  ) {
+    return (await WebAssembly.instantiateStreaming(response, importObject)).instance;
+  }
+  const bytes = await response.arrayBuffer();
+  return (await WebAssembly.instantiate(bytes, importObject)).instance;
+};
+
+const init = async (wasm: WasmSource, options: InitOptions = {}) => {
+  // globalThis rather than window, which workers and Node do not have.
+  const global = globalThis as any;
+  const namespace = options.namespace || "starlark";
+  // A bridge is handed over under a name only the runner is told, which it
+  // removes as it starts.
+  const handoff = options.bridge ? "starlarkBridge" + newExecutionId() : namespace;
+  global[handoff] = starlark;
+  starlark.logLevel = options.logLevel;
+  starlark.log = options.onLog;
+  hostApi = options.hostApi;
 
-  const go = new global.Go();
-  const wasmModule = await WebAssembly.instantiateStreaming(
-    fetch(wasmUrl),
-    go.importObject
-  );
-  go.run(wasmModule.instance);
+  const go = new (options.Go || global.Go)();
+  // The runner reads its namespace from the environment.
+  go.env = { ...go.env, STARLARK_NAMESPACE: namespace };
+  if (options.bridge) {
+    go.env.STARLARK_BRIDGE = handoff;
+  }
+  if (options.instanceId) {
+    go.env.STARLARK_INSTANCE_ID = options.instanceId;
+  }
+  const cache = options.persistentCache;
+  starlark.cacheGet = cache && ((key) => cache.get(key));
+  starlark.cachePut = cache && ((key, value) => cache.put(key, value));
+  const instance = await instantiate(wasm, go.importObject);
+  go.run(instance);
+  if (options.bridge) {
+    // The runner has taken it by now, unless it failed to start.
+    delete global[handoff];
+  }
 };
 
-const defaultLoad = async (_filename: string, _executionId: string) => {
+const newExecutionId = () => Math.random().toString().slice(2);
+
+// The hostApi given to init, which the instances configured without their
+// own callbacks call.
+let hostApi: HostApi | undefined;
+
+// The signal is not passed on to a hostApi, as it cannot cross a
+// contextBridge.
+const defaultLoad = async (filename: string, executionId: string) => {
+  if (hostApi?.load) {
+    return await hostApi.load(filename, executionId);
+  }
   throw new Error("No loader provided");
 };
 
-const defaultPrint = (message: string, _executionId: string) => {
+const defaultPrint: PrintFn = (message, executionId, position) => {
+  if (hostApi?.print) {
+    hostApi.print(message, executionId, position);
+    return;
+  }
   console.log(message);
 };
 
+const defaultPrintError: PrintFn = (message, executionId, position) => {
+  const print = hostApi?.printError ?? hostApi?.print;
+  if (print) {
+    print(message, executionId, position);
+    return;
+  }
+  console.error(message);
+};
+
 export class Starlark implements StarlarkInterface {
   print: PrintFn;
+  printError: PrintFn;
   load: Loader;
+  verify?: VerifyFn;
+  resolve?: ResolveFn;
+  onEmit?: EmitFn;
+  onWarning?: WarningFn;
+  onPaused?: PausedFn;
+  onTrace?: TraceFn;
+  onWatch?: WatchFn;
+  breakpoints?: Breakpoint[];
+  watch?: string[];
+  watchOn?: StarlarkConfig["watchOn"];
   maxExecutionTime?: StarlarkConfig["maxExecutionTime"];
+  printPositions?: StarlarkConfig["printPositions"];
+  printBatchSize?: StarlarkConfig["printBatchSize"];
+  printFlushInterval?: StarlarkConfig["printFlushInterval"];
+  maxUnackedOutput?: StarlarkConfig["maxUnackedOutput"];
+  captureLocals?: StarlarkConfig["captureLocals"];
+  trace?: StarlarkConfig["trace"];
+  onHostError?: StarlarkConfig["onHostError"];
+  lazy?: StarlarkConfig["lazy"];
+  cacheGlobals?: StarlarkConfig["cacheGlobals"];
+  binary?: StarlarkConfig["binary"];
+  locale?: StarlarkConfig["locale"];
+  maxErrorLength?: StarlarkConfig["maxErrorLength"];
+  maxResultSize?: StarlarkConfig["maxResultSize"];
+  maxValueSize?: StarlarkConfig["maxValueSize"];
+  maxTotalSize?: StarlarkConfig["maxTotalSize"];
+  memoryWatermarks?: StarlarkConfig["memoryWatermarks"];
+  maxModules?: StarlarkConfig["maxModules"];
+  maxSourceSize?: StarlarkConfig["maxSourceSize"];
+  maxCallRate?: StarlarkConfig["maxCallRate"];
+  callBurst?: StarlarkConfig["callBurst"];
+  maxSteps?: StarlarkConfig["maxSteps"];
+  strict?: StarlarkConfig["strict"];
+  extendedTypes?: StarlarkConfig["extendedTypes"];
+  sessionId?: StarlarkConfig["sessionId"];
+  labels?: StarlarkConfig["labels"];
+  retainResult?: StarlarkConfig["retainResult"];
+  allowBuiltins?: StarlarkConfig["allowBuiltins"];
+  printPolicy?: StarlarkConfig["printPolicy"];
+  meter?: StarlarkConfig["meter"];
+  builtins?: StarlarkConfig["builtins"];
+  hostFunctions?: StarlarkConfig["hostFunctions"];
+  dialect?: StarlarkConfig["dialect"];
+  secrets?: StarlarkConfig["secrets"];
+  lockfile?: StarlarkConfig["lockfile"];
+  allowLoads?: StarlarkConfig["allowLoads"];
+  denyLoads?: StarlarkConfig["denyLoads"];
+  share?: StarlarkConfig["share"];
+  priority?: StarlarkConfig["priority"];
+  // The REPL session id made up for an instance without a sessionId.
+  private replSession?: string;
+  // The chunk callbacks of the streams in flight, by execution id.
+  private chunkHandlers: { [executionId: string]: ChunkFn } = {};
+
+  // Load the wasm module, from a URL or a response, or from its bytes or a
+  // compiled module, as Node would read it from a file.
+  static async init(wasm: WasmSource, options?: InitOptions) {
+    await init(wasm, options);
+  }
+
+  // Report which of the APIs Starlark relies on this environment has, so
+  // that a host can fall back, say from syncLoads, rather than fail.
+  static hostSupport(): HostSupport {
+    return detectHostSupport();
+  }
+
+  // Load the wasm module in a Web Worker, and serve the runs of the
+  // StarlarkWorker instances on the other side of port, defaulting to the
+  // worker's own global scope.
+  static async serve(wasm: WasmSource, port?: WorkerPort, options?: InitOptions) {
+    await init(wasm, options);
+    if (!starlark.serve) {
+      throw new Error("Starlark not initialized");
+    }
+    starlark.serve(port);
+  }
 
-  static async init(wasm: string) {
-    await init(wasm);
+  // Check starlark source for common mistakes without running it.
+  static lint(source: string, filename?: string): LintFinding[] {
+    if (!starlark.lint) {
+      throw new Error("Starlark not initialized");
+    }
+    const findings = starlark.lint(source, filename);
+    if (findings instanceof Error) {
+      throw findings;
+    }
+    return findings;
+  }
+
+  // Resolve starlark source without running it, reporting every undefined
+  // name at once. predeclared lists any globals the host provides.
+  static analyze(
+    source: string,
+    filename?: string,
+    predeclared?: string[]
+  ): AnalysisResult {
+    if (!starlark.analyze) {
+      throw new Error("Starlark not initialized");
+    }
+    const result = starlark.analyze(source, filename, predeclared);
+    if (result instanceof Error) {
+      throw result;
+    }
+    return result;
+  }
+
+  // List the identifiers that could be typed at a 1-based line and column
+  // of starlark source, for an editor's autocomplete. predeclared lists any
+  // globals the host provides.
+  static complete(
+    source: string,
+    line: number,
+    column: number,
+    filename?: string,
+    predeclared?: string[]
+  ): CompletionResult {
+    if (!starlark.complete) {
+      throw new Error("Starlark not initialized");
+    }
+    const result = starlark.complete(source, line, column, filename, predeclared);
+    if (result instanceof Error) {
+      throw result;
+    }
+    return result;
+  }
+
+  // Describe the function called by the call whose arguments a 1-based line
+  // and column of starlark source are among, for an editor's parameter
+  // hints, or return null if there is no such call to a function of the file.
+  static signatureHelp(
+    source: string,
+    line: number,
+    column: number,
+    filename?: string
+  ): SignatureHelp | null {
+    if (!starlark.signatureHelp) {
+      throw new Error("Starlark not initialized");
+    }
+    const help = starlark.signatureHelp(source, line, column, filename);
+    if (help instanceof Error) {
+      throw help;
+    }
+    return help;
+  }
+
+  // Work out the edits that rename the name at a position of starlark source
+  // everywhere it is used, in the order they appear.
+  static rename(
+    source: string,
+    position: SourcePosition,
+    newName: string,
+    filename?: string
+  ): SourceEdit[] {
+    if (!starlark.rename) {
+      throw new Error("Starlark not initialized");
+    }
+    const edits = starlark.rename(source, position, newName, filename);
+    if (edits instanceof Error) {
+      throw edits;
+    }
+    return edits;
+  }
+
+  // Split starlark source into tokens classified for highlighting.
+  // predeclared lists any globals the host provides.
+  static tokenize(
+    source: string,
+    filename?: string,
+    predeclared?: string[]
+  ): SemanticToken[] {
+    if (!starlark.tokenize) {
+      throw new Error("Starlark not initialized");
+    }
+    const tokens = starlark.tokenize(source, filename, predeclared);
+    if (tokens instanceof Error) {
+      throw tokens;
+    }
+    return tokens;
+  }
+
+  // Return starlark source in the canonical layout, for format-on-save.
+  static format(source: string, filename?: string): string {
+    if (!starlark.format) {
+      throw new Error("Starlark not initialized");
+    }
+    const formatted = starlark.format(source, filename);
+    if (formatted instanceof Error) {
+      throw formatted;
+    }
+    return formatted;
+  }
+
+  // Run source and return its result, or the value of options.functionName
+  // called on it, without returning to the event loop first: for a Service
+  // Worker's fetch handler, say. Its loads must be answered synchronously.
+  static runSync(
+    source: SourceChunks,
+    options?: RunSyncOptions
+  ): StarlarkCompatibleValue | StarlarkResult {
+    if (!starlark.runSync) {
+      throw new Error("Starlark not initialized");
+    }
+    const outcome = starlark.runSync(source, options);
+    if ("error" in outcome) {
+      throw outcome.error;
+    }
+    return outcome.value;
+  }
+
+  // Compile starlark source without running it, and list the bytecode of
+  // each of its functions.
+  static disassemble(
+    source: string,
+    filename?: string,
+    predeclared?: string[]
+  ): DisassembledProgram {
+    if (!starlark.disassemble) {
+      throw new Error("Starlark not initialized");
+    }
+    const program = starlark.disassemble(source, filename, predeclared);
+    if (program instanceof Error) {
+      throw program;
+    }
+    return program;
+  }
+
+  // Switch the internal log shared by all instances, writing it to onLog, or
+  // to the console without one. Returns the previous level.
+  static setLogLevel(level: LogLevel, onLog?: LogFn): LogLevel {
+    if (!starlark.setLogLevel) {
+      throw new Error("Starlark not initialized");
+    }
+    starlark.log = onLog;
+    const previous = starlark.setLogLevel(level);
+    if (previous instanceof Error) {
+      throw previous;
+    }
+    return previous;
+  }
+
+  // The id of the wasm module instance, which tags its diagnostics, to tell
+  // them apart from those of other copies of the module.
+  static instanceId(): string {
+    if (!starlark.instanceId) {
+      throw new Error("Starlark not initialized");
+    }
+    return starlark.instanceId;
+  }
+
+  // Measure the resources the wasm module instance is using.
+  static usage(): InstanceUsage {
+    if (!starlark.usage) {
+      throw new Error("Starlark not initialized");
+    }
+    return starlark.usage();
+  }
+
+  // Give the runner's own error messages in a locale, for runs with the
+  // locale option. Messages the catalog lacks stay in English.
+  static setMessages(locale: string, messages: MessageCatalog) {
+    if (!starlark.setMessages) {
+      throw new Error("Starlark not initialized");
+    }
+    const error = starlark.setMessages(locale, messages);
+    if (error instanceof Error) {
+      throw error;
+    }
+  }
+
+  // The outcome of a run with the retainResult option, while it is kept:
+  // for code that lost track of the run, say after a navigation, to pick up
+  // its result by executionId.
+  static result(executionId: string): StoredResult | undefined {
+    if (!starlark.result) {
+      throw new Error("Starlark not initialized");
+    }
+    const result = starlark.result(executionId);
+    if (result instanceof Error) {
+      throw result;
+    }
+    return result;
+  }
+
+  // Limit the cumulative steps, time, loads and host calls of a tenant's
+  // runs, or remove its quota with null. A run over any limit is rejected
+  // with a StarlarkQuotaError before it starts; the usage so far is kept.
+  static setQuota(tenant: string, limits: QuotaLimits | null) {
+    if (!starlark.setQuota) {
+      throw new Error("Starlark not initialized");
+    }
+    const error = starlark.setQuota(tenant, limits);
+    if (error instanceof Error) {
+      throw error;
+    }
+  }
+
+  // The limits and usage of a tenant, if it has a quota.
+  static quota(tenant: string): Quota | undefined {
+    if (!starlark.quota) {
+      throw new Error("Starlark not initialized");
+    }
+    const quota = starlark.quota(tenant);
+    if (quota instanceof Error) {
+      throw quota;
+    }
+    return quota;
+  }
+
+  // Forget the usage of a tenant, as at the start of a billing period.
+  // Returns whether it has a quota.
+  static resetQuota(tenant: string): boolean {
+    if (!starlark.resetQuota) {
+      throw new Error("Starlark not initialized");
+    }
+    const reset = starlark.resetQuota(tenant);
+    if (reset instanceof Error) {
+      throw reset;
+    }
+    return reset;
+  }
+
+  // Evict the REPL sessions of every instance once idle for too long, or
+  // once there are too many, or remove the policy with null. Subscribe to
+  // the sessionEvicted event to keep what an evicted session held.
+  static setSessionPolicy(policy: SessionPolicy | null) {
+    if (!starlark.setSessionPolicy) {
+      throw new Error("Starlark not initialized");
+    }
+    starlark.setSessionPolicy(policy);
+  }
+
+  // Limit how many runs of every instance run at once, or lift the limit
+  // with 0 or null. Those over it wait, first come first served, until a
+  // running one ends; runSync fails instead, as it cannot wait.
+  static setConcurrency(limit: number | null) {
+    if (!starlark.setConcurrency) {
+      throw new Error("Starlark not initialized");
+    }
+    starlark.setConcurrency(limit);
+  }
+
+  // List the runs of every instance that are running, in the order they
+  // started, and then those waiting under the concurrency limit.
+  static listExecutions(): ExecutionInfo[] {
+    if (!starlark.listExecutions) {
+      throw new Error("Starlark not initialized");
+    }
+    return starlark.listExecutions();
+  }
+
+  // Give the instance a budget of heap in use, in bytes, whose levels, the
+  // fractions of it in levels, [0.7, 0.9] by default, a memoryWatermark
+  // event tells of as the heap rises to them; or remove it with null.
+  static setMemoryBudget(bytes: number | null, levels?: number[]) {
+    if (!starlark.setMemoryBudget) {
+      throw new Error("Starlark not initialized");
+    }
+    const error = starlark.setMemoryBudget(bytes, levels);
+    if (error instanceof Error) {
+      throw error;
+    }
+  }
+
+  // Bring the instance back to the state it started in without
+  // instantiating the wasm module again: every run is cancelled, every REPL
+  // session closed, and the module cache, kept results, lazy values and
+  // retry budgets dropped. Subscriptions, messages, quotas, the session
+  // policy and the memory budget are kept.
+  static reset(): Promise<ResetResult> {
+    if (!starlark.reset) {
+      throw new Error("Starlark not initialized");
+    }
+    return starlark.reset();
+  }
+
+  // Subscribe to an event of every instance's runs, rather than wrapping
+  // the callbacks each takes. Returns a function that unsubscribes.
+  static on<K extends RunnerEventName>(event: K, handler: RunnerEventHandler<K>): () => void {
+    if (!starlark.on) {
+      throw new Error("Starlark not initialized");
+    }
+    const off = starlark.on(event, handler);
+    if (off instanceof Error) {
+      throw off;
+    }
+    return () => {
+      off();
+    };
+  }
+
+  // Report what the wasm module was built with, and what its environment
+  // allows, to adapt to a build rather than fail a run.
+  static capabilities(): Capabilities {
+    if (!starlark.capabilities) {
+      throw new Error("Starlark not initialized");
+    }
+    return starlark.capabilities();
+  }
+
+  // The metrics of the instance's runs since it started, in the Prometheus
+  // text exposition format, for a host to serve or push to its monitoring.
+  static metrics(): string {
+    if (!starlark.metrics) {
+      throw new Error("Starlark not initialized");
+    }
+    return starlark.metrics();
+  }
+
+  // Measure the module cache shared by all instances.
+  static cacheStats(): CacheStats {
+    if (!starlark.cacheStats) {
+      throw new Error("Starlark not initialized");
+    }
+    return starlark.cacheStats();
+  }
+
+  // Drop the cached versions of a module, or the whole module cache and its
+  // stats. Returns how many modules were dropped.
+  static clearCache(filename?: string): number {
+    if (!starlark.clearCache) {
+      throw new Error("Starlark not initialized");
+    }
+    return starlark.clearCache(filename);
+  }
+
+  // Restore an error from its JSON string, or from the plain object it
+  // became after crossing a worker boundary.
+  static errorFromJSON(value: string | object): StarlarkRunError {
+    if (!starlark.errorFromJSON) {
+      throw new Error("Starlark not initialized");
+    }
+    const error = starlark.errorFromJSON(value);
+    if (error instanceof Error) {
+      throw error;
+    }
+    return error;
   }
 
   constructor(config: StarlarkConfig) {
     this.print = config.print || defaultPrint;
+    this.printError = config.printError || defaultPrintError;
     this.load = config.load || defaultLoad;
+    this.verify = config.verify;
+    this.resolve = config.resolve;
+    this.onEmit = config.onEmit;
+    this.onWarning = config.onWarning;
+    this.onPaused = config.onPaused;
+    this.onTrace = config.onTrace;
+    this.onWatch = config.onWatch;
+    this.breakpoints = config.breakpoints;
+    this.watch = config.watch;
+    this.watchOn = config.watchOn;
     this.maxExecutionTime = config.maxExecutionTime;
+    this.printPositions = config.printPositions;
+    this.printBatchSize = config.printBatchSize;
+    this.printFlushInterval = config.printFlushInterval;
+    this.maxUnackedOutput = config.maxUnackedOutput;
+    this.captureLocals = config.captureLocals;
+    this.trace = config.trace;
+    this.onHostError = config.onHostError;
+    this.lazy = config.lazy;
+    this.cacheGlobals = config.cacheGlobals;
+    this.binary = config.binary;
+    this.locale = config.locale;
+    this.maxErrorLength = config.maxErrorLength;
+    this.maxResultSize = config.maxResultSize;
+    this.maxValueSize = config.maxValueSize;
+    this.maxTotalSize = config.maxTotalSize;
+    this.memoryWatermarks = config.memoryWatermarks;
+    this.maxModules = config.maxModules;
+    this.maxSourceSize = config.maxSourceSize;
+    this.maxCallRate = config.maxCallRate;
+    this.callBurst = config.callBurst;
+    this.maxSteps = config.maxSteps;
+    this.strict = config.strict;
+    this.extendedTypes = config.extendedTypes;
+    this.sessionId = config.sessionId;
+    this.labels = config.labels;
+    this.retainResult = config.retainResult;
+    this.allowBuiltins = config.allowBuiltins;
+    this.printPolicy = config.printPolicy;
+    this.meter = config.meter;
+    this.builtins = config.builtins;
+    this.hostFunctions = config.hostFunctions;
+    this.dialect = config.dialect;
+    this.secrets = config.secrets;
+    this.lockfile = config.lockfile;
+    this.allowLoads = config.allowLoads;
+    this.denyLoads = config.denyLoads;
+    this.share = config.share;
+    this.priority = config.priority;
   }
 
   async run(
     filename: string,
     functionName: string = "main",
     args?: StarlarkCompatibleValue[],
-    kwargs?: StarlarkCompatibleDict,
+    kwargs?: StarlarkKwargs,
     maxExecutionTime?: number
   ): Promise<StarlarkCompatibleValue> {
-    if (!starlark.wasm_runner) {
+    return (await this.execute(
+      filename,
+      functionName,
+      args,
+      kwargs,
+      maxExecutionTime,
+      {}
+    )) as StarlarkCompatibleValue;
+  }
+
+  // Like run, but resolves with the return value together with any warnings
+  // raised during the call, and the output if captureOutput is set.
+  async runWithDetails(
+    filename: string,
+    functionName: string = "main",
+    args?: StarlarkCompatibleValue[],
+    kwargs?: StarlarkKwargs,
+    maxExecutionTime?: number,
+    options?: DetailsOptions
+  ): Promise<StarlarkResult> {
+    return (await this.execute(
+      filename,
+      functionName,
+      args,
+      kwargs,
+      maxExecutionTime,
+      { ...options, envelope: true }
+    )) as StarlarkResult;
+  }
+
+  // Like runWithDetails, but resolves even if the run fails, with ok set
+  // and the error in place of the value, and with all it printed as logs.
+  async runSettled(
+    filename: string,
+    functionName: string = "main",
+    args?: StarlarkCompatibleValue[],
+    kwargs?: StarlarkKwargs,
+    maxExecutionTime?: number,
+    options?: DetailsOptions
+  ): Promise<SettledResult> {
+    return (await this.execute(
+      filename,
+      functionName,
+      args,
+      kwargs,
+      maxExecutionTime,
+      { ...options, settle: true }
+    )) as SettledResult;
+  }
+
+  // Run a request, naming what runWithDetails takes in order, with this
+  // instance's settings and callbacks where the request has none.
+  async call(request: RunRequest): Promise<StarlarkResult> {
+    const executionId = request.id ?? newExecutionId();
+    const options = this.runOptions({ ...request.options, binary: false });
+    return this.invokeRequest(executionId, { ...request, id: executionId, options });
+  }
+
+  // Run a chunk of source in this instance's REPL session, where it sees the
+  // globals defined by the chunks before it, and resolve with the value of
+  // the expression it ends with, or null. Only the chunk is parsed each time,
+  // so evaluating a line stays fast however long the session gets.
+  async repl(
+    source: string,
+    maxExecutionTime?: number
+  ): Promise<StarlarkCompatibleValue> {
+    return this.replIn(this.replSessionId(), source, maxExecutionTime);
+  }
+
+  // Open a REPL session apart from this instance's own, with this
+  // instance's config, whose chunks see only the globals defined in it, and
+  // whose functions can be called with arguments from JS.
+  createSession(): StarlarkSession {
+    const sessionId = "session-" + newExecutionId();
+    return {
+      sessionId,
+      repl: (source, maxExecutionTime) => this.replIn(sessionId, source, maxExecutionTime),
+      call: (functionName, args, kwargs, maxExecutionTime) =>
+        this.callIn(sessionId, functionName, args, kwargs, maxExecutionTime),
+      close: () => {
+        if (!starlark.closeSession) {
+          throw new Error("Starlark not initialized");
+        }
+        const closed = starlark.closeSession(sessionId);
+        if (closed instanceof Error) {
+          throw closed;
+        }
+        return closed;
+      },
+    };
+  }
+
+  private async replIn(
+    sessionId: string,
+    source: string,
+    maxExecutionTime?: number
+  ): Promise<StarlarkCompatibleValue> {
+    if (!starlark.repl) {
       throw new Error("Starlark not initialized");
     }
+    const executionId = newExecutionId();
+    const options = this.runOptions({
+      sessionId,
+      maxExecutionTime: maxExecutionTime ?? this.maxExecutionTime ?? 0,
+      binary: false,
+    });
+    starlark._executions[executionId] = this;
+    try {
+      return await starlark.repl(executionId, source, options);
+    } finally {
+      delete starlark._executions[executionId];
+    }
+  }
 
-    const executionId = Math.random().toString().slice(2);
+  private async callIn(
+    sessionId: string,
+    functionName: string,
+    args?: StarlarkCompatibleValue[],
+    kwargs?: StarlarkKwargs,
+    maxExecutionTime?: number
+  ): Promise<StarlarkCompatibleValue> {
+    if (!starlark.sessionCall) {
+      throw new Error("Starlark not initialized");
+    }
+    const executionId = newExecutionId();
+    const options = this.runOptions({
+      sessionId,
+      maxExecutionTime: maxExecutionTime ?? this.maxExecutionTime ?? 0,
+      binary: false,
+    });
+    starlark._executions[executionId] = this;
+    try {
+      return await starlark.sessionCall(executionId, functionName, args, kwargs, options);
+    } finally {
+      delete starlark._executions[executionId];
+    }
+  }
 
-    if (maxExecutionTime === undefined) {
-      maxExecutionTime = this.maxExecutionTime;
+  // Evaluate a formula, such as "(A1 + A2) * Rate", asking the resolve
+  // callback for the values of the names it uses that Starlark does not
+  // know, all at once, rather than passing every value it might use.
+  async evaluate(formula: string, maxExecutionTime?: number): Promise<StarlarkCompatibleValue> {
+    if (!starlark.evaluate) {
+      throw new Error("Starlark not initialized");
+    }
+    const executionId = newExecutionId();
+    const options = this.runOptions({
+      maxExecutionTime: maxExecutionTime ?? this.maxExecutionTime ?? 0,
+      binary: false,
+    });
+    starlark._executions[executionId] = this;
+    try {
+      return await starlark.evaluate(executionId, formula, options);
+    } finally {
+      delete starlark._executions[executionId];
     }
+  }
 
+  // Run source passed as a string, rather than loaded, as a module with
+  // globals of the host's, and resolve with the globals it defines, other
+  // than its functions.
+  async exec(
+    source: string,
+    globals?: StarlarkCompatibleDict,
+    maxExecutionTime?: number
+  ): Promise<StarlarkCompatibleDict> {
+    if (!starlark.exec) {
+      throw new Error("Starlark not initialized");
+    }
+    const executionId = newExecutionId();
+    const options = this.runOptions({
+      maxExecutionTime: maxExecutionTime ?? this.maxExecutionTime ?? 0,
+      binary: false,
+    });
     starlark._executions[executionId] = this;
+    try {
+      return await starlark.exec(executionId, source, globals, options);
+    } finally {
+      delete starlark._executions[executionId];
+    }
+  }
 
-    const returnValue = await starlark.wasm_runner(
+  // Evaluate an expression passed as a string, with globals of the host's.
+  async eval(
+    expression: string,
+    globals?: StarlarkCompatibleDict,
+    maxExecutionTime?: number
+  ): Promise<StarlarkCompatibleValue> {
+    if (!starlark.eval) {
+      throw new Error("Starlark not initialized");
+    }
+    const executionId = newExecutionId();
+    const options = this.runOptions({
+      maxExecutionTime: maxExecutionTime ?? this.maxExecutionTime ?? 0,
+      binary: false,
+    });
+    starlark._executions[executionId] = this;
+    try {
+      return await starlark.eval(executionId, expression, globals, options);
+    } finally {
+      delete starlark._executions[executionId];
+    }
+  }
+
+  // Call a function repeatedly, after warming it up, and resolve with the
+  // spread of its times and step counts. The module's top level runs once,
+  // and is not measured; nor is converting the arguments, which are passed
+  // afresh to each call.
+  async benchmark(spec: BenchmarkSpec): Promise<BenchmarkResult> {
+    if (!starlark.benchmark) {
+      throw new Error("Starlark not initialized");
+    }
+    const executionId = newExecutionId();
+    starlark._executions[executionId] = this;
+    try {
+      return await starlark.benchmark(
+        executionId,
+        spec,
+        this.runOptions({ binary: false })
+      );
+    } finally {
+      delete starlark._executions[executionId];
+    }
+  }
+
+  // Call a function with its output captured, and compare what it printed
+  // and returned with golden data, resolving with a diff of each part that
+  // differs.
+  async golden(spec: GoldenSpec): Promise<GoldenResult> {
+    if (!starlark.golden) {
+      throw new Error("Starlark not initialized");
+    }
+    const executionId = newExecutionId();
+    starlark._executions[executionId] = this;
+    try {
+      return await starlark.golden(
+        executionId,
+        spec,
+        this.runOptions({ binary: false })
+      );
+    } finally {
+      delete starlark._executions[executionId];
+    }
+  }
+
+  // Run a module's test cases, each with limits of its own, and resolve
+  // with whether each passed, what it returned and printed, and the steps
+  // it took. The cases all run inside the wasm module, in one execution.
+  async grade(spec: GradeSpec): Promise<GradeResult> {
+    if (!starlark.grade) {
+      throw new Error("Starlark not initialized");
+    }
+    const executionId = newExecutionId();
+    starlark._executions[executionId] = this;
+    try {
+      return await starlark.grade(
+        executionId,
+        spec,
+        this.runOptions({ binary: false })
+      );
+    } finally {
+      delete starlark._executions[executionId];
+    }
+  }
+
+  // Compile a module and the modules it loads into the module cache, without
+  // running them, so that the first run that needs them does not wait.
+  async precompile(filename: string): Promise<PrecompileResult> {
+    if (!starlark.precompile) {
+      throw new Error("Starlark not initialized");
+    }
+    const executionId = newExecutionId();
+    starlark._executions[executionId] = this;
+    try {
+      return await starlark.precompile(
+        executionId,
+        filename,
+        this.runOptions({ binary: false })
+      );
+    } finally {
+      delete starlark._executions[executionId];
+    }
+  }
+
+  // Run a module written as configuration, and resolve with its globals,
+  // or the one the spec names, as a JSON document.
+  async render(spec: RenderSpec): Promise<RenderResult> {
+    if (!starlark.render) {
+      throw new Error("Starlark not initialized");
+    }
+    const executionId = newExecutionId();
+    starlark._executions[executionId] = this;
+    try {
+      return await starlark.render(
+        executionId,
+        spec,
+        this.runOptions({ binary: false })
+      );
+    } finally {
+      delete starlark._executions[executionId];
+    }
+  }
+
+  // Render two versions of a configuration, or one called with two sets of
+  // arguments, and resolve with what changes from the one to the other.
+  async renderDiff(spec: RenderDiffSpec): Promise<RenderDiffResult> {
+    if (!starlark.renderDiff) {
+      throw new Error("Starlark not initialized");
+    }
+    const executionId = newExecutionId();
+    starlark._executions[executionId] = this;
+    try {
+      return await starlark.renderDiff(
+        executionId,
+        spec,
+        this.runOptions({ binary: false })
+      );
+    } finally {
+      delete starlark._executions[executionId];
+    }
+  }
+
+  // Acknowledge lines of a run's output once they are rendered, letting a
+  // run with maxUnackedOutput print as many more. Returns whether the run is
+  // running.
+  ackOutput(executionId: string, lines = 1): boolean {
+    if (!starlark.ackOutput) {
+      throw new Error("Starlark not initialized");
+    }
+    const running = starlark.ackOutput(executionId, lines);
+    if (running instanceof Error) {
+      throw running;
+    }
+    return running;
+  }
+
+  // Stop a run, which fails with the reason. Returns whether it was
+  // running.
+  cancel(executionId: string, reason?: string): boolean {
+    if (!starlark.cancel) {
+      throw new Error("Starlark not initialized");
+    }
+    const running = starlark.cancel(executionId, reason);
+    if (running instanceof Error) {
+      throw running;
+    }
+    return running;
+  }
+
+  // Resume an execution paused at a breakpoint. Returns whether it was
+  // paused.
+  resume(executionId: string, command: DebugCommand = "continue"): boolean {
+    if (!starlark.resume) {
+      throw new Error("Starlark not initialized");
+    }
+    const resumed = starlark.resume(executionId, command);
+    if (resumed instanceof Error) {
+      throw resumed;
+    }
+    return resumed;
+  }
+
+  // List variables of an execution paused in onPaused: the locals or globals
+  // of a frame, or the elements of one of them. Only the values listed are
+  // converted, and only as reprs cut short, however large they are.
+  async inspect(
+    executionId: string,
+    request: InspectRequest = {}
+  ): Promise<InspectResult> {
+    if (!starlark.inspect) {
+      throw new Error("Starlark not initialized");
+    }
+    const result = starlark.inspect(executionId, request);
+    if (result instanceof Error) {
+      throw result;
+    }
+    return result;
+  }
+
+  // Take a snapshot of the call stack of a run in flight, without stopping
+  // it, e.g. to see what a script that seems stuck is doing.
+  async stack(executionId: string): Promise<StackSnapshot> {
+    if (!starlark.stack) {
+      throw new Error("Starlark not initialized");
+    }
+    return await starlark.stack(executionId);
+  }
+
+  // Snapshots of the call stacks of all of this instance's runs in flight.
+  async stacks(): Promise<StackSnapshot[]> {
+    return await Promise.all(this.runningExecutions().map((id) => this.stack(id)));
+  }
+
+  // The executionIds of this instance's runs in flight.
+  protected runningExecutions(): string[] {
+    return Object.keys(starlark._executions).filter(
+      (executionId) => starlark._executions[executionId] === this
+    );
+  }
+
+  // Replace the breakpoints of this instance's runs, including those in
+  // flight, which must have been started in debug mode.
+  setBreakpoints(breakpoints: Breakpoint[]) {
+    if (!starlark.setBreakpoints) {
+      throw new Error("Starlark not initialized");
+    }
+    this.breakpoints = breakpoints;
+    for (const executionId of this.runningExecutions()) {
+      const set = starlark.setBreakpoints(executionId, breakpoints);
+      if (set instanceof Error) {
+        throw set;
+      }
+    }
+  }
+
+  // Replace the watch expressions of this instance's runs, including those
+  // in flight, which must have been started in debug mode.
+  setWatches(watch: string[]) {
+    if (!starlark.setWatches) {
+      throw new Error("Starlark not initialized");
+    }
+    this.watch = watch;
+    for (const executionId of this.runningExecutions()) {
+      const set = starlark.setWatches(executionId, watch);
+      if (set instanceof Error) {
+        throw set;
+      }
+    }
+  }
+
+  // Drop this instance's REPL session and the globals defined in it, so the
+  // next chunk starts afresh. Returns whether there was a session.
+  closeRepl(): boolean {
+    if (!starlark.closeSession) {
+      throw new Error("Starlark not initialized");
+    }
+    const closed = starlark.closeSession(this.replSessionId());
+    if (closed instanceof Error) {
+      throw closed;
+    }
+    return closed;
+  }
+
+  // The REPL session of this instance: its sessionId, or else one of its own.
+  private replSessionId(): string {
+    if (this.sessionId) {
+      return this.sessionId;
+    }
+    if (!this.replSession) {
+      this.replSession = "repl-" + newExecutionId();
+    }
+    return this.replSession;
+  }
+
+  // Like run, but streams a list or dict result in chunks of up to chunkSize
+  // elements: arrays of a list's elements, or objects holding some of a
+  // dict's entries. The script only converts the next chunk once the stream
+  // wants more. Any other result arrives whole, as the only chunk.
+  stream(
+    filename: string,
+    functionName: string = "main",
+    args?: StarlarkCompatibleValue[],
+    kwargs?: StarlarkKwargs,
+    maxExecutionTime?: number,
+    chunkSize: number = 1000
+  ): ReadableStream<StarlarkCompatibleValue> {
+    let resume: (() => void) | undefined;
+    let cancelled = false;
+    return new ReadableStream<StarlarkCompatibleValue>({
+      start: (controller) => {
+        const onChunk = (chunk: StarlarkCompatibleValue) => {
+          if (cancelled) {
+            throw new Error("The stream was cancelled");
+          }
+          controller.enqueue(chunk);
+          if ((controller.desiredSize ?? 1) <= 0) {
+            return new Promise<void>((resolve) => (resume = resolve));
+          }
+        };
+        this.execute(
+          filename,
+          functionName,
+          args,
+          kwargs,
+          maxExecutionTime,
+          { chunkSize, binary: false, lazy: false },
+          onChunk
+        ).then(
+          (value) => {
+            if (value !== null) {
+              controller.enqueue(value as StarlarkCompatibleValue);
+            }
+            controller.close();
+          },
+          (error) => {
+            if (!cancelled) {
+              controller.error(error);
+            }
+          }
+        );
+      },
+      pull: () => {
+        resume?.();
+        resume = undefined;
+      },
+      cancel: () => {
+        cancelled = true;
+        resume?.();
+      },
+    });
+  }
+
+  // Like run, but returns an async iterator over the values the script
+  // emits as it runs, whose last step has the result, rather than only a
+  // promise of the result. Breaking out of iterating over it cancels the run.
+  // The onEmit callback still receives the values.
+  iterate(
+    filename: string,
+    functionName: string = "main",
+    args?: StarlarkCompatibleValue[],
+    kwargs?: StarlarkKwargs,
+    maxExecutionTime?: number
+  ): StarlarkIteration {
+    if (!starlark.wasm_runner) {
+      throw new Error("Starlark not initialized");
+    }
+    const executionId = newExecutionId();
+    const options = this.runOptions({ iterate: true, binary: false, lazy: false });
+    starlark._executions[executionId] = this;
+    const iteration = starlark.wasm_runner(
       executionId,
       filename,
       functionName || "main",
       args || [],
       kwargs || {},
-      maxExecutionTime || 0
+      maxExecutionTime ?? this.maxExecutionTime ?? 0,
+      options
+    ) as unknown as StarlarkIteration;
+    const forget = () => {
+      delete starlark._executions[executionId];
+    };
+    iteration.result.then(forget, forget);
+    return iteration;
+  }
+
+  // Receive a chunk of a streamed result.
+  chunk(chunk: StarlarkCompatibleValue, executionId: string) {
+    const onChunk = this.chunkHandlers[executionId];
+    if (!onChunk) {
+      throw new Error("Unable to stream. No stream found: " + executionId);
+    }
+    return onChunk(chunk);
+  }
+
+  private async execute(
+    filename: string,
+    functionName: string,
+    args: StarlarkCompatibleValue[] | undefined,
+    kwargs: StarlarkKwargs | undefined,
+    maxExecutionTime: number | undefined,
+    options: RunOptions,
+    onChunk?: ChunkFn
+  ): Promise<StarlarkCompatibleValue | StarlarkResult> {
+    const executionId = newExecutionId();
+    if (onChunk) {
+      this.chunkHandlers[executionId] = onChunk;
+    }
+    try {
+      return await this.executeAs(
+        executionId,
+        filename,
+        functionName,
+        args,
+        kwargs,
+        maxExecutionTime,
+        options
+      );
+    } finally {
+      delete this.chunkHandlers[executionId];
+    }
+  }
+
+  private async executeAs(
+    executionId: string,
+    filename: string,
+    functionName: string,
+    args: StarlarkCompatibleValue[] | undefined,
+    kwargs: StarlarkKwargs | undefined,
+    maxExecutionTime: number | undefined,
+    options: RunOptions
+  ): Promise<StarlarkCompatibleValue | StarlarkResult> {
+    if (maxExecutionTime === undefined) {
+      maxExecutionTime = this.maxExecutionTime;
+    }
+
+    options = this.runOptions(options);
+
+    if (!options.binary) {
+      return (await this.invokeRunner(
+        executionId,
+        filename,
+        functionName || "main",
+        args || [],
+        kwargs || {},
+        maxExecutionTime || 0,
+        options
+      )) as StarlarkCompatibleValue | StarlarkResult;
+    }
+
+    const result = await this.invokeRunner(
+      executionId,
+      filename,
+      functionName || "main",
+      encodeArgs(args || []),
+      encodeKwargs(kwargs || {}),
+      maxExecutionTime || 0,
+      options
     );
+    if (result instanceof Uint8Array) {
+      return decodeValue(result);
+    }
+    const details = result as StarlarkResult;
+    if (!(details.value instanceof Uint8Array)) {
+      // A failed run with the settle option.
+      return details;
+    }
+    return { ...details, value: decodeValue(details.value as unknown as Uint8Array) };
+  }
+
+  // The options of a run: this instance's config, overridden by options.
+  private runOptions(options: RunOptions): RunOptions {
+    return {
+      printPositions: this.printPositions,
+      printBatchSize: this.printBatchSize,
+      printFlushInterval: this.printFlushInterval,
+      maxUnackedOutput: this.maxUnackedOutput,
+      captureLocals: this.captureLocals,
+      trace: this.trace,
+      onHostError: this.onHostError,
+      lazy: this.lazy,
+      cacheGlobals: this.cacheGlobals,
+      binary: this.binary,
+      locale: this.locale,
+      maxErrorLength: this.maxErrorLength,
+      maxResultSize: this.maxResultSize,
+      maxValueSize: this.maxValueSize,
+      maxTotalSize: this.maxTotalSize,
+      memoryWatermarks: this.memoryWatermarks,
+      maxModules: this.maxModules,
+      maxSourceSize: this.maxSourceSize,
+      maxCallRate: this.maxCallRate,
+      callBurst: this.callBurst,
+      maxSteps: this.maxSteps,
+      breakpoints: this.breakpoints,
+      watch: this.watch,
+      watchOn: this.watchOn,
+      strict: this.strict,
+      extendedTypes: this.extendedTypes,
+      sessionId: this.sessionId,
+      retainResult: this.retainResult,
+      allowBuiltins: this.allowBuiltins,
+      printPolicy: this.printPolicy,
+      meter: this.meter,
+      builtins: this.builtins,
+      hostFunctions: this.hostFunctions,
+      dialect: this.dialect,
+      secrets: this.secrets,
+      lockfile: this.lockfile,
+      allowLoads: this.allowLoads,
+      denyLoads: this.denyLoads,
+      share: this.share,
+      priority: this.priority,
+      verifyModules: this.verify ? true : undefined,
+      ...options,
+      labels: this.labels || options.labels ? { ...this.labels, ...options.labels } : undefined,
+    };
+  }
+
+  // Call the wasm runner, with this instance's callbacks registered for the
+  // execution.
+  protected async invokeRunner(
+    executionId: string,
+    filename: string,
+    functionName: string,
+    args: StarlarkCompatibleValue[] | Uint8Array,
+    kwargs: StarlarkKwargs | Uint8Array,
+    maxExecutionTime: number,
+    options: RunOptions
+  ): Promise<StarlarkCompatibleValue | StarlarkResult | Uint8Array> {
+    if (!starlark.wasm_runner) {
+      throw new Error("Starlark not initialized");
+    }
+
+    starlark._executions[executionId] = this;
+    try {
+      return await starlark.wasm_runner(
+        executionId,
+        filename,
+        functionName,
+        args,
+        kwargs,
+        maxExecutionTime,
+        options
+      );
+    } finally {
+      delete starlark._executions[executionId];
+    }
+  }
+
+  // Call starlark.run, with this instance's callbacks registered for the
+  // execution.
+  protected async invokeRequest(
+    executionId: string,
+    request: RunRequest
+  ): Promise<StarlarkResult> {
+    if (!starlark.run) {
+      throw new Error("Starlark not initialized");
+    }
+
+    starlark._executions[executionId] = this;
+    try {
+      return await starlark.run(request);
+    } finally {
+      delete starlark._executions[executionId];
+    }
+  }
+}
+
+const syncChannelHeaderSize = 16;
+const defaultSyncLoadBufferSize = 1 << 20;
+
+// Write the answer to a sync load into the channel, and wake the worker
+// waiting on it. The channel starts with four Int32s: the state, set to 1
+// once answered; the status, 0 for a module, 1 for an error and 2 for a module
+// too large for the channel; and the byte lengths of the source, or error,
+// and of the hash, or -1 for none. Their UTF-8 follows.
+const answerSyncLoad = async (
+  channel: SharedArrayBuffer,
+  module: LoadedModule | undefined,
+  error: string | undefined
+) => {
+  const header = new Int32Array(channel, 0, 4);
+  const body = new Uint8Array(channel, syncChannelHeaderSize);
+  const encoder = new TextEncoder();
+  let sourceBytes: Uint8Array | undefined;
+  let hash: string | undefined;
+  if (error === undefined && module !== undefined) {
+    const loaded = isModuleSource(module) ? { source: module } : module;
+    hash = loaded.hash;
+    try {
+      sourceBytes = await moduleSourceBytes(loaded.source, encoder);
+    } catch (e) {
+      error = String(e);
+    }
+  }
+  if (sourceBytes === undefined) {
+    const message = encoder.encode(error ?? "Error: the loader returned nothing");
+    const length = Math.min(message.length, body.length);
+    body.set(message.subarray(0, length));
+    header.set([0, 1, length, -1]);
+  } else {
+    const hashBytes = hash === undefined ? undefined : encoder.encode(hash);
+    if (sourceBytes.length + (hashBytes?.length ?? 0) > body.length) {
+      header.set([0, 2, 0, -1]);
+    } else {
+      body.set(sourceBytes);
+      if (hashBytes) {
+        body.set(hashBytes, sourceBytes.length);
+      }
+      header.set([0, 0, sourceBytes.length, hashBytes ? hashBytes.length : -1]);
+    }
+  }
+  Atomics.store(header, 0, 1);
+  Atomics.notify(header, 0);
+};
+
+// Whether a loaded module is its bare source, rather than {source, hash}.
+const isModuleSource = (module: LoadedModule): module is ModuleSource =>
+  typeof module === "string" ||
+  module instanceof Uint8Array ||
+  Array.isArray(module) ||
+  (typeof ReadableStream !== "undefined" && module instanceof ReadableStream);
+
+// Join a module's source into its UTF-8.
+const moduleSourceBytes = async (
+  source: ModuleSource,
+  encoder: TextEncoder
+): Promise<Uint8Array> => {
+  let chunks: (string | Uint8Array)[];
+  if (typeof source === "string" || source instanceof Uint8Array) {
+    chunks = [source];
+  } else if (Array.isArray(source)) {
+    chunks = source;
+  } else {
+    chunks = [];
+    const reader = source.getReader();
+    for (let read = await reader.read(); !read.done; read = await reader.read()) {
+      chunks.push(read.value);
+    }
+  }
+  const parts = chunks.map((chunk) => (typeof chunk === "string" ? encoder.encode(chunk) : chunk));
+  if (parts.length === 1) {
+    return parts[0];
+  }
+  const bytes = new Uint8Array(parts.reduce((length, part) => length + part.length, 0));
+  let offset = 0;
+  for (const part of parts) {
+    bytes.set(part, offset);
+    offset += part.length;
+  }
+  return bytes;
+};
+
+// The ids of requests to workers, unique across the instances that share a
+// worker.
+let nextRequest = 1;
+
+// Runs scripts in a Web Worker that called Starlark.serve, so that they never
+// block the main thread. It takes the same config as Starlark, and its
+// callbacks run on this side; lazy results are not supported. The wasm module
+// only needs loading in the worker.
+export class StarlarkWorker extends Starlark {
+  // The instance id of the worker's wasm module, from the first message it
+  // posts here: its ready message, or any other.
+  instanceId?: string;
+  private port: WorkerPort;
+  // Shared with the worker to answer loads through synchronously, when the
+  // syncLoads option is set and the page can share memory.
+  private channel?: SharedArrayBuffer;
+  private runs: {
+    [executionId: string]: {
+      resolve: (value: StarlarkCompatibleValue | StarlarkResult | Uint8Array) => void;
+      reject: (error: StarlarkRunError) => void;
+    };
+  } = {};
+  // The loads the worker is waiting on, by id, to abort if it gives up on
+  // them.
+  private loads: { [id: number]: AbortController } = {};
+  // The handlers of the worker's events, by event.
+  private eventHandlers: { [event: string]: Set<RunnerEventHandler<any>> } = {};
+  // The inspect and stack requests waiting on the worker, by id.
+  private requests: {
+    [id: number]: {
+      resolve: (value: any) => void;
+      reject: (error: StarlarkRunError) => void;
+    };
+  } = {};
+
+  constructor(port: WorkerPort, config: StarlarkConfig) {
+    super(config);
+    this.port = port;
+    if (config.syncLoads && detectHostSupport().sharedMemory) {
+      this.channel = new SharedArrayBuffer(
+        syncChannelHeaderSize + (config.syncLoadBufferSize || defaultSyncLoadBufferSize)
+      );
+    }
+    port.addEventListener("message", (event) => this.receive(event.data));
+    // A MessagePort only delivers messages to listeners once started.
+    port.start?.();
+  }
+
+  protected invokeRunner(
+    executionId: string,
+    filename: string,
+    functionName: string,
+    args: StarlarkCompatibleValue[] | Uint8Array,
+    kwargs: StarlarkKwargs | Uint8Array,
+    maxExecutionTime: number,
+    options: RunOptions
+  ): Promise<StarlarkCompatibleValue | StarlarkResult | Uint8Array> {
+    return new Promise((resolve, reject) => {
+      this.runs[executionId] = { resolve, reject };
+      this.port.postMessage({
+        type: "run",
+        id: executionId,
+        executionId,
+        filename,
+        functionName,
+        args,
+        kwargs,
+        maxExecutionTime,
+        options,
+        channel: this.channel,
+      });
+    });
+  }
+
+  protected invokeRequest(
+    executionId: string,
+    request: RunRequest
+  ): Promise<StarlarkResult> {
+    return new Promise((resolve, reject) => {
+      this.runs[executionId] = {
+        resolve: (value) => resolve(value as StarlarkResult),
+        reject,
+      };
+      this.port.postMessage({
+        type: "request",
+        id: executionId,
+        request,
+        channel: this.channel,
+      });
+    });
+  }
+
+  // The worker answers asynchronously, so this cannot tell whether the
+  // execution was paused, and returns true.
+  resume(executionId: string, command: DebugCommand = "continue"): boolean {
+    this.port.postMessage({ type: "resume", executionId, command });
+    return true;
+  }
+
+  // The worker answers asynchronously, so this returns whether the run is
+  // running here.
+  ackOutput(executionId: string, lines = 1): boolean {
+    this.port.postMessage({ type: "ackOutput", executionId, lines });
+    return executionId in this.runs;
+  }
+
+  cancel(executionId: string, reason?: string): boolean {
+    this.port.postMessage({ type: "cancel", executionId, reason });
+    return executionId in this.runs;
+  }
 
-    delete starlark._executions[executionId];
+  inspect(executionId: string, request: InspectRequest = {}): Promise<InspectResult> {
+    return this.request({ type: "inspect", executionId, request });
+  }
 
-    return returnValue;
+  stack(executionId: string): Promise<StackSnapshot> {
+    return this.request({ type: "stack", executionId });
+  }
+
+  // Measure the resources of the worker's wasm module instance.
+  usage(): Promise<InstanceUsage> {
+    return this.request({ type: "usage" });
+  }
+
+  // Report what the worker's wasm module was built with.
+  capabilities(): Promise<Capabilities> {
+    return this.request({ type: "capabilities" });
+  }
+
+  // The metrics of the worker's instance, as Starlark.metrics.
+  metrics(): Promise<string> {
+    return this.request({ type: "metrics" });
+  }
+
+  // Clear the worker's module cache, as Starlark.clearCache.
+  clearCache(filename?: string): Promise<number> {
+    return this.request({ type: "clearCache", filename });
+  }
+
+  // Limit the runs of the worker that run at once, and list them, as
+  // Starlark.setConcurrency and Starlark.listExecutions.
+  setConcurrency(limit: number | null) {
+    this.port.postMessage({ type: "setConcurrency", limit });
+  }
+
+  listExecutions(): Promise<ExecutionInfo[]> {
+    return this.request({ type: "listExecutions" });
+  }
+
+  // The kept outcome of a run in the worker, as Starlark.result.
+  storedResult(executionId: string): Promise<StoredResult | undefined> {
+    return this.request({ type: "storedResult", executionId });
+  }
+
+  // Set, read and reset a tenant's quota in the worker, as
+  // Starlark.setQuota, Starlark.quota and Starlark.resetQuota.
+  setWorkerQuota(tenant: string, limits: QuotaLimits | null) {
+    this.port.postMessage({ type: "setQuota", tenant, limits });
+  }
+
+  workerQuota(tenant: string): Promise<Quota | undefined> {
+    return this.request({ type: "quota", tenant });
+  }
+
+  resetWorkerQuota(tenant: string) {
+    this.port.postMessage({ type: "resetQuota", tenant });
+  }
+
+  // Set the worker's memory budget, as Starlark.setMemoryBudget.
+  setWorkerMemoryBudget(bytes: number | null, levels?: number[]) {
+    this.port.postMessage({ type: "setMemoryBudget", bytes, levels });
+  }
+
+  // Reset the worker's instance, as Starlark.reset.
+  reset(): Promise<ResetResult> {
+    return this.request({ type: "reset" });
+  }
+
+  protected runningExecutions(): string[] {
+    return Object.keys(this.runs);
+  }
+
+  // Send the worker a request, resolving with its answer.
+  private request<T>(message: object): Promise<T> {
+    return new Promise((resolve, reject) => {
+      const id = nextRequest++;
+      this.requests[id] = { resolve, reject };
+      this.port.postMessage({ ...message, id });
+    });
+  }
+
+  setBreakpoints(breakpoints: Breakpoint[]) {
+    this.breakpoints = breakpoints;
+    for (const executionId of this.runningExecutions()) {
+      this.port.postMessage({ type: "setBreakpoints", executionId, breakpoints });
+    }
+  }
+
+  setWatches(watch: string[]) {
+    this.watch = watch;
+    for (const executionId of this.runningExecutions()) {
+      this.port.postMessage({ type: "setWatches", executionId, watches: watch });
+    }
+  }
+
+  // Switch the internal log of the worker, which it writes to its own
+  // console.
+  setWorkerLogLevel(level: LogLevel) {
+    this.port.postMessage({ type: "setLogLevel", level });
+  }
+
+  // Give the worker's error messages in a locale, as Starlark.setMessages.
+  setWorkerMessages(locale: string, messages: MessageCatalog) {
+    this.port.postMessage({ type: "setMessages", locale, messages });
+  }
+
+  // Subscribe to an event of this instance's runs in the worker, as
+  // Starlark.on. Returns a function that unsubscribes.
+  onWorkerEvent<K extends RunnerEventName>(event: K, handler: RunnerEventHandler<K>): () => void {
+    let handlers = this.eventHandlers[event];
+    if (!handlers) {
+      handlers = this.eventHandlers[event] = new Set();
+      this.port.postMessage({ type: "on", event });
+    }
+    handlers.add(handler);
+    return () => {
+      if (handlers.delete(handler) && handlers.size === 0 && this.eventHandlers[event] === handlers) {
+        delete this.eventHandlers[event];
+        this.port.postMessage({ type: "off", event });
+      }
+    };
+  }
+
+  // Handle a message from the worker. Messages about other instances' runs
+  // are ignored, so that several instances can share a worker.
+  private async receive(message: WorkerMessage) {
+    this.instanceId ??= (message as { instanceId?: string }).instanceId;
+    if (message.type === "ready") {
+      return;
+    }
+    if (
+      message.type === "inspected" ||
+      message.type === "snapshot" ||
+      message.type === "usage" ||
+      message.type === "capabilities" ||
+      message.type === "metrics" ||
+      message.type === "clearCache" ||
+      message.type === "listExecutions" ||
+      message.type === "storedResult" ||
+      message.type === "quota" ||
+      message.type === "reset"
+    ) {
+      // Answered even once the run is over.
+      const request = this.requests[message.id];
+      delete this.requests[message.id];
+      if ("error" in message && message.error) {
+        request?.reject(message.error);
+      } else {
+        request?.resolve(message.value);
+      }
+      return;
+    }
+    if (message.type === "abortLoad") {
+      // Sent as the run is cancelled, perhaps after its error.
+      this.loads[message.id]?.abort(new Error(message.reason));
+      return;
+    }
+    const executionId =
+      message.type === "result" || message.type === "error"
+        ? message.id
+        : message.executionId;
+    const run = this.runs[executionId];
+    if (!run) {
+      return;
+    }
+
+    switch (message.type) {
+      case "result":
+        delete this.runs[executionId];
+        run.resolve(message.value);
+        break;
+      case "error":
+        delete this.runs[executionId];
+        run.reject(message.error);
+        break;
+      case "load": {
+        let module: LoadedModule | undefined;
+        let error: string | undefined;
+        const aborter = new AbortController();
+        this.loads[message.id] = aborter;
+        try {
+          module = await this.load(message.filename, executionId, aborter.signal);
+        } catch (e) {
+          error = String(e);
+        } finally {
+          delete this.loads[message.id];
+        }
+        if (aborter.signal.aborted) {
+          // The worker has stopped waiting for the answer.
+          break;
+        }
+        if (message.sync && this.channel) {
+          await answerSyncLoad(this.channel, module, error);
+        } else {
+          // A stream cannot be copied to the worker, only handed over.
+          const source = module === undefined || isModuleSource(module) ? module : module.source;
+          const transfer =
+            typeof ReadableStream !== "undefined" && source instanceof ReadableStream
+              ? [source]
+              : [];
+          this.port.postMessage({ type: "loaded", id: message.id, source: module, error }, transfer);
+        }
+        break;
+      }
+      case "verify": {
+        let approved: boolean | undefined;
+        let error: string | undefined;
+        try {
+          if (!this.verify) {
+            throw new Error("Unable to verify. No verifier for execution: " + executionId);
+          }
+          approved = await this.verify(message.filename, message.hash, executionId);
+        } catch (e) {
+          error = String(e);
+        }
+        this.port.postMessage({ type: "verified", id: message.id, approved, error });
+        break;
+      }
+      case "print":
+        if (message.stream === "stderr") {
+          this.printError(message.message, executionId, message.position);
+        } else {
+          this.print(message.message, executionId, message.position);
+        }
+        break;
+      case "printBatch":
+        for (const line of message.lines) {
+          if (line.stream === "stderr") {
+            this.printError(line.message, executionId, line.position);
+          } else {
+            this.print(line.message, executionId, line.position);
+          }
+        }
+        break;
+      case "emit":
+        this.onEmit?.(message.value, executionId);
+        break;
+      case "event":
+        for (const handler of this.eventHandlers[message.event.type] ?? []) {
+          handler(message.event, executionId);
+        }
+        break;
+      case "warn":
+        this.onWarning?.(message.warning, executionId);
+        break;
+      case "trace":
+        this.onTrace?.(message.events, executionId);
+        break;
+      case "watch":
+        this.onWatch?.(message.event, executionId);
+        break;
+      case "chunk":
+        this.chunk(message.chunk, executionId);
+        break;
+      case "paused":
+        if (this.onPaused) {
+          this.onPaused(message.event, executionId);
+        } else {
+          // Nothing could resume it.
+          this.resume(executionId, "stop");
+        }
+        break;
+    }
   }
 }
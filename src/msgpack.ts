@@ -0,0 +1,297 @@
+// MessagePack encoding for the binary option, which passes arguments and
+// results to the wasm runner as Uint8Arrays instead of as JS values. Values
+// follow the same rules as the default conversion: integral numbers are ints,
+// arrays are lists and other objects are dicts. Two extension types stand in
+// for values MessagePack has no encoding for; the runner reports them just as
+// it would the values themselves.
+import { StarlarkCompatibleValue, StarlarkKwargs } from "./types.js";
+
+const EXT_UNDEFINED = 0;
+const EXT_UNSUPPORTED = 1;
+
+const textEncoder = new TextEncoder();
+const textDecoder = new TextDecoder();
+
+class Encoder {
+  private buffer = new Uint8Array(256);
+  private view = new DataView(this.buffer.buffer);
+  private length = 0;
+  // The encodings of the object keys seen so far, which tend to repeat.
+  private keys = new Map<string, Uint8Array>();
+
+  // Make room for n more bytes.
+  private reserve(n: number) {
+    if (this.length + n <= this.buffer.length) {
+      return;
+    }
+    let size = this.buffer.length * 2;
+    while (size < this.length + n) {
+      size *= 2;
+    }
+    const buffer = new Uint8Array(size);
+    buffer.set(this.buffer.subarray(0, this.length));
+    this.buffer = buffer;
+    this.view = new DataView(buffer.buffer);
+  }
+
+  private byte(b: number) {
+    this.reserve(1);
+    this.buffer[this.length++] = b;
+  }
+
+  private bytes(data: Uint8Array) {
+    this.reserve(data.length);
+    this.buffer.set(data, this.length);
+    this.length += data.length;
+  }
+
+  // Write a header for a str, array or map of n elements.
+  private header(fix: number, fixMax: number, tag16: number, tag32: number, n: number) {
+    if (n <= fixMax) {
+      this.byte(fix | n);
+    } else if (n <= 0xffff) {
+      this.byte(tag16);
+      this.reserve(2);
+      this.view.setUint16(this.length, n);
+      this.length += 2;
+    } else {
+      this.byte(tag32);
+      this.reserve(4);
+      this.view.setUint32(this.length, n);
+      this.length += 4;
+    }
+  }
+
+  private ext(type: number, data: Uint8Array) {
+    if (data.length === 1) {
+      this.byte(0xd4);
+    } else {
+      this.byte(0xc7);
+      this.byte(data.length);
+    }
+    this.byte(type);
+    this.bytes(data);
+  }
+
+  string(s: string) {
+    this.encoded(textEncoder.encode(s));
+  }
+
+  private key(s: string) {
+    let data = this.keys.get(s);
+    if (!data) {
+      data = textEncoder.encode(s);
+      this.keys.set(s, data);
+    }
+    this.encoded(data);
+  }
+
+  // Write a str of UTF-8 data.
+  private encoded(data: Uint8Array) {
+    if (data.length > 31 && data.length <= 0xff) {
+      this.byte(0xd9);
+      this.byte(data.length);
+    } else {
+      this.header(0xa0, 31, 0xda, 0xdb, data.length);
+    }
+    this.bytes(data);
+  }
+
+  private number(n: number) {
+    if (Number.isSafeInteger(n)) {
+      if (n >= 0 && n <= 0x7f) {
+        this.byte(n);
+        return;
+      }
+      if (n < 0 && n >= -32) {
+        this.byte(n & 0xff);
+        return;
+      }
+      if (n >= -0x80000000 && n <= 0x7fffffff) {
+        this.byte(0xd2);
+        this.reserve(4);
+        this.view.setInt32(this.length, n);
+        this.length += 4;
+        return;
+      }
+      this.byte(0xd3);
+      this.reserve(8);
+      this.view.setBigInt64(this.length, BigInt(n));
+      this.length += 8;
+      return;
+    }
+    this.byte(0xcb);
+    this.reserve(8);
+    this.view.setFloat64(this.length, n);
+    this.length += 8;
+  }
+
+  value(value: unknown) {
+    if (value === null) {
+      this.byte(0xc0);
+    } else if (value === undefined) {
+      this.ext(EXT_UNDEFINED, new Uint8Array(1));
+    } else if (typeof value === "boolean") {
+      this.byte(value ? 0xc3 : 0xc2);
+    } else if (typeof value === "number") {
+      this.number(value);
+    } else if (typeof value === "string") {
+      this.string(value);
+    } else if (Array.isArray(value)) {
+      this.header(0x90, 15, 0xdc, 0xdd, value.length);
+      for (const item of value) {
+        this.value(item);
+      }
+    } else if (typeof value === "object") {
+      const keys = Object.keys(value);
+      this.header(0x80, 15, 0xde, 0xdf, keys.length);
+      for (const key of keys) {
+        this.key(key);
+        this.value((value as Record<string, unknown>)[key]);
+      }
+    } else {
+      // Mirror the Go side, which names the type of unsupported values.
+      this.ext(EXT_UNSUPPORTED, textEncoder.encode(typeof value));
+    }
+  }
+
+  map(entries: [string, unknown][]) {
+    this.header(0x80, 15, 0xde, 0xdf, entries.length);
+    for (const [key, value] of entries) {
+      this.key(key);
+      this.value(value);
+    }
+  }
+
+  result(): Uint8Array {
+    return this.buffer.slice(0, this.length);
+  }
+}
+
+// Encode positional arguments.
+export function encodeArgs(args: StarlarkCompatibleValue[]): Uint8Array {
+  const encoder = new Encoder();
+  encoder.value(args);
+  return encoder.result();
+}
+
+// Encode keyword arguments, from a plain object or a Map.
+export function encodeKwargs(kwargs: StarlarkKwargs): Uint8Array {
+  const encoder = new Encoder();
+  encoder.map(
+    kwargs instanceof Map ? Array.from(kwargs.entries()) : Object.entries(kwargs)
+  );
+  return encoder.result();
+}
+
+class Decoder {
+  private view: DataView;
+  private offset = 0;
+
+  constructor(private data: Uint8Array) {
+    this.view = new DataView(data.buffer, data.byteOffset, data.byteLength);
+  }
+
+  private string(n: number): string {
+    const s = textDecoder.decode(this.data.subarray(this.offset, this.offset + n));
+    this.offset += n;
+    return s;
+  }
+
+  private array(n: number): StarlarkCompatibleValue[] {
+    const array: StarlarkCompatibleValue[] = [];
+    for (let i = 0; i < n; i++) {
+      array.push(this.value());
+    }
+    return array;
+  }
+
+  private map(n: number): { [key: string]: StarlarkCompatibleValue } {
+    const obj: { [key: string]: StarlarkCompatibleValue } = {};
+    for (let i = 0; i < n; i++) {
+      const key = this.value() as string;
+      obj[key] = this.value();
+    }
+    return obj;
+  }
+
+  private uint(size: 1 | 2 | 4): number {
+    const offset = this.offset;
+    this.offset += size;
+    if (size === 1) {
+      return this.view.getUint8(offset);
+    }
+    return size === 2 ? this.view.getUint16(offset) : this.view.getUint32(offset);
+  }
+
+  // The runner only produces the types it can produce from Starlark values:
+  // nil, booleans, safe integers, float64s, strings, arrays and maps.
+  value(): StarlarkCompatibleValue {
+    const tag = this.view.getUint8(this.offset++);
+    if (tag <= 0x7f) {
+      return tag;
+    }
+    if (tag >= 0xe0) {
+      return tag - 0x100;
+    }
+    if (tag >= 0x80 && tag <= 0x8f) {
+      return this.map(tag & 0x0f);
+    }
+    if (tag >= 0x90 && tag <= 0x9f) {
+      return this.array(tag & 0x0f);
+    }
+    if (tag >= 0xa0 && tag <= 0xbf) {
+      return this.string(tag & 0x1f);
+    }
+    switch (tag) {
+      case 0xc0:
+        return null;
+      case 0xc2:
+        return false;
+      case 0xc3:
+        return true;
+      case 0xcb: {
+        const n = this.view.getFloat64(this.offset);
+        this.offset += 8;
+        return n;
+      }
+      case 0xd0:
+        return this.view.getInt8(this.offset++);
+      case 0xd1: {
+        const n = this.view.getInt16(this.offset);
+        this.offset += 2;
+        return n;
+      }
+      case 0xd2: {
+        const n = this.view.getInt32(this.offset);
+        this.offset += 4;
+        return n;
+      }
+      case 0xd3: {
+        const n = Number(this.view.getBigInt64(this.offset));
+        this.offset += 8;
+        return n;
+      }
+      case 0xd9:
+        return this.string(this.uint(1));
+      case 0xda:
+        return this.string(this.uint(2));
+      case 0xdb:
+        return this.string(this.uint(4));
+      case 0xdc:
+        return this.array(this.uint(2));
+      case 0xdd:
+        return this.array(this.uint(4));
+      case 0xde:
+        return this.map(this.uint(2));
+      case 0xdf:
+        return this.map(this.uint(4));
+    }
+    throw new Error(`Unexpected MessagePack tag 0x${tag.toString(16)}`);
+  }
+}
+
+// Decode a result encoded by the runner.
+export function decodeValue(data: Uint8Array): StarlarkCompatibleValue {
+  return new Decoder(data).value();
+}
@@ -8,29 +8,1787 @@ export type StarlarkCompatibleValue =
   | number
   | string
   | boolean
-  | null;
+  | null
+  // Only with the extendedTypes option: tuples, big ints, bytes, sets and
+  // dicts with keys other than strings.
+  | ReadonlyArray<StarlarkCompatibleValue>
+  | bigint
+  | Uint8Array
+  | Set<StarlarkCompatibleValue>
+  | Map<StarlarkCompatibleValue, StarlarkCompatibleValue>;
 
-export type Loader = (filename: string, executionId: string) => Promise<string>;
-export type PrintFn = (message: string, executionId: string) => void;
+// A list or dict returned with the lazy option: a proxy that converts each
+// element on first access. materialize converts the whole value at once, to
+// plain JS values.
+export type LazyValue = (
+  | StarlarkCompatibleDict
+  | Array<StarlarkCompatibleValue>
+) & { materialize(): StarlarkCompatibleValue };
+
+// Keyword arguments: a plain object or a Map with string keys.
+export type StarlarkKwargs =
+  | StarlarkCompatibleDict
+  | Map<string, StarlarkCompatibleValue>;
+
+// A module's source: a string, its UTF-8, or chunks of either, which the
+// runner joins, so that a large module need not be one giant string.
+export type SourceChunks = string | Uint8Array | (string | Uint8Array)[];
+
+// A module's source as a loader gives it, which may also be a stream of
+// chunks, such as the body of a fetch Response.
+export type ModuleSource = SourceChunks | ReadableStream<string | Uint8Array>;
+
+// A loaded module: its source, or the source with a hash naming this version
+// of it, which the compile cache uses instead of hashing the source.
+export type LoadedModule = ModuleSource | { source: ModuleSource; hash?: string };
+
+// Loads a module, synchronously or through a promise. The signal aborts if
+// the run is cancelled, by a timeout say, and can be handed to fetch.
+export type Loader = (
+  filename: string,
+  executionId: string,
+  signal?: AbortSignal
+) => Promise<LoadedModule> | LoadedModule;
+// Approves a module before it runs, given the SHA-256 of its source in hex:
+// only true runs it.
+export type VerifyFn = (
+  filename: string,
+  hash: string,
+  executionId: string
+) => Promise<boolean> | boolean;
+// Gives the values of the names a formula uses, all those of a formula in
+// one call, as an object by name. A name it leaves out stays undefined, and
+// fails the formula.
+export type ResolveFn = (
+  names: string[],
+  executionId: string
+) => Promise<{ [name: string]: StarlarkCompatibleValue }> | { [name: string]: StarlarkCompatibleValue };
+// A module's entry in a lockfile: the SHA-256 of its source, in hex, and
+// the URL the loader is asked for in its place, which defaults to its name.
+export interface LockedModule {
+  hash: string;
+  url?: string;
+}
+export type PrintFn = (
+  message: string,
+  executionId: string,
+  position?: PrintPosition
+) => void;
+// Called in place of a builtin the builtins option replaces, or as a host
+// function, with the arguments of the call, to return its result, or a
+// promise of it.
+export type BuiltinFn = (
+  args: StarlarkCompatibleValue[],
+  kwargs: StarlarkKwargs,
+  executionId: string
+) => StarlarkCompatibleValue | Promise<StarlarkCompatibleValue>;
+// Host functions that scripts call as builtins, by name.
+export type HostFunctions = { [name: string]: BuiltinFn };
+
+// The language features beyond Starlark's defaults that a run's modules may
+// use, and the bundled modules, such as "json" or "struct", whose members
+// they see as builtins without loading them.
+export interface Dialect {
+  // Provide the set builtin.
+  set?: boolean;
+  // Allow while loops.
+  while?: boolean;
+  // Allow if, for and while statements at the top level of a module.
+  topLevelControl?: boolean;
+  // Allow a module to assign its global names more than once.
+  globalReassign?: boolean;
+  // Allow functions to call themselves.
+  recursion?: boolean;
+  modules?: string[];
+}
+
+// Changes the builtins a run's modules see: only keeps just these, remove
+// takes these away, and replace calls the host instead. A builtin taken
+// away stays defined, and calling it fails with a PermissionError, code
+// "permissionDenied".
+export interface BuiltinsOption {
+  only?: string[];
+  remove?: string[];
+  replace?: { [name: string]: BuiltinFn };
+}
+
+export type EmitFn = (
+  value: StarlarkCompatibleValue,
+  executionId: string
+) => void;
+
+// What wasm_runner returns with the iterate option: an async iterator over
+// the values a run emits, whose last step is done with the run's result,
+// and which rejects with its error. Stopping it early, as breaking out of a
+// for await loop does, cancels the run. result settles with the outcome too.
+export interface StarlarkIteration
+  extends AsyncIterableIterator<StarlarkCompatibleValue, StarlarkCompatibleValue | StarlarkResult> {
+  readonly executionId: string;
+  readonly result: Promise<StarlarkCompatibleValue | StarlarkResult>;
+}
+// Receives a chunk of a streamed result; the next chunk waits for the promise
+// it returns, if any.
+export type ChunkFn = (chunk: StarlarkCompatibleValue) => Promise<void> | void;
+// A line that pauses an execution in debug mode.
+export interface Breakpoint {
+  filename: string;
+  line: number;
+}
+
+// How to resume a paused execution, named as in the Debug Adapter Protocol:
+// run on to the next breakpoint; pause at the next line of the same frame
+// (next), of any frame (stepIn, or step), or of the caller (stepOut); or
+// cancel the execution.
+export type DebugCommand =
+  | "continue"
+  | "next"
+  | "stepIn"
+  | "stepOut"
+  | "step"
+  | "stop";
+
+// Where a paused execution stopped and why, with the locals of every frame.
+export interface PausedEvent extends DiagnosticTags {
+  reason: "breakpoint" | "step";
+  position: PrintPosition;
+  // Outermost frame first.
+  backtrace: BacktraceFrame[];
+  // Set when the run has watch expressions, evaluated in the innermost
+  // frame.
+  watches?: WatchResult[];
+}
+
+export type PausedFn = (event: PausedEvent, executionId: string) => void;
+
+// The value of a watch expression, as its repr, or why it could not be
+// evaluated.
+export interface WatchResult {
+  expression: string;
+  type?: string;
+  value?: string;
+  error?: string;
+}
+
+// The watch expressions at a new line of a run with watchOn: "line".
+export interface WatchEvent extends DiagnosticTags {
+  position: PrintPosition;
+  watches: WatchResult[];
+}
+
+export type WatchFn = (event: WatchEvent, executionId: string) => void;
+
+// Something a traced run did, at time milliseconds since it started. Calls
+// and returns pair up into spans, as do load and loaded; builtin events are
+// spans of duration milliseconds ending at time. Only the builtins of the
+// bundled modules and eprint and emit are traced, and builtins only show as
+// calls when they call back into Starlark, such as sorted with a key.
+export interface TraceEvent {
+  type: "call" | "return" | "load" | "loaded" | "print" | "builtin";
+  time: number;
+  // The function or builtin, the module, or for print, the stream.
+  name: string;
+  // The thread it happened on, which tells apart the top level of each
+  // module loaded.
+  thread?: string;
+  // The depth of the frame called or returned from, for call and return.
+  depth?: number;
+  // Where the function begins, or where the print or builtin was called.
+  position?: PrintPosition;
+  duration?: number;
+  // The run's labels option, if it had one.
+  labels?: Labels;
+}
+
+export type TraceFn = (events: TraceEvent[], executionId: string) => void;
+
+// Picks the variables of a paused execution to list: those of a scope of a
+// frame, or the elements of a value, reached by a path of the variable's
+// name and then the index of an element of each value in turn.
+export interface InspectRequest {
+  // Indexes the backtrace of the paused event, outermost first; 0 by
+  // default.
+  frame?: number;
+  // "locals" by default.
+  scope?: "locals" | "globals";
+  path?: [string, ...number[]];
+  // The window of the variables to list; the first 100 by default.
+  start?: number;
+  count?: number;
+}
+
+export interface InspectedVariable {
+  // An element's index, the repr of its key for a dict, or the name of an
+  // attribute.
+  name: string;
+  type: string;
+  // The repr of the value, cut short if long.
+  value: string;
+  // Set for values with elements to inspect, to how many there are.
+  elements?: number;
+}
+
+// The call stack of a running execution, taken without stopping it.
+export interface StackSnapshot extends DiagnosticTags {
+  // Outermost frame first, through the modules being loaded.
+  backtrace: BacktraceFrame[];
+  steps: number;
+  // Set if the execution was waiting on the host, e.g. for a load or an
+  // awaited promise, or paused in debug mode, rather than running.
+  waiting: boolean;
+}
+
+export interface InspectResult {
+  variables: InspectedVariable[];
+  // How many variables there are, of which the request listed a window.
+  total: number;
+}
+export type WarningFn = (warning: StarlarkWarning, executionId: string) => void;
+
+// The outcome of a run with the retainResult option, kept after it settled,
+// in the form of Promise.allSettled's: the value it resolved with, or the
+// error it rejected with.
+export type StoredResult = (
+  | { status: "fulfilled"; value: StarlarkCompatibleValue | StarlarkResult | Uint8Array }
+  | { status: "rejected"; reason: StarlarkRunError }
+) & {
+  executionId: string;
+  // In milliseconds since the Unix epoch.
+  settledAt: number;
+};
+
+// Tags a run with the host's own names for it, as {tenant: "acme"}.
+export type Labels = { [label: string]: string };
+
+// Bounds the cumulative use of a tenant's runs, with time in milliseconds.
+// A limit left out is no limit.
+export interface QuotaLimits {
+  steps?: number;
+  time?: number;
+  loads?: number;
+  hostCalls?: number;
+}
+
+// The priority classes of runs, as the priority option sets them.
+export type RunPriority = "interactive" | "batch";
+
+// Evicts the REPL sessions a host abandons: those idle for idleTimeout
+// milliseconds, and the one idle the longest when opening another would
+// make more than maxSessions. A limit left out is no limit.
+export interface SessionPolicy {
+  idleTimeout?: number;
+  maxSessions?: number;
+}
+
+// A REPL session of its own, as Starlark.createSession opens it, whose
+// chunks and calls see only the globals defined in it.
+export interface StarlarkSession {
+  readonly sessionId: string;
+  // Run a chunk of source in the session, as Starlark.repl.
+  repl(source: string, maxExecutionTime?: number): Promise<StarlarkCompatibleValue>;
+  // Call a function that the session's chunks defined.
+  call(
+    functionName: string,
+    args?: StarlarkCompatibleValue[],
+    kwargs?: StarlarkKwargs,
+    maxExecutionTime?: number
+  ): Promise<StarlarkCompatibleValue>;
+  // Drop the session and its globals. Returns whether it was open.
+  close(): boolean;
+}
+
+// A run of the instance, as Starlark.listExecutions lists it: running, or
+// queued while the concurrency limit keeps it waiting. Times are in
+// milliseconds since the Unix epoch.
+export interface ExecutionInfo {
+  executionId: string;
+  state: "running" | "queued";
+  priority: RunPriority;
+  calledAt: number;
+  // Unless queued.
+  startedAt?: number;
+  steps?: number;
+  sessionId?: string;
+  labels?: Labels;
+}
+
+// What a tenant's runs used, once they ended, with time in milliseconds.
+export interface QuotaUsage {
+  runs: number;
+  steps: number;
+  time: number;
+  loads: number;
+  hostCalls: number;
+}
+
+export interface Quota {
+  tenant: string;
+  limits: QuotaLimits;
+  usage: QuotaUsage;
+}
+
+// Identifies the run that produced a warning or error.
+export interface DiagnosticTags {
+  // The wasm module instance that produced it; see Starlark.instanceId.
+  instanceId: string;
+  executionId: string;
+  // Set when the Starlark instance was configured with a sessionId.
+  sessionId?: string;
+  // Set when the run had labels.
+  labels?: Labels;
+  // Set on the error a run with the audit option is rejected with.
+  audit?: AuditLog;
+}
+
+// A non-fatal diagnostic, e.g. a value that lost information in conversion.
+export interface StarlarkWarning extends DiagnosticTags {
+  code: "dropped_undefined" | "lossy_conversion" | "unsupported_type";
+  // Where the value sits, e.g. 'args[0]["items"][2]' or 'result["total"]'.
+  path: string;
+  message: string;
+}
+
+// Where a print() call was made, passed to the print callback when the
+// printPositions option is set.
+export interface PrintPosition {
+  filename: string;
+  line: number;
+  column: number;
+}
+
+export type HostErrorPolicy = "abort" | "raise" | "log";
+
+export type PrintPolicy = "allow" | "discard" | "deny";
+
+export interface RunOptions {
+  // Resolve with a StarlarkResult instead of the bare return value.
+  envelope?: boolean;
+  // Resolve with a SettledResult even if the run fails, instead of
+  // rejecting. Implies envelope.
+  settle?: boolean;
+  // Pass the position of each print() call to the print callback.
+  printPositions?: boolean;
+  // Buffer output instead of calling the print callbacks, and return it in
+  // the StarlarkResult. Implies envelope.
+  captureOutput?: boolean;
+  // Deliver output to the print callbacks in batches of up to this many
+  // lines, which is much faster for scripts that print a lot. Batches are
+  // also delivered when they have waited printFlushInterval milliseconds
+  // (50 by default), and when the run finishes.
+  printBatchSize?: number;
+  printFlushInterval?: number;
+  // Pause the run once it has printed this many lines not yet acknowledged
+  // with ackOutput, until they are, so that output cannot outrun the page
+  // rendering it.
+  maxUnackedOutput?: number;
+  // Attach each frame's local variables to StarlarkEvalErrors.
+  captureLocals?: boolean;
+  // Deliver trace events to the trace callback, in batches and at the end
+  // of the run. Like captureLocals, it slows execution.
+  trace?: boolean;
+  // Run under Starlark's profiler and return the profile in the
+  // StarlarkResult. Implies envelope. A profiled run cannot overlap other
+  // runs: it is rejected if any are in flight, and so are runs started
+  // while it is.
+  profile?: boolean;
+  // Sample the lines the run executes, and return this many of those that
+  // took the most steps in the StarlarkResult. Implies envelope.
+  profileLines?: number;
+  // Log the host's answers the run depends on, the modules it loads and the
+  // readings of time.now(), and return them in the StarlarkResult as a
+  // HostRecording. Implies envelope.
+  record?: boolean;
+  // Answer loads and time.now() from a recording made by an earlier run
+  // instead of the host, failing the run on anything it lacks.
+  replay?: HostRecording;
+  // Log every call the run makes to the host's callbacks, and return the
+  // log as audit on the StarlarkResult, or on the error if the run fails.
+  // Implies envelope.
+  audit?: boolean;
+  // Count what the run does under a fixed cost model, for billing, as
+  // stats.meter. Implies envelope.
+  meter?: boolean;
+  // What to do when a print, printError or onEmit callback throws: reject
+  // the run with a StarlarkHostError ("abort", the default), fail the
+  // script with a runtime error where it made the call ("raise"), or log it
+  // and carry on ("log").
+  onHostError?: HostErrorPolicy;
+  // Limit, in bytes, on the error quoted in error messages; 0 disables it.
+  // Defaults to 8192.
+  maxErrorLength?: number;
+  // Reject the run with a StarlarkStepLimitError once it has executed more
+  // than this many steps, counted as in stats.steps.
+  maxSteps?: number;
+  // Reject the run with a StarlarkResultSizeError as soon as converting the
+  // result passes this many bytes: those of its strings and keys, 8 per
+  // number and 1 per anything else. Applies to each chunk with chunkSize.
+  maxResultSize?: number;
+  // Fail the run with code "valueTooLarge" once a string, bytes, list,
+  // tuple, dict or set held by the script's variables has more than this
+  // many bytes or elements, and with code "totalTooLarge" once all of them
+  // together have more than maxTotalSize. Checked every thousand steps or
+  // so, and only for values assigned to variables.
+  maxValueSize?: number;
+  maxTotalSize?: number;
+  // The fractions of maxTotalSize at which a memoryWatermark event tells
+  // of the size of the run's values. Defaults to [0.7, 0.9].
+  memoryWatermarks?: number[];
+  // Fail the loads of the run once it has loaded this many modules from the
+  // loader, with code "tooManyModules", or once their source adds up to
+  // more than maxSourceSize bytes, with code "sourceTooLarge". The entry
+  // file counts, and bundled modules do not.
+  maxModules?: number;
+  maxSourceSize?: number;
+  // Fail the run with a StarlarkThrottleError once it calls host builtins
+  // (eprint, emit, plugin builtins and granted replacements) more than
+  // maxCallRate times a second, allowing bursts of up to callBurst calls.
+  // callBurst defaults to the rate rounded up.
+  maxCallRate?: number;
+  callBurst?: number;
+  // Return lists and dicts in the result as LazyValue proxies that convert
+  // their elements on first access. Ignored with the binary option.
+  lazy?: boolean;
+  // Stream a list or dict result to the chunk callback in chunks of this
+  // many elements, resolving with null. Overrides lazy and binary for the
+  // result.
+  chunkSize?: number;
+  // Have wasm_runner return a StarlarkIteration over the values the run
+  // emits instead of a promise. Dropped by StarlarkWorker.
+  iterate?: boolean;
+  // Reuse the globals of modules that have not changed since an earlier
+  // run, so that their top-level code only runs once.
+  cacheGlobals?: boolean;
+  // Pass arguments and the result as MessagePack in Uint8Arrays, which is
+  // much faster for large values. The Starlark class encodes and decodes
+  // them.
+  binary?: boolean;
+  // Reject lossy conversions with a StarlarkConversionError instead of
+  // warning about them.
+  strict?: boolean;
+  // Convert tuples to and from frozen arrays, sets to and from Sets, bytes
+  // to and from Uint8Arrays, ints beyond Number.MAX_SAFE_INTEGER to and from
+  // BigInts, and dicts with keys other than strings to Maps (and any Map to
+  // a dict), rather than losing them.
+  extendedTypes?: boolean;
+  // Turns on debug mode, pausing the run on reaching these lines and calling
+  // the paused callback, until starlark.resume is called.
+  breakpoints?: Breakpoint[];
+  // Expressions to evaluate in the innermost frame at every pause, for the
+  // paused event, and with watchOn: "line" at every new line too, for the
+  // watch callback. They see the frame's locals and its module's globals,
+  // and each may take up to 100000 steps; they should not change what they
+  // see. Turns on debug mode like breakpoints.
+  watch?: string[];
+  watchOn?: "pause" | "line";
+  // Attached to warnings and errors, alongside the executionId. Also names
+  // the session that starlark.repl runs chunks in.
+  sessionId?: string;
+  // The host's own tags for the run, such as its tenant, feature or user,
+  // attached to its warnings, errors, events, stats and trace events, and
+  // totalled in Starlark.usage.
+  labels?: Labels;
+  // Let the run call only these of the host builtins: the runner's own,
+  // eprint and emit, and those that plugins add. Calls to the others fail
+  // with a PermissionError, code "permissionDenied". All are allowed if
+  // not set.
+  allowBuiltins?: string[];
+  // Restrict or replace the builtins the run's modules see, such as
+  // getattr and dir, or the runner's own and those of plugins. Replacements
+  // cannot cross to a worker.
+  builtins?: BuiltinsOption;
+  // Functions of the host the run's modules call as builtins, in addition
+  // to those on globalThis.starlark, which the run's own of the same name
+  // take the place of. They cannot cross to a worker.
+  hostFunctions?: HostFunctions;
+  // The dialect of the run's modules. Features and modules it gives take the
+  // place of those of the dialect on globalThis.starlark.
+  dialect?: Dialect;
+  // What becomes of the run's print and eprint output: delivered as usual
+  // with "allow", the default, dropped with "discard", or failing the run
+  // with a PermissionError, code "printDenied", with "deny".
+  printPolicy?: PrintPolicy;
+  // Credentials the run reads as attributes of the secrets global, such as
+  // secrets.token, and which are redacted from its output, result and
+  // errors.
+  secrets?: Record<string, string>;
+  // Resolve every load of the run, the file run included, from this
+  // lockfile: the loader is asked for each module's url, and a module the
+  // lockfile lacks, code "notLocked", or whose source has some other hash,
+  // code "lockDrift", fails to load.
+  lockfile?: Record<string, LockedModule>;
+  // Patterns, as Go's path.Match takes them, of the modules the run's load
+  // statements may load, bundled ones included, where "*" matches within a
+  // directory: any, or those allowLoads matches, bar those denyLoads
+  // matches. A load of another fails with a PermissionError, code
+  // "loadForbidden". The file run need not match.
+  allowLoads?: string[];
+  denyLoads?: string[];
+  // Have the verify callback on globalThis.starlark approve each module
+  // before it runs, as a run's own verify does.
+  verifyModules?: boolean;
+  // How many steps the run takes in each turn while other runs are busy
+  // too, as a multiple of the usual: a run with share 2 makes twice the
+  // progress of one with 1, the default. Between 0.01 and 10.
+  share?: number;
+  // "batch" has the run wait while any "interactive" run, the default, is
+  // in progress, so that background work never holds up a user's.
+  priority?: RunPriority;
+  // Keep the run's outcome for this many milliseconds after it settles, for
+  // Starlark.result to return, should the code awaiting it be gone.
+  retainResult?: number;
+  // An idempotency token naming the attempts of a run the host retries,
+  // whose time adds up against retryBudget milliseconds, or else against
+  // the time limit of one attempt. An attempt past the budget times out
+  // with code "retryBudget".
+  retryKey?: string;
+  retryBudget?: number;
+  // The language of the runner's own error messages, such as "fr" or
+  // "pt-BR", if Starlark.setMessages gave messages for it; English
+  // otherwise, and for any message the locale's catalog lacks.
+  locale?: string;
+  // The time limit of starlark.repl, in seconds, which takes no
+  // maxExecutionTime argument.
+  maxExecutionTime?: number;
+  // Callbacks for this run alone, in place of those on globalThis.starlark,
+  // for calling wasm_runner directly. Functions cannot cross to a worker,
+  // so a StarlarkWorker's runs cannot take them.
+  load?: Loader;
+  verify?: VerifyFn;
+  resolve?: ResolveFn;
+  print?: PrintFn;
+  printError?: PrintFn;
+  printBatch?: (lines: OutputLine[], executionId: string) => void;
+  emit?: EmitFn;
+  cacheGet?: (key: string, executionId: string) => unknown;
+  cachePut?: (key: string, value: Uint8Array | LoadedModule, executionId: string) => unknown;
+}
+
+// The options of Starlark.runSync: what to run, and the run options, bar
+// those that cannot work without waiting on the host.
+export interface RunSyncOptions
+  extends Omit<RunOptions, "breakpoints" | "watch" | "profile" | "chunkSize" | "lazy" | "iterate"> {
+  // The name the source is run as. Defaults to "<runSync>".
+  filename?: string;
+  // The function to call once the module has run, if any.
+  functionName?: string;
+  args?: StarlarkCompatibleValue[];
+  kwargs?: StarlarkKwargs;
+  // In seconds, and fractions of one.
+  maxExecutionTime?: number;
+  // Defaults to "sync-" and a count.
+  executionId?: string;
+}
+
+// What starlark.runSync returns: the result, or what a run would have been
+// rejected with.
+export type RunSyncOutcome =
+  | { value: StarlarkCompatibleValue | StarlarkResult }
+  | { error: StarlarkRunError };
+
+// A request to starlark.run, or Starlark.call: the arguments of wasm_runner
+// by name. Fields it does not know are errors, rather than ignored.
+export interface RunRequest {
+  file: string;
+  // The function to call. Without one the file is only run, and the result
+  // has a null value.
+  entry?: string;
+  args?: StarlarkCompatibleValue[];
+  kwargs?: StarlarkKwargs;
+  timeoutMs?: number;
+  limits?: Pick<
+    RunOptions,
+    | "maxSteps"
+    | "maxResultSize"
+    | "maxValueSize"
+    | "maxTotalSize"
+    | "maxModules"
+    | "maxSourceSize"
+    | "maxCallRate"
+    | "callBurst"
+    | "maxErrorLength"
+  >;
+  // Callbacks for this run alone, which cannot cross to a worker.
+  io?: Pick<RunOptions, "load" | "print" | "printError" | "printBatch" | "emit">;
+  // The sessionId of RunOptions.
+  session?: string;
+  // The executionId. Defaults to "run-" and a count.
+  id?: string;
+  // The other run options. The result is always a StarlarkResult.
+  options?: Omit<RunOptions, "envelope" | "binary">;
+}
+
+export interface DetailsOptions {
+  captureOutput?: boolean;
+  profile?: boolean;
+  profileLines?: number;
+  record?: boolean;
+  replay?: HostRecording;
+  audit?: boolean;
+  meter?: boolean;
+}
+
+// What a run did, counted under the cost model numbered model, which does
+// not depend on the machine, the host's configuration or the cache.
+// units is what it costs: each step 1, each call 100, each load 1000 and
+// each unit of allocations 1.
+export interface Meter {
+  model: number;
+  steps: number;
+  // Lines printed and values emitted.
+  calls: number;
+  // Modules loaded by the run, each once, bundled ones left out.
+  loads: number;
+  // The most the script's variables held at once, in the bytes of strings
+  // and the elements of collections, as maxTotalSize measures it.
+  allocations: number;
+  units: number;
+}
+
+// A call a run made to one of the host's callbacks, such as load or print.
+// Times are in milliseconds, time since the run started, and a load's
+// duration includes the wait for its promise.
+export interface AuditEntry {
+  callback: string;
+  // The arguments, in short: the module loaded, the line printed, the
+  // value emitted, the name of a replaced builtin, or the number of lines,
+  // items or events delivered.
+  summary: string;
+  time: number;
+  duration: number;
+  outcome: "ok" | "error";
+  // What the callback threw or rejected with.
+  error?: string;
+}
+
+export interface AuditLog {
+  // The first 10000 calls, in order.
+  entries: AuditEntry[];
+  // The calls past the first 10000.
+  dropped: number;
+}
+
+// An answer from the host that a run with the record option depended on:
+// a module its load callback served or failed to, or a reading of the
+// clock, as an RFC 3339 time.
+export type HostResponse =
+  | { type: "load"; filename: string; source: string; hash?: string }
+  | { type: "load"; filename: string; error: string }
+  | { type: "now"; time: string };
+
+// The host responses of a run, in the order they were made. It is plain
+// JSON, to attach to bug reports and replay with the replay option.
+export interface HostRecording {
+  version: 1;
+  entries: HostResponse[];
+}
+
+// The steps and time the line profiler attributed to a line, in
+// milliseconds, from its samples, one every 10 steps.
+export interface LineCost {
+  filename: string;
+  line: number;
+  steps: number;
+  time: number;
+  samples: number;
+}
+
+// A line of output buffered by the captureOutput option.
+export interface OutputLine {
+  stream: "stdout" | "stderr";
+  message: string;
+  // Set when the printPositions option is set.
+  position?: PrintPosition;
+}
+
+export interface StarlarkResult {
+  value: StarlarkCompatibleValue;
+  warnings: StarlarkWarning[];
+  // Present when the captureOutput option is set.
+  output?: OutputLine[];
+  stats: ExecutionStats;
+  // Present when the profile option is set: a gzipped pprof profile of the
+  // wall time spent in each Starlark function.
+  profile?: Uint8Array;
+  // The same profile as folded stacks, for flame graph tools: a line per
+  // stack, outermost frame first, and its wall time in nanoseconds.
+  foldedProfile?: string;
+  // Present when the profileLines option is set, the costliest line first.
+  lineProfile?: LineCost[];
+  // Present when the record option is set.
+  recording?: HostRecording;
+  // Present when the audit option is set.
+  audit?: AuditLog;
+}
+
+// What a run with the settle option resolves with, whether it succeeded or
+// not: the envelope, with ok, the error of a failure instead of a value, and
+// everything the run printed as logs, which also went to the callbacks.
+export type SettledResult = StarlarkResult & { logs: OutputLine[] } & (
+    | { ok: true }
+    | { ok: false; value: null; error: StarlarkRunError }
+  );
+
+export interface ExecutionStats {
+  // Steps executed across all threads of the execution.
+  steps: number;
+  // Time spent in each phase of the call, in milliseconds.
+  timings: {
+    convertArgs: number;
+    // Fetching modules from the loader and compiling them.
+    load: number;
+    // Running Starlark code, less any loading along the way.
+    execute: number;
+    convertResult: number;
+    total: number;
+  };
+  // Memory of the whole wasm instance, in bytes, from the Go runtime.
+  memory: {
+    // Allocated during the call, including by any runs in flight at the
+    // same time.
+    allocated: number;
+    // Heap in use after the call, and how much it grew by.
+    heapInUse: number;
+    heapInUseChange: number;
+  };
+  timeline: ExecutionTimeline;
+  // The run's labels option, if it had one.
+  labels?: Labels;
+  // With the meter option.
+  meter?: Meter;
+}
+
+// When each phase of a call began and ended, in milliseconds since origin,
+// the time of the call in milliseconds since the Unix epoch, as Date.now()
+// counts. Phases are in the order they began, and nest: a module's init
+// contains the loads of the modules it loads.
+export interface ExecutionTimeline {
+  origin: number;
+  phases: TimelinePhase[];
+}
+
+export interface TimelinePhase {
+  phase:
+    | "queued"
+    | "convertArgs"
+    | "load"
+    | "compile"
+    | "init"
+    | "execute"
+    | "convertResult";
+  // Set for the phases of a module: load, compile and init.
+  module?: string;
+  start: number;
+  end: number;
+}
+
+// The modules a precompile compiled, or took from the persistent cache, and
+// those that were cached already, by filename.
+export interface PrecompileResult {
+  compiled: string[];
+  cached: string[];
+}
+
+// Measurements of the module cache since the wasm module started, or since
+// the cache was last reset or cleared.
+export interface CacheStats {
+  shards: number;
+  // Compiled modules currently cached.
+  modules: number;
+  lookups: number;
+  hits: number;
+  // Lookups and stores that waited for another execution to release a
+  // shard, and how long they waited in total, in milliseconds.
+  contended: number;
+  waited: number;
+}
+
+// What Starlark.reset dropped.
+export interface ResetResult {
+  // Runs cancelled, including REPL chunks.
+  cancelled: number;
+  sessions: number;
+  // Compiled modules, and results kept with the retainResult option.
+  modules: number;
+  results: number;
+}
+
+export interface BenchmarkSpec {
+  filename: string;
+  // Defaults to "main".
+  function?: string;
+  args?: StarlarkCompatibleValue[];
+  kwargs?: StarlarkKwargs;
+  // Timed calls, 10 by default, after warmup untimed ones, 1 by default.
+  iterations?: number;
+  warmup?: number;
+  // Limit on the whole benchmark, in seconds.
+  maxExecutionTime?: number;
+}
+
+export interface BenchmarkSummary {
+  min: number;
+  median: number;
+  p95: number;
+  mean: number;
+}
+
+export interface BenchmarkResult {
+  iterations: number;
+  warmup: number;
+  // Times are in milliseconds, measured inside the wasm module.
+  time: BenchmarkSummary;
+  steps: BenchmarkSummary;
+  samples: { time: number; steps: number }[];
+}
+
+// The expected outcome of a call, as text: the lines it prints to each
+// stream, and its return value as JSON indented by two spaces, with the keys
+// of dicts sorted, or its repr if it has no JSON encoding. Only the parts
+// given are compared.
+export interface GoldenData {
+  stdout?: string;
+  stderr?: string;
+  value?: string;
+}
+
+export interface GoldenSpec {
+  filename: string;
+  // Defaults to "main".
+  function?: string;
+  args?: StarlarkCompatibleValue[];
+  kwargs?: StarlarkKwargs;
+  maxExecutionTime?: number;
+  golden: GoldenData;
+}
+
+// A run of changed lines, with up to 3 unchanged lines around them. The
+// ranges are numbered from 1, as in a unified diff's @@ line.
+export interface GoldenHunk {
+  goldenStart: number;
+  goldenLines: number;
+  actualStart: number;
+  actualLines: number;
+  lines: { kind: "equal" | "delete" | "insert"; text: string }[];
+}
+
+export interface GoldenDiff {
+  part: keyof GoldenData;
+  // The hunks as a unified diff, from golden/<part> to actual/<part>.
+  unified: string;
+  hunks: GoldenHunk[];
+}
+
+export interface GoldenResult {
+  passed: boolean;
+  // Every part of the outcome, to update golden data from.
+  actual: Required<GoldenData>;
+  // A diff of each part that did not match.
+  diffs: GoldenDiff[];
+}
+
+// A test case of Starlark.grade: a call of a function of the module, and
+// what it should return. A case with neither expected nor check passes if
+// the call succeeds.
+export interface GradeCase {
+  // Defaults to "case 1", "case 2" and so on.
+  name?: string;
+  // Defaults to "main".
+  function?: string;
+  args?: StarlarkCompatibleValue[];
+  kwargs?: StarlarkKwargs;
+  // Compared with the value returned, as Starlark's == does.
+  expected?: StarlarkCompatibleValue;
+  // The name of a function of the checker module, called with the value
+  // returned and the case's arguments, or a host function, called with the
+  // value and the case. Either answers whether the case passed, or with a
+  // string, the message it failed with.
+  check?: string | ((value: StarlarkCompatibleValue, testCase: GradeCase) => boolean | string | Promise<boolean | string>);
+  // Limits on the case alone, in steps and milliseconds, in place of the
+  // spec's; 0 lifts a limit.
+  maxSteps?: number;
+  timeout?: number;
+}
+
+export interface GradeSpec {
+  filename: string;
+  // A module of check functions, loaded as the module is.
+  checker?: string;
+  cases: GradeCase[];
+  // The limits of each case that does not set its own.
+  maxSteps?: number;
+  timeout?: number;
+  // Limit on the whole grading, in seconds.
+  maxExecutionTime?: number;
+}
+
+export interface GradeCaseResult {
+  name: string;
+  passed: boolean;
+  // What the call returned, if it returned, and converts to JS.
+  value?: StarlarkCompatibleValue;
+  repr?: string;
+  // The message a check failed the case with.
+  message?: string;
+  // Why the call, or the checker module's check, failed.
+  error?: StarlarkRunError;
+  output: OutputLine[];
+  steps: number;
+  // In milliseconds, measured inside the wasm module.
+  time: number;
+}
+
+export interface GradeResult {
+  passed: number;
+  failed: number;
+  steps: number;
+  cases: GradeCaseResult[];
+}
+
+export interface RenderSpec {
+  filename: string;
+  // The one global to render, such as a dict named config, in place of
+  // all the module's globals.
+  global?: string;
+  // Spaces to indent the document by; 0, the default, for none.
+  indent?: number;
+  // Limit on the run, in seconds.
+  maxExecutionTime?: number;
+}
+
+export interface RenderResult {
+  // The JSON document.
+  json: string;
+  // The globals left out for having no JSON encoding, such as functions.
+  skipped: string[];
+}
+
+// One of the two renders of a render diff. The filename and global default
+// to those of the spec. With args or kwargs, what the global returns when
+// called with them is rendered.
+export interface RenderDiffSide {
+  filename?: string;
+  global?: string;
+  args?: any[];
+  kwargs?: { [key: string]: any };
+}
+
+export interface RenderDiffSpec {
+  filename?: string;
+  global?: string;
+  before: RenderDiffSide;
+  after: RenderDiffSide;
+  // Limit on the run, in seconds.
+  maxExecutionTime?: number;
+}
+
+// A change from the render before to the render after, at a path into them
+// such as ["scaling"]["max"], empty for the documents themselves. An element
+// removed from a list is at its index before, any other at its index after.
+export interface RenderChange {
+  path: string;
+  kind: "added" | "removed" | "changed";
+  // Unless added.
+  old?: any;
+  // Unless removed.
+  new?: any;
+}
+
+export interface RenderDiffResult {
+  // The first 1000 changes.
+  changes: RenderChange[];
+  total: number;
+}
+
+export interface CapturedLocal {
+  name: string;
+  type: string;
+  // The repr of the value, truncated if long.
+  value: string;
+}
+
+export interface BacktraceFrame {
+  name: string;
+  position: PrintPosition;
+  // Set when the captureLocals option is set.
+  locals?: CapturedLocal[];
+}
+
+// The events of an instance's runs, by name, as its handlers are given
+// them; see Starlark.on.
+export interface RunnerEventMap {
+  // A line printed, even by a run that captures or batches its output.
+  print: { stream: OutputLine["stream"]; message: string; position?: PrintPosition };
+  // A running execution's steps and milliseconds so far, at most every
+  // 100ms.
+  progress: { steps: number; elapsed: number };
+  // A module that loaded and ran its top level, the file run included.
+  moduleLoaded: { filename: string };
+  warning: { warning: StarlarkWarning };
+  // The end of a run, and the error it failed with, if it did.
+  done: { ok: boolean; error?: StarlarkRunError };
+  // A REPL session the session policy evicted, with the milliseconds it
+  // had been idle and those of its globals that convert to JS without
+  // loss. The executionId is that of its last chunk.
+  sessionEvicted: {
+    reason: "idle" | "limit";
+    idle: number;
+    globals: { [name: string]: StarlarkCompatibleValue };
+  };
+  // A level of a memory budget that a run's values, of maxTotalSize, or
+  // the instance's heap in use, of Starlark.setMemoryBudget, has risen to,
+  // in bytes, with the executionIds of the runs in progress for the
+  // instance.
+  memoryWatermark: {
+    scope: "execution" | "instance";
+    level: number;
+    used: number;
+    limit: number;
+    executions?: string[];
+  };
+  // The security events, each of a policy that a run's script broke, and
+  // failed for with the error of the code given. A module the verifier
+  // did not approve, or the lockfile or load patterns do not allow, with
+  // the hash of its source and the hash the lockfile has for it.
+  loadDenied: {
+    filename: string;
+    code: "notApproved" | "notLocked" | "lockDrift" | "loadForbidden";
+    hash?: string;
+    locked?: string;
+  };
+  // A run refused as its tenant has used up a quota.
+  quotaExceeded: { tenant: string; resource: keyof QuotaLimits; used: number; limit: number };
+  // A builtin the allowBuiltins, builtins or printPolicy options keep the
+  // script from calling.
+  capabilityDenied: { function: string; code: "permissionDenied" | "printDenied" };
+}
+
+export type RunnerEventName = keyof RunnerEventMap;
+
+export type RunnerEvent<K extends RunnerEventName = RunnerEventName> = RunnerEventMap[K] & {
+  type: K;
+  executionId: string;
+  instanceId: string;
+  sessionId?: string;
+  labels?: Labels;
+};
+
+export type RunnerEventHandler<K extends RunnerEventName = RunnerEventName> = (
+  event: RunnerEvent<K>,
+  executionId: string
+) => void;
+
+// The codes of the runner's own errors, which stay the same whatever the
+// locale of their messages. Each names a message of the catalogs given to
+// Starlark.setMessages.
+export type RunnerErrorCode =
+  | "timeout"
+  | "missingFunction"
+  | "evalFailed"
+  | "execFailed"
+  | "loadFailed"
+  | "noLoader"
+  | "loadNotAwaited"
+  | "loadInvalid"
+  | "permissionDenied"
+  | "printDenied"
+  | "valueTooLarge"
+  | "totalTooLarge"
+  | "tooManyModules"
+  | "sourceTooLarge"
+  | "noVerifier"
+  | "verifyFailed"
+  | "notApproved"
+  | "notLocked"
+  | "lockDrift"
+  | "loadForbidden"
+  | "retryBudget"
+  | "stepLimit"
+  | "throttled"
+  | "atPosition";
+
+// A catalog of messages for a locale: templates by code, in which {file},
+// {function}, {cause}, {namespace}, {type}, {error}, {position}, {name},
+// {size}, {limit}, {hash}, {locked}, {key}, {builtin}, {rate} and {burst}
+// stand for the error's details.
+export type MessageCatalog = { [code in RunnerErrorCode]?: string };
+
+// Rejection value for errors without further structure, such as a missing
+// function.
+export interface StarlarkError extends DiagnosticTags {
+  kind: "error";
+  message: string;
+  // Set for the runner's own errors, such as a missing function.
+  code?: RunnerErrorCode;
+}
+
+// Rejection value for runtime errors in starlark code.
+export interface StarlarkEvalError extends DiagnosticTags {
+  kind: "eval";
+  message: string;
+  // What failed: evalFailed for the module, execFailed for the function it
+  // was called for, or the code of the runner's error it came from, such as
+  // loadFailed.
+  code: RunnerErrorCode;
+  // Outermost frame first.
+  backtrace: BacktraceFrame[];
+  // Where the error happened: that of the innermost frame of the script,
+  // the call to a builtin such as fail() rather than the builtin itself.
+  position?: PrintPosition;
+  // Set when the error is a failed assert.eq.
+  assertion?: AssertionFailure;
+}
+
+// Rejection value for source that does not parse, or that uses names that
+// are not defined.
+export interface StarlarkSyntaxError extends DiagnosticTags {
+  kind: "syntax";
+  message: string;
+  // evalFailed, or the code of the runner's error it came from.
+  code: RunnerErrorCode;
+  // Where the first problem is.
+  position: PrintPosition;
+  // Every problem found, in the order of the source.
+  errors: { message: string; position: PrintPosition }[];
+}
+
+// A difference between the actual and expected values of an assert.eq, at a
+// path into them such as ["rows"][2].name, empty for the values
+// themselves. The values are reprs, truncated if long.
+export interface ValueDiff {
+  path: string;
+  kind: "added" | "removed" | "changed";
+  // Unless removed.
+  actual?: string;
+  // Unless added.
+  expected?: string;
+}
+
+export interface AssertionFailure {
+  // The first 100 differences.
+  diffs: ValueDiff[];
+  // All the differences, including those left out.
+  total: number;
+}
+
+// Rejection value used when an execution exceeds maxExecutionTime.
+export interface StarlarkTimeoutError extends DiagnosticTags {
+  kind: "timeout";
+  message: string;
+  // "retryBudget" if the time shared by the run's retryKey ran out.
+  code: "timeout" | "retryBudget";
+  // Steps executed across all threads of the execution.
+  steps: number;
+  // Where the script was interrupted; omitted if it did not stop in time.
+  position?: PrintPosition;
+  // Outermost frame first.
+  backtrace?: BacktraceFrame[];
+}
+
+// Rejection value for a lossy conversion when the strict option is set.
+export interface StarlarkConversionError extends DiagnosticTags {
+  kind: "conversion";
+  code: StarlarkWarning["code"];
+  path: string;
+  message: string;
+}
+
+// Rejection value when a run passes the maxSteps option.
+export interface StarlarkStepLimitError extends DiagnosticTags {
+  kind: "steps";
+  message: string;
+  code: "stepLimit";
+  limit: number;
+  // Steps executed, the last of which was over the limit.
+  steps: number;
+  // Where the script was stopped.
+  position?: PrintPosition;
+  // Outermost frame first.
+  backtrace?: BacktraceFrame[];
+}
+
+// Rejection value when a run calls host builtins faster than the
+// maxCallRate option allows.
+export interface StarlarkThrottleError extends DiagnosticTags {
+  kind: "throttled";
+  message: string;
+  code: "throttled";
+  // The builtin whose call was over the limit.
+  builtin: string;
+  rate: number;
+  burst: number;
+  // Where the script made the call.
+  position?: PrintPosition;
+  // Outermost frame first.
+  backtrace?: BacktraceFrame[];
+}
+
+// Rejection value for a run whose tenant has used up a quota, before it
+// started.
+export interface StarlarkQuotaError extends DiagnosticTags {
+  kind: "quota";
+  message: string;
+  tenant: string;
+  resource: keyof QuotaLimits;
+  used: number;
+  limit: number;
+}
+
+// Rejection value when a result passes the maxResultSize option.
+export interface StarlarkResultSizeError extends DiagnosticTags {
+  kind: "resultSize";
+  message: string;
+  limit: number;
+  // The size reached, at the value at path.
+  size: number;
+  path: string;
+}
+
+// Rejection value when a host callback throws and the onHostError policy is
+// "abort".
+export interface StarlarkHostError extends DiagnosticTags {
+  kind: "host";
+  callback:
+    | "print"
+    | "printError"
+    | "emit"
+    | "chunk"
+    | "paused"
+    | "watch"
+    | "trace";
+  message: string;
+}
+
+// Rejection value used when the Go side of the runner panics. The tags are
+// unset for panics in lint and analyze, which are not runs.
+export interface StarlarkInternalError extends Partial<DiagnosticTags> {
+  kind: "internal";
+  category:
+    | "type_assertion"
+    | "js_value"
+    | "js_exception"
+    | "runtime"
+    | "error"
+    | "panic";
+  message: string;
+  stack: string;
+}
+
+// Any value a run can be rejected with. Each has a non-enumerable toJSON
+// method, so it survives JSON.stringify and postMessage alike; use
+// Starlark.errorFromJSON to restore it on the other side.
+export type StarlarkRunError = (
+  | StarlarkError
+  | StarlarkEvalError
+  | StarlarkSyntaxError
+  | StarlarkTimeoutError
+  | StarlarkStepLimitError
+  | StarlarkThrottleError
+  | StarlarkQuotaError
+  | StarlarkConversionError
+  | StarlarkResultSizeError
+  | StarlarkHostError
+  | StarlarkInternalError
+) & { toJSON(): object };
+
+export interface SourcePosition {
+  line: number;
+  column: number;
+}
+
+export interface LintFinding {
+  check:
+    | "unused-load"
+    | "builtin-shadow"
+    | "constant-condition"
+    | "name-conventions"
+    | "syntax-error"
+    | "resolve-error";
+  severity: "warning" | "error";
+  message: string;
+  start: SourcePosition;
+  end: SourcePosition;
+}
+
+export interface AnalysisFinding {
+  // The identifier (or module, for unused loads) concerned; absent for
+  // syntax and other errors.
+  name?: string;
+  // Set on unused findings.
+  kind?: "load" | "module" | "variable";
+  message: string;
+  start: SourcePosition;
+  end: SourcePosition;
+}
+
+export interface AnalysisResult {
+  undefined: AnalysisFinding[];
+  unused: AnalysisFinding[];
+  errors: AnalysisFinding[];
+}
+
+// A name that could be typed at the cursor, and what binds it. detail is the
+// type of a module member.
+export interface CompletionItem {
+  label: string;
+  kind:
+    | "parameter"
+    | "local"
+    | "function"
+    | "global"
+    | "load"
+    | "predeclared"
+    | "builtin"
+    | "member";
+  detail?: string;
+}
+
+// The completions of the identifier being typed, prefix, which starts at
+// from: the names of the innermost scopes first, builtins last.
+export interface CompletionResult {
+  prefix: string;
+  from: SourcePosition;
+  items: CompletionItem[];
+}
+
+// A parameter of a signature. label is how the signature shows it, such as
+// "retries=3" or "*args", and default the source of an optional parameter's
+// default value.
+export interface SignatureParameter {
+  name: string;
+  kind: "positional" | "optional" | "varargs" | "kwonly" | "kwargs";
+  label: string;
+  default?: string;
+}
+
+// The signature of the function a call at the cursor is to.
+// activeParameter is the index of the parameter the argument at the cursor
+// is for, or -1 if it is for none.
+export interface SignatureHelp {
+  name: string;
+  label: string;
+  doc?: string;
+  parameters: SignatureParameter[];
+  activeParameter: number;
+}
+
+// An edit of source: the text from start up to end is replaced by newText.
+export interface SourceEdit {
+  start: SourcePosition;
+  end: SourcePosition;
+  newText: string;
+}
+
+// A token of source, classified for highlighting. Identifiers are classified
+// by what binds them, and are all "identifier" in source that does not parse.
+// definition is set on the identifier that binds a name. end is just past the
+// token.
+export interface SemanticToken {
+  type:
+    | "keyword"
+    | "comment"
+    | "string"
+    | "number"
+    | "operator"
+    | "identifier"
+    | "parameter"
+    | "local"
+    | "global"
+    | "function"
+    | "load"
+    | "builtin"
+    | "predeclared"
+    | "undefined"
+    | "attribute"
+    | "argument";
+  start: SourcePosition;
+  end: SourcePosition;
+  definition?: true;
+}
+
+// An instruction of compiled bytecode. arg is unset for the opcodes that take
+// none, and detail says what it refers to, such as the value of a constant,
+// the name of a variable or a jump's target. The position is the one errors
+// at the instruction would report.
+export interface Instruction {
+  pc: number;
+  op: string;
+  arg?: number;
+  detail?: string;
+  position: SourcePosition;
+}
+
+// The bytecode of a function, or of a module's toplevel code. params are the
+// first locals, including any *args and **kwargs.
+export interface DisassembledFunction {
+  name: string;
+  position: SourcePosition;
+  doc?: string;
+  params: string[];
+  kwonlyParams: number;
+  varargs: boolean;
+  kwargs: boolean;
+  locals: string[];
+  freevars: string[];
+  maxStack: number;
+  instructions: Instruction[];
+}
+
+export interface DisassembledProgram {
+  filename: string;
+  // The toplevel code first, then each function in the order of its
+  // makefunc argument.
+  functions: DisassembledFunction[];
+  // All of the above as text, one instruction a line.
+  listing: string;
+}
+
+// The optional APIs of the environment that Starlark uses, as
+// Starlark.hostSupport finds them.
+export interface HostSupport {
+  // Whether Starlark.init can fetch the wasm module from a URL.
+  fetch: boolean;
+  // Whether the module can compile while it downloads.
+  streaming: boolean;
+  // Whether shared memory is available, which the syncLoads option needs.
+  sharedMemory: boolean;
+  // Whether MessageChannel is available, to connect a StarlarkWorker to a
+  // worker through a port.
+  messageChannel: boolean;
+}
+
+// Where Starlark.init finds the wasm module: a URL to fetch, a response
+// fetched already, say from a cache, the bytes of the file, or the module
+// compiled already.
+export type WasmSource =
+  | string
+  | URL
+  | Response
+  | BufferSource
+  | WebAssembly.Module;
+
+export interface InitOptions {
+  // The Go runtime class to run the wasm module with. Defaults to the one
+  // bundled for standard Go builds; pass TinyGo's, from its wasm_exec.js,
+  // for a TinyGo build.
+  Go?: new () => {
+    importObject: WebAssembly.Imports;
+    env?: { [name: string]: string };
+    run(instance: WebAssembly.Instance): Promise<void>;
+  };
+  // The name of the global object the wasm module and this library share,
+  // "starlark" by default. Give each copy of the library its own to keep
+  // them apart.
+  namespace?: string;
+  // Hand the wasm module the object it shares with this library directly,
+  // rather than leaving it on globalThis, for extension content scripts
+  // and offscreen documents, whose globals are partitioned from the page's.
+  bridge?: boolean;
+  // The callbacks of instances configured without their own: an object a
+  // preload script exposed with Electron's contextBridge, say.
+  hostApi?: HostApi;
+  // The level of the internal log from the start, "off" by default.
+  logLevel?: LogLevel;
+  // Receives the internal log, instead of the console.
+  onLog?: LogFn;
+  // Names the instance, in place of the random id it otherwise takes.
+  instanceId?: string;
+  // Keeps the programs the runner compiles, and the sources of the modules
+  // it compiled them from, beyond the life of the instance, so that runs
+  // after a page load need not compile their modules again. IndexedDBCache
+  // keeps them in IndexedDB.
+  persistentCache?: PersistentCache;
+}
+
+// Callbacks for the instances configured without their own, which may live
+// across a boundary such as Electron's contextBridge: the loader is not
+// given a signal, and should answer with a string, bytes or {source, hash}
+// rather than with a stream, which cannot be copied across it.
+export interface HostApi {
+  load?: (filename: string, executionId: string) => Promise<LoadedModule> | LoadedModule;
+  print?: PrintFn;
+  // Falls back to print.
+  printError?: PrintFn;
+}
+
+// A store the runner keeps compiled programs in, under keys starting
+// "program/", and the modules they were compiled from, as {source, hash}
+// under "source/" and their filename. Either method may answer with a
+// promise; the runner does not wait for put.
+export interface PersistentCache {
+  get(key: string): unknown | Promise<unknown>;
+  put(key: string, value: Uint8Array | LoadedModule): void | Promise<void>;
+}
+
+// The resources a wasm module instance is using, from Starlark.usage or
+// StarlarkWorker.usage.
+export interface InstanceUsage {
+  instanceId: string;
+  // Since the instance started, in milliseconds.
+  uptime: number;
+  executions: { active: number; started: number };
+  // From Go's runtime, in bytes, and the garbage collections so far.
+  memory: {
+    heapAlloc: number;
+    heapSys: number;
+    sys: number;
+    totalAlloc: number;
+    gcCycles: number;
+  };
+  goroutines: number;
+  moduleCache: CacheStats;
+  // The runs that have ended with each label, by label and then value,
+  // with their time in milliseconds.
+  labels: { [label: string]: { [value: string]: { runs: number; steps: number; time: number } } };
+}
+
+// What a wasm module was built with, and what its environment allows, from
+// Starlark.capabilities or StarlarkWorker.capabilities.
+export interface Capabilities {
+  goVersion: string;
+  // "gc", or "tinygo" for TinyGo builds.
+  compiler: string;
+  // The bundled modules, loaded as @std/<name>, and the plugins compiled in.
+  modules: string[];
+  plugins: string[];
+  // Whether runs can set the dialect's file options.
+  fileOptions: boolean;
+  // Whether runs can pause at breakpoints.
+  debug: boolean;
+  // Whether internal errors carry the Go stack.
+  stackTraces: boolean;
+  // Whether a run's channel can answer its loads synchronously.
+  sharedArrayBuffer: boolean;
+}
+
+// The levels of the internal log, least severe first.
+export type LogLevel = "debug" | "info" | "warn" | "error" | "off";
+
+// A message of the internal log, for debugging how the runner is
+// integrated: its start, module cache decisions, cancellations and lossy
+// conversions. The messages are not a stable interface.
+export interface LogEntry {
+  level: Exclude<LogLevel, "off">;
+  category: "init" | "cache" | "cancel" | "convert" | "queue";
+  message: string;
+  // When it was logged, in milliseconds since the epoch.
+  time: number;
+}
+
+export type LogFn = (entry: LogEntry) => void;
+
+// The side of a Worker or MessagePort that StarlarkWorker and Starlark.serve
+// talk through.
+export interface WorkerPort {
+  postMessage(message: unknown, transfer?: Transferable[]): void;
+  addEventListener(
+    type: "message",
+    listener: (event: MessageEvent) => void
+  ): void;
+  start?(): void;
+}
+
+// The messages a worker serving runs posts back. Runs are identified by
+// their executionId, and loads by an id of the worker's choosing.
+// Every message from a worker also carries the worker's instanceId.
+export type WorkerMessage =
+  | { type: "ready"; instanceId: string }
+  | { type: "usage"; id: number; value: InstanceUsage }
+  | { type: "capabilities"; id: number; value: Capabilities }
+  | { type: "metrics"; id: number; value: string }
+  | { type: "clearCache"; id: number; value: number }
+  | { type: "listExecutions"; id: number; value: ExecutionInfo[] }
+  | { type: "storedResult"; id: number; value?: StoredResult }
+  | { type: "quota"; id: number; value?: Quota }
+  | { type: "reset"; id: number; value: ResetResult }
+  | {
+      type: "result";
+      id: string;
+      value: StarlarkCompatibleValue | StarlarkResult | Uint8Array;
+    }
+  | { type: "error"; id: string; error: StarlarkRunError }
+  | {
+      type: "load";
+      id: number;
+      executionId: string;
+      filename: string;
+      // Set for loads to answer through the run's channel.
+      sync?: boolean;
+    }
+  // The worker no longer waits on a load, as its run was cancelled.
+  | { type: "abortLoad"; id: number; executionId: string; reason: string }
+  | { type: "verify"; id: number; executionId: string; filename: string; hash: string }
+  | {
+      type: "print";
+      executionId: string;
+      stream: OutputLine["stream"];
+      message: string;
+      position?: PrintPosition;
+    }
+  | { type: "printBatch"; executionId: string; lines: OutputLine[] }
+  | { type: "emit"; executionId: string; value: StarlarkCompatibleValue }
+  | { type: "warn"; executionId: string; warning: StarlarkWarning }
+  | { type: "trace"; executionId: string; events: TraceEvent[] }
+  | { type: "chunk"; executionId: string; chunk: StarlarkCompatibleValue }
+  | { type: "paused"; executionId: string; event: PausedEvent }
+  | { type: "watch"; executionId: string; event: WatchEvent }
+  | { type: "event"; executionId: string; event: RunnerEvent }
+  | {
+      type: "inspected";
+      id: number;
+      executionId: string;
+      value?: InspectResult;
+      error?: StarlarkRunError;
+    }
+  | {
+      type: "snapshot";
+      id: number;
+      executionId: string;
+      value?: StackSnapshot;
+      error?: StarlarkRunError;
+    };
+
+// A message to a worker serving runs, in the {id, cmd, payload} form, for
+// hosts that post to the worker without StarlarkWorker. cmd is the type of
+// the message, and payload its other fields; a run without an executionId
+// in its payload has its id as one.
+export interface WorkerCommand {
+  id: string | number;
+  cmd:
+    | "run"
+    | "request"
+    | "loaded"
+    | "verified"
+    | "resume"
+    | "setBreakpoints"
+    | "setWatches"
+    | "inspect"
+    | "stack"
+    | "usage"
+    | "capabilities"
+    | "metrics"
+    | "clearCache"
+    | "setLogLevel"
+    | "setMessages"
+    | "on"
+    | "off"
+    | "ackOutput"
+    | "cancel"
+    | "storedResult"
+    | "setMemoryBudget"
+    | "setConcurrency"
+    | "listExecutions"
+    | "reset";
+  payload?: { [field: string]: unknown };
+}
 
 export interface StarlarkConfig {
   load?: Loader;
+  // Approves each module, the file run and those it loads, before it runs:
+  // for a policy of running only signed scripts. A module it does not
+  // approve fails the run with a PermissionError, code "notApproved".
+  verify?: VerifyFn;
+  // Gives the values of the names a formula of evaluate uses that Starlark
+  // does not know, such as the cells it refers to.
+  resolve?: ResolveFn;
   print?: PrintFn;
+  // Receives eprint() output; defaults to console.error.
+  printError?: PrintFn;
+  // Receives the values passed to emit().
+  onEmit?: EmitFn;
+  onWarning?: WarningFn;
+  // Called when a run with breakpoints pauses; resume it with resume().
+  onPaused?: PausedFn;
+  // Receives the events of runs with the trace option.
+  onTrace?: TraceFn;
+  // Receives the watch expressions of runs with watchOn: "line".
+  onWatch?: WatchFn;
   maxExecutionTime?: number;
+  printPositions?: boolean;
+  printBatchSize?: number;
+  printFlushInterval?: number;
+  maxUnackedOutput?: number;
+  captureLocals?: boolean;
+  trace?: boolean;
+  onHostError?: HostErrorPolicy;
+  lazy?: boolean;
+  cacheGlobals?: boolean;
+  binary?: boolean;
+  locale?: string;
+  maxErrorLength?: number;
+  maxResultSize?: number;
+  maxValueSize?: number;
+  maxTotalSize?: number;
+  memoryWatermarks?: number[];
+  maxModules?: number;
+  maxSourceSize?: number;
+  maxCallRate?: number;
+  callBurst?: number;
+  maxSteps?: number;
+  strict?: boolean;
+  extendedTypes?: boolean;
+  breakpoints?: Breakpoint[];
+  watch?: string[];
+  watchOn?: "pause" | "line";
+  // Tags this instance's warnings and errors, to tell apart several
+  // instances on one page.
+  sessionId?: string;
+  // The labels of this instance's runs, which a run's own labels add to.
+  labels?: Labels;
+  retainResult?: number;
+  allowBuiltins?: string[];
+  printPolicy?: PrintPolicy;
+  meter?: boolean;
+  builtins?: BuiltinsOption;
+  hostFunctions?: HostFunctions;
+  dialect?: Dialect;
+  secrets?: Record<string, string>;
+  lockfile?: Record<string, LockedModule>;
+  allowLoads?: string[];
+  denyLoads?: string[];
+  share?: number;
+  priority?: RunPriority;
+  // For StarlarkWorker: answer loads synchronously through shared memory,
+  // when the page is cross-origin isolated. syncLoadBufferSize bounds the
+  // size of a module loaded this way, in bytes; larger ones are loaded as
+  // usual. Defaults to 1MB.
+  syncLoads?: boolean;
+  syncLoadBufferSize?: number;
 }
 
 export interface StarlarkInterface {
   print: PrintFn;
+  printError: PrintFn;
   load: Loader;
+  verify?: VerifyFn;
+  resolve?: ResolveFn;
+  onEmit?: EmitFn;
+  onWarning?: WarningFn;
+  onPaused?: PausedFn;
+  onTrace?: TraceFn;
+  onWatch?: WatchFn;
   maxExecutionTime?: number;
+  chunk?: (
+    chunk: StarlarkCompatibleValue,
+    executionId: string
+  ) => Promise<void> | void;
 
   run(
     filename: string,
     functionName?: string,
     args?: StarlarkCompatibleValue[],
-    kwargs?: StarlarkCompatibleDict,
+    kwargs?: StarlarkKwargs,
     maxExecutionTime?: number
   ): Promise<StarlarkCompatibleValue>;
+
+  runWithDetails(
+    filename: string,
+    functionName?: string,
+    args?: StarlarkCompatibleValue[],
+    kwargs?: StarlarkKwargs,
+    maxExecutionTime?: number,
+    options?: DetailsOptions
+  ): Promise<StarlarkResult>;
+
+  call(request: RunRequest): Promise<StarlarkResult>;
 }
 
 export interface StarlarkGlobal {
@@ -38,13 +1796,193 @@ export interface StarlarkGlobal {
     executionId: string,
     filename: string,
     fn: string,
-    args?: StarlarkCompatibleValue[],
-    kwargs?: StarlarkCompatibleDict,
-    maxExecutionTime?: number
-  ) => StarlarkCompatibleValue;
+    // Uint8Arrays of MessagePack when the binary option is set, as is the
+    // result value.
+    args?: StarlarkCompatibleValue[] | Uint8Array,
+    kwargs?: StarlarkKwargs | Uint8Array,
+    maxExecutionTime?: number,
+    options?: RunOptions
+    // Or a StarlarkIteration, with the iterate option.
+  ) => Promise<StarlarkCompatibleValue | StarlarkResult | Uint8Array>;
+  run?: (request: RunRequest) => Promise<StarlarkResult>;
 
-  load?: (filename: string, executionId: string) => Promise<string>;
-  print?: (message: string, executionId: string) => void;
+  load?: Loader;
+  verify?: VerifyFn;
+  resolve?: ResolveFn;
+  // Called by every run's modules as builtins.
+  hostFunctions?: HostFunctions;
+  // The dialect of every run's modules.
+  dialect?: Dialect;
+  print?: PrintFn;
+  printError?: PrintFn;
+  // Receives batched output when the printBatchSize option is set.
+  printBatch?: (lines: OutputLine[], executionId: string) => void;
+  emit?: EmitFn;
+  chunk?: (
+    chunk: StarlarkCompatibleValue,
+    executionId: string
+  ) => Promise<void> | void;
+  warn?: (warning: StarlarkWarning, executionId: string) => void;
+  trace?: TraceFn;
+  lint?: (source: string, filename?: string) => LintFinding[] | Error;
+  analyze?: (
+    source: string,
+    filename?: string,
+    predeclared?: string[]
+  ) => AnalysisResult | Error;
+  complete?: (
+    source: string,
+    line: number,
+    column: number,
+    filename?: string,
+    predeclared?: string[]
+  ) => CompletionResult | Error;
+  signatureHelp?: (
+    source: string,
+    line: number,
+    column: number,
+    filename?: string
+  ) => SignatureHelp | null | Error;
+  rename?: (
+    source: string,
+    position: SourcePosition,
+    newName: string,
+    filename?: string
+  ) => SourceEdit[] | Error;
+  tokenize?: (
+    source: string,
+    filename?: string,
+    predeclared?: string[]
+  ) => SemanticToken[] | Error;
+  format?: (source: string, filename?: string) => string | Error;
+  runSync?: (source: SourceChunks, options?: RunSyncOptions) => RunSyncOutcome;
+  disassemble?: (
+    source: string,
+    filename?: string,
+    predeclared?: string[]
+  ) => DisassembledProgram | Error;
+  errorFromJSON?: (value: string | object) => StarlarkRunError | Error;
+  serve?: (port?: WorkerPort) => void;
+  // Runs a chunk of source in the session named by options.sessionId,
+  // resolving with the value of the expression it ends with, or null.
+  repl?: (
+    executionId: string,
+    source: string,
+    options: RunOptions
+  ) => Promise<StarlarkCompatibleValue>;
+  // Calls a function defined in the session named by options.sessionId.
+  sessionCall?: (
+    executionId: string,
+    functionName: string,
+    args: StarlarkCompatibleValue[] | undefined,
+    kwargs: StarlarkKwargs | undefined,
+    options: RunOptions
+  ) => Promise<StarlarkCompatibleValue>;
+  // Evaluates a formula, asking the resolve callback for the names it uses
+  // that Starlark does not know.
+  evaluate?: (
+    executionId: string,
+    formula: string,
+    options?: RunOptions
+  ) => Promise<StarlarkCompatibleValue>;
+  exec?: (
+    executionId: string,
+    source: string,
+    globals?: StarlarkCompatibleDict,
+    options?: RunOptions
+  ) => Promise<StarlarkCompatibleDict>;
+  eval?: (
+    executionId: string,
+    expression: string,
+    globals?: StarlarkCompatibleDict,
+    options?: RunOptions
+  ) => Promise<StarlarkCompatibleValue>;
+  closeSession?: (sessionId: string) => boolean | Error;
+  setSessionPolicy?: (policy: SessionPolicy | null) => void;
+  setMemoryBudget?: (bytes: number | null, levels?: number[]) => void | Error;
+  setConcurrency?: (limit: number | null) => void;
+  listExecutions?: () => ExecutionInfo[];
+  reset?: () => Promise<ResetResult>;
+  cacheStats?: () => CacheStats;
+  clearCache?: (filename?: string) => number;
+  precompile?: (
+    executionId: string,
+    filename: string,
+    options?: RunOptions
+  ) => Promise<PrecompileResult>;
+  instanceId?: string;
+  usage?: () => InstanceUsage;
+  capabilities?: () => Capabilities;
+  // The metrics of the instance, in the Prometheus text format.
+  metrics?: () => string;
+  setMessages?: (locale: string, messages: MessageCatalog) => void | Error;
+  // Subscribes a handler to an event, returning a function that
+  // unsubscribes it, which off also does.
+  on?: <K extends RunnerEventName>(
+    event: K,
+    handler: RunnerEventHandler<K>
+  ) => (() => boolean) | Error;
+  off?: <K extends RunnerEventName>(event: K, handler: RunnerEventHandler<K>) => boolean | Error;
+  // The persistentCache given to init, if any.
+  cacheGet?: (key: string, executionId: string) => unknown;
+  cachePut?: (key: string, value: Uint8Array | LoadedModule, executionId: string) => unknown;
+  paused?: PausedFn;
+  watch?: WatchFn;
+  // The kept outcome of a run with the retainResult option, if it is kept.
+  result?: (executionId: string) => StoredResult | undefined | Error;
+  setQuota?: (tenant: string, limits: QuotaLimits | null) => void | Error;
+  quota?: (tenant: string) => Quota | undefined | Error;
+  // Returns whether the tenant has a quota.
+  resetQuota?: (tenant: string) => boolean | Error;
+  // Acknowledges lines of a run's output. Returns whether it is running.
+  ackOutput?: (executionId: string, lines?: number) => boolean | Error;
+  cancel?: (executionId: string, reason?: string) => boolean | Error;
+  // Returns whether the execution was paused.
+  resume?: (executionId: string, command?: DebugCommand) => boolean | Error;
+  // Replaces the breakpoints of a run in debug mode. Returns whether it is
+  // running.
+  setBreakpoints?: (
+    executionId: string,
+    breakpoints: Breakpoint[]
+  ) => boolean | Error;
+  // Replaces the watch expressions of a run in debug mode. Returns whether
+  // it is running.
+  setWatches?: (executionId: string, watches: string[]) => boolean | Error;
+  inspect?: (
+    executionId: string,
+    request: InspectRequest
+  ) => InspectResult | Error;
+  stack?: (executionId: string) => Promise<StackSnapshot>;
+  // Sets the level of the internal log, returning the previous one.
+  setLogLevel?: (level: LogLevel) => LogLevel | Error;
+  // The level of the internal log the module starts with.
+  logLevel?: LogLevel;
+  log?: LogFn;
+  benchmark?: (
+    executionId: string,
+    spec: BenchmarkSpec,
+    options?: RunOptions
+  ) => Promise<BenchmarkResult>;
+  golden?: (
+    executionId: string,
+    spec: GoldenSpec,
+    options?: RunOptions
+  ) => Promise<GoldenResult>;
+  grade?: (
+    executionId: string,
+    spec: GradeSpec,
+    options?: RunOptions
+  ) => Promise<GradeResult>;
+  render?: (
+    executionId: string,
+    spec: RenderSpec,
+    options?: RunOptions
+  ) => Promise<RenderResult>;
+  renderDiff?: (
+    executionId: string,
+    spec: RenderDiffSpec,
+    options?: RunOptions
+  ) => Promise<RenderDiffResult>;
 
   _executions: {
     [executionId: string]: StarlarkInterface;